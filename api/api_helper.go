@@ -1,9 +1,22 @@
 package api
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
+	"github.com/metildachee/userie/dao/interfaces"
+	"github.com/metildachee/userie/models"
+)
+
+const (
+	defaultLimit = 10
+	// maxBulkUsers bounds how many users one bulk request may carry.
+	maxBulkUsers = 10000
 )
 
 func getParam(field string, r *http.Request) string {
@@ -11,7 +24,148 @@ func getParam(field string, r *http.Request) string {
 	return params[field]
 }
 
+func getQuery(field string, r *http.Request) string {
+	return r.URL.Query().Get(field)
+}
+
+// getParamOrQuery prefers a path variable and falls back to the query string.
+func getParamOrQuery(field string, r *http.Request) string {
+	if value := getParam(field, r); value != "" {
+		return value
+	}
+	return getQuery(field, r)
+}
+
+// getLimitOffset reads limit and offset from the path or query string. Non-positive
+// limits fall back to the default and negative offsets to zero.
+func getLimitOffset(r *http.Request) (limit, offset int, err error) {
+	limit, offset = defaultLimit, 0
+	if queryLimit := getParamOrQuery("limit", r); queryLimit != "" {
+		if limit, err = strconv.Atoi(queryLimit); err != nil {
+			return 0, 0, fmt.Errorf("invalid limit %q", queryLimit)
+		}
+		if limit <= 0 {
+			limit = defaultLimit
+		}
+	}
+	if queryOffset := getParamOrQuery("offset", r); queryOffset != "" {
+		if offset, err = strconv.Atoi(queryOffset); err != nil {
+			return 0, 0, fmt.Errorf("invalid offset %q", queryOffset)
+		}
+		if offset < 0 {
+			offset = 0
+		}
+	}
+	return
+}
+
+// getUserFilter reads the listing filters and sort order from the query
+// string. Parameters outside of models.FilterParams and the paging params are
+// rejected with a *models.UnknownParamError.
+func getUserFilter(r *http.Request, extra ...string) (filter models.UserFilter, err error) {
+	allowed := append(append([]string{"limit", "offset"}, extra...), models.FilterParams...)
+	for key := range r.URL.Query() {
+		if !containsString(allowed, key) {
+			return filter, &models.UnknownParamError{Kind: "filter", Name: key, Allowed: allowed}
+		}
+	}
+
+	if filter.DobFrom, err = getInt32Query("dob_from", r); err != nil {
+		return
+	}
+	if filter.DobTo, err = getInt32Query("dob_to", r); err != nil {
+		return
+	}
+	if filter.CtimeFrom, err = getInt32Query("ctime_from", r); err != nil {
+		return
+	}
+	if filter.CtimeTo, err = getInt32Query("ctime_to", r); err != nil {
+		return
+	}
+	filter.NamePrefix = getQuery("name_prefix", r)
+	filter.Sort, err = models.ParseSort(getQuery("sort", r))
+	return
+}
+
+func getInt32Query(field string, r *http.Request) (*int32, error) {
+	value := getQuery(field, r)
+	if value == "" {
+		return nil, nil
+	}
+	parsed, err := strconv.ParseInt(value, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q", field, value)
+	}
+	result := int32(parsed)
+	return &result, nil
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// etag quotes a dao version for the ETag header.
+func etag(version string) string {
+	return `"` + version + `"`
+}
+
+// ifMatch resolves the If-Match header against the user's current version and
+// returns the version a conditional write has to see. ok is false when the
+// request carries no If-Match, and a header matching nothing current gives
+// interfaces.ErrVersionConflict.
+func (s *Server) ifMatch(ctx context.Context, r *http.Request, id string) (version string, ok bool, err error) {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return "", false, nil
+	}
+	_, current, err := s.dao.GetVersioned(ctx, id)
+	if err != nil {
+		return "", true, err
+	}
+	if !matchesIfMatch(header, current) {
+		return "", true, interfaces.ErrVersionConflict
+	}
+	return current, true, nil
+}
+
+// ifMatchError turns a missing user into a failed precondition when the
+// request carries If-Match, RFC 7232 has If-Match fail when there is no
+// current representation.
+func ifMatchError(r *http.Request, err error) error {
+	if r.Header.Get("If-Match") != "" && errors.Is(err, interfaces.ErrNotFound) {
+		return fmt.Errorf("%w: %v", interfaces.ErrVersionConflict, err)
+	}
+	return err
+}
+
+// matchesIfMatch reports whether an If-Match header lists version. If-Match
+// uses strong comparison, weak W/ tags never match.
+func matchesIfMatch(header, version string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		if tag = strings.TrimSpace(tag); tag == "*" || tag == etag(version) {
+			return true
+		}
+	}
+	return false
+}
+
+// errorStatus maps dao errors onto response codes.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, interfaces.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, interfaces.ErrVersionConflict):
+		return http.StatusPreconditionFailed
+	}
+	return http.StatusInternalServerError
+}
+
 func writeJsonHeader(w http.ResponseWriter) http.ResponseWriter {
 	w.Header().Set("Content-Type", "application/json")
 	return w
-}
\ No newline at end of file
+}
@@ -0,0 +1,169 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/metildachee/userie/dao/feed"
+	"github.com/metildachee/userie/models"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+const (
+	// changesHeartbeat is how often an idle change feed sends a comment, so
+	// proxies do not time the connection out.
+	changesHeartbeat = 15 * time.Second
+	// eventReset tells a resuming client that events were missed and it has
+	// to reload the users it keeps.
+	eventReset = "reset"
+)
+
+var errNoChangeFeed = errors.New("the server cannot stream changes")
+
+// getChangesFilter reads the listing filters and the fields a change feed is
+// narrowed to.
+func getChangesFilter(r *http.Request) (filter feed.Filter, err error) {
+	if filter.Users, err = getUserFilter(r, "fields", "last_event_id"); err != nil {
+		return
+	}
+	for _, field := range strings.Split(getQuery("fields", r), ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		if !containsString(feed.Fields, field) {
+			return filter, &models.UnknownParamError{Kind: "field", Name: field, Allowed: feed.Fields}
+		}
+		filter.Fields = append(filter.Fields, field)
+	}
+	return
+}
+
+// getLastEventId reads where a reconnecting client left off, from the
+// Last-Event-ID header EventSource sends or the last_event_id query for the
+// first connection. Zero starts with new events.
+func getLastEventId(r *http.Request) (uint64, error) {
+	value := r.Header.Get("Last-Event-ID")
+	if value == "" {
+		value = getQuery("last_event_id", r)
+	}
+	if value == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid last event id %q", value)
+	}
+	return id, nil
+}
+
+func writeEvent(w io.Writer, id uint64, eventType string, data interface{}) error {
+	doc, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", id, eventType, doc)
+	return err
+}
+
+// StreamChanges streams the user writes made through this server as
+// Server-Sent Events, narrowed by the listing filters and fields. A client
+// resuming with Last-Event-ID first gets the events it missed; when they are
+// no longer kept it gets a reset event instead and should reload.
+//
+// The writes of mass operations are streamed as their tasks record them, on
+// Elasticsearch once the task completed. Purges are not streamed, they remove
+// users whose delete was streamed already.
+func (s *Server) StreamChanges(w http.ResponseWriter, r *http.Request) {
+	span, ctx := s.startSpan(r, "stream changes")
+	ext.SpanKindRPCClient.Set(span)
+	defer span.Finish()
+
+	flusher, ok := w.(http.Flusher)
+	if s.changes == nil || !ok {
+		writeProblem(ctx, w, http.StatusNotImplemented, errNoChangeFeed)
+		return
+	}
+	filter, err := getChangesFilter(r)
+	if err != nil {
+		ext.LogError(span, err)
+		writeBadRequest(ctx, w, err)
+		return
+	}
+	lastId, err := getLastEventId(r)
+	if err != nil {
+		ext.LogError(span, err)
+		writeBadRequest(ctx, w, err)
+		return
+	}
+
+	replay, sub, missed := s.changes.Subscribe(lastId)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// keep buffering proxies from holding events back
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if missed {
+		// the reset carries the latest id, so the client resumes after it
+		var last uint64
+		if len(replay) > 0 {
+			last = replay[len(replay)-1].ID
+			replay = nil
+		}
+		if err := writeEvent(w, last, eventReset, struct{}{}); err != nil {
+			ext.LogError(span, err)
+			return
+		}
+	}
+	sent := 0
+	send := func(e feed.Event) error {
+		if !filter.Match(e) {
+			return nil
+		}
+		sent++
+		return writeEvent(w, e.ID, e.Type, e)
+	}
+	for _, e := range replay {
+		if err := send(e); err != nil {
+			ext.LogError(span, err)
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(changesHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			span.LogFields(log.Int("events", sent))
+			s.logger.Info("stream changes closed by client, check tracer: ", span.Context())
+			return
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+				ext.LogError(span, err)
+				return
+			}
+		case e, ok := <-sub.C:
+			if !ok {
+				// dropped for falling behind, the client reconnects and resumes
+				span.LogFields(log.Int("events", sent), log.String("closed", "subscriber fell behind"))
+				return
+			}
+			if err := send(e); err != nil {
+				ext.LogError(span, err)
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/metildachee/userie/dao/feed"
+	"github.com/metildachee/userie/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readEvent reads the next event off a change stream, skipping comments.
+func readEvent(t *testing.T, r *bufio.Reader) (id, eventType string, e feed.Event) {
+	for {
+		line, err := r.ReadString('\n')
+		require.Nil(t, err, "should not have error when reading the stream")
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && eventType != "":
+			return
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			eventType = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			require.Nil(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e), "json decoder err")
+		}
+	}
+}
+
+func streamChanges(t *testing.T, ctx context.Context, url, lastEventId string) *bufio.Reader {
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if lastEventId != "" {
+		req.Header.Set("Last-Event-ID", lastEventId)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err, "should not have error when connecting")
+	t.Cleanup(func() { resp.Body.Close() })
+	require.EqualValues(t, http.StatusOK, resp.StatusCode, "response code is not ok")
+	assert.EqualValues(t, "text/event-stream", resp.Header.Get("Content-Type"), "should stream events")
+	return bufio.NewReader(resp.Body)
+}
+
+func TestStreamChanges(t *testing.T) {
+	srv := newTestServer(t)
+	router := mux.NewRouter()
+	srv.Routes(router)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream := streamChanges(t, ctx, ts.URL+"/api/users/changes?fields=address", "")
+	id, err := srv.dao.Create(ctx, models.User{Name: "streamed", Address: "kent ridge"})
+	require.Nil(t, err, "should not have error when creating")
+	require.Nil(t, srv.dao.Patch(ctx, id, map[string]interface{}{"description": "skipped"}), "should not have error when patching")
+	require.Nil(t, srv.dao.Patch(ctx, id, map[string]interface{}{"address": "clementi"}), "should not have error when patching")
+	require.Nil(t, srv.dao.Delete(ctx, id), "should not have error when deleting")
+
+	eventId, eventType, e := readEvent(t, stream)
+	assert.EqualValues(t, feed.EventCreated, eventType, "should stream the create")
+	assert.EqualValues(t, id, e.UserID, "should stream the created user")
+	_, eventType, e = readEvent(t, stream)
+	assert.EqualValues(t, feed.EventUpdated, eventType, "should skip patches of other fields")
+	assert.EqualValues(t, []string{"address"}, e.Fields, "should report the patched fields")
+	require.NotNil(t, e.User, "should stream the written user")
+	assert.EqualValues(t, "clementi", e.User.Address, "should stream the written user")
+	_, eventType, _ = readEvent(t, stream)
+	assert.EqualValues(t, feed.EventDeleted, eventType, "should stream the delete")
+
+	// resuming after the create replays the writes that followed it
+	resumed := streamChanges(t, ctx, ts.URL+"/api/users/changes", eventId)
+	_, eventType, e = readEvent(t, resumed)
+	assert.EqualValues(t, feed.EventUpdated, eventType, "should replay the next write")
+	assert.EqualValues(t, []string{"description"}, e.Fields, "should replay the next write")
+
+	// ids from before a restart cannot be resumed
+	reset := streamChanges(t, ctx, ts.URL+"/api/users/changes", "1000")
+	eventId, eventType, _ = readEvent(t, reset)
+	assert.EqualValues(t, "reset", eventType, "should ask the client to reload")
+	assert.EqualValues(t, "4", eventId, "should resume after the latest event")
+}
+
+func TestStreamChangesInvalid(t *testing.T) {
+	srv := newTestServer(t)
+	router := mux.NewRouter()
+	srv.Routes(router)
+
+	for _, path := range []string{
+		"/api/users/changes?fields=password",
+		"/api/users/changes?colour=red",
+		"/api/users/changes?last_event_id=first",
+	} {
+		req, _ := http.NewRequest(http.MethodGet, path, nil)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		assert.EqualValues(t, http.StatusBadRequest, resp.Code, "should reject %s", path)
+	}
+
+	_, router = newFakeServer()
+	req, _ := http.NewRequest(http.MethodGet, "/api/users/changes", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.EqualValues(t, http.StatusNotImplemented, resp.Code, "should need a change feed")
+}
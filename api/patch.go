@@ -0,0 +1,101 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"reflect"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/metildachee/userie/models"
+)
+
+const (
+	mergePatchType = "application/merge-patch+json"
+	jsonPatchType  = "application/json-patch+json"
+	// maxPatchBytes bounds the size of a patch document.
+	maxPatchBytes = 1 << 20
+	// maxPatchAttempts bounds how often an unconditional patch is re-applied
+	// when the user changes between reading and writing it.
+	maxPatchAttempts = 3
+)
+
+var (
+	patchTypes          = []string{mergePatchType, jsonPatchType}
+	errUnsupportedPatch = fmt.Errorf("unsupported patch content type, expecting one of %v", patchTypes)
+)
+
+// patcher applies a patch document of one of the patchTypes to a JSON
+// document.
+type patcher func(doc []byte) ([]byte, error)
+
+func newPatcher(contentType string, patch []byte) (patcher, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, errUnsupportedPatch
+	}
+	switch mediaType {
+	case mergePatchType:
+		if !json.Valid(patch) {
+			return nil, errors.New("invalid merge patch document")
+		}
+		return func(doc []byte) ([]byte, error) {
+			return jsonpatch.MergePatch(doc, patch)
+		}, nil
+	case jsonPatchType:
+		ops, err := jsonpatch.DecodePatch(patch)
+		if err != nil {
+			return nil, fmt.Errorf("invalid json patch document: %v", err)
+		}
+		return ops.Apply, nil
+	}
+	return nil, errUnsupportedPatch
+}
+
+// applyPatch patches the user and returns the result together with the json
+// fields it changed. The result has to decode into a user with the same id.
+func applyPatch(current models.User, apply patcher) (patched models.User, changed map[string]interface{}, err error) {
+	doc, err := json.Marshal(current)
+	if err != nil {
+		return
+	}
+	if doc, err = apply(doc); err != nil {
+		return patched, nil, fmt.Errorf("cannot apply patch: %v", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(doc))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(&patched); err != nil {
+		return patched, nil, fmt.Errorf("patched user is invalid: %v", err)
+	}
+	if patched.ID != current.ID {
+		return patched, nil, errors.New("user id cannot be patched")
+	}
+
+	before, err := userFields(current)
+	if err != nil {
+		return
+	}
+	after, err := userFields(patched)
+	if err != nil {
+		return
+	}
+	changed = map[string]interface{}{}
+	for name, value := range after {
+		if !reflect.DeepEqual(before[name], value) {
+			changed[name] = value
+		}
+	}
+	return patched, changed, nil
+}
+
+// userFields returns the user keyed by json field names.
+func userFields(u models.User) (fields map[string]interface{}, err error) {
+	doc, err := json.Marshal(u)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(doc, &fields)
+	return
+}
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/metildachee/userie/dao/audit"
+	"github.com/metildachee/userie/models"
+)
+
+const problemContentType = "application/problem+json"
+
+// internalErrorDetail stands in for the cause of a 500, which may reveal the
+// storage backend; the trace id leads operators to it.
+const internalErrorDetail = "the request failed on the server, quote its trace id when reporting it"
+
+// problemCodes are the codes of failures that are told apart by their status
+// alone.
+var problemCodes = map[int]string{
+	http.StatusBadRequest:            models.ProblemInvalidRequest,
+	http.StatusNotFound:              models.ProblemNotFound,
+	http.StatusPreconditionFailed:    models.ProblemVersionConflict,
+	http.StatusRequestEntityTooLarge: models.ProblemPayloadTooLarge,
+	http.StatusUnsupportedMediaType:  models.ProblemUnsupportedMediaType,
+	http.StatusNotImplemented:        models.ProblemNotImplemented,
+}
+
+// isMalformedJson reports whether err comes from decoding a request body that
+// is not the expected JSON, including an empty or cut off one.
+func isMalformedJson(err error) bool {
+	var (
+		syntaxErr *json.SyntaxError
+		typeErr   *json.UnmarshalTypeError
+	)
+	return errors.As(err, &syntaxErr) || errors.As(err, &typeErr) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// newProblem describes err, which failed the request with status.
+func newProblem(ctx context.Context, status int, err error) models.Problem {
+	problem := models.Problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Code:      models.ProblemInternalError,
+		RequestID: requestId(ctx),
+		TraceID:   audit.TraceID(ctx),
+	}
+	if code, ok := problemCodes[status]; ok {
+		problem.Code = code
+	}
+	if err != nil {
+		problem.Detail = err.Error()
+	}
+	if status >= http.StatusInternalServerError && status != http.StatusNotImplemented {
+		problem.Detail = internalErrorDetail
+		return problem
+	}
+	if status != http.StatusBadRequest {
+		return problem
+	}
+
+	var (
+		validationErr *models.ValidationError
+		paramErr      *models.UnknownParamError
+	)
+	switch {
+	case errors.As(err, &validationErr):
+		problem.Code, problem.Errors = models.ProblemValidationFailed, validationErr.Fields
+	case errors.As(err, &paramErr):
+		problem.Code, problem.Allowed = models.ProblemUnknownParameter, paramErr.Allowed
+	case isMalformedJson(err):
+		problem.Code = models.ProblemMalformedJson
+	}
+	return problem
+}
+
+// writeProblem answers with status and an RFC 7807 body describing err.
+func writeProblem(ctx context.Context, w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", problemContentType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(newProblem(ctx, status, err))
+}
+
+// writeError answers a dao error with the status errorStatus maps it onto.
+func writeError(ctx context.Context, w http.ResponseWriter, err error) {
+	writeProblem(ctx, w, errorStatus(err), err)
+}
+
+// writeBadRequest answers with a 400 whose body explains the rejected input.
+func writeBadRequest(ctx context.Context, w http.ResponseWriter, err error) {
+	writeProblem(ctx, w, http.StatusBadRequest, err)
+}
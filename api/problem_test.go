@@ -0,0 +1,114 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/metildachee/userie/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readProblem(t *testing.T, resp *httptest.ResponseRecorder) models.Problem {
+	assert.EqualValues(t, problemContentType, resp.Header().Get("Content-Type"), "should answer with problem details")
+	problem := models.Problem{}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&problem), "json decoder err")
+	assert.EqualValues(t, resp.Code, problem.Status, "problem should repeat the status")
+	assert.EqualValues(t, http.StatusText(resp.Code), problem.Title, "problem title should be the status text")
+	return problem
+}
+
+func TestProblemValidationFailed(t *testing.T) {
+	srv := newTestServer(t)
+	router := mux.NewRouter()
+	srv.Routes(router)
+
+	resp := sendJson(router, http.MethodPost, "/api/user", `{"id": "7", "name": "metchee"}`)
+	require.EqualValues(t, http.StatusBadRequest, resp.Code, "invalid user should be rejected")
+	problem := readProblem(t, resp)
+	assert.EqualValues(t, models.ProblemValidationFailed, problem.Code)
+	fields := make([]string, 0, len(problem.Errors))
+	for _, field := range problem.Errors {
+		assert.NotEmpty(t, field.Message, "every field should say what is wrong")
+		fields = append(fields, field.Field)
+	}
+	assert.ElementsMatch(t, []string{"id", "address", "description"}, fields, "should list every failing field")
+
+	resp = sendJson(router, http.MethodPut, "/api/user/1", `{"name": "", "address": "", "description": "meow"}`)
+	require.EqualValues(t, http.StatusBadRequest, resp.Code, "invalid update should be rejected")
+	problem = readProblem(t, resp)
+	assert.EqualValues(t, models.ProblemValidationFailed, problem.Code)
+	assert.Len(t, problem.Errors, 2, "should list name and address")
+}
+
+func TestProblemMalformedJson(t *testing.T) {
+	srv := newTestServer(t)
+	router := mux.NewRouter()
+	srv.Routes(router)
+
+	for _, request := range []struct{ method, path, body string }{
+		{http.MethodPost, "/api/user", `{"name": `},
+		{http.MethodPost, "/api/user", ``},
+		{http.MethodPost, "/api/user", `{"dob": "yesterday"}`},
+		{http.MethodPut, "/api/user/1", `not json`},
+		{http.MethodPost, "/api/users/_bulk", `{}`},
+	} {
+		resp := sendJson(router, request.method, request.path, request.body)
+		require.EqualValues(t, http.StatusBadRequest, resp.Code, "malformed body should be rejected: "+request.body)
+		problem := readProblem(t, resp)
+		assert.EqualValues(t, models.ProblemMalformedJson, problem.Code, request.body)
+		assert.NotEmpty(t, problem.Detail, "should say what is malformed")
+	}
+}
+
+func TestProblemCodes(t *testing.T) {
+	srv := newTestServer(t)
+	router := mux.NewRouter()
+	srv.Routes(router)
+
+	req, _ := http.NewRequest(http.MethodGet, "/api/user/404", nil)
+	req.Header.Set(requestIdHeader, "req-42")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	require.EqualValues(t, http.StatusNotFound, resp.Code)
+	problem := readProblem(t, resp)
+	assert.EqualValues(t, models.ProblemNotFound, problem.Code)
+	assert.EqualValues(t, "req-42", problem.RequestID, "should echo the request id")
+
+	resp = sendJson(router, http.MethodGet, "/api/users?colour=blue", "")
+	require.EqualValues(t, http.StatusBadRequest, resp.Code)
+	problem = readProblem(t, resp)
+	assert.EqualValues(t, models.ProblemUnknownParameter, problem.Code)
+	assert.Contains(t, problem.Allowed, "name_prefix", "should list allowed filters")
+
+	req, _ = http.NewRequest(http.MethodPut, "/api/user/1", strings.NewReader(`{"name": "meow", "dob": 1, "address": "a", "description": "d"}`))
+	req.Header.Set("If-Match", `"stale"`)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	require.EqualValues(t, http.StatusPreconditionFailed, resp.Code)
+	assert.EqualValues(t, models.ProblemVersionConflict, readProblem(t, resp).Code)
+
+	resp = patchUser(router, "1", "text/plain", `{"name": "meow"}`)
+	require.EqualValues(t, http.StatusUnsupportedMediaType, resp.Code)
+	assert.EqualValues(t, models.ProblemUnsupportedMediaType, readProblem(t, resp).Code)
+}
+
+func TestProblemHidesInternalErrors(t *testing.T) {
+	_, router := newFakeServer()
+
+	resp := sendJson(router, http.MethodGet, "/api/users", "")
+	require.EqualValues(t, http.StatusInternalServerError, resp.Code, "fake store cannot list users")
+	problem := readProblem(t, resp)
+	assert.EqualValues(t, models.ProblemInternalError, problem.Code)
+	assert.EqualValues(t, internalErrorDetail, problem.Detail, "should not reveal the storage error")
+
+	resp = sendJson(router, http.MethodGet, "/api/webhooks", "")
+	require.EqualValues(t, http.StatusNotImplemented, resp.Code, "fake server has no webhooks")
+	problem = readProblem(t, resp)
+	assert.EqualValues(t, models.ProblemNotImplemented, problem.Code)
+	assert.EqualValues(t, errNoWebhooks.Error(), problem.Detail, "should say what is not implemented")
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/google/logger"
+	"github.com/gorilla/mux"
+	"github.com/metildachee/userie/dao/audit"
+	"github.com/metildachee/userie/dao/feed"
+	"github.com/metildachee/userie/dao/interfaces"
+	"github.com/metildachee/userie/webhook"
+	"github.com/opentracing/opentracing-go"
+)
+
+// actorHeader names who makes a request, it is recorded with the changes the
+// request makes. The gateway in front of the api is expected to set it.
+const actorHeader = "X-Actor"
+
+// requestIdHeader carries the id the gateway gave a request, failed requests
+// answer with it.
+const requestIdHeader = "X-Request-ID"
+
+type requestIdKey struct{}
+
+// requestId returns the gateway's id of the request ctx belongs to.
+func requestId(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey{}).(string)
+	return id
+}
+
+// Server holds the long lived dependencies shared by every request.
+type Server struct {
+	dao interfaces.UserDao
+	// changes streams the writes made through dao, the change feed answers
+	// 501 without it
+	changes *feed.Broker
+	// hooks delivers user writes to the registered webhooks, the webhook
+	// endpoints answer 501 without it
+	hooks *webhook.Dispatcher
+	// hooksFromOutbox is set when the outbox relay notifies the webhooks
+	// instead of the handlers
+	hooksFromOutbox bool
+
+	logger *logger.Logger
+	tracer opentracing.Tracer
+}
+
+func NewServer(dao interfaces.UserDao, changes *feed.Broker, hooks *webhook.Dispatcher, lg *logger.Logger, tracer opentracing.Tracer) *Server {
+	return &Server{
+		dao:     dao,
+		changes: changes,
+		hooks:   hooks,
+		logger:  lg,
+		tracer:  tracer,
+	}
+}
+
+// Routes registers the api under r.
+func (s *Server) Routes(r *mux.Router) {
+	prefix := r.PathPrefix("/api").Subrouter()
+
+	u := prefix.PathPrefix("/user").Subrouter()
+	u.HandleFunc("/{id}", s.GetUser).Methods(http.MethodGet)
+	u.HandleFunc("/{id}", s.UpdateUser).Methods(http.MethodPut)
+	u.HandleFunc("/{id}", s.PatchUser).Methods(http.MethodPatch)
+	u.HandleFunc("/{id}", s.DeleteUser).Methods(http.MethodDelete)
+	u.HandleFunc("/{id}/restore", s.RestoreUser).Methods(http.MethodPost)
+	u.HandleFunc("/{id}/history", s.GetUserHistory).Methods(http.MethodGet)
+	u.HandleFunc("/{id}/revert", s.RevertUser).Methods(http.MethodPost)
+	u.HandleFunc("", s.CreateUser).Methods(http.MethodPost)
+
+	us := prefix.PathPrefix("/users").Subrouter()
+	us.HandleFunc("", s.GetAll).Methods(http.MethodGet)
+	us.HandleFunc("/limit={limit}&offset={offset}", s.GetAll).Methods(http.MethodGet)
+	us.HandleFunc("/search", s.SearchUsers).Methods(http.MethodGet)
+	us.HandleFunc("/deleted", s.GetDeletedUsers).Methods(http.MethodGet)
+	us.HandleFunc("/_bulk", s.BulkCreateUsers).Methods(http.MethodPost)
+	us.HandleFunc("/_import", s.ImportUsers).Methods(http.MethodPost)
+	us.HandleFunc("/export", s.ExportUsers).Methods(http.MethodGet)
+	us.HandleFunc("/changes", s.StreamChanges).Methods(http.MethodGet)
+	us.HandleFunc("/_delete_by_query", s.DeleteByQuery).Methods(http.MethodPost)
+	us.HandleFunc("/_update_by_query", s.UpdateByQuery).Methods(http.MethodPost)
+
+	prefix.HandleFunc("/tasks/{id}", s.GetTask).Methods(http.MethodGet)
+
+	wh := prefix.PathPrefix("/webhooks").Subrouter()
+	wh.HandleFunc("", s.CreateWebhook).Methods(http.MethodPost)
+	wh.HandleFunc("", s.GetWebhooks).Methods(http.MethodGet)
+	wh.HandleFunc("/{id}", s.GetWebhook).Methods(http.MethodGet)
+	wh.HandleFunc("/{id}", s.UpdateWebhook).Methods(http.MethodPut)
+	wh.HandleFunc("/{id}", s.DeleteWebhook).Methods(http.MethodDelete)
+	wh.HandleFunc("/{id}/deliveries", s.GetWebhookDeliveries).Methods(http.MethodGet)
+	wh.HandleFunc("/{id}/dead_letters", s.GetWebhookDeadLetters).Methods(http.MethodGet)
+	wh.HandleFunc("/{id}/dead_letters/{letter}/redeliver", s.RedeliverWebhookDeadLetter).Methods(http.MethodPost)
+}
+
+// startSpan starts the request span on the server's tracer and returns a
+// context carrying it, so dao spans are recorded as its children. The context
+// also carries the request's actor for the user history and its request id.
+func (s *Server) startSpan(r *http.Request, operation string) (opentracing.Span, context.Context) {
+	ctx := r.Context()
+	if actor := r.Header.Get(actorHeader); actor != "" {
+		ctx = audit.WithActor(ctx, actor)
+	}
+	id := r.Header.Get(requestIdHeader)
+	if id != "" {
+		ctx = context.WithValue(ctx, requestIdKey{}, id)
+	}
+	span, ctx := opentracing.StartSpanFromContextWithTracer(ctx, s.tracer, operation)
+	if id != "" {
+		span.SetTag("request_id", id)
+	}
+	return span, ctx
+}
@@ -0,0 +1,191 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/logger"
+	"github.com/gorilla/mux"
+	"github.com/metildachee/userie/dao/interfaces"
+	"github.com/metildachee/userie/models"
+	"github.com/opentracing/opentracing-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeStore is an interfaces.UserDao keeping users in a map.
+type fakeStore struct {
+	users map[string]models.User
+}
+
+func (f *fakeStore) Create(ctx context.Context, u models.User) (string, error) {
+	u.ID = "fake"
+	f.users[u.ID] = u
+	return u.ID, nil
+}
+
+func (f *fakeStore) GetById(ctx context.Context, id string) (models.User, error) {
+	if u, ok := f.users[id]; ok {
+		return u, nil
+	}
+	return models.User{}, interfaces.ErrNotFound
+}
+
+func (f *fakeStore) GetVersioned(ctx context.Context, id string) (models.User, string, error) {
+	u, err := f.GetById(ctx, id)
+	return u, "1", err
+}
+
+func (f *fakeStore) BatchCreate(ctx context.Context, users []models.User) error {
+	return errors.New("not implemented")
+}
+
+// BulkCreate writes the first user only and fails as if the storage went
+// away before the rest was sent.
+func (f *fakeStore) BulkCreate(ctx context.Context, users []models.User) ([]models.BulkItemResult, error) {
+	results := make([]models.BulkItemResult, len(users))
+	if len(users) == 0 {
+		return results, nil
+	}
+	results[0] = models.CreateResult(f.Create(ctx, users[0]))
+	return results, errors.New("storage went away")
+}
+
+func (f *fakeStore) GetAll(ctx context.Context, limit, offset int, filter ...models.UserFilter) ([]models.User, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (f *fakeStore) GetAllAfter(ctx context.Context, token string, limit int, filter ...models.UserFilter) ([]models.User, string, error) {
+	return nil, "", errors.New("not implemented")
+}
+
+func (f *fakeStore) Search(ctx context.Context, text string, limit, offset int) (models.SearchResult, error) {
+	return models.SearchResult{}, errors.New("not implemented")
+}
+
+func (f *fakeStore) Update(ctx context.Context, u models.User) error {
+	f.users[u.ID] = u
+	return nil
+}
+
+func (f *fakeStore) Upsert(ctx context.Context, u models.User) (bool, error) {
+	_, exists := f.users[u.ID]
+	f.users[u.ID] = u
+	return !exists, nil
+}
+
+func (f *fakeStore) Patch(ctx context.Context, id string, fields map[string]interface{}) error {
+	return errors.New("not implemented")
+}
+
+func (f *fakeStore) Delete(ctx context.Context, id string) error {
+	delete(f.users, id)
+	return nil
+}
+
+func (f *fakeStore) UpdateIfMatch(ctx context.Context, u models.User, version string) (string, error) {
+	return "", errors.New("not implemented")
+}
+
+func (f *fakeStore) PatchIfMatch(ctx context.Context, id string, fields map[string]interface{}, version string) (string, error) {
+	return "", errors.New("not implemented")
+}
+
+func (f *fakeStore) DeleteIfMatch(ctx context.Context, id, version string) error {
+	return errors.New("not implemented")
+}
+
+func (f *fakeStore) Restore(ctx context.Context, id string) error {
+	return errors.New("not implemented")
+}
+
+func (f *fakeStore) GetDeleted(ctx context.Context, limit, offset int) ([]models.User, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (f *fakeStore) Purge(ctx context.Context, before int32) (int64, error) {
+	return 0, errors.New("not implemented")
+}
+
+func (f *fakeStore) GetHistory(ctx context.Context, id string, limit, offset int) (models.HistoryPage, error) {
+	return models.HistoryPage{}, errors.New("not implemented")
+}
+
+func newFakeServer() (*Server, *mux.Router) {
+	srv := NewServer(&fakeStore{users: map[string]models.User{}}, nil, nil, logger.Init("test logger", false, false, ioutil.Discard), opentracing.NoopTracer{})
+	router := mux.NewRouter()
+	srv.Routes(router)
+	return srv, router
+}
+
+func TestServerGetUserNotFound(t *testing.T) {
+	_, router := newFakeServer()
+	req, _ := http.NewRequest(http.MethodGet, "/api/user/404", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.EqualValues(t, http.StatusNotFound, resp.Code, "missing user should be not found")
+}
+
+func TestServerCreateThenGetUser(t *testing.T) {
+	_, router := newFakeServer()
+	u := models.User{
+		Name:        "metchee",
+		DOB:         int32(time.Now().AddDate(-20, 0, 0).Unix()),
+		Address:     "Kent Ridge",
+		Description: "default user info",
+		Ctime:       int32(time.Now().Unix()),
+	}
+	jsonBody, err := json.Marshal(u)
+	require.Nil(t, err, "should not have error when marshal")
+
+	req, _ := http.NewRequest(http.MethodPost, "/api/user", bytes.NewBuffer(jsonBody))
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	require.EqualValues(t, http.StatusOK, resp.Code, "response code is not ok")
+	id := resp.Body.String()
+	assert.EqualValues(t, "fake", id, "should answer with the new id")
+
+	got := models.User{}
+	req, _ = http.NewRequest(http.MethodGet, "/api/user/"+id, nil)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	require.EqualValues(t, http.StatusOK, resp.Code, "response code is not ok")
+	err = json.NewDecoder(resp.Body).Decode(&got)
+	require.Nil(t, err, "json decoder err")
+	assert.EqualValues(t, u.Name, got.Name, "should get the created user")
+}
+
+func TestServerBulkCreateFailsPartWay(t *testing.T) {
+	_, router := newFakeServer()
+	u := models.User{
+		Name:        "metchee",
+		DOB:         int32(time.Now().AddDate(-20, 0, 0).Unix()),
+		Address:     "Kent Ridge",
+		Description: "default user info",
+	}
+	jsonBody, err := json.Marshal([]models.User{u, {Name: "no address"}, u})
+	require.Nil(t, err, "should not have error when marshal")
+
+	req, _ := http.NewRequest(http.MethodPost, "/api/users/_bulk", bytes.NewBuffer(jsonBody))
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	require.EqualValues(t, http.StatusOK, resp.Code, "written users should still be reported")
+
+	result := models.BulkResult{}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&result), "json decoder err")
+	require.Len(t, result.Items, 3, "should answer for every user")
+	assert.True(t, result.Errors, "should flag the failures")
+	assert.EqualValues(t, models.BulkItemResult{ID: "fake", Status: http.StatusCreated}, result.Items[0], "written user should keep its result")
+	assert.EqualValues(t, http.StatusBadRequest, result.Items[1].Status, "invalid user should be rejected")
+	assert.EqualValues(t, http.StatusInternalServerError, result.Items[2].Status, "unsent user should be failed")
+	assert.Contains(t, result.Items[2].Error, "storage went away", "unsent user should carry the error")
+	assert.Empty(t, result.Items[2].ID, "unsent user has no id")
+}
@@ -0,0 +1,179 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/metildachee/userie/dao/interfaces"
+	"github.com/metildachee/userie/models"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+var (
+	errMissingFilter    = errors.New("mass operations need at least one filter")
+	errNoMassOperations = errors.New("the storage backend cannot run mass operations")
+)
+
+// massOperator returns the dao as an interfaces.MassOperator, or answers 501
+// when the storage backend cannot run mass operations.
+func (s *Server) massOperator(ctx context.Context, w http.ResponseWriter) (interfaces.MassOperator, bool) {
+	op, ok := s.dao.(interfaces.MassOperator)
+	if !ok {
+		writeProblem(ctx, w, http.StatusNotImplemented, errNoMassOperations)
+	}
+	return op, ok
+}
+
+// getMassFilter reads the listing filters of a mass operation, at least one
+// is required so a mistake cannot touch every user, and its dry_run flag.
+func getMassFilter(r *http.Request) (filter models.UserFilter, dryRun bool, err error) {
+	if filter, err = getUserFilter(r, "dry_run"); err != nil {
+		return
+	}
+	if filter.IsEmpty() {
+		return filter, false, errMissingFilter
+	}
+	if value := getQuery("dry_run", r); value != "" {
+		if dryRun, err = strconv.ParseBool(value); err != nil {
+			return filter, false, fmt.Errorf("invalid dry_run %q", value)
+		}
+	}
+	return
+}
+
+// startMassOperation answers a dry run with the number of matching users, or
+// starts the operation and answers 202 with the task to follow.
+func (s *Server) startMassOperation(ctx context.Context, w http.ResponseWriter, op interfaces.MassOperator, filter models.UserFilter, dryRun bool,
+	start func() (string, error)) error {
+	var body interface{}
+	if dryRun {
+		matched, err := op.Count(ctx, filter)
+		if err != nil {
+			writeError(ctx, w, err)
+			return err
+		}
+		body = models.DryRunResult{DryRun: true, Matched: matched}
+	} else {
+		id, err := start()
+		if err != nil {
+			writeError(ctx, w, err)
+			return err
+		}
+		accepted := models.TaskAccepted{Task: id, StatusUrl: "/api/tasks/" + id}
+		w.Header().Set("Location", accepted.StatusUrl)
+		w.WriteHeader(http.StatusAccepted)
+		body = accepted
+	}
+	return json.NewEncoder(w).Encode(body)
+}
+
+// DeleteByQuery deletes every user matching the listing filters in the
+// background.
+func (s *Server) DeleteByQuery(w http.ResponseWriter, r *http.Request) {
+	span, ctx := s.startSpan(r, "delete by query")
+	ext.SpanKindRPCClient.Set(span)
+	defer span.Finish()
+
+	w = writeJsonHeader(w)
+
+	op, ok := s.massOperator(ctx, w)
+	if !ok {
+		return
+	}
+	filter, dryRun, err := getMassFilter(r)
+	if err != nil {
+		ext.LogError(span, err)
+		writeBadRequest(ctx, w, err)
+		return
+	}
+	span.LogFields(log.Bool("dry run", dryRun))
+
+	err = s.startMassOperation(ctx, w, op, filter, dryRun, func() (string, error) {
+		return op.StartDeleteByQuery(ctx, filter)
+	})
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	s.logger.Info("delete by query request done, check tracer: ", span.Context())
+}
+
+// UpdateByQuery sets the fields of the JSON body on every user matching the
+// listing filters in the background.
+func (s *Server) UpdateByQuery(w http.ResponseWriter, r *http.Request) {
+	span, ctx := s.startSpan(r, "update by query")
+	ext.SpanKindRPCClient.Set(span)
+	defer span.Finish()
+
+	w = writeJsonHeader(w)
+
+	op, ok := s.massOperator(ctx, w)
+	if !ok {
+		return
+	}
+	filter, dryRun, err := getMassFilter(r)
+	if err != nil {
+		ext.LogError(span, err)
+		writeBadRequest(ctx, w, err)
+		return
+	}
+	var fields map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&fields); err != nil {
+		ext.LogError(span, err)
+		writeBadRequest(ctx, w, err)
+		return
+	}
+	if err := models.ValidateFields(fields); err != nil {
+		ext.LogError(span, err)
+		writeBadRequest(ctx, w, err)
+		return
+	}
+	span.LogFields(log.Bool("dry run", dryRun), log.String("fields", fmt.Sprintf("%v", fields)))
+
+	err = s.startMassOperation(ctx, w, op, filter, dryRun, func() (string, error) {
+		return op.StartUpdateByQuery(ctx, filter, fields)
+	})
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	s.logger.Info("update by query request done, check tracer: ", span.Context())
+}
+
+func (s *Server) GetTask(w http.ResponseWriter, r *http.Request) {
+	span, ctx := s.startSpan(r, "get task")
+	ext.SpanKindRPCClient.Set(span)
+	defer span.Finish()
+
+	w = writeJsonHeader(w)
+
+	op, ok := s.massOperator(ctx, w)
+	if !ok {
+		return
+	}
+	taskId := ""
+	if taskId = getParam("id", r); taskId == "" {
+		err := errors.New("missing task id in param")
+		ext.LogError(span, err)
+		writeBadRequest(ctx, w, err)
+		return
+	}
+
+	status, err := op.GetTask(ctx, taskId)
+	if err != nil {
+		ext.LogError(span, err)
+		writeError(ctx, w, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	span.LogFields(log.String("task", taskId), log.Bool("completed", status.Completed))
+	s.logger.Info("get task request done, check tracer: ", span.Context())
+}
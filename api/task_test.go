@@ -0,0 +1,115 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/metildachee/userie/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func post(router *mux.Router, path, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(http.MethodPost, path, bytes.NewBufferString(body))
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	return resp
+}
+
+// waitForTask polls the task status url until the task completed.
+func waitForTask(t *testing.T, router *mux.Router, url string) models.TaskStatus {
+	status := models.TaskStatus{}
+	for i := 0; i < 100 && !status.Completed; i++ {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		require.EqualValues(t, http.StatusOK, resp.Code, "response code is not ok")
+		require.Nil(t, json.NewDecoder(resp.Body).Decode(&status), "json decoder err")
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.True(t, status.Completed, "task should complete")
+	return status
+}
+
+func TestDeleteByQuery(t *testing.T) {
+	srv := newTestServer(t)
+	router := mux.NewRouter()
+	srv.Routes(router)
+	// users "3" to "5" were created more than two and a half days ago
+	query := fmt.Sprintf("/api/users/_delete_by_query?ctime_to=%d", time.Now().Add(-60*time.Hour).Unix())
+
+	resp := post(router, query+"&dry_run=true", "")
+	require.EqualValues(t, http.StatusOK, resp.Code, "response code is not ok")
+	dryRun := models.DryRunResult{}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&dryRun), "json decoder err")
+	assert.EqualValues(t, 3, dryRun.Matched, "dry run should count matching users")
+	_, err := srv.dao.GetById(context.Background(), "5")
+	assert.Nil(t, err, "dry run should not delete")
+
+	resp = post(router, query, "")
+	require.EqualValues(t, http.StatusAccepted, resp.Code, "should start a task")
+	accepted := models.TaskAccepted{}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&accepted), "json decoder err")
+	assert.EqualValues(t, accepted.StatusUrl, resp.Header().Get("Location"), "should point at the task")
+
+	status := waitForTask(t, router, accepted.StatusUrl)
+	assert.EqualValues(t, models.TaskDeleteByQuery, status.Operation)
+	assert.EqualValues(t, 3, status.Deleted, "should delete matching users")
+	_, err = srv.dao.GetById(context.Background(), "5")
+	assert.NotNil(t, err, "matching user should be deleted")
+	_, err = srv.dao.GetById(context.Background(), "1")
+	assert.Nil(t, err, "other users should be kept")
+
+	history, err := srv.dao.GetHistory(context.Background(), "5", 10, 0)
+	require.Nil(t, err, "should not have error when getting history")
+	require.NotEmpty(t, history.Changes, "the delete should be recorded")
+	assert.EqualValues(t, models.ChangeDelete, history.Changes[0].Operation, "the delete should be recorded")
+	assert.Nil(t, srv.dao.Restore(context.Background(), "5"), "users deleted by query should be restorable")
+}
+
+func TestUpdateByQuery(t *testing.T) {
+	srv := newTestServer(t)
+	router := mux.NewRouter()
+	srv.Routes(router)
+	query := "/api/users/_update_by_query?name_prefix=metchee"
+
+	for _, body := range []string{`{}`, `{"id": "1"}`, `{"name": ""}`, `{"nickname": "x"}`, `{"dob": "x"}`} {
+		resp := post(router, query, body)
+		assert.EqualValues(t, http.StatusBadRequest, resp.Code, "should reject "+body)
+	}
+	resp := post(router, "/api/users/_update_by_query", `{"description": "test account"}`)
+	assert.EqualValues(t, http.StatusBadRequest, resp.Code, "should require a filter")
+
+	resp = post(router, query, `{"description": "test account"}`)
+	require.EqualValues(t, http.StatusAccepted, resp.Code, "should start a task")
+	accepted := models.TaskAccepted{}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&accepted), "json decoder err")
+
+	status := waitForTask(t, router, accepted.StatusUrl)
+	assert.EqualValues(t, 5, status.Updated, "should update matching users")
+	user, err := srv.dao.GetById(context.Background(), "2")
+	require.Nil(t, err, "should not have err when getting user")
+	assert.EqualValues(t, "test account", user.Description, "should set the field")
+	assert.EqualValues(t, "metchee 2", user.Name, "should keep other fields")
+}
+
+func TestMassOperationsUnsupported(t *testing.T) {
+	_, router := newFakeServer()
+	resp := post(router, "/api/users/_delete_by_query?name_prefix=a", "")
+	assert.EqualValues(t, http.StatusNotImplemented, resp.Code, "backend without mass operations")
+
+	srv := newTestServer(t)
+	router = mux.NewRouter()
+	srv.Routes(router)
+	req, _ := http.NewRequest(http.MethodGet, "/api/tasks/404", nil)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.EqualValues(t, http.StatusNotFound, resp.Code, "unknown task should be not found")
+}
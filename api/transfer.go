@@ -0,0 +1,118 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/metildachee/userie/transfer"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+// importTypes maps the accepted import content types onto transfer formats.
+var importTypes = map[string]string{
+	"application/x-ndjson": transfer.FormatNDJSON,
+	"application/ndjson":   transfer.FormatNDJSON,
+	"text/csv":             transfer.FormatCSV,
+}
+
+// ImportUsers streams users from an NDJSON or CSV body into storage and
+// answers with a line numbered report of the rows that failed.
+func (s *Server) ImportUsers(w http.ResponseWriter, r *http.Request) {
+	span, ctx := s.startSpan(r, "import users")
+	ext.SpanKindRPCClient.Set(span)
+	defer span.Finish()
+
+	w = writeJsonHeader(w)
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	format, ok := importTypes[mediaType]
+	if !ok {
+		err := fmt.Errorf("unsupported import content type %q", mediaType)
+		ext.LogError(span, err)
+		writeProblem(ctx, w, http.StatusUnsupportedMediaType, err)
+		return
+	}
+	batchSize := transfer.DefaultBatchSize
+	if value := getQuery("batch_size", r); value != "" {
+		var err error
+		if batchSize, err = strconv.Atoi(value); err != nil || batchSize <= 0 || batchSize > maxBulkUsers {
+			err = fmt.Errorf("invalid batch_size %q", value)
+			ext.LogError(span, err)
+			writeBadRequest(ctx, w, err)
+			return
+		}
+	}
+	span.LogFields(log.String("format", format), log.Int("batch size", batchSize))
+
+	report, err := transfer.Import(ctx, s.dao, r.Body, format, batchSize)
+	var formatErr *transfer.FormatError
+	if errors.As(err, &formatErr) {
+		ext.LogError(span, err)
+		writeBadRequest(ctx, w, err)
+		return
+	}
+	if err != nil {
+		ext.LogError(span, err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	// the report of an import that stopped still tells what was written
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	s.logger.Info("import users request done, check tracer: ", span.Context())
+}
+
+// exportTypes are the content types export answers with per format.
+var exportTypes = map[string]string{
+	transfer.FormatNDJSON: "application/x-ndjson",
+	transfer.FormatCSV:    "text/csv",
+}
+
+// ExportUsers streams every user matching the listing filters as NDJSON or
+// CSV. Rows are sent as they are read, the export stops when the client goes
+// away.
+func (s *Server) ExportUsers(w http.ResponseWriter, r *http.Request) {
+	span, ctx := s.startSpan(r, "export users")
+	ext.SpanKindRPCClient.Set(span)
+	defer span.Finish()
+
+	format := getQuery("format", r)
+	if format == "" {
+		format = transfer.FormatNDJSON
+	}
+	contentType, ok := exportTypes[format]
+	if !ok {
+		err := fmt.Errorf("unknown format %q, expecting one of %v", format, transfer.Formats)
+		ext.LogError(span, err)
+		writeBadRequest(ctx, w, err)
+		return
+	}
+	filter, err := getUserFilter(r, "format")
+	if err != nil {
+		ext.LogError(span, err)
+		writeBadRequest(ctx, w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"users.%s\"", format))
+	exported, err := transfer.Export(ctx, s.dao, w, format, filter)
+	span.LogFields(log.Int("exported", exported))
+	if err != nil {
+		ext.LogError(span, err)
+		if ctx.Err() != nil {
+			s.logger.Info("export users cancelled by client, check tracer: ", span.Context())
+			return
+		}
+		// the status is already sent, break the connection so the client
+		// does not take a cut export for a complete one
+		panic(http.ErrAbortHandler)
+	}
+	s.logger.Info("export users request done, check tracer: ", span.Context())
+}
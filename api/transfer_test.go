@@ -0,0 +1,98 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/metildachee/userie/transfer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func importUsers(router *mux.Router, path, contentType, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(http.MethodPost, path, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", contentType)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	return resp
+}
+
+func TestImportUsers(t *testing.T) {
+	srv := newTestServer(t)
+	router := mux.NewRouter()
+	srv.Routes(router)
+	before, err := srv.dao.GetAll(context.Background(), 100, 0)
+	require.Nil(t, err, "should not have error when listing")
+
+	body := "{\"name\": \"imported 1\", \"address\": \"kent ridge\", \"description\": \"imported\"}\n{\"name\": \"\"}\n"
+	resp := importUsers(router, "/api/users/_import?batch_size=1", "application/x-ndjson", body)
+	require.EqualValues(t, http.StatusOK, resp.Code, "response code is not ok")
+	report := transfer.ImportReport{}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&report), "json decoder err")
+	assert.EqualValues(t, 1, report.Imported, "valid rows should be imported")
+	require.Len(t, report.Errors, 1, "should report the invalid row")
+	assert.EqualValues(t, 2, report.Errors[0].Line, "should report the line")
+
+	body = "name,address,description\nimported 2,kent ridge,imported\n"
+	resp = importUsers(router, "/api/users/_import", "text/csv; charset=utf-8", body)
+	require.EqualValues(t, http.StatusOK, resp.Code, "response code is not ok")
+
+	after, err := srv.dao.GetAll(context.Background(), 100, 0)
+	require.Nil(t, err, "should not have error when listing")
+	assert.Len(t, after, len(before)+2, "should store the imported users")
+}
+
+func TestImportUsersInvalid(t *testing.T) {
+	srv := newTestServer(t)
+	router := mux.NewRouter()
+	srv.Routes(router)
+
+	resp := importUsers(router, "/api/users/_import", "application/json", "[]")
+	assert.EqualValues(t, http.StatusUnsupportedMediaType, resp.Code, "should reject unknown formats")
+	resp = importUsers(router, "/api/users/_import?batch_size=0", "text/csv", "name\n")
+	assert.EqualValues(t, http.StatusBadRequest, resp.Code, "should reject invalid batch sizes")
+	resp = importUsers(router, "/api/users/_import", "text/csv", "name,nickname\n")
+	assert.EqualValues(t, http.StatusBadRequest, resp.Code, "should reject unknown columns")
+}
+
+func TestExportUsers(t *testing.T) {
+	srv := newTestServer(t)
+	router := mux.NewRouter()
+	srv.Routes(router)
+
+	req, _ := http.NewRequest(http.MethodGet, "/api/users/export", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	require.EqualValues(t, http.StatusOK, resp.Code, "response code is not ok")
+	assert.EqualValues(t, "application/x-ndjson", resp.Header().Get("Content-Type"))
+	assert.EqualValues(t, 5, strings.Count(resp.Body.String(), "\n"), "should write a line per user")
+
+	req, _ = http.NewRequest(http.MethodGet, "/api/users/export?format=csv&name_prefix=metchee+1", nil)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	require.EqualValues(t, http.StatusOK, resp.Code, "response code is not ok")
+	assert.EqualValues(t, "text/csv", resp.Header().Get("Content-Type"))
+	lines := strings.Split(strings.TrimSpace(resp.Body.String()), "\n")
+	require.Len(t, lines, 2, "should write the header and the matching user")
+	assert.True(t, strings.HasPrefix(lines[1], "1,metchee 1,"), "should write the user's fields")
+}
+
+func TestExportUsersInvalid(t *testing.T) {
+	srv := newTestServer(t)
+	router := mux.NewRouter()
+	srv.Routes(router)
+
+	for _, query := range []string{"format=xml", "nickname=metchee"} {
+		req, _ := http.NewRequest(http.MethodGet, "/api/users/export?"+query, nil)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		assert.EqualValues(t, http.StatusBadRequest, resp.Code, "should reject "+query)
+		assert.EqualValues(t, problemContentType, resp.Header().Get("Content-Type"))
+	}
+}
@@ -5,20 +5,21 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"strconv"
 
-	"github.com/google/logger"
-	"github.com/metildachee/userie/dao/elasticsearch"
+	"github.com/metildachee/userie/dao/audit"
+	"github.com/metildachee/userie/dao/interfaces"
 	"github.com/metildachee/userie/models"
 	"github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/ext"
 	"github.com/opentracing/opentracing-go/log"
 )
 
-func GetAll(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
-	span, _ := opentracing.StartSpanFromContext(ctx, "get all")
+func (s *Server) GetAll(w http.ResponseWriter, r *http.Request) {
+	span, ctx := s.startSpan(r, "get all")
 	ext.SpanKindRPCClient.Set(span)
 	defer span.Finish()
 
@@ -33,50 +34,55 @@ func GetAll(w http.ResponseWriter, r *http.Request) {
 
 	w = writeJsonHeader(w)
 
-	dao, err := elasticsearch.NewDao(ctx)
+	limit, offset, err := getLimitOffset(r)
 	if err != nil {
 		ext.LogError(span, err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeBadRequest(ctx, w, err)
+		return
+	}
+	filter, err := getUserFilter(r, "cursor")
+	if err != nil {
+		ext.LogError(span, err)
+		writeBadRequest(ctx, w, err)
 		return
 	}
 
-	limit, offset := 10, 0
-	if queryLimit := getParam("limit", r); queryLimit != "" {
-		limit, err = strconv.Atoi(queryLimit)
+	// a cursor param, even an empty one, switches to cursor pagination
+	if _, ok := r.URL.Query()["cursor"]; ok {
+		page := models.UserPage{Users: []models.User{}}
+		users, next, err := s.dao.GetAllAfter(ctx, getQuery("cursor", r), limit, filter)
 		if err != nil {
 			ext.LogError(span, err)
-			w.WriteHeader(http.StatusInternalServerError)
+			if errors.Is(err, interfaces.ErrInvalidCursor) {
+				writeBadRequest(ctx, w, err)
+			} else {
+				writeError(ctx, w, err)
+			}
 			return
 		}
-
-		if limit <= 0 {
-			limit = 10
-		}
-	}
-	if queryOffset := getParam("offset", r); queryOffset != "" {
-		if offset, err = strconv.Atoi(queryOffset); err != nil {
+		page.Users, page.NextCursor = append(page.Users, users...), next
+		if err := json.NewEncoder(w).Encode(page); err != nil {
 			ext.LogError(span, err)
-			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		if offset < 0 {
-			offset = 0
-		}
+		span.LogFields(log.Int("users", len(page.Users)), log.String("next cursor", next))
+		s.logger.Info("get all user page request done, check tracer: ", span.Context())
+		return
 	}
+
 	span.LogFields(
 		log.String("offset value", string(rune(offset))),
 		log.String("limit", string(rune(limit))))
 
-	users, err := dao.GetAll(ctx, limit, offset)
+	users, err := s.dao.GetAll(ctx, limit, offset, filter)
 	if err != nil {
 		ext.LogError(span, err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(ctx, w, err)
 		return
 	}
 
 	if err := json.NewEncoder(w).Encode(users); err != nil {
 		ext.LogError(span, err)
-		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -84,156 +90,630 @@ func GetAll(w http.ResponseWriter, r *http.Request) {
 		log.String("event", "get users result from es"),
 		log.String("value", fmt.Sprintf("%v", users)),
 	)
-	logger.Info("get all user request done, check tracer: ", span.Context())
+	s.logger.Info("get all user request done, check tracer: ", span.Context())
 }
 
-func GetUser(w http.ResponseWriter, r *http.Request) {
-	logger.Info("start get user")
-	ctx := context.Background()
-	span, _ := opentracing.StartSpanFromContext(ctx, "get user")
+func (s *Server) SearchUsers(w http.ResponseWriter, r *http.Request) {
+	span, ctx := s.startSpan(r, "search users")
 	ext.SpanKindRPCClient.Set(span)
 	defer span.Finish()
 
 	w = writeJsonHeader(w)
-	dao, err := elasticsearch.NewDao(ctx)
+
+	text := ""
+	if text = getQuery("q", r); text == "" {
+		err := errors.New("missing query param q")
+		ext.LogError(span, err)
+		writeBadRequest(ctx, w, err)
+		return
+	}
+	limit, offset, err := getLimitOffset(r)
 	if err != nil {
 		ext.LogError(span, err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeBadRequest(ctx, w, err)
 		return
 	}
+	span.LogFields(
+		log.String("q", text),
+		log.Int("limit", limit),
+		log.Int("offset", offset))
+
+	result, err := s.dao.Search(ctx, text, limit, offset)
+	if err != nil {
+		ext.LogError(span, err)
+		writeError(ctx, w, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	span.LogFields(log.Int64("total hits", result.Total))
+	s.logger.Info("search users request done, check tracer: ", span.Context())
+}
+
+func (s *Server) GetUser(w http.ResponseWriter, r *http.Request) {
+	s.logger.Info("start get user")
+	span, ctx := s.startSpan(r, "get user")
+	ext.SpanKindRPCClient.Set(span)
+	defer span.Finish()
+
+	w = writeJsonHeader(w)
 
 	userId := ""
 	if userId = getParam("id", r); userId == "" {
-		ext.LogError(span, errors.New("missing params of id"), log.String("user id", userId))
-		w.WriteHeader(http.StatusBadRequest)
+		err := errors.New("missing params of id")
+		ext.LogError(span, err, log.String("user id", userId))
+		writeBadRequest(ctx, w, err)
 		return
 	}
 
-	var user models.User
-	if user, err = dao.GetById(ctx, userId); err != nil {
-		if err.Error() == "nil hit" {
-			w.WriteHeader(http.StatusNotFound)
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-		}
+	user, version, err := s.dao.GetVersioned(ctx, userId)
+	if err != nil {
+		writeError(ctx, w, err)
 		ext.LogError(span, err)
 		return
 	}
+	w.Header().Set("ETag", etag(version))
 	if err := json.NewEncoder(w).Encode(user); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
 		ext.LogError(span, err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 	span.LogFields(log.String("user", user.ToString()))
-	logger.Info("get one user request done, check tracer: ", span.Context())
+	s.logger.Info("get one user request done, check tracer: ", span.Context())
 }
 
-func CreateUser(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
-	span, _ := opentracing.StartSpanFromContext(ctx, "create user")
+func (s *Server) CreateUser(w http.ResponseWriter, r *http.Request) {
+	span, ctx := s.startSpan(r, "create user")
 	ext.SpanKindRPCClient.Set(span)
 	defer span.Finish()
 
 	w = writeJsonHeader(w)
-	dao, err := elasticsearch.NewDao(ctx)
-	if err != nil {
-		ext.LogError(span, err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
 
 	newUser := models.User{}
 	if err := json.NewDecoder(r.Body).Decode(&newUser); err != nil {
 		ext.LogError(span, err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeBadRequest(ctx, w, err)
 		return
 	}
 
 	if err := newUser.Validate(); err != nil {
 		ext.LogError(span, err)
-		w.WriteHeader(http.StatusBadRequest)
+		writeBadRequest(ctx, w, err)
 		return
 	}
 
-	id := ""
-	if id, err = dao.Create(ctx, newUser); err != nil {
+	id, err := s.dao.Create(ctx, newUser)
+	if err != nil {
 		ext.LogError(span, err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(ctx, w, err)
 		return
 	}
+	newUser.ID = id
+	s.notifyWebhooks(ctx, span, models.WebhookUserCreated, id, &newUser)
 	_, err = w.Write([]byte(id))
 	if err != nil {
 		ext.LogError(span, err)
-		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 	span.LogFields(log.String("user_id", id))
-	logger.Info("create one user request done, check tracer: ", span.Context())
+	s.logger.Info("create one user request done, check tracer: ", span.Context())
 	w.WriteHeader(http.StatusCreated)
 }
 
-func UpdateUser(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
-	span, _ := opentracing.StartSpanFromContext(ctx, "update user")
+// BulkCreateUsers creates a JSON array of users and answers with a result
+// for each of them. Users failing validation are reported without being
+// written, the others are created in bulk.
+func (s *Server) BulkCreateUsers(w http.ResponseWriter, r *http.Request) {
+	span, ctx := s.startSpan(r, "bulk create users")
 	ext.SpanKindRPCClient.Set(span)
 	defer span.Finish()
 
-	dao, err := elasticsearch.NewDao(ctx)
+	w = writeJsonHeader(w)
+
+	var users []models.User
+	if err := json.NewDecoder(r.Body).Decode(&users); err != nil {
+		ext.LogError(span, err)
+		writeBadRequest(ctx, w, err)
+		return
+	}
+	if len(users) > maxBulkUsers {
+		err := fmt.Errorf("%d users exceed the limit of %d", len(users), maxBulkUsers)
+		ext.LogError(span, err)
+		writeProblem(ctx, w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+
+	result := models.BulkResult{Items: make([]models.BulkItemResult, len(users))}
+	valid, positions := make([]models.User, 0, len(users)), make([]int, 0, len(users))
+	for i, u := range users {
+		if err := u.Validate(); err != nil {
+			result.Items[i] = models.BulkItemResult{Status: http.StatusBadRequest, Error: err.Error()}
+			continue
+		}
+		valid, positions = append(valid, u), append(positions, i)
+	}
+	// a failure part way keeps the results of the users already written, the
+	// users not sent are reported with the error so only they are retried
+	created, err := s.dao.BulkCreate(ctx, valid)
 	if err != nil {
 		ext.LogError(span, err)
-		w.WriteHeader(http.StatusInternalServerError)
+	}
+	for n := range valid {
+		var item models.BulkItemResult
+		if n < len(created) {
+			item = created[n]
+		}
+		if item.Status == 0 {
+			item = models.BulkItemResult{Status: http.StatusInternalServerError, Error: fmt.Sprintf("not written: %v", err)}
+		}
+		result.Items[positions[n]] = item
+		if item.Error == "" && item.ID != "" {
+			u := valid[n]
+			u.ID = item.ID
+			s.notifyWebhooks(ctx, span, models.WebhookUserCreated, u.ID, &u)
+		}
+	}
+	failed := 0
+	for _, item := range result.Items {
+		if item.Error != "" {
+			failed++
+		}
+	}
+	result.Errors = failed > 0
+
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	span.LogFields(log.Int("users", len(users)), log.Int("failed", failed))
+	s.logger.Info("bulk create users request done, check tracer: ", span.Context())
+}
+
+// UpdateUser replaces the user at the path id. A missing user is not found,
+// unless upsert=true asks to create it under that id.
+func (s *Server) UpdateUser(w http.ResponseWriter, r *http.Request) {
+	span, ctx := s.startSpan(r, "update user")
+	ext.SpanKindRPCClient.Set(span)
+	defer span.Finish()
+
+	w = writeJsonHeader(w)
+
+	userId := ""
+	if userId = getParam("id", r); userId == "" {
+		err := errors.New("missing user id in param")
+		ext.LogError(span, err, log.String("user_id", userId))
+		writeBadRequest(ctx, w, err)
 		return
 	}
+	upsert := false
+	if value := getQuery("upsert", r); value != "" {
+		var err error
+		if upsert, err = strconv.ParseBool(value); err != nil {
+			err = fmt.Errorf("invalid upsert %q", value)
+			ext.LogError(span, err)
+			writeBadRequest(ctx, w, err)
+			return
+		}
+	}
+	span.LogFields(log.String("user_id", userId), log.Bool("upsert", upsert))
 
 	var updatedUser models.User
 	if err := json.NewDecoder(r.Body).Decode(&updatedUser); err != nil {
 		ext.LogError(span, err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeBadRequest(ctx, w, err)
 		return
 	}
-	if err := updatedUser.Validate(); err != nil {
+	// the path id is authoritative, the body may only repeat it
+	if updatedUser.ID != "" && updatedUser.ID != userId {
+		err := fmt.Errorf("user id %q does not match the path", updatedUser.ID)
 		ext.LogError(span, err)
-		w.WriteHeader(http.StatusBadRequest)
+		writeBadRequest(ctx, w, err)
 		return
 	}
-	if err := dao.Update(ctx, updatedUser); err != nil {
+	updatedUser.ID = userId
+	if err := updatedUser.ValidateUpdate(); err != nil {
 		ext.LogError(span, err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeBadRequest(ctx, w, err)
 		return
 	}
-	w.WriteHeader(http.StatusNoContent)
-	span.LogKV("updated user success")
-	logger.Info("update user request done, check tracer: ", span.Context())
+
+	created := false
+	version, conditional, err := s.ifMatch(ctx, r, userId)
+	if err == nil {
+		switch {
+		case conditional:
+			if version, err = s.dao.UpdateIfMatch(ctx, updatedUser, version); err == nil {
+				w.Header().Set("ETag", etag(version))
+			}
+		case upsert:
+			created, err = s.dao.Upsert(ctx, updatedUser)
+		default:
+			err = s.dao.Update(ctx, updatedUser)
+		}
+	}
+	if err != nil {
+		ext.LogError(span, err)
+		writeError(ctx, w, ifMatchError(r, err))
+		return
+	}
+	if created {
+		s.notifyWebhooks(ctx, span, models.WebhookUserCreated, userId, &updatedUser)
+		w.WriteHeader(http.StatusCreated)
+		span.LogKV("created user success")
+	} else {
+		s.notifyWebhooks(ctx, span, models.WebhookUserUpdated, userId, &updatedUser)
+		w.WriteHeader(http.StatusNoContent)
+		span.LogKV("updated user success")
+	}
+	s.logger.Info("update user request done, check tracer: ", span.Context())
 }
 
-func DeleteUser(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
-	span, _ := opentracing.StartSpanFromContext(ctx, "delete user")
+// PatchUser applies a JSON Merge Patch or JSON Patch to a user. The patched
+// user is validated before the changed fields are written, guarded by the
+// version they were read at.
+func (s *Server) PatchUser(w http.ResponseWriter, r *http.Request) {
+	span, ctx := s.startSpan(r, "patch user")
 	ext.SpanKindRPCClient.Set(span)
 	defer span.Finish()
 
-	dao, err := elasticsearch.NewDao(ctx)
+	w = writeJsonHeader(w)
+
+	userId := ""
+	if userId = getParam("id", r); userId == "" {
+		err := errors.New("missing user id in param")
+		ext.LogError(span, err, log.String("user_id", userId))
+		writeBadRequest(ctx, w, err)
+		return
+	}
+	span.LogFields(log.String("user_id", userId))
+
+	patch, err := ioutil.ReadAll(io.LimitReader(r.Body, maxPatchBytes+1))
+	if err != nil {
+		ext.LogError(span, err)
+		writeBadRequest(ctx, w, err)
+		return
+	}
+	if len(patch) > maxPatchBytes {
+		err := fmt.Errorf("patch exceeds the limit of %d bytes", maxPatchBytes)
+		ext.LogError(span, err)
+		writeProblem(ctx, w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	apply, err := newPatcher(r.Header.Get("Content-Type"), patch)
+	if err != nil {
+		ext.LogError(span, err)
+		if errors.Is(err, errUnsupportedPatch) {
+			writeProblem(ctx, w, http.StatusUnsupportedMediaType, err)
+		} else {
+			writeBadRequest(ctx, w, err)
+		}
+		return
+	}
+
+	ifMatch := r.Header.Get("If-Match")
+	var (
+		patched models.User
+		version string
+		// written is false when the patch left the user as it was
+		written bool
+	)
+	for attempt := 1; ; attempt++ {
+		var (
+			current models.User
+			fields  map[string]interface{}
+		)
+		if current, version, err = s.dao.GetVersioned(ctx, userId); err != nil {
+			break
+		}
+		if ifMatch != "" && !matchesIfMatch(ifMatch, version) {
+			err = interfaces.ErrVersionConflict
+			break
+		}
+		patched, fields, err = applyPatch(current, apply)
+		if err == nil {
+			err = patched.ValidateUpdate()
+		}
+		if err != nil {
+			ext.LogError(span, err)
+			writeBadRequest(ctx, w, err)
+			return
+		}
+		if written = len(fields) > 0; !written {
+			break
+		}
+		version, err = s.dao.PatchIfMatch(ctx, userId, fields, version)
+		// without If-Match the patch was not based on a version the client
+		// saw, so it is simply applied again to the newer user
+		if errors.Is(err, interfaces.ErrVersionConflict) && ifMatch == "" && attempt < maxPatchAttempts {
+			continue
+		}
+		break
+	}
 	if err != nil {
 		ext.LogError(span, err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(ctx, w, ifMatchError(r, err))
 		return
 	}
 
+	if written {
+		s.notifyWebhooks(ctx, span, models.WebhookUserUpdated, userId, &patched)
+	}
+	w.Header().Set("ETag", etag(version))
+	if err := json.NewEncoder(w).Encode(patched); err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	span.LogFields(log.String("user", patched.ToString()))
+	s.logger.Info("patch user request done, check tracer: ", span.Context())
+}
+
+func (s *Server) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	span, ctx := s.startSpan(r, "delete user")
+	ext.SpanKindRPCClient.Set(span)
+	defer span.Finish()
+
 	userId := ""
 	if userId = getParam("id", r); userId == "" {
-		ext.LogError(span, errors.New("missing user id in param"), log.String("user_id", userId))
-		w.WriteHeader(http.StatusBadRequest)
+		err := errors.New("missing user id in param")
+		ext.LogError(span, err, log.String("user_id", userId))
+		writeBadRequest(ctx, w, err)
 		return
 	}
 	span.LogFields(log.String("user_id", userId))
 
-	if err := dao.Delete(ctx, userId); err != nil {
+	version, conditional, err := s.ifMatch(ctx, r, userId)
+	if err == nil {
+		if conditional {
+			err = s.dao.DeleteIfMatch(ctx, userId, version)
+		} else {
+			err = s.dao.Delete(ctx, userId)
+		}
+	}
+	if err != nil {
 		ext.LogError(span, err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(ctx, w, ifMatchError(r, err))
 		return
 	}
+	s.notifyWebhooks(ctx, span, models.WebhookUserDeleted, userId, nil)
 	w.WriteHeader(http.StatusNoContent)
 	span.LogKV("deleted user successfully")
-	logger.Info("delete request done, check tracer: ", span.Context())
+	s.logger.Info("delete request done, check tracer: ", span.Context())
+}
+
+// RestoreUser brings back a deleted user and answers with it.
+func (s *Server) RestoreUser(w http.ResponseWriter, r *http.Request) {
+	span, ctx := s.startSpan(r, "restore user")
+	ext.SpanKindRPCClient.Set(span)
+	defer span.Finish()
+
+	w = writeJsonHeader(w)
+
+	userId := ""
+	if userId = getParam("id", r); userId == "" {
+		err := errors.New("missing user id in param")
+		ext.LogError(span, err, log.String("user_id", userId))
+		writeBadRequest(ctx, w, err)
+		return
+	}
+	span.LogFields(log.String("user_id", userId))
+
+	if err := s.dao.Restore(ctx, userId); err != nil {
+		ext.LogError(span, err)
+		writeError(ctx, w, err)
+		return
+	}
+	user, version, err := s.dao.GetVersioned(ctx, userId)
+	if err != nil {
+		ext.LogError(span, err)
+		writeError(ctx, w, err)
+		return
+	}
+	// the restored user reappears to partners as it does to readers
+	s.notifyWebhooks(ctx, span, models.WebhookUserCreated, userId, &user)
+	w.Header().Set("ETag", etag(version))
+	if err := json.NewEncoder(w).Encode(user); err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	span.LogFields(log.String("user", user.ToString()))
+	s.logger.Info("restore user request done, check tracer: ", span.Context())
+}
+
+// GetDeletedUsers lists the deleted users that can still be restored, the
+// most recently deleted first.
+func (s *Server) GetDeletedUsers(w http.ResponseWriter, r *http.Request) {
+	span, ctx := s.startSpan(r, "get deleted users")
+	ext.SpanKindRPCClient.Set(span)
+	defer span.Finish()
+
+	w = writeJsonHeader(w)
+
+	limit, offset, err := getLimitOffset(r)
+	if err != nil {
+		ext.LogError(span, err)
+		writeBadRequest(ctx, w, err)
+		return
+	}
+	users, err := s.dao.GetDeleted(ctx, limit, offset)
+	if err != nil {
+		ext.LogError(span, err)
+		writeError(ctx, w, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(users); err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	span.LogFields(log.Int("users", len(users)))
+	s.logger.Info("get deleted users request done, check tracer: ", span.Context())
+}
+
+// GetUserHistory lists the recorded changes to a user, the newest first. The
+// history is kept after the user is deleted or purged.
+func (s *Server) GetUserHistory(w http.ResponseWriter, r *http.Request) {
+	span, ctx := s.startSpan(r, "get user history")
+	ext.SpanKindRPCClient.Set(span)
+	defer span.Finish()
+
+	w = writeJsonHeader(w)
+
+	userId := ""
+	if userId = getParam("id", r); userId == "" {
+		err := errors.New("missing user id in param")
+		ext.LogError(span, err, log.String("user_id", userId))
+		writeBadRequest(ctx, w, err)
+		return
+	}
+	span.LogFields(log.String("user_id", userId))
+
+	limit, offset, err := getLimitOffset(r)
+	if err != nil {
+		ext.LogError(span, err)
+		writeBadRequest(ctx, w, err)
+		return
+	}
+	page, err := s.dao.GetHistory(ctx, userId, limit, offset)
+	if err != nil {
+		ext.LogError(span, err)
+		writeError(ctx, w, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	span.LogFields(log.Int64("changes", page.Total))
+	s.logger.Info("get user history request done, check tracer: ", span.Context())
+}
+
+const (
+	// historyPageSize is how many changes are read at a time when looking a
+	// version up in a user's history.
+	historyPageSize = 100
+	// maxRevertAttempts bounds how often an unconditional revert is written
+	// again when other writes slip in.
+	maxRevertAttempts = 3
+)
+
+// errAmbiguousVersion is returned by snapshotAt when more than one change has
+// the version, as with storages that count versions afresh once a purged id is
+// written again.
+var errAmbiguousVersion = errors.New("more than one change in the history has the version")
+
+// snapshotAt looks up the user as it was at version in its history. A version
+// the history does not know is interfaces.ErrNotFound.
+func (s *Server) snapshotAt(ctx context.Context, id, version string) (*models.User, error) {
+	var (
+		snapshot *models.User
+		found    bool
+	)
+	for offset := 0; ; offset += historyPageSize {
+		page, err := s.dao.GetHistory(ctx, id, historyPageSize, offset)
+		if err != nil {
+			return nil, err
+		}
+		for _, change := range page.Changes {
+			if change.Version != version {
+				continue
+			}
+			if found {
+				return nil, errAmbiguousVersion
+			}
+			snapshot, found = change.After, true
+		}
+		if len(page.Changes) < historyPageSize {
+			break
+		}
+	}
+	if !found {
+		return nil, interfaces.ErrNotFound
+	}
+	return snapshot, nil
+}
+
+// RevertUser replaces a user with its snapshot of an earlier version from the
+// history. The snapshot is validated like an update and written with the same
+// If-Match rules; the history records the write as a revert.
+func (s *Server) RevertUser(w http.ResponseWriter, r *http.Request) {
+	span, ctx := s.startSpan(r, "revert user")
+	ext.SpanKindRPCClient.Set(span)
+	defer span.Finish()
+
+	w = writeJsonHeader(w)
+
+	userId := ""
+	if userId = getParam("id", r); userId == "" {
+		err := errors.New("missing user id in param")
+		ext.LogError(span, err, log.String("user_id", userId))
+		writeBadRequest(ctx, w, err)
+		return
+	}
+	target := getQuery("version", r)
+	if target == "" {
+		err := errors.New("missing version to revert to")
+		ext.LogError(span, err)
+		writeBadRequest(ctx, w, err)
+		return
+	}
+	span.LogFields(log.String("user_id", userId), log.String("version", target))
+
+	snapshot, err := s.snapshotAt(ctx, userId, target)
+	if errors.Is(err, errAmbiguousVersion) {
+		ext.LogError(span, err)
+		writeBadRequest(ctx, w, err)
+		return
+	}
+	if err != nil {
+		ext.LogError(span, err)
+		writeError(ctx, w, err)
+		return
+	}
+	if snapshot == nil {
+		err := fmt.Errorf("user was deleted at version %s, restore it instead", target)
+		ext.LogError(span, err)
+		writeBadRequest(ctx, w, err)
+		return
+	}
+	reverted := *snapshot
+	reverted.ID, reverted.DeletedAt = userId, 0
+	if err := reverted.ValidateUpdate(); err != nil {
+		ext.LogError(span, err)
+		writeBadRequest(ctx, w, err)
+		return
+	}
+
+	ifMatch := r.Header.Get("If-Match")
+	ctx = audit.WithRevert(ctx, target)
+	version := ""
+	for attempt := 1; ; attempt++ {
+		_, current, err := s.dao.GetVersioned(ctx, userId)
+		if err == nil && ifMatch != "" && !matchesIfMatch(ifMatch, current) {
+			err = interfaces.ErrVersionConflict
+		}
+		if err == nil {
+			version, err = s.dao.UpdateIfMatch(ctx, reverted, current)
+		}
+		// without If-Match the revert does not depend on the current user, a
+		// write slipping in is simply overwritten
+		if errors.Is(err, interfaces.ErrVersionConflict) && ifMatch == "" && attempt < maxRevertAttempts {
+			continue
+		}
+		if err != nil {
+			ext.LogError(span, err)
+			writeError(ctx, w, ifMatchError(r, err))
+			return
+		}
+		break
+	}
+
+	s.notifyWebhooks(ctx, span, models.WebhookUserUpdated, userId, &reverted)
+	w.Header().Set("ETag", etag(version))
+	if err := json.NewEncoder(w).Encode(reverted); err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	span.LogFields(log.String("user", reverted.ToString()))
+	s.logger.Info("revert user request done, check tracer: ", span.Context())
 }
@@ -2,8 +2,10 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -12,35 +14,43 @@ import (
 
 	"github.com/google/logger"
 	"github.com/gorilla/mux"
+	"github.com/metildachee/userie/dao/feed"
+	"github.com/metildachee/userie/dao/memory"
 	"github.com/metildachee/userie/models"
+	"github.com/metildachee/userie/webhook"
+	"github.com/opentracing/opentracing-go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
 func TestGetUserInvalid(t *testing.T) {
+	srv := newTestServer(t)
 	userId, user := 0, models.User{}
 	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("/api/user/%d", userId), nil)
 	resp := httptest.NewRecorder()
 
 	router := mux.NewRouter()
 	router.HandleFunc("/api/user/{id}", func(w http.ResponseWriter, r *http.Request) {
-		GetUser(w, r)
+		srv.GetUser(w, r)
 	})
 	router.ServeHTTP(resp, req)
 
-	err := json.NewDecoder(resp.Body).Decode(&user)
-	assert.NotNil(t, err, "json decoder err")
+	problem := models.Problem{}
+	err := json.NewDecoder(resp.Body).Decode(&problem)
+	assert.Nil(t, err, "json decoder err")
 	require.EqualValues(t, models.User{}, user, "response is nil")
 	assert.EqualValues(t, http.StatusNotFound, resp.Code, "response code is not ok")
+	assert.EqualValues(t, models.ProblemNotFound, problem.Code, "should tell the user was not found")
 }
 
 func TestGetUserValid(t *testing.T) {
+	srv := newTestServer(t)
 	userId, user := 1, models.User{}
 	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("/api/user/%d", userId), nil)
 	resp := httptest.NewRecorder()
 
 	router := mux.NewRouter()
-	router.HandleFunc("/api/user/{id}", GetUser)
+	router.HandleFunc("/api/user/{id}", srv.GetUser)
 	router.ServeHTTP(resp, req)
 
 	err := json.NewDecoder(resp.Body).Decode(&user)
@@ -50,13 +60,14 @@ func TestGetUserValid(t *testing.T) {
 }
 
 func TestGetAllWithLimit(t *testing.T) {
+	srv := newTestServer(t)
 	limit, offset, users := 2, 1, make([]models.User, 0)
 	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("/api/users/limit=%d&offset=%d", limit, offset), nil)
 	resp := httptest.NewRecorder()
 
 	router := mux.NewRouter()
 	router.HandleFunc("/api/users/limit={limit}&offset={offset}", func(w http.ResponseWriter, r *http.Request) {
-		GetAll(w, r)
+		srv.GetAll(w, r)
 	})
 	router.ServeHTTP(resp, req)
 
@@ -67,12 +78,13 @@ func TestGetAllWithLimit(t *testing.T) {
 }
 
 func TestGetAllDefault(t *testing.T) {
+	srv := newTestServer(t)
 	limit, users := 10, make([]models.User, 0)
 	req, _ := http.NewRequest(http.MethodGet, "/api/users", nil)
 	resp := httptest.NewRecorder()
 
 	router := mux.NewRouter()
-	router.HandleFunc("/api/users", GetAll)
+	router.HandleFunc("/api/users", srv.GetAll)
 	router.ServeHTTP(resp, req)
 
 	err := json.NewDecoder(resp.Body).Decode(&users)
@@ -81,7 +93,127 @@ func TestGetAllDefault(t *testing.T) {
 	assert.EqualValues(t, http.StatusOK, resp.Code, "response code is not ok")
 }
 
+func TestGetAllUnknownFilter(t *testing.T) {
+	srv := newTestServer(t)
+	body := map[string]interface{}{}
+	req, _ := http.NewRequest(http.MethodGet, "/api/users?colour=blue", nil)
+	resp := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/users", srv.GetAll)
+	router.ServeHTTP(resp, req)
+
+	err := json.NewDecoder(resp.Body).Decode(&body)
+	assert.Nil(t, err, "json decoder err")
+	assert.EqualValues(t, http.StatusBadRequest, resp.Code, "unknown filter should be rejected")
+	assert.Contains(t, body["allowed"], "name_prefix", "should list allowed filters")
+}
+
+func TestGetAllUnknownSortField(t *testing.T) {
+	srv := newTestServer(t)
+	body := map[string]interface{}{}
+	req, _ := http.NewRequest(http.MethodGet, "/api/users?sort=-address", nil)
+	resp := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/users", srv.GetAll)
+	router.ServeHTTP(resp, req)
+
+	err := json.NewDecoder(resp.Body).Decode(&body)
+	assert.Nil(t, err, "json decoder err")
+	assert.EqualValues(t, http.StatusBadRequest, resp.Code, "unknown sort field should be rejected")
+	assert.Contains(t, body["allowed"], "ctime", "should list allowed sort fields")
+}
+
+func TestGetAllWithFilter(t *testing.T) {
+	srv := newTestServer(t)
+	users := make([]models.User, 0)
+	req, _ := http.NewRequest(http.MethodGet, "/api/users?name_prefix=met&sort=-ctime,name&limit=5", nil)
+	resp := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/users", srv.GetAll)
+	router.ServeHTTP(resp, req)
+
+	err := json.NewDecoder(resp.Body).Decode(&users)
+	assert.Nil(t, err, "json decoder err")
+	assert.LessOrEqual(t, len(users), 5, "does not conform to limit")
+	for i := 1; i < len(users); i++ {
+		assert.GreaterOrEqual(t, users[i-1].Ctime, users[i].Ctime, "should be sorted by ctime descending")
+	}
+	assert.EqualValues(t, http.StatusOK, resp.Code, "response code is not ok")
+}
+
+func TestGetAllInvalidCursor(t *testing.T) {
+	srv := newTestServer(t)
+	req, _ := http.NewRequest(http.MethodGet, "/api/users?cursor=not-a-cursor", nil)
+	resp := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/users", srv.GetAll)
+	router.ServeHTTP(resp, req)
+
+	assert.EqualValues(t, http.StatusBadRequest, resp.Code, "invalid cursor should be rejected")
+}
+
+func TestGetAllWithCursor(t *testing.T) {
+	srv := newTestServer(t)
+	limit, seen := 2, map[string]bool{}
+	router := mux.NewRouter()
+	router.HandleFunc("/api/users", srv.GetAll)
+
+	cursor := ""
+	for {
+		page := models.UserPage{}
+		req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("/api/users?limit=%d&cursor=%s", limit, cursor), nil)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+
+		require.EqualValues(t, http.StatusOK, resp.Code, "response code is not ok")
+		err := json.NewDecoder(resp.Body).Decode(&page)
+		require.Nil(t, err, "json decoder err")
+		assert.LessOrEqual(t, len(page.Users), limit, "does not conform to limit")
+		for _, user := range page.Users {
+			assert.False(t, seen[user.ID], "user should not be returned twice")
+			seen[user.ID] = true
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+}
+
+func TestSearchUsersMissingQuery(t *testing.T) {
+	srv := newTestServer(t)
+	req, _ := http.NewRequest(http.MethodGet, "/api/users/search", nil)
+	resp := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/users/search", srv.SearchUsers)
+	router.ServeHTTP(resp, req)
+
+	assert.EqualValues(t, http.StatusBadRequest, resp.Code, "missing q should be rejected")
+}
+
+func TestSearchUsers(t *testing.T) {
+	srv := newTestServer(t)
+	result := models.SearchResult{}
+	req, _ := http.NewRequest(http.MethodGet, "/api/users/search?q=kent&limit=2", nil)
+	resp := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/users/search", srv.SearchUsers)
+	router.ServeHTTP(resp, req)
+
+	err := json.NewDecoder(resp.Body).Decode(&result)
+	assert.Nil(t, err, "json decoder err")
+	assert.LessOrEqual(t, len(result.Hits), 2, "does not conform to limit")
+	assert.EqualValues(t, http.StatusOK, resp.Code, "response code is not ok")
+}
+
 func TestDeleteUser(t *testing.T) {
+	srv := newTestServer(t)
 	setup()
 	userId, user := "1", models.User{}
 
@@ -90,7 +222,7 @@ func TestDeleteUser(t *testing.T) {
 	resp := httptest.NewRecorder()
 
 	router := mux.NewRouter()
-	router.HandleFunc("/api/user/{id}", GetUser)
+	router.HandleFunc("/api/user/{id}", srv.GetUser)
 	router.ServeHTTP(resp, req)
 
 	err := json.NewDecoder(resp.Body).Decode(&user)
@@ -103,7 +235,7 @@ func TestDeleteUser(t *testing.T) {
 	resp = httptest.NewRecorder()
 
 	router = mux.NewRouter()
-	router.HandleFunc("/api/user/{id}", DeleteUser)
+	router.HandleFunc("/api/user/{id}", srv.DeleteUser)
 	router.ServeHTTP(resp, req)
 
 	assert.EqualValues(t, http.StatusNoContent, resp.Code, "response code is not ok")
@@ -114,18 +246,168 @@ func TestDeleteUser(t *testing.T) {
 
 	router = mux.NewRouter()
 	router.HandleFunc("/api/user/{id}", func(w http.ResponseWriter, r *http.Request) {
-		GetUser(w, r)
+		srv.GetUser(w, r)
 	})
 	router.ServeHTTP(resp, req)
 
-	u := models.User{}
-	err = json.NewDecoder(resp.Body).Decode(&u)
-	assert.NotNil(t, err, "json decoder err")
-	require.EqualValues(t, models.User{}, u, "response should be nil")
+	problem := models.Problem{}
+	err = json.NewDecoder(resp.Body).Decode(&problem)
+	assert.Nil(t, err, "json decoder err")
 	assert.EqualValues(t, http.StatusNotFound, resp.Code, "response code is not ok")
+	assert.EqualValues(t, models.ProblemNotFound, problem.Code, "should tell the user was not found")
+}
+
+func TestRestoreUser(t *testing.T) {
+	srv := newTestServer(t)
+	router := mux.NewRouter()
+	srv.Routes(router)
+
+	req, _ := http.NewRequest(http.MethodDelete, "/api/user/1", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	require.EqualValues(t, http.StatusNoContent, resp.Code, "response code is not ok")
+
+	req, _ = http.NewRequest(http.MethodGet, "/api/users/deleted", nil)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	require.EqualValues(t, http.StatusOK, resp.Code, "response code is not ok")
+	deleted := []models.User{}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&deleted), "json decoder err")
+	require.Len(t, deleted, 1, "should list the deleted user")
+	assert.EqualValues(t, "1", deleted[0].ID)
+	assert.NotZero(t, deleted[0].DeletedAt, "should say when the user was deleted")
+
+	resp = post(router, "/api/user/1/restore", "")
+	require.EqualValues(t, http.StatusOK, resp.Code, "response code is not ok")
+	assert.NotEmpty(t, resp.Header().Get("ETag"), "should answer with the version")
+	user := models.User{}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&user), "json decoder err")
+	assert.EqualValues(t, "metchee 1", user.Name, "should answer with the restored user")
+
+	req, _ = http.NewRequest(http.MethodGet, "/api/user/1", nil)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.EqualValues(t, http.StatusOK, resp.Code, "restored user should be found")
+	resp = post(router, "/api/user/1/restore", "")
+	assert.EqualValues(t, http.StatusNotFound, resp.Code, "live user cannot be restored")
+}
+
+func TestGetUserHistory(t *testing.T) {
+	srv := newTestServer(t)
+	router := mux.NewRouter()
+	srv.Routes(router)
+
+	req, _ := http.NewRequest(http.MethodPatch, "/api/user/1", bytes.NewBufferString(`{"address": "Kent Ridge"}`))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	req.Header.Set("X-Actor", "admin")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	require.EqualValues(t, http.StatusOK, resp.Code, "response code is not ok")
+
+	req, _ = http.NewRequest(http.MethodGet, "/api/user/1/history?limit=1&offset=0", nil)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	require.EqualValues(t, http.StatusOK, resp.Code, "response code is not ok")
+	page := models.HistoryPage{}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&page), "json decoder err")
+	assert.EqualValues(t, 2, page.Total, "create and patch should be recorded")
+	require.Len(t, page.Changes, 1, "should answer one page")
+	change := page.Changes[0]
+	assert.Equal(t, models.ChangePatch, change.Operation, "newest change should come first")
+	assert.Equal(t, "admin", change.Actor, "should record the actor header")
+	assert.Equal(t, "Kent Ridge", change.Diff["address"].After, "should record the patched field")
+	assert.NotContains(t, change.Diff, "name", "should only record changed fields")
+
+	req, _ = http.NewRequest(http.MethodGet, "/api/user/1/history?limit=ten", nil)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.EqualValues(t, http.StatusBadRequest, resp.Code, "bad paging should be rejected")
+}
+
+func TestRevertUser(t *testing.T) {
+	srv := newTestServer(t)
+	router := mux.NewRouter()
+	srv.Routes(router)
+
+	req, _ := http.NewRequest(http.MethodPatch, "/api/user/1", bytes.NewBufferString(`{"address": "Kent Ridge"}`))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	require.EqualValues(t, http.StatusOK, resp.Code, "response code is not ok")
+	patched := resp.Header().Get("ETag")
+
+	resp = post(router, "/api/user/1/revert?version=1", "")
+	require.EqualValues(t, http.StatusOK, resp.Code, "response code is not ok")
+	assert.NotEqual(t, patched, resp.Header().Get("ETag"), "revert should change the version")
+	user := models.User{}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&user), "json decoder err")
+	assert.EqualValues(t, "kent ridge 1", user.Address, "should answer with the reverted user")
+
+	req, _ = http.NewRequest(http.MethodGet, "/api/user/1/history", nil)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	require.EqualValues(t, http.StatusOK, resp.Code, "response code is not ok")
+	page := models.HistoryPage{}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&page), "json decoder err")
+	require.NotEmpty(t, page.Changes, "revert should be recorded")
+	assert.Equal(t, models.ChangeRevert, page.Changes[0].Operation, "revert should be recorded as such")
+	assert.Equal(t, "1", page.Changes[0].RevertedTo, "revert should record its target")
+	assert.Equal(t, "kent ridge 1", page.Changes[0].Diff["address"].After, "revert should record the restored field")
+
+	resp = post(router, "/api/user/1/revert?version=99", "")
+	assert.EqualValues(t, http.StatusNotFound, resp.Code, "unknown version should not be found")
+	resp = post(router, "/api/user/1/revert", "")
+	assert.EqualValues(t, http.StatusBadRequest, resp.Code, "version should be required")
+	req, _ = http.NewRequest(http.MethodPost, "/api/user/1/revert?version=2", nil)
+	req.Header.Set("If-Match", patched)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.EqualValues(t, http.StatusPreconditionFailed, resp.Code, "stale If-Match should be refused")
+}
+
+func TestDeleteUserIfMatch(t *testing.T) {
+	srv := newTestServer(t)
+	router := mux.NewRouter()
+	srv.Routes(router)
+
+	req, _ := http.NewRequest(http.MethodGet, "/api/user/2", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	require.EqualValues(t, http.StatusOK, resp.Code, "response code is not ok")
+	tag := resp.Header().Get("ETag")
+	require.NotEmpty(t, tag, "should answer with an etag")
+
+	// stale version
+	req, _ = http.NewRequest(http.MethodDelete, "/api/user/2", nil)
+	req.Header.Set("If-Match", `"not the version"`)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.EqualValues(t, http.StatusPreconditionFailed, resp.Code, "stale version should fail")
+
+	// current version
+	req, _ = http.NewRequest(http.MethodDelete, "/api/user/2", nil)
+	req.Header.Set("If-Match", tag)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.EqualValues(t, http.StatusNoContent, resp.Code, "current version should delete")
+
+	req, _ = http.NewRequest(http.MethodDelete, "/api/user/2", nil)
+	req.Header.Set("If-Match", "*")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.EqualValues(t, http.StatusPreconditionFailed, resp.Code, "If-Match on a deleted user should fail")
+
+	req, _ = http.NewRequest(http.MethodDelete, "/api/user/2", nil)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.EqualValues(t, http.StatusNotFound, resp.Code, "deleted user should be not found")
+
+	resp = patchUser(router, "2", "application/merge-patch+json", `{"name": "meow"}`, "If-Match", tag)
+	assert.EqualValues(t, http.StatusPreconditionFailed, resp.Code, "If-Match patch of a deleted user should fail")
 }
 
 func TestCreateUser(t *testing.T) {
+	srv := newTestServer(t)
 	setup()
 	u := models.User{
 		Name:        "metchee",
@@ -144,7 +426,7 @@ func TestCreateUser(t *testing.T) {
 	resp := httptest.NewRecorder()
 
 	router := mux.NewRouter()
-	router.HandleFunc("/api/users", CreateUser)
+	router.HandleFunc("/api/users", srv.CreateUser)
 	router.ServeHTTP(resp, req)
 
 	var id int
@@ -155,7 +437,49 @@ func TestCreateUser(t *testing.T) {
 	assert.NotNil(t, id, "id should be auto incremented")
 }
 
+func TestBulkCreateUsers(t *testing.T) {
+	srv := newTestServer(t)
+	router := mux.NewRouter()
+	srv.Routes(router)
+	valid := models.User{
+		Name:        "metchee",
+		DOB:         int32(time.Now().AddDate(-20, 0, 0).Unix()),
+		Address:     "Kent Ridge",
+		Description: "bulk user",
+		Ctime:       int32(time.Now().Unix()),
+	}
+	invalid := valid
+	invalid.Name = ""
+	jsonBody, err := json.Marshal([]models.User{valid, invalid, valid})
+	require.Nil(t, err, "should not have error when marshal")
+
+	req, _ := http.NewRequest(http.MethodPost, "/api/users/_bulk", bytes.NewBuffer(jsonBody))
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	require.EqualValues(t, http.StatusOK, resp.Code, "response code is not ok")
+
+	result := models.BulkResult{}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&result), "json decoder err")
+	require.Len(t, result.Items, 3, "should answer for every user")
+	assert.True(t, result.Errors, "should flag the invalid user")
+	assert.EqualValues(t, http.StatusCreated, result.Items[0].Status, "valid user should be created")
+	assert.EqualValues(t, http.StatusBadRequest, result.Items[1].Status, "invalid user should be rejected")
+	assert.NotEmpty(t, result.Items[1].Error, "invalid user should say why")
+	assert.Empty(t, result.Items[1].ID, "invalid user should not get an id")
+	assert.EqualValues(t, http.StatusCreated, result.Items[2].Status, "valid user should be created")
+	assert.NotEqual(t, result.Items[0].ID, result.Items[2].ID, "users should get distinct ids")
+
+	_, err = srv.dao.GetById(context.Background(), result.Items[2].ID)
+	assert.Nil(t, err, "created user should be stored")
+
+	req, _ = http.NewRequest(http.MethodPost, "/api/users/_bulk", bytes.NewBufferString(`{"name": "not a list"}`))
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.EqualValues(t, http.StatusBadRequest, resp.Code, "body should be a list of users")
+}
+
 func TestUpdateUser(t *testing.T) {
+	srv := newTestServer(t)
 	var (
 		newName = "meow meow"
 	)
@@ -166,7 +490,7 @@ func TestUpdateUser(t *testing.T) {
 	resp := httptest.NewRecorder()
 
 	router := mux.NewRouter()
-	router.HandleFunc("/api/user/{id}", GetUser)
+	srv.Routes(router)
 	router.ServeHTTP(resp, getReq)
 
 	err := json.NewDecoder(resp.Body).Decode(&user)
@@ -180,20 +504,163 @@ func TestUpdateUser(t *testing.T) {
 	require.Nil(t, err, "should not have error when marshal")
 	updateReq, _ := http.NewRequest(http.MethodPut, fmt.Sprintf("/api/user/%s", userId), bytes.NewBuffer(jsonBody))
 	resp = httptest.NewRecorder()
-	fmt.Println(string(jsonBody))
-
-	router.HandleFunc("/api/user/{id}", UpdateUser)
 	router.ServeHTTP(resp, updateReq)
 
-	require.EqualValues(t, http.StatusOK, resp.Code, "response code is not ok")
+	require.EqualValues(t, http.StatusNoContent, resp.Code, "response code is not ok")
 
 	// get again
+	resp = httptest.NewRecorder()
 	router.ServeHTTP(resp, getReq)
 	require.EqualValues(t, http.StatusOK, resp.Code, "response code is not ok")
 	u := models.User{}
 	err = json.NewDecoder(resp.Body).Decode(&u)
 	assert.Nil(t, err, "json decoder err")
-	require.EqualValues(t, newName, user.Name, "name is already the same")
+	require.EqualValues(t, newName, u.Name, "name should be updated")
+}
+
+func putUser(router *mux.Router, path string, u models.User) *httptest.ResponseRecorder {
+	jsonBody, _ := json.Marshal(u)
+	req, _ := http.NewRequest(http.MethodPut, path, bytes.NewBuffer(jsonBody))
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	return resp
+}
+
+func TestUpdateUserReplaceSemantics(t *testing.T) {
+	srv := newTestServer(t)
+	router := mux.NewRouter()
+	srv.Routes(router)
+	u := models.User{
+		Name:        "metchee",
+		DOB:         int32(time.Now().AddDate(-20, 0, 0).Unix()),
+		Address:     "Kent Ridge",
+		Description: "replaced",
+		Ctime:       int32(time.Now().Unix()),
+	}
+
+	resp := putUser(router, "/api/user/2", u)
+	assert.EqualValues(t, http.StatusNoContent, resp.Code, "body without id should take the path id")
+	u.ID = "3"
+	resp = putUser(router, "/api/user/2", u)
+	assert.EqualValues(t, http.StatusBadRequest, resp.Code, "body id should match the path")
+	u.ID = ""
+
+	resp = putUser(router, "/api/user/404", u)
+	assert.EqualValues(t, http.StatusNotFound, resp.Code, "missing user should be not found")
+	resp = putUser(router, "/api/user/404?upsert=true", u)
+	assert.EqualValues(t, http.StatusCreated, resp.Code, "upsert should create the missing user")
+	resp = putUser(router, "/api/user/404?upsert=true", u)
+	assert.EqualValues(t, http.StatusNoContent, resp.Code, "upsert should replace an existing user")
+	resp = putUser(router, "/api/user/404?upsert=maybe", u)
+	assert.EqualValues(t, http.StatusBadRequest, resp.Code, "upsert should be a boolean")
+
+	stored, err := srv.dao.GetById(context.Background(), "404")
+	require.Nil(t, err, "upserted user should be stored")
+	assert.EqualValues(t, "replaced", stored.Description, "should store the body")
+
+	u.Name = ""
+	resp = putUser(router, "/api/user/2", u)
+	assert.EqualValues(t, http.StatusBadRequest, resp.Code, "invalid user should be rejected")
+}
+
+func patchUser(router *mux.Router, id, contentType, patch string, header ...string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(http.MethodPatch, "/api/user/"+id, bytes.NewBufferString(patch))
+	req.Header.Set("Content-Type", contentType)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	return resp
+}
+
+func TestPatchUserMergePatch(t *testing.T) {
+	srv := newTestServer(t)
+	router := mux.NewRouter()
+	srv.Routes(router)
+
+	resp := patchUser(router, "3", "application/merge-patch+json", `{"name": "meow meow"}`)
+	require.EqualValues(t, http.StatusOK, resp.Code, "response code is not ok")
+	assert.NotEmpty(t, resp.Header().Get("ETag"), "should answer with the new etag")
+	user := models.User{}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&user), "json decoder err")
+	assert.EqualValues(t, "meow meow", user.Name, "should patch the name")
+	assert.EqualValues(t, "kent ridge 3", user.Address, "should keep other fields")
+
+	stored, err := srv.dao.GetById(context.Background(), "3")
+	require.Nil(t, err, "should not have err when getting user")
+	assert.EqualValues(t, user, stored, "should store the patched user")
+}
+
+func TestPatchUserJsonPatch(t *testing.T) {
+	srv := newTestServer(t)
+	router := mux.NewRouter()
+	srv.Routes(router)
+
+	patch := `[
+		{"op": "test", "path": "/name", "value": "metchee 3"},
+		{"op": "replace", "path": "/description", "value": "patched"}
+	]`
+	resp := patchUser(router, "3", "application/json-patch+json", patch)
+	require.EqualValues(t, http.StatusOK, resp.Code, "response code is not ok")
+	user := models.User{}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&user), "json decoder err")
+	assert.EqualValues(t, "patched", user.Description, "should patch the description")
+
+	resp = patchUser(router, "3", "application/json-patch+json", patch)
+	assert.EqualValues(t, http.StatusOK, resp.Code, "passing test op should apply again")
+	resp = patchUser(router, "3", "application/json-patch+json", `[{"op": "test", "path": "/name", "value": "nope"}]`)
+	assert.EqualValues(t, http.StatusBadRequest, resp.Code, "failing test op should be rejected")
+}
+
+func TestPatchUserInvalid(t *testing.T) {
+	srv := newTestServer(t)
+	router := mux.NewRouter()
+	srv.Routes(router)
+
+	for _, patch := range []string{
+		`{"name": null}`,
+		`{"id": "42"}`,
+		`{"nickname": "meow"}`,
+		`{"dob": "yesterday"}`,
+		`not json`,
+	} {
+		resp := patchUser(router, "3", "application/merge-patch+json", patch)
+		assert.EqualValues(t, http.StatusBadRequest, resp.Code, "should reject "+patch)
+	}
+	resp := patchUser(router, "3", "application/json", `{"name": "meow"}`)
+	assert.EqualValues(t, http.StatusUnsupportedMediaType, resp.Code, "should reject other content types")
+	resp = patchUser(router, "404", "application/merge-patch+json", `{"name": "meow"}`)
+	assert.EqualValues(t, http.StatusNotFound, resp.Code, "missing user should be not found")
+	resp = patchUser(router, "3", "application/merge-patch+json", `{"name": "meow"}`, "If-Match", `"stale"`)
+	assert.EqualValues(t, http.StatusPreconditionFailed, resp.Code, "stale version should fail")
+
+	user, err := srv.dao.GetById(context.Background(), "3")
+	require.Nil(t, err, "should not have err when getting user")
+	assert.EqualValues(t, "metchee 3", user.Name, "rejected patches should not be stored")
+}
+
+// newTestServer serves an in-memory dao seeded with users "1" to "5".
+func newTestServer(t *testing.T) *Server {
+	ctx := context.Background()
+	dao, err := memory.NewDao(ctx)
+	require.Nil(t, err, "should not have error when init dao")
+	for i := 1; i <= 5; i++ {
+		_, err := dao.Create(ctx, models.User{
+			Name:        fmt.Sprintf("metchee %d", i),
+			DOB:         int32(time.Now().AddDate(-20, 0, i).Unix()),
+			Address:     fmt.Sprintf("kent ridge %d", i),
+			Description: fmt.Sprintf("default user info %d", i),
+			Ctime:       int32(time.Now().AddDate(0, 0, -i).Unix()),
+		})
+		require.Nil(t, err, "should not have error when seeding users")
+	}
+	changes := feed.NewBroker(feed.DefaultBufferSize)
+	hooks := webhook.NewDispatcher(webhook.NewMemoryStore(), opentracing.NoopTracer{}, webhook.RetryPolicy{MaxAttempts: 2, Backoff: time.Millisecond})
+	hooksCtx, stop := context.WithCancel(ctx)
+	t.Cleanup(stop)
+	hooks.Start(hooksCtx, 1)
+	return NewServer(feed.NewDao(dao, changes), changes, hooks, logger.Init("test logger", false, false, ioutil.Discard), opentracing.NoopTracer{})
 }
 
 func setup() {
@@ -0,0 +1,320 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/metildachee/userie/models"
+	"github.com/metildachee/userie/webhook"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+// webhookRequest is the body creating or replacing a webhook. Active defaults
+// to true and an empty secret is generated on create, kept on replace.
+type webhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret"`
+	Active *bool    `json:"active"`
+}
+
+var errNoWebhooks = errors.New("the server was started without webhooks")
+
+// webhookStore returns the webhook store, or answers 501 when the server was
+// started without webhooks.
+func (s *Server) webhookStore(ctx context.Context, w http.ResponseWriter) (webhook.Store, bool) {
+	if s.hooks == nil {
+		writeProblem(ctx, w, http.StatusNotImplemented, errNoWebhooks)
+		return nil, false
+	}
+	return s.hooks.Store(), true
+}
+
+// readWebhook decodes and validates the webhook in the request body onto h.
+func readWebhook(r *http.Request, h *models.Webhook) error {
+	var req webhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	h.URL, h.Events = req.URL, req.Events
+	if req.Secret != "" {
+		h.Secret = req.Secret
+	}
+	if req.Active != nil {
+		h.Active = *req.Active
+	}
+	return h.Validate()
+}
+
+// WebhooksFromOutbox stops the handlers notifying the webhooks of their
+// writes, for servers whose outbox relay hands every recorded change to the
+// dispatcher instead.
+func (s *Server) WebhooksFromOutbox() {
+	s.hooksFromOutbox = true
+}
+
+// notifyWebhooks tells the subscribed webhooks about a user write, failures
+// are only traced as they must not fail the write.
+func (s *Server) notifyWebhooks(ctx context.Context, span opentracing.Span, eventType, userId string, u *models.User) {
+	if s.hooks == nil || s.hooksFromOutbox {
+		return
+	}
+	if err := s.hooks.Notify(ctx, eventType, userId, u); err != nil {
+		ext.LogError(span, err)
+	}
+}
+
+// CreateWebhook registers a webhook and answers with it, the only answer
+// showing its secret.
+func (s *Server) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	span, ctx := s.startSpan(r, "create webhook")
+	ext.SpanKindRPCClient.Set(span)
+	defer span.Finish()
+
+	w = writeJsonHeader(w)
+
+	store, ok := s.webhookStore(ctx, w)
+	if !ok {
+		return
+	}
+	hook := models.Webhook{Active: true, Ctime: time.Now().UTC()}
+	if err := readWebhook(r, &hook); err != nil {
+		ext.LogError(span, err)
+		writeBadRequest(ctx, w, err)
+		return
+	}
+	if hook.Secret == "" {
+		secret, err := webhook.NewSecret()
+		if err != nil {
+			ext.LogError(span, err)
+			writeError(ctx, w, err)
+			return
+		}
+		hook.Secret = secret
+	}
+	hook, err := store.Create(ctx, hook)
+	if err != nil {
+		ext.LogError(span, err)
+		writeError(ctx, w, err)
+		return
+	}
+	w.Header().Set("Location", "/api/webhooks/"+hook.ID)
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(hook); err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	span.LogFields(log.String("webhook_id", hook.ID))
+	s.logger.Info("create webhook request done, check tracer: ", span.Context())
+}
+
+func (s *Server) GetWebhooks(w http.ResponseWriter, r *http.Request) {
+	span, ctx := s.startSpan(r, "get webhooks")
+	ext.SpanKindRPCClient.Set(span)
+	defer span.Finish()
+
+	w = writeJsonHeader(w)
+
+	store, ok := s.webhookStore(ctx, w)
+	if !ok {
+		return
+	}
+	hooks, err := store.List(ctx)
+	if err != nil {
+		ext.LogError(span, err)
+		writeError(ctx, w, err)
+		return
+	}
+	for i := range hooks {
+		hooks[i].Secret = ""
+	}
+	if err := json.NewEncoder(w).Encode(hooks); err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	span.LogFields(log.Int("webhooks", len(hooks)))
+	s.logger.Info("get webhooks request done, check tracer: ", span.Context())
+}
+
+func (s *Server) GetWebhook(w http.ResponseWriter, r *http.Request) {
+	span, ctx := s.startSpan(r, "get webhook")
+	ext.SpanKindRPCClient.Set(span)
+	defer span.Finish()
+
+	w = writeJsonHeader(w)
+
+	store, ok := s.webhookStore(ctx, w)
+	if !ok {
+		return
+	}
+	hookId := getParam("id", r)
+	span.LogFields(log.String("webhook_id", hookId))
+	hook, err := store.Get(ctx, hookId)
+	if err != nil {
+		ext.LogError(span, err)
+		writeError(ctx, w, err)
+		return
+	}
+	hook.Secret = ""
+	if err := json.NewEncoder(w).Encode(hook); err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	s.logger.Info("get webhook request done, check tracer: ", span.Context())
+}
+
+// UpdateWebhook replaces the url, events and active flag of a webhook, and
+// its secret when the body carries one.
+func (s *Server) UpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	span, ctx := s.startSpan(r, "update webhook")
+	ext.SpanKindRPCClient.Set(span)
+	defer span.Finish()
+
+	w = writeJsonHeader(w)
+
+	store, ok := s.webhookStore(ctx, w)
+	if !ok {
+		return
+	}
+	hookId := getParam("id", r)
+	span.LogFields(log.String("webhook_id", hookId))
+	hook, err := store.Get(ctx, hookId)
+	if err != nil {
+		ext.LogError(span, err)
+		writeError(ctx, w, err)
+		return
+	}
+	hook.Active = true
+	if err := readWebhook(r, &hook); err != nil {
+		ext.LogError(span, err)
+		writeBadRequest(ctx, w, err)
+		return
+	}
+	if err := store.Update(ctx, hook); err != nil {
+		ext.LogError(span, err)
+		writeError(ctx, w, err)
+		return
+	}
+	hook.Secret = ""
+	if err := json.NewEncoder(w).Encode(hook); err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	s.logger.Info("update webhook request done, check tracer: ", span.Context())
+}
+
+// DeleteWebhook removes a webhook with its delivery log and dead letters,
+// deliveries still queued for it are dropped.
+func (s *Server) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	span, ctx := s.startSpan(r, "delete webhook")
+	ext.SpanKindRPCClient.Set(span)
+	defer span.Finish()
+
+	store, ok := s.webhookStore(ctx, w)
+	if !ok {
+		return
+	}
+	hookId := getParam("id", r)
+	span.LogFields(log.String("webhook_id", hookId))
+	if err := store.Delete(ctx, hookId); err != nil {
+		ext.LogError(span, err)
+		writeError(ctx, w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+	s.logger.Info("delete webhook request done, check tracer: ", span.Context())
+}
+
+// GetWebhookDeliveries lists the delivery attempts of a webhook, the latest
+// first.
+func (s *Server) GetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	span, ctx := s.startSpan(r, "get webhook deliveries")
+	ext.SpanKindRPCClient.Set(span)
+	defer span.Finish()
+
+	w = writeJsonHeader(w)
+
+	store, ok := s.webhookStore(ctx, w)
+	if !ok {
+		return
+	}
+	hookId := getParam("id", r)
+	span.LogFields(log.String("webhook_id", hookId))
+	limit, offset, err := getLimitOffset(r)
+	if err != nil {
+		ext.LogError(span, err)
+		writeBadRequest(ctx, w, err)
+		return
+	}
+	deliveries, err := store.GetDeliveries(ctx, hookId, limit, offset)
+	if err != nil {
+		ext.LogError(span, err)
+		writeError(ctx, w, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(deliveries); err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	s.logger.Info("get webhook deliveries request done, check tracer: ", span.Context())
+}
+
+// GetWebhookDeadLetters lists the events a webhook could not be given after
+// every retry, the latest first.
+func (s *Server) GetWebhookDeadLetters(w http.ResponseWriter, r *http.Request) {
+	span, ctx := s.startSpan(r, "get webhook dead letters")
+	ext.SpanKindRPCClient.Set(span)
+	defer span.Finish()
+
+	w = writeJsonHeader(w)
+
+	store, ok := s.webhookStore(ctx, w)
+	if !ok {
+		return
+	}
+	hookId := getParam("id", r)
+	span.LogFields(log.String("webhook_id", hookId))
+	limit, offset, err := getLimitOffset(r)
+	if err != nil {
+		ext.LogError(span, err)
+		writeBadRequest(ctx, w, err)
+		return
+	}
+	letters, err := store.GetDeadLetters(ctx, hookId, limit, offset)
+	if err != nil {
+		ext.LogError(span, err)
+		writeError(ctx, w, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(letters); err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	s.logger.Info("get webhook dead letters request done, check tracer: ", span.Context())
+}
+
+// RedeliverWebhookDeadLetter takes a dead letter off the list and queues its
+// event for the webhook again.
+func (s *Server) RedeliverWebhookDeadLetter(w http.ResponseWriter, r *http.Request) {
+	span, ctx := s.startSpan(r, "redeliver webhook dead letter")
+	ext.SpanKindRPCClient.Set(span)
+	defer span.Finish()
+
+	if _, ok := s.webhookStore(ctx, w); !ok {
+		return
+	}
+	hookId, letterId := getParam("id", r), getParam("letter", r)
+	span.LogFields(log.String("webhook_id", hookId), log.String("dead_letter_id", letterId))
+	if err := s.hooks.Redeliver(ctx, hookId, letterId); err != nil {
+		ext.LogError(span, err)
+		writeError(ctx, w, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	s.logger.Info("redeliver webhook dead letter request done, check tracer: ", span.Context())
+}
@@ -0,0 +1,159 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/logger"
+	"github.com/gorilla/mux"
+	"github.com/metildachee/userie/dao/memory"
+	"github.com/metildachee/userie/models"
+	"github.com/metildachee/userie/outbox"
+	"github.com/metildachee/userie/webhook"
+	"github.com/opentracing/opentracing-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sendJson(router *mux.Router, method, path, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	return resp
+}
+
+func TestWebhooks(t *testing.T) {
+	received := make(chan models.WebhookEvent, 10)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := models.WebhookEvent{}
+		json.NewDecoder(r.Body).Decode(&event)
+		received <- event
+	}))
+	defer target.Close()
+
+	srv := newTestServer(t)
+	router := mux.NewRouter()
+	srv.Routes(router)
+
+	resp := sendJson(router, http.MethodPost, "/api/webhooks", `{"url": "`+target.URL+`", "events": ["user.created", "user.deleted"]}`)
+	require.EqualValues(t, http.StatusCreated, resp.Code, "response code is not created")
+	hook := models.Webhook{}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&hook), "json decoder err")
+	assert.NotEmpty(t, hook.Secret, "should generate a secret")
+	assert.True(t, hook.Active, "should be active")
+	assert.EqualValues(t, "/api/webhooks/"+hook.ID, resp.Header().Get("Location"), "should point at the webhook")
+
+	resp = sendJson(router, http.MethodGet, "/api/webhooks/"+hook.ID, "")
+	require.EqualValues(t, http.StatusOK, resp.Code, "response code is not ok")
+	listed := models.Webhook{}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&listed), "json decoder err")
+	assert.Empty(t, listed.Secret, "should hide the secret")
+
+	u := models.User{Name: "hooked", Address: "kent ridge", Description: "hooked", DOB: 1, Ctime: 1}
+	doc, _ := json.Marshal(u)
+	resp = sendJson(router, http.MethodPost, "/api/user", string(doc))
+	require.EqualValues(t, http.StatusOK, resp.Code, "response code is not ok")
+	id := resp.Body.String()
+	require.EqualValues(t, http.StatusNoContent, sendJson(router, http.MethodPut, "/api/user/"+id, string(doc)).Code, "should update")
+	require.EqualValues(t, http.StatusNoContent, sendJson(router, http.MethodDelete, "/api/user/"+id, "").Code, "should delete")
+
+	for _, eventType := range []string{models.WebhookUserCreated, models.WebhookUserDeleted} {
+		select {
+		case event := <-received:
+			assert.EqualValues(t, eventType, event.Type, "should only deliver subscribed events")
+			assert.EqualValues(t, id, event.UserID, "should deliver the written user")
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %s", eventType)
+		}
+	}
+
+	resp = sendJson(router, http.MethodGet, "/api/webhooks/"+hook.ID+"/deliveries", "")
+	require.EqualValues(t, http.StatusOK, resp.Code, "response code is not ok")
+	var deliveries []models.WebhookDelivery
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&deliveries), "json decoder err")
+	assert.NotEmpty(t, deliveries, "should log the deliveries")
+
+	resp = sendJson(router, http.MethodPut, "/api/webhooks/"+hook.ID, `{"url": "`+target.URL+`", "active": false}`)
+	require.EqualValues(t, http.StatusOK, resp.Code, "response code is not ok")
+	stored, err := srv.hooks.Store().Get(context.Background(), hook.ID)
+	require.Nil(t, err, "should not have error when getting webhook")
+	assert.False(t, stored.Active, "should deactivate")
+	assert.EqualValues(t, hook.Secret, stored.Secret, "should keep the secret")
+
+	assert.EqualValues(t, http.StatusNoContent, sendJson(router, http.MethodDelete, "/api/webhooks/"+hook.ID, "").Code, "should delete")
+	assert.EqualValues(t, http.StatusNotFound, sendJson(router, http.MethodGet, "/api/webhooks/"+hook.ID+"/dead_letters", "").Code, "should not find deleted webhooks")
+}
+
+func TestWebhooksInvalid(t *testing.T) {
+	srv := newTestServer(t)
+	router := mux.NewRouter()
+	srv.Routes(router)
+
+	for _, body := range []string{`{"url": "ftp://partner"}`, `{"url": "http://partner", "events": ["user.renamed"]}`, `{"url": `} {
+		resp := sendJson(router, http.MethodPost, "/api/webhooks", body)
+		assert.EqualValues(t, http.StatusBadRequest, resp.Code, "should reject %s", body)
+	}
+	assert.EqualValues(t, http.StatusNotFound, sendJson(router, http.MethodPost, "/api/webhooks/missing/dead_letters/missing/redeliver", "").Code,
+		"should not find unknown webhooks")
+
+	_, router = newFakeServer()
+	assert.EqualValues(t, http.StatusNotImplemented, sendJson(router, http.MethodGet, "/api/webhooks", "").Code, "should need webhooks")
+}
+
+func TestWebhooksFromOutbox(t *testing.T) {
+	received := make(chan models.WebhookEvent, 10)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := models.WebhookEvent{}
+		json.NewDecoder(r.Body).Decode(&event)
+		received <- event
+	}))
+	defer target.Close()
+
+	ctx := context.Background()
+	dao, err := memory.NewDao(ctx)
+	require.Nil(t, err, "should not have error when init dao")
+	require.Nil(t, dao.EnableOutbox(ctx), "should not have error when enabling outbox")
+	hooks := webhook.NewDispatcher(webhook.NewMemoryStore(), opentracing.NoopTracer{}, webhook.RetryPolicy{MaxAttempts: 2, Backoff: time.Millisecond})
+	hooksCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	hooks.Start(hooksCtx, 1)
+	broker := outbox.NewBroker()
+	broker.Subscribe("webhooks", func(ctx context.Context, record models.OutboxRecord) error {
+		return hooks.NotifyChange(ctx, record.Change)
+	})
+	relay := outbox.NewRelay(dao, broker, &outbox.MemoryOffsetStore{}, 10, 0)
+	srv := NewServer(dao, nil, hooks, logger.Init("test logger", false, false, ioutil.Discard), opentracing.NoopTracer{})
+	srv.WebhooksFromOutbox()
+	router := mux.NewRouter()
+	srv.Routes(router)
+
+	resp := sendJson(router, http.MethodPost, "/api/webhooks", `{"url": "`+target.URL+`"}`)
+	require.EqualValues(t, http.StatusCreated, resp.Code, "response code is not created")
+	doc, _ := json.Marshal(models.User{Name: "hooked", Address: "kent ridge", Description: "hooked", DOB: 1, Ctime: 1})
+	resp = sendJson(router, http.MethodPost, "/api/user", string(doc))
+	require.EqualValues(t, http.StatusOK, resp.Code, "response code is not ok")
+	id := resp.Body.String()
+
+	select {
+	case event := <-received:
+		t.Fatalf("handlers should leave %s to the outbox", event.Type)
+	case <-time.After(50 * time.Millisecond):
+	}
+	n, err := relay.RelayOnce(ctx)
+	require.Nil(t, err, "should not have error when relaying")
+	require.EqualValues(t, 1, n, "should relay the create")
+	select {
+	case event := <-received:
+		assert.EqualValues(t, models.WebhookUserCreated, event.Type, "should deliver the recorded create")
+		assert.EqualValues(t, id, event.UserID, "should deliver the written user")
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the create")
+	}
+}
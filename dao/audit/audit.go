@@ -0,0 +1,124 @@
+// Package audit builds the change records the storage backends keep in each
+// user's history: who changed the user, when, under which trace and how.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"time"
+
+	"github.com/metildachee/userie/dao/internal/uuid"
+	"github.com/metildachee/userie/models"
+	"github.com/opentracing/opentracing-go"
+	jaeger "github.com/uber/jaeger-client-go"
+)
+
+// UnknownActor is recorded for changes made without an actor in the context,
+// e.g. by the command line tools.
+const UnknownActor = "unknown"
+
+type actorKey struct{}
+
+type revertKey struct{}
+
+// WithActor returns a context whose changes are recorded as made by actor.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// Actor returns the actor carried by ctx.
+func Actor(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey{}).(string); ok && actor != "" {
+		return actor
+	}
+	return UnknownActor
+}
+
+// WithRevert returns a context whose update of a user is recorded as a revert
+// to version, rather than as a plain update.
+func WithRevert(ctx context.Context, version string) context.Context {
+	return context.WithValue(ctx, revertKey{}, version)
+}
+
+// TraceID returns the id of the trace ctx's span belongs to, empty when it is
+// not traced by jaeger.
+func TraceID(ctx context.Context) string {
+	span := opentracing.SpanFromContext(ctx)
+	if span == nil {
+		return ""
+	}
+	if sc, ok := span.Context().(jaeger.SpanContext); ok {
+		return sc.TraceID().String()
+	}
+	return ""
+}
+
+// NewChange records operation turning before into after, either of which is
+// nil for a user that did not exist. version is the user's version after the
+// change. Changes are ordered by their timestamp, ties broken by id.
+func NewChange(ctx context.Context, operation string, before, after *models.User, version string) (models.Change, error) {
+	now := time.Now().UTC()
+	id, err := uuid.NewV7(now)
+	if err != nil {
+		return models.Change{}, err
+	}
+	diff, err := Diff(before, after)
+	if err != nil {
+		return models.Change{}, err
+	}
+	change := models.Change{
+		ID:        id,
+		Operation: operation,
+		Version:   version,
+		Actor:     Actor(ctx),
+		Timestamp: now,
+		TraceID:   TraceID(ctx),
+		Diff:      diff,
+	}
+	if version, ok := ctx.Value(revertKey{}).(string); ok && operation == models.ChangeUpdate {
+		change.Operation, change.RevertedTo = models.ChangeRevert, version
+	}
+	if after != nil {
+		snapshot := *after
+		change.UserID, change.After = after.ID, &snapshot
+	} else if before != nil {
+		change.UserID = before.ID
+	}
+	return change, nil
+}
+
+// Diff returns the fields, keyed by their json names, that differ between
+// before and after. The id never changes and is left out.
+func Diff(before, after *models.User) (map[string]models.FieldChange, error) {
+	from, err := fieldsOf(before)
+	if err != nil {
+		return nil, err
+	}
+	to, err := fieldsOf(after)
+	if err != nil {
+		return nil, err
+	}
+	diff := map[string]models.FieldChange{}
+	for _, fields := range []map[string]interface{}{from, to} {
+		for name := range fields {
+			if _, seen := diff[name]; seen || name == "id" || reflect.DeepEqual(from[name], to[name]) {
+				continue
+			}
+			diff[name] = models.FieldChange{Before: from[name], After: to[name]}
+		}
+	}
+	return diff, nil
+}
+
+func fieldsOf(u *models.User) (map[string]interface{}, error) {
+	fields := map[string]interface{}{}
+	if u == nil {
+		return fields, nil
+	}
+	doc, err := json.Marshal(u)
+	if err != nil {
+		return nil, err
+	}
+	return fields, json.Unmarshal(doc, &fields)
+}
@@ -0,0 +1,48 @@
+package audit
+
+import (
+	"context"
+	"testing"
+
+	"github.com/metildachee/userie/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestActor(t *testing.T) {
+	assert.Equal(t, UnknownActor, Actor(context.Background()), "context without actor should be unknown")
+	assert.Equal(t, "admin", Actor(WithActor(context.Background(), "admin")), "actor should be carried")
+	assert.Empty(t, TraceID(context.Background()), "untraced context should have no trace id")
+}
+
+func TestNewChange(t *testing.T) {
+	before := models.User{ID: "1", Name: "metchee", Address: "kent ridge", Description: "default"}
+	after := before
+	after.Address, after.Description = "Kent Ridge", ""
+
+	change, err := NewChange(context.Background(), models.ChangePatch, &before, &after, "2")
+	require.Nil(t, err, "should not have err when building change")
+	assert.NotEmpty(t, change.ID, "change should have an id")
+	assert.Equal(t, "1", change.UserID, "change should belong to the user")
+	assert.Equal(t, "2", change.Version, "change should carry the version")
+	assert.False(t, change.Timestamp.IsZero(), "change should be timestamped")
+	assert.Equal(t, map[string]models.FieldChange{
+		"address":     {Before: "kent ridge", After: "Kent Ridge"},
+		"description": {Before: "default", After: ""},
+	}, change.Diff, "diff should hold the changed fields only")
+	after.Name = "meow"
+	assert.Equal(t, "metchee", change.After.Name, "snapshot should not follow later changes")
+
+	created, err := NewChange(context.Background(), models.ChangeCreate, nil, &before, "1")
+	require.Nil(t, err, "should not have err when building change")
+	assert.Equal(t, "metchee", created.Diff["name"].After, "create should set every field")
+	assert.Nil(t, created.Diff["name"].Before, "create should start from nothing")
+	assert.NotContains(t, created.Diff, "id", "id should not be diffed")
+	assert.NotEqual(t, change.ID, created.ID, "changes should have their own ids")
+	assert.False(t, created.Timestamp.Before(change.Timestamp), "timestamps should follow the order changes were made")
+
+	reverted, err := NewChange(WithRevert(context.Background(), "1"), models.ChangeUpdate, &after, &before, "3")
+	require.Nil(t, err, "should not have err when building change")
+	assert.Equal(t, models.ChangeRevert, reverted.Operation, "update should be recorded as a revert")
+	assert.Equal(t, "1", reverted.RevertedTo, "revert should record its target")
+}
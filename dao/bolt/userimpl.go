@@ -0,0 +1,775 @@
+// Package bolt persists users to a local bbolt file, for single node
+// deployments that cannot run an Elasticsearch cluster.
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/metildachee/userie/dao/audit"
+	"github.com/metildachee/userie/dao/interfaces"
+	"github.com/metildachee/userie/dao/internal/listing"
+	"github.com/metildachee/userie/models"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+	bbolt "go.etcd.io/bbolt"
+)
+
+const (
+	openTimeout = 5 * time.Second
+)
+
+var (
+	usersBucket = []byte("users")
+	// namesBucket indexes users by name, keyed by name, a zero byte and id,
+	// so name prefixes can be looked up without reading every user.
+	namesBucket = []byte("names")
+	// versionsBucket counts the writes to each user, keyed by id. Purges keep
+	// the count, as the history outlives the user and its versions must stay
+	// unique.
+	versionsBucket = []byte("versions")
+	// deletedBucket holds the soft deleted users, keyed by id, until they are
+	// restored or purged.
+	deletedBucket = []byte("deleted")
+	// historyBucket holds the changes to every user, keyed by user id, a zero
+	// byte and change id, so a user's changes sit together in the order they
+	// were made.
+	historyBucket = []byte("history")
+	// outboxBucket holds the changes waiting to be published, keyed by their
+	// offset in big endian so they sit in the order they were made.
+	outboxBucket = []byte("outbox")
+	// outboxLeaseBucket holds the lease of the relay publishing the outbox,
+	// under outboxLeaseKey.
+	outboxLeaseBucket = []byte("outbox_lease")
+	outboxLeaseKey    = []byte("lease")
+)
+
+var (
+	_ interfaces.UserDao = (*UserImplDao)(nil)
+	_ interfaces.Outbox  = (*UserImplDao)(nil)
+)
+
+type UserImplDao struct {
+	db *bbolt.DB
+	// outbox is set once records are written to the outbox bucket
+	outbox bool
+}
+
+func NewDao(ctx context.Context, path string) (*UserImplDao, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "get new bolt dao")
+	defer span.Finish()
+
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: openTimeout})
+	if err != nil {
+		ext.LogError(span, err)
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{usersBucket, namesBucket, versionsBucket, deletedBucket, historyBucket, outboxBucket, outboxLeaseBucket,
+			webhooksBucket, deliveriesBucket, deadLettersBucket, pendingBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		ext.LogError(span, err)
+		db.Close()
+		return nil, err
+	}
+	span.LogFields(log.String("bolt file", path))
+	return &UserImplDao{db: db}, nil
+}
+
+func (dao *UserImplDao) Close() error {
+	return dao.db.Close()
+}
+
+func nameKey(u models.User) []byte {
+	return []byte(u.Name + "\x00" + u.ID)
+}
+
+func get(tx *bbolt.Tx, id string) (u models.User, err error) {
+	doc := tx.Bucket(usersBucket).Get([]byte(id))
+	if doc == nil {
+		return u, interfaces.ErrNotFound
+	}
+	err = json.Unmarshal(doc, &u)
+	return
+}
+
+func put(tx *bbolt.Tx, u models.User) error {
+	doc, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(usersBucket).Put([]byte(u.ID), doc); err != nil {
+		return err
+	}
+	if err := tx.Bucket(namesBucket).Put(nameKey(u), []byte(u.ID)); err != nil {
+		return err
+	}
+	next := strconv.FormatUint(version(tx, u.ID)+1, 10)
+	return tx.Bucket(versionsBucket).Put([]byte(u.ID), []byte(next))
+}
+
+// version returns how often the user was written, users stored before
+// versions were kept count as zero.
+func version(tx *bbolt.Tx, id string) uint64 {
+	value, _ := strconv.ParseUint(string(tx.Bucket(versionsBucket).Get([]byte(id))), 10, 64)
+	return value
+}
+
+// checkVersion compares the stored user's version with the expected one.
+func checkVersion(tx *bbolt.Tx, id, expected string) (models.User, error) {
+	u, err := get(tx, id)
+	if err != nil {
+		return u, err
+	}
+	if strconv.FormatUint(version(tx, id), 10) != expected {
+		return u, interfaces.ErrVersionConflict
+	}
+	return u, nil
+}
+
+// softDelete moves a user to the deleted bucket, bumps its version and
+// records the delete.
+func (dao *UserImplDao) softDelete(ctx context.Context, tx *bbolt.Tx, u models.User) error {
+	if err := remove(tx, u); err != nil {
+		return err
+	}
+	before := u
+	u.DeletedAt = int32(time.Now().Unix())
+	doc, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(deletedBucket).Put([]byte(u.ID), doc); err != nil {
+		return err
+	}
+	next := strconv.FormatUint(version(tx, u.ID)+1, 10)
+	if err := tx.Bucket(versionsBucket).Put([]byte(u.ID), []byte(next)); err != nil {
+		return err
+	}
+	return dao.record(ctx, tx, models.ChangeDelete, &before, nil)
+}
+
+func remove(tx *bbolt.Tx, u models.User) error {
+	if err := tx.Bucket(usersBucket).Delete([]byte(u.ID)); err != nil {
+		return err
+	}
+	return tx.Bucket(namesBucket).Delete(nameKey(u))
+}
+
+// record adds the change from before to after to the user's history, in the
+// same transaction as the write and after its version was bumped.
+func (dao *UserImplDao) record(ctx context.Context, tx *bbolt.Tx, operation string, before, after *models.User) error {
+	change, err := audit.NewChange(ctx, operation, before, after, "")
+	if err != nil {
+		return err
+	}
+	change.Version = strconv.FormatUint(version(tx, change.UserID), 10)
+	doc, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(historyBucket).Put([]byte(change.UserID+"\x00"+change.ID), doc); err != nil {
+		return err
+	}
+	if !dao.outbox {
+		return nil
+	}
+	outbox := tx.Bucket(outboxBucket)
+	offset, err := outbox.NextSequence()
+	if err != nil {
+		return err
+	}
+	if doc, err = json.Marshal(models.OutboxRecord{Offset: int64(offset), Change: change}); err != nil {
+		return err
+	}
+	return outbox.Put(offsetKey(offset), doc)
+}
+
+func offsetKey(offset uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, offset)
+	return key
+}
+
+// candidates returns the users a listing has to look at. With a name prefix
+// they come from the name index, otherwise every user is read.
+func candidates(tx *bbolt.Tx, filter ...models.UserFilter) (users []models.User, err error) {
+	prefix := ""
+	for _, f := range filter {
+		if f.NamePrefix != "" {
+			prefix = f.NamePrefix
+		}
+	}
+	if prefix == "" {
+		err = tx.Bucket(usersBucket).ForEach(func(k, v []byte) error {
+			var u models.User
+			if err := json.Unmarshal(v, &u); err != nil {
+				return err
+			}
+			users = append(users, u)
+			return nil
+		})
+		return
+	}
+
+	c := tx.Bucket(namesBucket).Cursor()
+	for k, id := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, id = c.Next() {
+		u, err := get(tx, string(id))
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return
+}
+
+func (dao *UserImplDao) GetAll(ctx context.Context, limit, offset int, filter ...models.UserFilter) (users []models.User, err error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "bolt get all")
+	defer span.Finish()
+
+	err = dao.db.View(func(tx *bbolt.Tx) error {
+		all, err := candidates(tx, filter...)
+		users = listing.Slice(listing.Filter(all, filter...), limit, offset)
+		return err
+	})
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	span.LogFields(log.Int("users", len(users)))
+	return
+}
+
+func (dao *UserImplDao) GetAllAfter(ctx context.Context, token string, limit int, filter ...models.UserFilter) (users []models.User, next string, err error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "bolt get all after")
+	defer span.Finish()
+
+	err = dao.db.View(func(tx *bbolt.Tx) error {
+		all, err := candidates(tx)
+		if err != nil {
+			return err
+		}
+		users, next, err = listing.Page(all, token, limit, filter...)
+		return err
+	})
+	if err != nil {
+		ext.LogError(span, err)
+	}
+	return
+}
+
+func (dao *UserImplDao) Search(ctx context.Context, text string, limit, offset int) (result models.SearchResult, err error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "bolt search")
+	defer span.Finish()
+
+	err = dao.db.View(func(tx *bbolt.Tx) error {
+		all, err := candidates(tx)
+		result = listing.Search(all, text, limit, offset)
+		return err
+	})
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	span.LogFields(log.Int64("total hits", result.Total))
+	return
+}
+
+func (dao *UserImplDao) GetById(ctx context.Context, id string) (user models.User, err error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "bolt by id")
+	defer span.Finish()
+
+	err = dao.db.View(func(tx *bbolt.Tx) error {
+		user, err = get(tx, id)
+		return err
+	})
+	return
+}
+
+func (dao *UserImplDao) Create(ctx context.Context, new models.User) (id string, err error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "bolt create item")
+	defer span.Finish()
+
+	err = dao.db.Update(func(tx *bbolt.Tx) error {
+		return dao.create(ctx, tx, &new)
+	})
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	span.LogFields(log.String("user doc", new.ID))
+	return new.ID, nil
+}
+
+// create stores new under the next free id of the users bucket sequence,
+// which is persisted with the bucket and so survives restarts. Ids of deleted
+// users are not free.
+func (dao *UserImplDao) create(ctx context.Context, tx *bbolt.Tx, new *models.User) error {
+	users, deleted := tx.Bucket(usersBucket), tx.Bucket(deletedBucket)
+	for {
+		seq, err := users.NextSequence()
+		if err != nil {
+			return err
+		}
+		new.ID = strconv.FormatUint(seq, 10)
+		if users.Get([]byte(new.ID)) == nil && deleted.Get([]byte(new.ID)) == nil {
+			if err := put(tx, *new); err != nil {
+				return err
+			}
+			return dao.record(ctx, tx, models.ChangeCreate, nil, new)
+		}
+	}
+}
+
+func (dao *UserImplDao) BatchCreate(ctx context.Context, new []models.User) (err error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "bolt batch item")
+	defer span.Finish()
+
+	err = dao.db.Update(func(tx *bbolt.Tx) error {
+		for i := range new {
+			if err := dao.create(ctx, tx, &new[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	span.LogKV("batch index done")
+	return
+}
+
+func (dao *UserImplDao) BulkCreate(ctx context.Context, new []models.User) ([]models.BulkItemResult, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "bolt bulk create")
+	defer span.Finish()
+
+	results := make([]models.BulkItemResult, len(new))
+	for i, item := range new {
+		results[i] = models.CreateResult(dao.Create(ctx, item))
+	}
+	span.LogFields(log.Int("users", len(new)))
+	return results, nil
+}
+
+func (dao *UserImplDao) Update(ctx context.Context, updated models.User) (err error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "bolt update item")
+	defer span.Finish()
+
+	err = dao.db.Update(func(tx *bbolt.Tx) error {
+		old, err := get(tx, updated.ID)
+		if err != nil {
+			return err
+		}
+		if err := remove(tx, old); err != nil {
+			return err
+		}
+		if err := put(tx, updated); err != nil {
+			return err
+		}
+		return dao.record(ctx, tx, models.ChangeUpdate, &old, &updated)
+	})
+	if err != nil {
+		ext.LogError(span, err)
+	}
+	return
+}
+
+func (dao *UserImplDao) Upsert(ctx context.Context, u models.User) (created bool, err error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "bolt upsert item")
+	defer span.Finish()
+
+	err = dao.db.Update(func(tx *bbolt.Tx) error {
+		old, err := get(tx, u.ID)
+		if errors.Is(err, interfaces.ErrNotFound) {
+			created = true
+		} else if err != nil {
+			return err
+		} else if err := remove(tx, old); err != nil {
+			return err
+		}
+		// a deleted user under the id is replaced, and cannot be restored anymore
+		if err := tx.Bucket(deletedBucket).Delete([]byte(u.ID)); err != nil {
+			return err
+		}
+		if err := put(tx, u); err != nil {
+			return err
+		}
+		if created {
+			return dao.record(ctx, tx, models.ChangeCreate, nil, &u)
+		}
+		return dao.record(ctx, tx, models.ChangeUpdate, &old, &u)
+	})
+	if err != nil {
+		ext.LogError(span, err)
+	}
+	return
+}
+
+func (dao *UserImplDao) Patch(ctx context.Context, id string, fields map[string]interface{}) (err error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "bolt patch item")
+	defer span.Finish()
+
+	err = dao.db.Update(func(tx *bbolt.Tx) error {
+		old, err := get(tx, id)
+		if err != nil {
+			return err
+		}
+		updated := old
+		if err := models.ApplyFields(&updated, fields); err != nil {
+			return err
+		}
+		updated.ID = id
+		if err := remove(tx, old); err != nil {
+			return err
+		}
+		if err := put(tx, updated); err != nil {
+			return err
+		}
+		return dao.record(ctx, tx, models.ChangePatch, &old, &updated)
+	})
+	if err != nil {
+		ext.LogError(span, err)
+	}
+	return
+}
+
+func (dao *UserImplDao) UpdateUserName(ctx context.Context, id, newName string) error {
+	return dao.Patch(ctx, id, map[string]interface{}{"name": newName})
+}
+
+func (dao *UserImplDao) Delete(ctx context.Context, id string) (err error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "bolt delete item")
+	defer span.Finish()
+	span.LogFields(log.String("doc id", id))
+
+	err = dao.db.Update(func(tx *bbolt.Tx) error {
+		old, err := get(tx, id)
+		if err != nil {
+			return err
+		}
+		return dao.softDelete(ctx, tx, old)
+	})
+	if err != nil {
+		ext.LogError(span, err)
+	}
+	return
+}
+
+func (dao *UserImplDao) GetVersioned(ctx context.Context, id string) (user models.User, ver string, err error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "bolt versioned by id")
+	defer span.Finish()
+
+	err = dao.db.View(func(tx *bbolt.Tx) error {
+		if user, err = get(tx, id); err != nil {
+			return err
+		}
+		ver = strconv.FormatUint(version(tx, id), 10)
+		return nil
+	})
+	return
+}
+
+func (dao *UserImplDao) UpdateIfMatch(ctx context.Context, updated models.User, expected string) (ver string, err error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "bolt conditional update item")
+	defer span.Finish()
+
+	err = dao.db.Update(func(tx *bbolt.Tx) error {
+		old, err := checkVersion(tx, updated.ID, expected)
+		if err != nil {
+			return err
+		}
+		if err := remove(tx, old); err != nil {
+			return err
+		}
+		if err := put(tx, updated); err != nil {
+			return err
+		}
+		if err := dao.record(ctx, tx, models.ChangeUpdate, &old, &updated); err != nil {
+			return err
+		}
+		ver = strconv.FormatUint(version(tx, updated.ID), 10)
+		return nil
+	})
+	if err != nil {
+		ext.LogError(span, err)
+	}
+	return
+}
+
+func (dao *UserImplDao) PatchIfMatch(ctx context.Context, id string, fields map[string]interface{}, expected string) (ver string, err error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "bolt conditional patch item")
+	defer span.Finish()
+
+	err = dao.db.Update(func(tx *bbolt.Tx) error {
+		old, err := checkVersion(tx, id, expected)
+		if err != nil {
+			return err
+		}
+		updated := old
+		if err := models.ApplyFields(&updated, fields); err != nil {
+			return err
+		}
+		updated.ID = id
+		if err := remove(tx, old); err != nil {
+			return err
+		}
+		if err := put(tx, updated); err != nil {
+			return err
+		}
+		if err := dao.record(ctx, tx, models.ChangePatch, &old, &updated); err != nil {
+			return err
+		}
+		ver = strconv.FormatUint(version(tx, id), 10)
+		return nil
+	})
+	if err != nil {
+		ext.LogError(span, err)
+	}
+	return
+}
+
+func (dao *UserImplDao) DeleteIfMatch(ctx context.Context, id, expected string) (err error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "bolt conditional delete item")
+	defer span.Finish()
+	span.LogFields(log.String("doc id", id))
+
+	err = dao.db.Update(func(tx *bbolt.Tx) error {
+		old, err := checkVersion(tx, id, expected)
+		if err != nil {
+			return err
+		}
+		return dao.softDelete(ctx, tx, old)
+	})
+	if err != nil {
+		ext.LogError(span, err)
+	}
+	return
+}
+
+func (dao *UserImplDao) Restore(ctx context.Context, id string) (err error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "bolt restore item")
+	defer span.Finish()
+	span.LogFields(log.String("doc id", id))
+
+	err = dao.db.Update(func(tx *bbolt.Tx) error {
+		deleted := tx.Bucket(deletedBucket)
+		doc := deleted.Get([]byte(id))
+		if doc == nil {
+			return interfaces.ErrNotFound
+		}
+		var u models.User
+		if err := json.Unmarshal(doc, &u); err != nil {
+			return err
+		}
+		if err := deleted.Delete([]byte(id)); err != nil {
+			return err
+		}
+		u.DeletedAt = 0
+		if err := put(tx, u); err != nil {
+			return err
+		}
+		return dao.record(ctx, tx, models.ChangeRestore, nil, &u)
+	})
+	if err != nil {
+		ext.LogError(span, err)
+	}
+	return
+}
+
+func (dao *UserImplDao) GetDeleted(ctx context.Context, limit, offset int) (users []models.User, err error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "bolt get deleted")
+	defer span.Finish()
+
+	users = []models.User{}
+	err = dao.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(deletedBucket).ForEach(func(k, v []byte) error {
+			var u models.User
+			if err := json.Unmarshal(v, &u); err != nil {
+				return err
+			}
+			users = append(users, u)
+			return nil
+		})
+	})
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	users = listing.Deleted(users, limit, offset)
+	span.LogFields(log.Int("users", len(users)))
+	return
+}
+
+func (dao *UserImplDao) Purge(ctx context.Context, before int32) (purged int64, err error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "bolt purge")
+	defer span.Finish()
+
+	err = dao.db.Update(func(tx *bbolt.Tx) error {
+		// keys cannot be deleted while the bucket is walked, so collect them
+		var expired [][]byte
+		err := tx.Bucket(deletedBucket).ForEach(func(k, v []byte) error {
+			var u models.User
+			if err := json.Unmarshal(v, &u); err != nil {
+				return err
+			}
+			if u.DeletedAt < before {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, id := range expired {
+			if err := tx.Bucket(deletedBucket).Delete(id); err != nil {
+				return err
+			}
+		}
+		purged = int64(len(expired))
+		return nil
+	})
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	span.LogFields(log.Int64("purged", purged))
+	return
+}
+
+func (dao *UserImplDao) GetHistory(ctx context.Context, id string, limit, offset int) (page models.HistoryPage, err error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "bolt get history")
+	defer span.Finish()
+	span.LogFields(log.String("doc id", id))
+
+	var changes []models.Change
+	err = dao.db.View(func(tx *bbolt.Tx) error {
+		prefix := []byte(id + "\x00")
+		c := tx.Bucket(historyBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var change models.Change
+			if err := json.Unmarshal(v, &change); err != nil {
+				return err
+			}
+			changes = append(changes, change)
+		}
+		return nil
+	})
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	return listing.History(changes, limit, offset), nil
+}
+
+func (dao *UserImplDao) EnableOutbox(ctx context.Context) error {
+	dao.outbox = true
+	return nil
+}
+
+func (dao *UserImplDao) ReadOutbox(ctx context.Context, after int64, limit int) (records []models.OutboxRecord, err error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "bolt read outbox")
+	defer span.Finish()
+
+	records = []models.OutboxRecord{}
+	err = dao.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(outboxBucket).Cursor()
+		for k, v := c.Seek(offsetKey(uint64(after) + 1)); k != nil && len(records) < limit; k, v = c.Next() {
+			var record models.OutboxRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			records = append(records, record)
+		}
+		return nil
+	})
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	span.LogFields(log.Int64("after", after), log.Int("records", len(records)))
+	return
+}
+
+func (dao *UserImplDao) TrimOutbox(ctx context.Context, through int64) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "bolt trim outbox")
+	defer span.Finish()
+
+	trimmed := 0
+	err := dao.db.Update(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(outboxBucket).Cursor()
+		for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) <= uint64(through); k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			trimmed++
+		}
+		return nil
+	})
+	if err != nil {
+		ext.LogError(span, err)
+		return err
+	}
+	span.LogFields(log.Int64("through", through), log.Int("records", trimmed))
+	return nil
+}
+
+// updateOutboxLease hands update the stored lease and stores it again when
+// update took it.
+func (dao *UserImplDao) updateOutboxLease(update func(lease *models.OutboxLease) bool) (lease models.OutboxLease, err error) {
+	err = dao.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(outboxLeaseBucket)
+		if doc := b.Get(outboxLeaseKey); doc != nil {
+			if err := json.Unmarshal(doc, &lease); err != nil {
+				return err
+			}
+		}
+		if !update(&lease) {
+			return interfaces.ErrOutboxLeased
+		}
+		doc, err := json.Marshal(lease)
+		if err != nil {
+			return err
+		}
+		return b.Put(outboxLeaseKey, doc)
+	})
+	return
+}
+
+func (dao *UserImplDao) ClaimOutbox(ctx context.Context, holder string, ttl time.Duration) (int64, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "bolt claim outbox")
+	defer span.Finish()
+
+	lease, err := dao.updateOutboxLease(func(lease *models.OutboxLease) bool {
+		return lease.Claim(holder, time.Now(), ttl)
+	})
+	if err != nil {
+		return 0, err
+	}
+	span.LogFields(log.String("holder", holder), log.Int64("committed", lease.Committed))
+	return lease.Committed, nil
+}
+
+func (dao *UserImplDao) CommitOutbox(ctx context.Context, holder string, offset int64, ttl time.Duration) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "bolt commit outbox")
+	defer span.Finish()
+
+	_, err := dao.updateOutboxLease(func(lease *models.OutboxLease) bool {
+		return lease.Commit(holder, offset, time.Now(), ttl)
+	})
+	span.LogFields(log.String("holder", holder), log.Int64("offset", offset))
+	return err
+}
@@ -0,0 +1,338 @@
+package bolt
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/metildachee/userie/dao/audit"
+	"github.com/metildachee/userie/dao/interfaces"
+	"github.com/metildachee/userie/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestDao(t *testing.T) (*UserImplDao, string) {
+	dir, err := ioutil.TempDir("", "userie-bolt")
+	require.Nil(t, err, "should not have error when making temp dir")
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "userie.db")
+	dao, err := NewDao(context.Background(), path)
+	require.Nil(t, err, "should not have error when init")
+	return dao, path
+}
+
+func newUser(i int) models.User {
+	return models.User{
+		Name:        fmt.Sprintf("metchee %d", i),
+		DOB:         int32(time.Now().AddDate(-20, 0, i).Unix()),
+		Address:     fmt.Sprintf("kent ridge %d", i),
+		Description: fmt.Sprintf("default user info %d", i),
+		Ctime:       int32(time.Now().AddDate(0, 0, -i).Unix()),
+	}
+}
+
+func TestSurvivesRestart(t *testing.T) {
+	ctx := context.Background()
+	dao, path := newTestDao(t)
+	id, err := dao.Create(ctx, newUser(0))
+	require.Nil(t, err, "should not have error when create user")
+	require.Nil(t, dao.Close(), "should not have error when closing")
+
+	dao, err = NewDao(ctx, path)
+	require.Nil(t, err, "should not have error when reopening")
+	defer dao.Close()
+	user, err := dao.GetById(ctx, id)
+	assert.Nil(t, err, "should not have err when getting user")
+	assert.EqualValues(t, "metchee 0", user.Name, "should read back the stored user")
+
+	next, err := dao.Create(ctx, newUser(1))
+	assert.Nil(t, err, "should not have error when create user")
+	assert.NotEqualValues(t, id, next, "sequence should survive restarts")
+}
+
+func TestGetUsers(t *testing.T) {
+	ctx := context.Background()
+	dao, _ := newTestDao(t)
+	defer dao.Close()
+	users := make([]models.User, 0)
+	for i := 0; i < 5; i++ {
+		users = append(users, newUser(i))
+	}
+	require.Nil(t, dao.BatchCreate(ctx, users), "should not have error when create users")
+
+	res, err := dao.GetAll(ctx, 2, 1)
+	assert.Nil(t, err, "should not have error when get users")
+	require.Len(t, res, 2, "does not conform to limit")
+	assert.EqualValues(t, "2", res[0].ID, "should skip offset")
+}
+
+func TestGetUsersByNamePrefix(t *testing.T) {
+	ctx := context.Background()
+	dao, _ := newTestDao(t)
+	defer dao.Close()
+	for _, name := range []string{"metchee", "metilda", "meow", "alice"} {
+		u := newUser(0)
+		u.Name = name
+		_, err := dao.Create(ctx, u)
+		require.Nil(t, err, "should not have error when create user")
+	}
+
+	filter := models.UserFilter{NamePrefix: "met", Sort: []models.SortField{{Field: "name", Desc: true}}}
+	res, err := dao.GetAll(ctx, 10, 0, filter)
+	assert.Nil(t, err, "should not have error when get users")
+	require.Len(t, res, 2, "should only match the prefix")
+	assert.EqualValues(t, "metilda", res[0].Name, "should be sorted by name descending")
+
+	// renamed users move in the name index
+	require.Nil(t, dao.UpdateUserName(ctx, res[0].ID, "alicia"), "should not have err when update user")
+	res, err = dao.GetAll(ctx, 10, 0, models.UserFilter{NamePrefix: "ali"})
+	assert.Nil(t, err, "should not have error when get users")
+	assert.Len(t, res, 2, "renamed user should match its new name")
+}
+
+func TestGetUsersAfter(t *testing.T) {
+	ctx := context.Background()
+	dao, _ := newTestDao(t)
+	defer dao.Close()
+	for i := 0; i < 5; i++ {
+		_, err := dao.Create(ctx, newUser(i))
+		require.Nil(t, err, "should not have error when create user")
+	}
+
+	seen, next := map[string]bool{}, ""
+	for {
+		users, token, err := dao.GetAllAfter(ctx, next, 2)
+		require.Nil(t, err, "should not have error when walking users")
+		for _, user := range users {
+			assert.False(t, seen[user.ID], "user should not be returned twice")
+			seen[user.ID] = true
+		}
+		if next = token; next == "" {
+			break
+		}
+	}
+	assert.Len(t, seen, 5, "should walk every user")
+}
+
+func TestUpdateAndDeleteUser(t *testing.T) {
+	ctx := context.Background()
+	dao, _ := newTestDao(t)
+	defer dao.Close()
+	id, err := dao.Create(ctx, newUser(0))
+	require.Nil(t, err, "should not have error when create user")
+
+	user, err := dao.GetById(ctx, id)
+	require.Nil(t, err, "should not have err when getting user")
+	user.Description = "let me change this up"
+	assert.Nil(t, dao.Update(ctx, user), "should not have err when update user")
+	updated, err := dao.GetById(ctx, id)
+	assert.Nil(t, err, "should not have err when getting user")
+	assert.EqualValues(t, user.Description, updated.Description, "should have the same value")
+
+	assert.Nil(t, dao.Delete(ctx, id), "should not have err when delete user")
+	_, err = dao.GetById(ctx, id)
+	assert.Equal(t, interfaces.ErrNotFound, err, "deleted user should not be found")
+	assert.Equal(t, interfaces.ErrNotFound, dao.Update(ctx, user), "missing user should not be updated")
+}
+
+func TestConditionalWrites(t *testing.T) {
+	ctx := context.Background()
+	dao, _ := newTestDao(t)
+	defer dao.Close()
+	id, err := dao.Create(ctx, newUser(0))
+	require.Nil(t, err, "should not have error when create user")
+
+	user, version, err := dao.GetVersioned(ctx, id)
+	require.Nil(t, err, "should not have err when getting user")
+	require.Nil(t, dao.UpdateUserName(ctx, id, "meow meow"), "should not have err when update user")
+	_, err = dao.UpdateIfMatch(ctx, user, version)
+	assert.Equal(t, interfaces.ErrVersionConflict, err, "stale version should conflict")
+
+	_, version, err = dao.GetVersioned(ctx, id)
+	require.Nil(t, err, "should not have err when getting user")
+	assert.Equal(t, interfaces.ErrVersionConflict, dao.DeleteIfMatch(ctx, id, "0"), "stale version should not delete")
+	assert.Nil(t, dao.DeleteIfMatch(ctx, id, version), "current version should delete")
+	_, _, err = dao.GetVersioned(ctx, id)
+	assert.Equal(t, interfaces.ErrNotFound, err, "deleted user should not be found")
+}
+
+func TestUpsertUser(t *testing.T) {
+	ctx := context.Background()
+	dao, _ := newTestDao(t)
+	defer dao.Close()
+	user := newUser(0)
+	user.ID = "legacy"
+	created, err := dao.Upsert(ctx, user)
+	assert.Nil(t, err, "should not have err when upserting")
+	assert.True(t, created, "missing user should be created")
+
+	user.Name = "meow"
+	created, err = dao.Upsert(ctx, user)
+	assert.Nil(t, err, "should not have err when upserting")
+	assert.False(t, created, "existing user should be replaced")
+	users, err := dao.GetAll(ctx, 10, 0, models.UserFilter{NamePrefix: "metchee"})
+	assert.Nil(t, err, "should not have err when listing users")
+	assert.Empty(t, users, "old name should be dropped from the name index")
+}
+
+func TestSoftDeleteAndRestore(t *testing.T) {
+	ctx := context.Background()
+	dao, _ := newTestDao(t)
+	defer dao.Close()
+	id, err := dao.Create(ctx, newUser(0))
+	require.Nil(t, err, "should not have error when create user")
+	_, version, err := dao.GetVersioned(ctx, id)
+	require.Nil(t, err, "should not have err when getting user")
+	require.Nil(t, dao.Delete(ctx, id), "should not have err when delete user")
+
+	_, err = dao.GetById(ctx, id)
+	assert.Equal(t, interfaces.ErrNotFound, err, "deleted user should be hidden")
+	assert.Equal(t, interfaces.ErrNotFound, dao.Delete(ctx, id), "deleted user cannot be deleted twice")
+	users, err := dao.GetAll(ctx, 10, 0)
+	assert.Nil(t, err, "should not have err when listing users")
+	assert.Empty(t, users, "deleted user should not be listed")
+	deleted, err := dao.GetDeleted(ctx, 10, 0)
+	assert.Nil(t, err, "should not have err when listing deleted users")
+	require.Len(t, deleted, 1, "deleted user should be listed as deleted")
+	assert.NotZero(t, deleted[0].DeletedAt, "should say when the user was deleted")
+
+	require.Nil(t, dao.Restore(ctx, id), "should not have err when restoring")
+	user, restored, err := dao.GetVersioned(ctx, id)
+	assert.Nil(t, err, "restored user should be found")
+	assert.EqualValues(t, newUser(0).Name, user.Name, "restored user should keep its fields")
+	assert.NotEqual(t, version, restored, "delete and restore should change the version")
+	assert.Equal(t, interfaces.ErrNotFound, dao.Restore(ctx, id), "live user cannot be restored")
+
+	require.Nil(t, dao.DeleteIfMatch(ctx, id, restored), "should not have err when delete user")
+	purged, err := dao.Purge(ctx, int32(time.Now().Add(-time.Hour).Unix()))
+	assert.Nil(t, err, "should not have err when purging")
+	assert.Zero(t, purged, "users within retention should be kept")
+	purged, err = dao.Purge(ctx, int32(time.Now().Unix())+1)
+	assert.Nil(t, err, "should not have err when purging")
+	assert.EqualValues(t, 1, purged, "users past retention should be purged")
+	assert.Equal(t, interfaces.ErrNotFound, dao.Restore(ctx, id), "purged user cannot be restored")
+
+	user = newUser(0)
+	user.ID = id
+	_, err = dao.Upsert(ctx, user)
+	require.Nil(t, err, "should not have err when upserting a purged id")
+	page, err := dao.GetHistory(ctx, id, 10, 0)
+	require.Nil(t, err, "should not have err when getting history")
+	seen := map[string]bool{}
+	for _, change := range page.Changes {
+		assert.False(t, seen[change.Version], "versions should not repeat after a purge")
+		seen[change.Version] = true
+	}
+}
+
+func TestHistory(t *testing.T) {
+	ctx := audit.WithActor(context.Background(), "admin")
+	dao, _ := newTestDao(t)
+	defer dao.Close()
+	id, err := dao.Create(ctx, newUser(0))
+	require.Nil(t, err, "should not have error when create user")
+	require.Nil(t, dao.Patch(ctx, id, map[string]interface{}{"address": "Kent Ridge"}), "should not have err when patch user")
+	require.Nil(t, dao.Delete(ctx, id), "should not have err when delete user")
+	require.Nil(t, dao.Restore(ctx, id), "should not have err when restoring")
+	_, version, err := dao.GetVersioned(ctx, id)
+	require.Nil(t, err, "should not have err when getting user")
+
+	page, err := dao.GetHistory(ctx, id, 10, 0)
+	require.Nil(t, err, "should not have err when getting history")
+	assert.EqualValues(t, 4, page.Total, "every write should be recorded")
+	require.Len(t, page.Changes, 4, "every write should be listed")
+	operations := []string{}
+	for _, change := range page.Changes {
+		operations = append(operations, change.Operation)
+		assert.Equal(t, id, change.UserID, "change should belong to the user")
+		assert.Equal(t, "admin", change.Actor, "change should carry the actor")
+	}
+	assert.Equal(t, []string{models.ChangeRestore, models.ChangeDelete, models.ChangePatch, models.ChangeCreate}, operations,
+		"newest change should come first")
+	assert.Equal(t, version, page.Changes[0].Version, "change should carry the version it left")
+	patch := page.Changes[2]
+	assert.Equal(t, map[string]models.FieldChange{
+		"address": {Before: "kent ridge 0", After: "Kent Ridge"},
+	}, patch.Diff, "patch should only change the address")
+	require.NotNil(t, patch.After, "patch should keep the patched user")
+	assert.Equal(t, "Kent Ridge", patch.After.Address, "patch should keep the patched user")
+	assert.Nil(t, page.Changes[1].After, "deleted user should not be kept")
+
+	page, err = dao.GetHistory(ctx, id, 1, 1)
+	assert.Nil(t, err, "should not have err when paging history")
+	require.Len(t, page.Changes, 1, "page should hold one change")
+	assert.Equal(t, models.ChangeDelete, page.Changes[0].Operation, "page should skip the newest change")
+	page, err = dao.GetHistory(ctx, "unknown", 10, 0)
+	assert.Nil(t, err, "should not have err for a user never written")
+	assert.Empty(t, page.Changes, "user never written should have no history")
+}
+
+func TestOutbox(t *testing.T) {
+	ctx := context.Background()
+	dao, path := newTestDao(t)
+	defer func() { dao.Close() }()
+	before, err := dao.Create(ctx, newUser(0))
+	require.Nil(t, err, "should not have error when create user")
+	require.Nil(t, dao.EnableOutbox(ctx), "should not have error when enabling outbox")
+	id, err := dao.Create(ctx, newUser(1))
+	require.Nil(t, err, "should not have error when create user")
+	require.Nil(t, dao.Patch(ctx, id, map[string]interface{}{"address": "Kent Ridge"}), "should not have err when patch user")
+	require.Nil(t, dao.Delete(ctx, id), "should not have err when delete user")
+
+	records, err := dao.ReadOutbox(ctx, 0, 10)
+	require.Nil(t, err, "should not have err when reading outbox")
+	require.Len(t, records, 3, "writes should be in the outbox once enabled")
+	for i, record := range records {
+		assert.EqualValues(t, i+1, record.Offset, "offsets should follow the writes")
+		assert.NotEqual(t, before, record.UserID, "writes before enabling should not be in the outbox")
+	}
+	assert.Equal(t, models.ChangePatch, records[1].Operation, "record should carry the change")
+	assert.Equal(t, "Kent Ridge", records[1].After.Address, "record should carry the written user")
+
+	records, err = dao.ReadOutbox(ctx, 1, 1)
+	require.Nil(t, err, "should not have err when reading outbox")
+	require.Len(t, records, 1, "should read up to the limit")
+	assert.EqualValues(t, 2, records[0].Offset, "should read after the offset")
+
+	require.Nil(t, dao.TrimOutbox(ctx, 2), "should not have err when trimming outbox")
+	records, err = dao.ReadOutbox(ctx, 0, 10)
+	require.Nil(t, err, "should not have err when reading outbox")
+	require.Len(t, records, 1, "trimmed records should be gone")
+	assert.EqualValues(t, 3, records[0].Offset, "later records should be kept")
+
+	require.Nil(t, dao.Close(), "should not have error when closing")
+	dao, err = NewDao(ctx, path)
+	require.Nil(t, err, "should not have error when reopening")
+	require.Nil(t, dao.EnableOutbox(ctx), "should not have error when enabling outbox")
+	require.Nil(t, dao.Restore(ctx, id), "should not have err when restoring")
+	records, err = dao.ReadOutbox(ctx, 3, 10)
+	require.Nil(t, err, "should not have err when reading outbox")
+	require.Len(t, records, 1, "outbox should survive restarts")
+	assert.EqualValues(t, 4, records[0].Offset, "offsets should survive restarts")
+}
+
+func TestOutboxLease(t *testing.T) {
+	ctx := context.Background()
+	dao, _ := newTestDao(t)
+	defer dao.Close()
+	committed, err := dao.ClaimOutbox(ctx, "relay a", time.Hour)
+	require.Nil(t, err, "should not have error when claiming the outbox")
+	assert.EqualValues(t, 0, committed, "nothing should be committed yet")
+	require.Nil(t, dao.CommitOutbox(ctx, "relay a", 3, time.Hour), "should not have error when committing")
+	_, err = dao.ClaimOutbox(ctx, "relay b", time.Hour)
+	assert.Equal(t, interfaces.ErrOutboxLeased, err, "another relay should wait for the lease")
+	assert.Equal(t, interfaces.ErrOutboxLeased, dao.CommitOutbox(ctx, "relay b", 4, time.Hour), "only the holder should commit")
+
+	// a commit that lets the lease run out, as a stopped relay's does
+	require.Nil(t, dao.CommitOutbox(ctx, "relay a", 3, -time.Second), "should not have error when committing")
+	committed, err = dao.ClaimOutbox(ctx, "relay b", time.Hour)
+	require.Nil(t, err, "a lease that ran out should be taken over")
+	assert.EqualValues(t, 3, committed, "should carry on from the committed offset")
+	assert.Equal(t, interfaces.ErrOutboxLeased, dao.CommitOutbox(ctx, "relay a", 5, time.Hour), "a lost lease should not commit")
+}
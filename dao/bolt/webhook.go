@@ -0,0 +1,356 @@
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+
+	"github.com/metildachee/userie/dao/interfaces"
+	"github.com/metildachee/userie/models"
+	"github.com/metildachee/userie/webhook"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+	bbolt "go.etcd.io/bbolt"
+)
+
+var (
+	// webhooksBucket holds the webhooks, keyed by id.
+	webhooksBucket = []byte("webhooks")
+	// deliveriesBucket holds the delivery logs, keyed by webhook id, a zero
+	// byte and a sequence in big endian, so a webhook's attempts sit together
+	// in the order they were made.
+	deliveriesBucket = []byte("webhook_deliveries")
+	// deadLettersBucket holds the dead letters, keyed like the deliveries.
+	deadLettersBucket = []byte("webhook_dead_letters")
+	// pendingBucket holds the events the webhooks have yet to take, keyed by
+	// id.
+	pendingBucket = []byte("webhook_pending")
+)
+
+var _ webhook.Storage = (*UserImplDao)(nil)
+
+// WebhookStore keeps the webhooks in the bolt file, next to the users.
+type WebhookStore struct {
+	db *bbolt.DB
+}
+
+var _ webhook.Store = (*WebhookStore)(nil)
+
+func (dao *UserImplDao) WebhookStore(ctx context.Context) (webhook.Store, error) {
+	return &WebhookStore{db: dao.db}, nil
+}
+
+func hookPrefix(id string) []byte {
+	return []byte(id + "\x00")
+}
+
+// hookExists fails with interfaces.ErrNotFound when the webhook id is unknown.
+func hookExists(tx *bbolt.Tx, id string) error {
+	if tx.Bucket(webhooksBucket).Get([]byte(id)) == nil {
+		return interfaces.ErrNotFound
+	}
+	return nil
+}
+
+// appendLog adds doc to the log of the webhook id in bucket.
+func appendLog(tx *bbolt.Tx, bucket []byte, id string, doc interface{}) error {
+	if err := hookExists(tx, id); err != nil {
+		return err
+	}
+	b := tx.Bucket(bucket)
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return b.Put(append(hookPrefix(id), offsetKey(seq)...), value)
+}
+
+// logKeys returns the keys of the webhook id's log in bucket, the oldest
+// first.
+func logKeys(tx *bbolt.Tx, bucket []byte, id string) [][]byte {
+	var keys [][]byte
+	prefix := hookPrefix(id)
+	c := tx.Bucket(bucket).Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		keys = append(keys, append([]byte(nil), k...))
+	}
+	return keys
+}
+
+// readLog decodes a page of the webhook id's log in bucket, the latest first,
+// with decode.
+func readLog(tx *bbolt.Tx, bucket []byte, id string, limit, offset int, decode func(doc []byte) error) error {
+	if err := hookExists(tx, id); err != nil {
+		return err
+	}
+	keys := logKeys(tx, bucket, id)
+	b := tx.Bucket(bucket)
+	for i := len(keys) - 1 - offset; i >= 0 && limit > 0; i, limit = i-1, limit-1 {
+		if err := decode(b.Get(keys[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *WebhookStore) Create(ctx context.Context, h models.Webhook) (models.Webhook, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "bolt create webhook")
+	defer span.Finish()
+
+	id, err := webhook.NewID()
+	if err != nil {
+		ext.LogError(span, err)
+		return h, err
+	}
+	h.ID = id
+	doc, err := json.Marshal(h)
+	if err != nil {
+		ext.LogError(span, err)
+		return h, err
+	}
+	err = s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(webhooksBucket).Put([]byte(id), doc)
+	})
+	if err != nil {
+		ext.LogError(span, err)
+	}
+	span.LogFields(log.String("webhook_id", id))
+	return h, err
+}
+
+func (s *WebhookStore) Get(ctx context.Context, id string) (h models.Webhook, err error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "bolt get webhook")
+	defer span.Finish()
+
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		doc := tx.Bucket(webhooksBucket).Get([]byte(id))
+		if doc == nil {
+			return interfaces.ErrNotFound
+		}
+		return json.Unmarshal(doc, &h)
+	})
+	return
+}
+
+func (s *WebhookStore) List(ctx context.Context) (hooks []models.Webhook, err error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "bolt list webhooks")
+	defer span.Finish()
+
+	hooks = []models.Webhook{}
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(webhooksBucket).ForEach(func(k, v []byte) error {
+			var h models.Webhook
+			if err := json.Unmarshal(v, &h); err != nil {
+				return err
+			}
+			hooks = append(hooks, h)
+			return nil
+		})
+	})
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	webhook.SortWebhooks(hooks)
+	return
+}
+
+func (s *WebhookStore) Update(ctx context.Context, h models.Webhook) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "bolt update webhook")
+	defer span.Finish()
+
+	doc, err := json.Marshal(h)
+	if err != nil {
+		ext.LogError(span, err)
+		return err
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		if err := hookExists(tx, h.ID); err != nil {
+			return err
+		}
+		return tx.Bucket(webhooksBucket).Put([]byte(h.ID), doc)
+	})
+}
+
+func (s *WebhookStore) Delete(ctx context.Context, id string) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "bolt delete webhook")
+	defer span.Finish()
+
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		if err := hookExists(tx, id); err != nil {
+			return err
+		}
+		for _, bucket := range [][]byte{deliveriesBucket, deadLettersBucket} {
+			for _, k := range logKeys(tx, bucket, id) {
+				if err := tx.Bucket(bucket).Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+		b := tx.Bucket(pendingBucket)
+		var pending [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			var p models.WebhookPending
+			if err := json.Unmarshal(v, &p); err != nil {
+				return err
+			}
+			if p.WebhookID == id {
+				pending = append(pending, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range pending {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(webhooksBucket).Delete([]byte(id))
+	})
+}
+
+// AddDelivery logs the attempt and forgets the webhook's oldest attempts past
+// webhook.MaxDeliveries.
+func (s *WebhookStore) AddDelivery(ctx context.Context, d models.WebhookDelivery) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "bolt add webhook delivery")
+	defer span.Finish()
+
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		if err := appendLog(tx, deliveriesBucket, d.WebhookID, d); err != nil {
+			return err
+		}
+		keys := logKeys(tx, deliveriesBucket, d.WebhookID)
+		for len(keys) > webhook.MaxDeliveries {
+			if err := tx.Bucket(deliveriesBucket).Delete(keys[0]); err != nil {
+				return err
+			}
+			keys = keys[1:]
+		}
+		return nil
+	})
+}
+
+func (s *WebhookStore) GetDeliveries(ctx context.Context, id string, limit, offset int) (deliveries []models.WebhookDelivery, err error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "bolt get webhook deliveries")
+	defer span.Finish()
+
+	deliveries = []models.WebhookDelivery{}
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		return readLog(tx, deliveriesBucket, id, limit, offset, func(doc []byte) error {
+			var d models.WebhookDelivery
+			if err := json.Unmarshal(doc, &d); err != nil {
+				return err
+			}
+			deliveries = append(deliveries, d)
+			return nil
+		})
+	})
+	return
+}
+
+func (s *WebhookStore) AddDeadLetter(ctx context.Context, l models.WebhookDeadLetter) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "bolt add webhook dead letter")
+	defer span.Finish()
+
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return appendLog(tx, deadLettersBucket, l.WebhookID, l)
+	})
+}
+
+func (s *WebhookStore) GetDeadLetters(ctx context.Context, id string, limit, offset int) (letters []models.WebhookDeadLetter, err error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "bolt get webhook dead letters")
+	defer span.Finish()
+
+	letters = []models.WebhookDeadLetter{}
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		return readLog(tx, deadLettersBucket, id, limit, offset, func(doc []byte) error {
+			var l models.WebhookDeadLetter
+			if err := json.Unmarshal(doc, &l); err != nil {
+				return err
+			}
+			letters = append(letters, l)
+			return nil
+		})
+	})
+	return
+}
+
+func (s *WebhookStore) TakeDeadLetter(ctx context.Context, id, letterID string) (letter models.WebhookDeadLetter, err error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "bolt take webhook dead letter")
+	defer span.Finish()
+
+	err = s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(deadLettersBucket)
+		for _, k := range logKeys(tx, deadLettersBucket, id) {
+			var l models.WebhookDeadLetter
+			if err := json.Unmarshal(b.Get(k), &l); err != nil {
+				return err
+			}
+			if l.ID == letterID {
+				letter = l
+				return b.Delete(k)
+			}
+		}
+		return interfaces.ErrNotFound
+	})
+	return
+}
+
+func (s *WebhookStore) AddPending(ctx context.Context, p models.WebhookPending) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "bolt add webhook pending")
+	defer span.Finish()
+
+	doc, err := json.Marshal(p)
+	if err != nil {
+		ext.LogError(span, err)
+		return err
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		if err := hookExists(tx, p.WebhookID); err != nil {
+			return err
+		}
+		return tx.Bucket(pendingBucket).Put([]byte(p.ID), doc)
+	})
+}
+
+func (s *WebhookStore) ListPending(ctx context.Context, limit int) (pending []models.WebhookPending, err error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "bolt list webhook pending")
+	defer span.Finish()
+
+	pending = []models.WebhookPending{}
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(pendingBucket).ForEach(func(k, v []byte) error {
+			var p models.WebhookPending
+			if err := json.Unmarshal(v, &p); err != nil {
+				return err
+			}
+			pending = append(pending, p)
+			return nil
+		})
+	})
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	webhook.SortPending(pending)
+	if len(pending) > limit {
+		pending = pending[:limit]
+	}
+	return
+}
+
+func (s *WebhookStore) RemovePending(ctx context.Context, id string) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "bolt remove webhook pending")
+	defer span.Finish()
+
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(pendingBucket).Delete([]byte(id))
+	})
+}
@@ -0,0 +1,28 @@
+package bolt
+
+import (
+	"context"
+	"testing"
+
+	"github.com/metildachee/userie/webhook/storetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookStore(t *testing.T) {
+	ctx := context.Background()
+	dao, path := newTestDao(t)
+	store, err := dao.WebhookStore(ctx)
+	require.Nil(t, err, "should not have error when opening the webhook store")
+	storetest.Run(t, store)
+	require.Nil(t, dao.Close(), "should not have error when closing")
+
+	dao, err = NewDao(ctx, path)
+	require.Nil(t, err, "should not have error when reopening")
+	defer dao.Close()
+	store, err = dao.WebhookStore(ctx)
+	require.Nil(t, err, "should not have error when opening the webhook store")
+	hooks, err := store.List(ctx)
+	assert.Nil(t, err, "should not have error when listing webhooks")
+	assert.Len(t, hooks, 1, "webhooks should survive restarts")
+}
@@ -0,0 +1,282 @@
+package elasticsearch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/google/logger"
+	elasticv7 "github.com/olivere/elastic/v7"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+const (
+	// maxCatchUpPasses bounds how often reindex copies writes that landed on
+	// the old index while the previous pass ran.
+	maxCatchUpPasses = 5
+	reconcileBatch   = 1000
+)
+
+// The dao reads and writes through the alias named by cluster_name. The alias
+// points at one versioned index, <alias><generation>, e.g. usersg0.
+func indexName(alias string, generation int) string {
+	return alias + strconv.Itoa(generation)
+}
+
+func generationOf(alias, index string) (int, error) {
+	generation, err := strconv.Atoi(strings.TrimPrefix(index, alias))
+	if err != nil || !strings.HasPrefix(index, alias) || generation < 0 {
+		return 0, fmt.Errorf("index %s is not a generation of alias %s", index, alias)
+	}
+	return generation, nil
+}
+
+// backingIndices lists the indices the alias points at.
+func (dao *UserImplDao) backingIndices(ctx context.Context) ([]string, error) {
+	res, err := dao.cli.Aliases().Alias(dao.cluster).Do(ctx)
+	if elasticv7.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res.IndicesByAlias(dao.cluster), nil
+}
+
+// currentIndex returns the single index behind the alias.
+func (dao *UserImplDao) currentIndex(ctx context.Context) (string, error) {
+	indices, err := dao.backingIndices(ctx)
+	if err != nil {
+		return "", err
+	}
+	if len(indices) != 1 {
+		return "", fmt.Errorf("alias %s points at %d indices, expected 1", dao.cluster, len(indices))
+	}
+	return indices[0], nil
+}
+
+// ensureAlias makes sure the alias exists. An index left from before aliases
+// were used, <alias>0, is adopted; otherwise <alias>0 is created. A concrete
+// index named like the alias is left alone, it just cannot be reindexed.
+func (dao *UserImplDao) ensureAlias(ctx context.Context) error {
+	indices, err := dao.backingIndices(ctx)
+	if err != nil || len(indices) > 0 {
+		return err
+	}
+	if exists, err := dao.cli.IndexExists(dao.cluster).Do(ctx); err != nil || exists {
+		if exists {
+			logger.Warningf("%s is an index rather than an alias, it cannot be reindexed without downtime", dao.cluster)
+		}
+		return err
+	}
+
+	first := indexName(dao.cluster, 0)
+	exists, err := dao.cli.IndexExists(first).Do(ctx)
+	if err != nil {
+		return err
+	}
+	if exists {
+		_, err = dao.cli.Alias().
+			Action(elasticv7.NewAliasAddAction(dao.cluster).Index(first).IsWriteIndex(true)).
+			Do(ctx)
+		logger.Infof("pointed alias %s at existing index %s", dao.cluster, first)
+		return err
+	}
+	if _, err = dao.cli.CreateIndex(first).BodyJson(indexBody(dao.cluster)).Do(ctx); err != nil {
+		return err
+	}
+	logger.Infof("created index %s behind alias %s with mapping version %d", first, dao.cluster, MappingVersion)
+	return nil
+}
+
+// swapAlias moves the alias from one index to another in a single atomic
+// request, so readers and writers never see it missing.
+func (dao *UserImplDao) swapAlias(ctx context.Context, from, to string) error {
+	_, err := dao.cli.Alias().
+		Action(
+			elasticv7.NewAliasRemoveAction(dao.cluster).Index(from),
+			elasticv7.NewAliasAddAction(dao.cluster).Index(to).IsWriteIndex(true),
+		).
+		Do(ctx)
+	return err
+}
+
+type ReindexReport struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Copied   int64  `json:"copied"`
+	CaughtUp int64  `json:"caught_up"`
+	Deleted  int64  `json:"deleted"`
+}
+
+// Reindex copies the index behind the alias into the next generation with the
+// current mapping and swaps the alias over, without taking the api down:
+//
+//  1. the next generation is created and every document is copied with the
+//     Reindex API, keeping each document's version
+//  2. writes made meanwhile are caught up by copying again, documents only
+//     overwrite their copy when their version is newer
+//  3. the copies are listed, the alias is swapped atomically and the old
+//     index gets no more writes
+//  4. a last pass copies writes that reached the old index just before the
+//     swap, and the listed copies of documents deleted from the old index
+//     are removed; documents written to the new index after the swap were
+//     not listed and are left alone
+//
+// The old index is kept so Rollback can point the alias back at it.
+func (dao *UserImplDao) Reindex(ctx context.Context) (report ReindexReport, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "es reindex")
+	defer span.Finish()
+
+	if report.From, err = dao.currentIndex(ctx); err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	generation, err := generationOf(dao.cluster, report.From)
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	report.To = indexName(dao.cluster, generation+1)
+	span.LogFields(log.String("from", report.From), log.String("to", report.To))
+
+	if _, err = dao.cli.CreateIndex(report.To).BodyJson(indexBody("")).Do(ctx); err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	if report.Copied, err = dao.copyNewer(ctx, report.From, report.To); err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	logger.Infof("copied %d users from %s to %s", report.Copied, report.From, report.To)
+
+	for pass := 0; pass < maxCatchUpPasses; pass++ {
+		changed, err := dao.copyNewer(ctx, report.From, report.To)
+		if err != nil {
+			ext.LogError(span, err)
+			return report, err
+		}
+		report.CaughtUp += changed
+		if changed == 0 {
+			break
+		}
+	}
+	copies := dao.cli.Scroll(report.To).FetchSource(false).Size(reconcileBatch)
+	defer copies.Clear(context.Background())
+	listed, err := copies.Do(ctx)
+	if err != nil && err != io.EOF {
+		ext.LogError(span, err)
+		return
+	}
+
+	if err = dao.swapAlias(ctx, report.From, report.To); err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	logger.Infof("alias %s now points at %s, %s is kept for rollback", dao.cluster, report.To, report.From)
+
+	changed, err := dao.copyNewer(ctx, report.From, report.To)
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	report.CaughtUp += changed
+	if listed != nil {
+		if report.Deleted, err = dao.removeDeleted(ctx, copies, listed, report.From, report.To); err != nil {
+			ext.LogError(span, err)
+			return
+		}
+	}
+	span.LogFields(
+		log.Int64("copied", report.Copied),
+		log.Int64("caught up", report.CaughtUp),
+		log.Int64("deleted", report.Deleted))
+	return
+}
+
+// copyNewer copies documents whose version is newer than their copy, or that
+// have no copy yet, and returns how many were written.
+func (dao *UserImplDao) copyNewer(ctx context.Context, from, to string) (int64, error) {
+	res, err := dao.cli.Reindex().
+		Source(elasticv7.NewReindexSource().Index(from)).
+		Destination(elasticv7.NewReindexDestination().Index(to).VersionType("external")).
+		ProceedOnVersionConflict().
+		Refresh("true").
+		WaitForCompletion(true).
+		Do(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if len(res.Failures) > 0 {
+		return 0, fmt.Errorf("reindex from %s to %s had %d failures", from, to, len(res.Failures))
+	}
+	return res.Created + res.Updated, nil
+}
+
+// removeDeleted deletes the documents of to that scroll lists, starting with
+// res, when they no longer exist in from. The scroll sees to as it was when
+// it was opened.
+func (dao *UserImplDao) removeDeleted(ctx context.Context, scroll *elasticv7.ScrollService, res *elasticv7.SearchResult,
+	from, to string) (deleted int64, err error) {
+	for ; ; res, err = scroll.Do(ctx) {
+		if err == io.EOF {
+			return deleted, nil
+		}
+		if err != nil {
+			return deleted, err
+		}
+
+		mget := dao.cli.MultiGet()
+		for _, hit := range res.Hits.Hits {
+			mget.Add(elasticv7.NewMultiGetItem().Index(from).Id(hit.Id).FetchSource(elasticv7.NewFetchSourceContext(false)))
+		}
+		docs, err := mget.Do(ctx)
+		if err != nil {
+			return deleted, err
+		}
+		bulk := dao.cli.Bulk().Index(to)
+		for _, doc := range docs.Docs {
+			if !doc.Found {
+				bulk.Add(elasticv7.NewBulkDeleteRequest().Id(doc.Id))
+			}
+		}
+		if bulk.NumberOfActions() == 0 {
+			continue
+		}
+		removed, err := bulk.Refresh("true").Do(ctx)
+		if err != nil {
+			return deleted, err
+		}
+		deleted += int64(len(removed.Succeeded()))
+	}
+}
+
+// Rollback points the alias back at the previous generation, which Reindex
+// keeps. Writes made since the reindex are not carried back.
+func (dao *UserImplDao) Rollback(ctx context.Context) (previous string, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "es rollback index")
+	defer span.Finish()
+
+	current, err := dao.currentIndex(ctx)
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	generation, err := generationOf(dao.cluster, current)
+	if err != nil || generation == 0 {
+		err = fmt.Errorf("index %s has no previous generation", current)
+		ext.LogError(span, err)
+		return
+	}
+	previous = indexName(dao.cluster, generation-1)
+	if err = dao.swapAlias(ctx, current, previous); err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	logger.Infof("alias %s now points back at %s", dao.cluster, previous)
+	return
+}
@@ -0,0 +1,59 @@
+package elasticsearch
+
+import (
+	"context"
+	"testing"
+
+	"github.com/metildachee/userie/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerationOf(t *testing.T) {
+	generation, err := generationOf("usersg", "usersg0")
+	assert.Nil(t, err, "should parse first generation")
+	assert.Equal(t, 0, generation)
+
+	generation, err = generationOf("usersg", indexName("usersg", 12))
+	assert.Nil(t, err, "should parse generation from index name")
+	assert.Equal(t, 12, generation)
+
+	for _, index := range []string{"usersg", "usersgx", "other1", "usersg-1"} {
+		_, err = generationOf("usersg", index)
+		assert.NotNil(t, err, "should reject "+index)
+	}
+}
+
+func TestReindexAndRollback(t *testing.T) {
+	setup()
+	ctx := context.Background()
+	dao, err := NewDao(ctx)
+	require.Nil(t, err, "should not have error when init")
+	dao.cluster = "usersg_reindex_test"
+	defer dao.cli.DeleteIndex(dao.cluster + "*").Do(ctx)
+	require.Nil(t, dao.EnsureIndex(ctx), "should create the alias")
+
+	id, err := dao.Create(ctx, models.User{Name: "reindex me", Ctime: 1})
+	require.Nil(t, err, "should not have error when creating user")
+	gone, err := dao.Create(ctx, models.User{Name: "delete me", Ctime: 1})
+	require.Nil(t, err, "should not have error when creating user")
+	require.Nil(t, dao.Delete(ctx, gone), "should not have error when deleting user")
+
+	report, err := dao.Reindex(ctx)
+	require.Nil(t, err, "should not have error when reindexing")
+	assert.Equal(t, indexName(dao.cluster, 0), report.From)
+	assert.Equal(t, indexName(dao.cluster, 1), report.To)
+
+	current, err := dao.currentIndex(ctx)
+	assert.Nil(t, err, "alias should point at one index")
+	assert.Equal(t, report.To, current, "alias should point at the new index")
+	user, err := dao.GetById(ctx, id)
+	assert.Nil(t, err, "user should be readable through the alias")
+	assert.Equal(t, "reindex me", user.Name)
+	_, err = dao.GetById(ctx, gone)
+	assert.NotNil(t, err, "deleted user should stay deleted")
+
+	previous, err := dao.Rollback(ctx)
+	assert.Nil(t, err, "should not have error when rolling back")
+	assert.Equal(t, report.From, previous, "should roll back to the old index")
+}
@@ -0,0 +1,125 @@
+package elasticsearch
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/google/logger"
+	"github.com/metildachee/userie/models"
+	elasticv7 "github.com/olivere/elastic/v7"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+const (
+	// bulkChunkSize bounds how many users go into one _bulk request.
+	bulkChunkSize = 500
+)
+
+// BulkCreate creates the users with the _bulk API, bulkChunkSize at a time,
+// and returns a result for every user. The error is only set when a whole
+// chunk could not be sent; users of later chunks are then left without a
+// result.
+func (dao *UserImplDao) BulkCreate(ctx context.Context, users []models.User) (results []models.BulkItemResult, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "es bulk create")
+	defer span.Finish()
+
+	results = make([]models.BulkItemResult, len(users))
+	failed := 0
+	for start := 0; start < len(users); start += bulkChunkSize {
+		end := start + bulkChunkSize
+		if end > len(users) {
+			end = len(users)
+		}
+		if err = dao.bulkCreateChunk(ctx, users[start:end], results[start:end]); err != nil {
+			ext.LogError(span, err)
+			return
+		}
+	}
+	for _, result := range results {
+		if result.Error != "" {
+			failed++
+		}
+	}
+	span.LogFields(log.Int("users", len(users)), log.Int("failed", failed))
+	return
+}
+
+// bulkCreateChunk writes one chunk, fills in its results and records the
+// created users in their history. Users whose
+// generated id turns out to be taken are sent again with a fresh id.
+func (dao *UserImplDao) bulkCreateChunk(ctx context.Context, users []models.User, results []models.BulkItemResult) error {
+	span := opentracing.SpanFromContext(ctx)
+	pending := make([]int, len(users))
+	kept := make([]pendingChange, len(users))
+	for i := range pending {
+		pending[i] = i
+		change, err := newPendingChange(ctx, models.ChangeCreate, nil)
+		if err != nil {
+			return err
+		}
+		kept[i] = change
+	}
+	for attempt := 0; len(pending) > 0 && attempt < maxIdAttempts; attempt++ {
+		// wait_for makes the users searchable without forcing a refresh
+		bulk := dao.cli.Bulk().Index(dao.cluster).Refresh("wait_for")
+		ids, err := dao.ids.NextIds(ctx, len(pending))
+		if err != nil {
+			return err
+		}
+		for n, i := range pending {
+			u, id := users[i], ids[n]
+			// create refuses to overwrite, like a single create
+			if u.ID = id; id != "" {
+				bulk.Add(elasticv7.NewBulkCreateRequest().Id(id).Doc(kept[i].stored(u)))
+			} else {
+				bulk.Add(elasticv7.NewBulkIndexRequest().Doc(kept[i].stored(u)))
+			}
+		}
+		res, err := bulk.Do(ctx)
+		if err != nil {
+			return err
+		}
+
+		var retry []int
+		var changes []models.Change
+		for n, item := range res.Items {
+			i := pending[n]
+			for _, r := range item {
+				if r.Status == http.StatusConflict {
+					retry = append(retry, i)
+					continue
+				}
+				results[i] = models.BulkItemResult{ID: r.Id, Status: r.Status}
+				if r.Error != nil {
+					results[i].ID = ""
+					results[i].Error = r.Error.Reason
+					continue
+				}
+				created := users[i]
+				change, err := kept[i].complete(r.Id, formatVersion(r.SeqNo, r.PrimaryTerm), &created)
+				if err != nil {
+					ext.LogError(span, err)
+					continue
+				}
+				changes = append(changes, change)
+			}
+		}
+		// the changes are kept with the users, the next write to them or the
+		// sweep records what fails here
+		if err := dao.recordChanges(ctx, changes); err != nil {
+			ext.LogError(span, err)
+			logger.Errorf("recording %d created users failed: %v", len(changes), err)
+		}
+		pending = retry
+	}
+	for _, i := range pending {
+		results[i] = models.BulkItemResult{
+			Status: http.StatusConflict,
+			Error:  fmt.Sprintf("no free id after %d attempts", maxIdAttempts),
+		}
+	}
+	return nil
+}
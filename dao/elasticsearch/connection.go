@@ -25,6 +25,10 @@ func NewDao(ctx context.Context) (*UserImplDao, error) {
 	dao := &UserImplDao{}
 	dao.cli = es
 	dao.cluster = config.GetClusterName()
+	if dao.ids, err = NewIdGenerator(config.GetIdGenerator(), es, dao.cluster); err != nil {
+		ext.LogError(span, err)
+		return nil, err
+	}
 	span.LogKV("es client init successfully")
 	return dao, nil
 }
@@ -35,7 +39,7 @@ func (dao *UserImplDao) CheckInit(ctx context.Context) bool {
 
 	if dao.cli == nil {
 		ext.LogError(span, errors.New("es client does not exist"))
-		logger.Fatalf("es client does not exist, exiting")
+		logger.Error("es client does not exist")
 		return false
 	}
 	exists, err := dao.cli.IndexExists(dao.cluster).Do(ctx)
@@ -45,7 +49,7 @@ func (dao *UserImplDao) CheckInit(ctx context.Context) bool {
 	}
 	if !exists {
 		ext.LogError(span, errors.New("index does not exists"))
-		logger.Fatalf("index does not exists, exiting")
+		logger.Errorf("index %s does not exists, run init-index to create it", dao.cluster)
 		return false
 	}
 	span.LogKV("es client is ok")
@@ -0,0 +1,47 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+
+	"github.com/metildachee/userie/dao/interfaces"
+	"github.com/metildachee/userie/models"
+)
+
+const (
+	pitKeepAlive = "5m"
+)
+
+// cursor is the state behind an opaque next_cursor token. It pins the point in
+// time being walked, the sort values of the last hit returned and the filter
+// the walk was started with, so every page is read from the same snapshot in
+// the same order.
+type cursor struct {
+	PitId  string            `json:"pit"`
+	After  []interface{}     `json:"after,omitempty"`
+	Filter models.UserFilter `json:"filter"`
+}
+
+func (c cursor) encode() (string, error) {
+	raw, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+func decodeCursor(token string) (c cursor, err error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return c, interfaces.ErrInvalidCursor
+	}
+	// sort values are kept as json.Number so large tie breakers survive the
+	// round trip without losing precision
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err = decoder.Decode(&c); err != nil || c.PitId == "" {
+		return c, interfaces.ErrInvalidCursor
+	}
+	return c, nil
+}
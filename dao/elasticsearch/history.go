@@ -0,0 +1,207 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/google/logger"
+	"github.com/metildachee/userie/dao/interfaces"
+	"github.com/metildachee/userie/models"
+	elasticv7 "github.com/olivere/elastic/v7"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+const (
+	// maxWriteAttempts bounds how often an unconditional write is retried when
+	// another write to the user slips in between its read and its update.
+	maxWriteAttempts = 10
+)
+
+// historyMapping is the mapping of the history index. Diffs and snapshots are
+// kept in the source only, their fields change with the user's.
+var historyMapping = map[string]interface{}{
+	"properties": map[string]interface{}{
+		"id":        map[string]interface{}{"type": "keyword"},
+		"user_id":   map[string]interface{}{"type": "keyword"},
+		"operation": map[string]interface{}{"type": "keyword"},
+		"version":   map[string]interface{}{"type": "keyword"},
+		"actor":     map[string]interface{}{"type": "keyword"},
+		"timestamp": map[string]interface{}{"type": "date_nanos"},
+		"trace_id":  map[string]interface{}{"type": "keyword"},
+		"diff":      map[string]interface{}{"type": "object", "enabled": false},
+		"after":     map[string]interface{}{"type": "object", "enabled": false},
+	},
+}
+
+// historyIndex holds the changes to every user. It sits outside the alias, so
+// reindexing users leaves their history alone.
+func (dao *UserImplDao) historyIndex() string {
+	return dao.cluster + "_history"
+}
+
+func (dao *UserImplDao) ensureHistoryIndex(ctx context.Context) error {
+	exists, err := dao.cli.IndexExists(dao.historyIndex()).Do(ctx)
+	if err != nil || exists {
+		return err
+	}
+	_, err = dao.cli.CreateIndex(dao.historyIndex()).
+		BodyJson(map[string]interface{}{"settings": indexSettings, "mappings": historyMapping}).
+		Do(ctx)
+	if err == nil {
+		logger.Infof("created history index %s", dao.historyIndex())
+	}
+	return err
+}
+
+// getRaw reads the stored user, deleted or not, with its version.
+func (dao *UserImplDao) getRaw(ctx context.Context, id string) (user models.User, version string, err error) {
+	stored, version, err := dao.getStored(ctx, id)
+	return stored.User, version, err
+}
+
+// getStored reads the user document, with the changes it keeps, and its
+// version.
+func (dao *UserImplDao) getStored(ctx context.Context, id string) (stored storedUser, version string, err error) {
+	res, err := dao.cli.Get().
+		Index(dao.cluster).
+		Id(id).
+		Do(ctx)
+	if elasticv7.IsNotFound(err) {
+		return stored, "", interfaces.ErrNotFound
+	}
+	if err != nil {
+		return
+	}
+	if !res.Found || res.SeqNo == nil || res.PrimaryTerm == nil {
+		return stored, "", interfaces.ErrNotFound
+	}
+	if err = json.Unmarshal(res.Source, &stored); err != nil {
+		return
+	}
+	if stored.ID == "" {
+		stored.ID = res.Id
+	}
+	return stored, formatVersion(*res.SeqNo, *res.PrimaryTerm), nil
+}
+
+// recordedUpdate runs the script source with params on the user id and
+// records the change as operation. The user is read first so the change can
+// show what it was, and the update is guarded by the version read. A
+// conditional write, with an expected version, fails when the user moved on;
+// an unconditional one reads again and retries.
+func (dao *UserImplDao) recordedUpdate(ctx context.Context, span opentracing.Span, operation, id, expected, source string,
+	params map[string]interface{}, refresh bool) (string, error) {
+	for attempt := 1; ; attempt++ {
+		stored, current, err := dao.getStored(ctx, id)
+		if err != nil {
+			return "", err
+		}
+		before := stored.User
+		// only restores act on deleted users
+		if (before.DeletedAt != 0) != (operation == models.ChangeRestore) {
+			return "", interfaces.ErrNotFound
+		}
+		if expected != "" && current != expected {
+			return "", interfaces.ErrVersionConflict
+		}
+		seqNo, primaryTerm, err := parseVersion(current)
+		if err != nil {
+			return "", err
+		}
+		// the write replaces the changes kept in the user
+		if err := dao.settle(ctx, id, current, stored); err != nil {
+			return "", err
+		}
+		var change pendingChange
+		if operation == models.ChangeRestore {
+			change, err = newPendingChange(ctx, operation, nil)
+		} else {
+			change, err = newPendingChange(ctx, operation, &before)
+		}
+		if err != nil {
+			return "", err
+		}
+		update := dao.updateLive(id, change.keeping(source, params)).
+			IfSeqNo(seqNo).
+			IfPrimaryTerm(primaryTerm).
+			FetchSource(true)
+		if refresh {
+			update = update.Refresh("true")
+		}
+		res, err := updateResult(update.Do(ctx))
+		if errors.Is(err, interfaces.ErrVersionConflict) && expected == "" && attempt < maxWriteAttempts {
+			span.LogFields(log.Int("write conflict", attempt))
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		var after models.User
+		if res.GetResult != nil {
+			if err := json.Unmarshal(res.GetResult.Source, &after); err != nil {
+				return "", err
+			}
+		}
+		next := formatVersion(res.SeqNo, res.PrimaryTerm)
+		if operation == models.ChangeDelete {
+			dao.record(ctx, span, id, next, nil, change)
+		} else {
+			dao.record(ctx, span, id, next, &after, change)
+		}
+		return next, nil
+	}
+}
+
+// record records the change kept with the write that left the user id as
+// after, at version. The user and the change are written by then, a failure
+// to record it is only logged: the next write to the user, or the sweep,
+// records it.
+func (dao *UserImplDao) record(ctx context.Context, span opentracing.Span, id, version string, after *models.User, kept pendingChange) {
+	change, err := kept.complete(id, version, after)
+	if err == nil {
+		err = dao.recordChanges(ctx, []models.Change{change})
+	}
+	if err != nil {
+		ext.LogError(span, err)
+		logger.Errorf("recording %s of user %s failed: %v", kept.Operation, id, err)
+	}
+}
+
+func (dao *UserImplDao) GetHistory(ctx context.Context, id string, limit, offset int) (page models.HistoryPage, err error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "es get history")
+	defer span.Finish()
+	span.LogFields(log.String("doc id", id))
+
+	page.Changes = []models.Change{}
+	searchResult, err := dao.cli.Search().
+		Index(dao.historyIndex()).
+		Query(elasticv7.NewTermQuery("user_id", id)).
+		SortBy(elasticv7.NewFieldSort("timestamp").Desc(), elasticv7.NewFieldSort("id").Desc()).
+		TrackTotalHits(true).
+		From(offset).
+		Size(limit).
+		Do(ctx)
+	if elasticv7.IsNotFound(err) {
+		// nothing was recorded yet
+		return page, nil
+	}
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	page.Total = searchResult.TotalHits()
+	for _, hit := range searchResult.Hits.Hits {
+		var change models.Change
+		if err = json.Unmarshal(hit.Source, &change); err != nil {
+			ext.LogError(span, err)
+			return
+		}
+		page.Changes = append(page.Changes, change)
+	}
+	span.LogFields(log.Int64("total", page.Total))
+	return
+}
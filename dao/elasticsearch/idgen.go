@@ -0,0 +1,127 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/metildachee/userie/dao/internal/uuid"
+	"github.com/metildachee/userie/models"
+	elasticv7 "github.com/olivere/elastic/v7"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+const (
+	sequenceIndexSuffix = "_sequence"
+	sequenceRetries     = 10
+)
+
+// IdGenerator hands out ids for new users.
+type IdGenerator interface {
+	// NextId returns the id of the next user. An empty id lets Elasticsearch
+	// assign one when the document is indexed.
+	NextId(ctx context.Context) (string, error)
+	// NextIds returns the ids of the next n users, in one round trip where
+	// the generator needs one.
+	NextIds(ctx context.Context, n int) ([]string, error)
+}
+
+func NewIdGenerator(kind string, cli *elasticv7.Client, cluster string) (IdGenerator, error) {
+	switch kind {
+	case models.IdGeneratorAuto:
+		return AutoIdGenerator{}, nil
+	case models.IdGeneratorUUIDv7:
+		return UUIDv7Generator{}, nil
+	case models.IdGeneratorSequence:
+		return &SequenceIdGenerator{cli: cli, index: cluster + sequenceIndexSuffix, name: cluster}, nil
+	}
+	return nil, fmt.Errorf("unknown id generator %q", kind)
+}
+
+// AutoIdGenerator leaves id assignment to Elasticsearch.
+type AutoIdGenerator struct{}
+
+func (AutoIdGenerator) NextId(ctx context.Context) (string, error) {
+	return "", nil
+}
+
+func (AutoIdGenerator) NextIds(ctx context.Context, n int) ([]string, error) {
+	return make([]string, n), nil
+}
+
+// UUIDv7Generator generates time ordered RFC 9562 version 7 UUIDs.
+type UUIDv7Generator struct{}
+
+func (UUIDv7Generator) NextId(ctx context.Context) (string, error) {
+	return uuid.NewV7(time.Now())
+}
+
+func (g UUIDv7Generator) NextIds(ctx context.Context, n int) (ids []string, err error) {
+	ids = make([]string, n)
+	for i := range ids {
+		if ids[i], err = g.NextId(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+// SequenceIdGenerator keeps a counter document in Elasticsearch and bumps it
+// with a scripted update, which Elasticsearch applies atomically per document.
+// Ids therefore stay unique across restarts and across userie instances.
+type SequenceIdGenerator struct {
+	cli   *elasticv7.Client
+	index string
+	name  string
+}
+
+type sequenceDoc struct {
+	Value int64 `json:"value"`
+}
+
+func (g *SequenceIdGenerator) NextId(ctx context.Context) (string, error) {
+	ids, err := g.NextIds(ctx, 1)
+	if err != nil {
+		return "", err
+	}
+	return ids[0], nil
+}
+
+// NextIds reserves n ids with a single bump of the counter and hands them out
+// in order.
+func (g *SequenceIdGenerator) NextIds(ctx context.Context, n int) ([]string, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "es next sequence ids")
+	defer span.Finish()
+
+	if n <= 0 {
+		return nil, nil
+	}
+	res, err := g.cli.Update().
+		Index(g.index).
+		Id(g.name).
+		Script(elasticv7.NewScript("ctx._source.value += params.n").Param("n", n)).
+		Upsert(sequenceDoc{Value: int64(n)}).
+		RetryOnConflict(sequenceRetries).
+		FetchSource(true).
+		Do(ctx)
+	if err != nil {
+		ext.LogError(span, err)
+		return nil, err
+	}
+	if res.GetResult == nil {
+		return nil, fmt.Errorf("sequence %s returned no source", g.name)
+	}
+	var doc sequenceDoc
+	if err := json.Unmarshal(res.GetResult.Source, &doc); err != nil {
+		ext.LogError(span, err)
+		return nil, err
+	}
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = strconv.FormatInt(doc.Value-int64(n-1-i), 10)
+	}
+	return ids, nil
+}
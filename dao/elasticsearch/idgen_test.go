@@ -0,0 +1,76 @@
+package elasticsearch
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/metildachee/userie/dao/internal/uuid"
+	"github.com/metildachee/userie/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUUIDv7(t *testing.T) {
+	format := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	seen := map[string]bool{}
+	for i := 0; i < 1000; i++ {
+		id, err := UUIDv7Generator{}.NextId(context.Background())
+		require.Nil(t, err, "should not have error when generating id")
+		assert.Regexp(t, format, id, "should be a version 7 uuid")
+		assert.False(t, seen[id], "ids should not repeat")
+		seen[id] = true
+	}
+}
+
+func TestUUIDv7TimeOrdered(t *testing.T) {
+	now := time.Now()
+	earlier, err := uuid.NewV7(now)
+	require.Nil(t, err, "should not have error when generating id")
+	later, err := uuid.NewV7(now.Add(time.Millisecond))
+	require.Nil(t, err, "should not have error when generating id")
+	assert.Less(t, earlier, later, "later ids should sort after earlier ones")
+}
+
+func TestUUIDv7OrderedWithinMillisecond(t *testing.T) {
+	now := time.Now()
+	previous, err := uuid.NewV7(now)
+	require.Nil(t, err, "should not have error when generating id")
+	// more ids than the counter holds, and a clock going back
+	for i := 0; i < 5000; i++ {
+		id, err := uuid.NewV7(now.Add(-time.Duration(i%2) * time.Second))
+		require.Nil(t, err, "should not have error when generating id")
+		require.Less(t, previous, id, "ids of the same millisecond should sort in generation order")
+		previous = id
+	}
+}
+
+func TestUnknownIdGenerator(t *testing.T) {
+	_, err := NewIdGenerator("counter", nil, "usersg0")
+	assert.NotNil(t, err, "unknown generator should be rejected")
+}
+
+func TestSequenceIdGenerator(t *testing.T) {
+	setup()
+	ctx := context.Background()
+	dao, err := NewDao(ctx)
+	require.Nil(t, err, "should not have error when init")
+
+	ids, err := NewIdGenerator(models.IdGeneratorSequence, dao.cli, dao.cluster)
+	require.Nil(t, err, "should not have error when building generator")
+	first, err := ids.NextId(ctx)
+	require.Nil(t, err, "should not have error when generating id")
+	second, err := ids.NextId(ctx)
+	require.Nil(t, err, "should not have error when generating id")
+	assert.NotEqualValues(t, first, second, "sequence should not repeat")
+
+	reserved, err := ids.NextIds(ctx, 3)
+	require.Nil(t, err, "should not have error when reserving ids")
+	require.Len(t, reserved, 3, "should reserve every id asked for")
+	last, _ := strconv.ParseInt(second, 10, 64)
+	for i, id := range reserved {
+		assert.EqualValues(t, strconv.FormatInt(last+int64(i)+1, 10), id, "reserved ids should follow the sequence")
+	}
+}
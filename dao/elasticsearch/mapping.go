@@ -0,0 +1,182 @@
+package elasticsearch
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/logger"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+// MappingVersion is recorded in the index mapping's _meta. Bump it whenever
+// userFields or indexSettings change.
+const MappingVersion = 3
+
+type field struct {
+	Type   string
+	Fields map[string]field
+	// Disabled objects are kept in the source only
+	Disabled bool
+}
+
+func (f field) source() map[string]interface{} {
+	src := map[string]interface{}{"type": f.Type}
+	if f.Disabled {
+		src["enabled"] = false
+	}
+	if len(f.Fields) > 0 {
+		fields := map[string]interface{}{}
+		for name, sub := range f.Fields {
+			fields[name] = sub.source()
+		}
+		src["fields"] = fields
+	}
+	return src
+}
+
+// userFields is the mapping of the user index. Text fields that are sorted or
+// prefix matched carry a keyword sub-field. changes and changed_at hold the
+// changes of the latest write, see pendingChange.
+var userFields = map[string]field{
+	"id":          {Type: "keyword"},
+	"name":        {Type: "text", Fields: map[string]field{"keyword": {Type: "keyword"}}},
+	"dob":         {Type: "long"},
+	"address":     {Type: "text"},
+	"description": {Type: "text"},
+	"ctime":       {Type: "long"},
+	"deleted_at":  {Type: "long"},
+	"changes":     {Type: "object", Disabled: true},
+	"changed_at":  {Type: "long"},
+}
+
+var indexSettings = map[string]interface{}{
+	"number_of_shards": 1,
+}
+
+func mappingSource(fields map[string]field) map[string]interface{} {
+	properties := map[string]interface{}{}
+	for name, f := range fields {
+		properties[name] = f.source()
+	}
+	return map[string]interface{}{
+		"_meta":      map[string]interface{}{"version": MappingVersion},
+		"properties": properties,
+	}
+}
+
+// indexBody is the body that creates a user index. A non-empty alias is
+// attached to the new index as its write index.
+func indexBody(alias string) map[string]interface{} {
+	body := map[string]interface{}{
+		"settings": indexSettings,
+		"mappings": mappingSource(userFields),
+	}
+	if alias != "" {
+		body["aliases"] = map[string]interface{}{
+			alias: map[string]interface{}{"is_write_index": true},
+		}
+	}
+	return body
+}
+
+// MappingDriftError reports mapping differences that cannot be fixed in place,
+// such as a field indexed with a different type. They need a reindex.
+type MappingDriftError struct {
+	Index        string
+	Incompatible []string
+}
+
+func (e *MappingDriftError) Error() string {
+	return fmt.Sprintf("index %s has an incompatible mapping: %s", e.Index, strings.Join(e.Incompatible, "; "))
+}
+
+// EnsureIndex creates the user alias and its first index with the current
+// mapping, and the history index, when they do not exist. The index behind the alias is compared with
+// the mapping: missing fields are added in place and incompatible ones are
+// returned as a *MappingDriftError.
+func (dao *UserImplDao) EnsureIndex(ctx context.Context) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "es ensure index")
+	defer span.Finish()
+
+	if err := dao.ensureAlias(ctx); err != nil {
+		ext.LogError(span, err)
+		return err
+	}
+	if err := dao.ensureHistoryIndex(ctx); err != nil {
+		ext.LogError(span, err)
+		return err
+	}
+
+	mappings, err := dao.cli.GetMapping().Index(dao.cluster).Do(ctx)
+	if err != nil {
+		ext.LogError(span, err)
+		return err
+	}
+	for index, raw := range mappings {
+		mapping := asMap(asMap(raw)["mappings"])
+		additions, incompatible := diffFields(userFields, asMap(mapping["properties"]), "")
+		if len(incompatible) > 0 {
+			err := &MappingDriftError{Index: index, Incompatible: incompatible}
+			ext.LogError(span, err)
+			return err
+		}
+		if len(additions) == 0 && mappingVersion(mapping) >= MappingVersion {
+			continue
+		}
+		if _, err := dao.cli.PutMapping().Index(index).BodyJson(mappingSource(additions)).Do(ctx); err != nil {
+			ext.LogError(span, err)
+			return err
+		}
+		span.LogFields(log.String("updated mapping", index))
+		logger.Infof("updated mapping of index %s to version %d", index, MappingVersion)
+	}
+	return nil
+}
+
+// diffFields compares the expected fields with the properties of an existing
+// mapping. Missing fields and sub-fields can be added in place and are
+// returned as additions; type changes cannot and are described in
+// incompatible.
+func diffFields(expected map[string]field, actual map[string]interface{}, prefix string) (additions map[string]field, incompatible []string) {
+	additions = map[string]field{}
+	for name, f := range expected {
+		path := prefix + name
+		existing, ok := actual[name]
+		if !ok {
+			additions[name] = f
+			continue
+		}
+		// object fields carry properties but no type
+		found, _ := asMap(existing)["type"].(string)
+		if found == "" {
+			found = "object"
+		}
+		if found != f.Type {
+			incompatible = append(incompatible, fmt.Sprintf("%s: expected %s, found %s", path, f.Type, found))
+			continue
+		}
+		subAdditions, subIncompatible := diffFields(f.Fields, asMap(asMap(existing)["fields"]), path+".")
+		incompatible = append(incompatible, subIncompatible...)
+		if len(subAdditions) > 0 {
+			additions[name] = f
+		}
+	}
+	sort.Strings(incompatible)
+	return
+}
+
+func mappingVersion(mapping map[string]interface{}) int {
+	version, _ := asMap(mapping["_meta"])["version"].(float64)
+	return int(version)
+}
+
+func asMap(value interface{}) map[string]interface{} {
+	if m, ok := value.(map[string]interface{}); ok {
+		return m
+	}
+	return map[string]interface{}{}
+}
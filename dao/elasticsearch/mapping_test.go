@@ -0,0 +1,58 @@
+package elasticsearch
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffFieldsNoDrift(t *testing.T) {
+	actual := asMap(mappingSource(userFields)["properties"])
+	additions, incompatible := diffFields(userFields, actual, "")
+	assert.Empty(t, additions, "current mapping needs no additions")
+	assert.Empty(t, incompatible, "current mapping is compatible")
+}
+
+func TestDiffFieldsMissingFields(t *testing.T) {
+	// the mapping the README used to ask for, no id and no name.keyword
+	actual := map[string]interface{}{
+		"name":        map[string]interface{}{"type": "text"},
+		"dob":         map[string]interface{}{"type": "long"},
+		"address":     map[string]interface{}{"type": "text"},
+		"description": map[string]interface{}{"type": "text"},
+		"ctime":       map[string]interface{}{"type": "long"},
+		"deleted_at":  map[string]interface{}{"type": "long"},
+	}
+	additions, incompatible := diffFields(userFields, actual, "")
+	assert.Empty(t, incompatible, "missing fields can be added in place")
+	assert.Contains(t, additions, "id", "should add id")
+	assert.Contains(t, additions, "name", "should add the name keyword sub-field")
+	assert.Contains(t, additions, "changes", "should add the kept changes")
+	assert.Contains(t, additions, "changed_at", "should add the time of the kept changes")
+	assert.Len(t, additions, 4, "should only add what is missing")
+}
+
+func TestDiffFieldsIncompatible(t *testing.T) {
+	actual := asMap(mappingSource(userFields)["properties"])
+	actual["dob"] = map[string]interface{}{"type": "date"}
+	actual["name"] = map[string]interface{}{
+		"type":   "text",
+		"fields": map[string]interface{}{"keyword": map[string]interface{}{"type": "text"}},
+	}
+	_, incompatible := diffFields(userFields, actual, "")
+	assert.EqualValues(t, []string{
+		"dob: expected long, found date",
+		"name.keyword: expected keyword, found text",
+	}, incompatible, "should report every type change")
+}
+
+func TestEnsureIndex(t *testing.T) {
+	setup()
+	ctx := context.Background()
+	dao, err := NewDao(ctx)
+	require.Nil(t, err, "should not have error when init")
+	assert.Nil(t, dao.EnsureIndex(ctx), "should not have error when ensuring index")
+	assert.True(t, dao.CheckInit(ctx), "index should exist")
+}
@@ -0,0 +1,206 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/logger"
+	"github.com/metildachee/userie/dao/interfaces"
+	"github.com/metildachee/userie/models"
+	elasticv7 "github.com/olivere/elastic/v7"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+const (
+	// setFieldsScript copies params.fields onto each document.
+	setFieldsScript = `for (entry in params.fields.entrySet()) { ctx._source[entry.getKey()] = entry.getValue(); }`
+	// taskKindSeparator follows the kind of a by query task in the ids
+	// handed out. Deletes by query are updates too, Elasticsearch cannot tell
+	// them apart.
+	taskKindSeparator = ":"
+	// taskPollInterval is how often a by query task is checked for completion
+	// before its changes are recorded.
+	taskPollInterval = time.Second
+)
+
+var _ interfaces.MassOperator = (*UserImplDao)(nil)
+
+func (dao *UserImplDao) Count(ctx context.Context, filter models.UserFilter) (count int64, err error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "es count")
+	defer span.Finish()
+
+	if count, err = dao.cli.Count(dao.cluster).Query(buildListQuery(filter)).Do(ctx); err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	span.LogFields(log.Int64("count", count))
+	return
+}
+
+// StartDeleteByQuery runs _update_by_query as an Elasticsearch task, marking
+// the live users that match deleted like Delete does. Users that change while
+// it runs are skipped and counted as version conflicts.
+func (dao *UserImplDao) StartDeleteByQuery(ctx context.Context, filter models.UserFilter) (id string, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "es start delete by query")
+	defer span.Finish()
+
+	return dao.startByQuery(ctx, span, filter, models.TaskDeleteByQuery, models.ChangeDelete, markDeletedScript, softDeleteParams())
+}
+
+// StartUpdateByQuery runs _update_by_query as an Elasticsearch task.
+func (dao *UserImplDao) StartUpdateByQuery(ctx context.Context, filter models.UserFilter, fields map[string]interface{}) (id string, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "es start update by query")
+	defer span.Finish()
+
+	return dao.startByQuery(ctx, span, filter, models.TaskUpdateByQuery, models.ChangePatch, setFieldsScript, map[string]interface{}{"fields": fields})
+}
+
+// startByQuery starts an _update_by_query task running the script source over
+// the live users matching filter and returns its id, prefixed by kind. The
+// script keeps a change of operation in each user it writes, which are
+// recorded once the task completed.
+func (dao *UserImplDao) startByQuery(ctx context.Context, span opentracing.Span, filter models.UserFilter, kind, operation, source string,
+	params map[string]interface{}) (id string, err error) {
+	change, err := newPendingChange(ctx, operation, nil)
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	dao.startWatching(change.ID)
+	task, err := dao.cli.UpdateByQuery(dao.cluster).
+		Query(buildListQuery(filter)).
+		Script(change.appending(source, params)).
+		ProceedOnVersionConflict().
+		Refresh("true").
+		DoAsync(ctx)
+	if err != nil {
+		dao.stopWatching(change.ID)
+		ext.LogError(span, err)
+		return
+	}
+	id = kind + taskKindSeparator + task.TaskId
+	go dao.settleTask(id, change)
+	span.LogFields(log.String("task", id))
+	return id, nil
+}
+
+// settleTask waits for the by query task id to complete and records the
+// changes kept by the users written since it started. Changes it misses, when
+// the process stops first, are recorded by the next write to the user or by
+// the outbox sweep.
+func (dao *UserImplDao) settleTask(id string, change pendingChange) {
+	defer dao.stopWatching(change.ID)
+	ctx := context.Background()
+	for {
+		status, err := dao.GetTask(ctx, id)
+		if err != nil {
+			logger.Errorf("checking task %s failed: %v", id, err)
+			return
+		}
+		if status.Completed {
+			break
+		}
+		time.Sleep(taskPollInterval)
+	}
+	if _, err := dao.settleSince(ctx, change.Timestamp); err != nil {
+		logger.Errorf("recording the changes of task %s failed: %v", id, err)
+	}
+}
+
+func (dao *UserImplDao) WatchTasks(watch func(change models.Change)) {
+	dao.tasksMu.Lock()
+	defer dao.tasksMu.Unlock()
+	dao.watchTasks = watch
+}
+
+// startWatching hands the changes of the task keeping the change id to the
+// watcher until stopWatching, whichever write records them.
+func (dao *UserImplDao) startWatching(id string) {
+	dao.tasksMu.Lock()
+	defer dao.tasksMu.Unlock()
+	if dao.tasks == nil {
+		dao.tasks = map[string]bool{}
+	}
+	dao.tasks[id] = true
+}
+
+func (dao *UserImplDao) stopWatching(id string) {
+	dao.tasksMu.Lock()
+	defer dao.tasksMu.Unlock()
+	delete(dao.tasks, id)
+}
+
+// watchRecorded hands the recorded changes of running tasks to the watcher.
+// The tasks add the user id to the id of the change they keep.
+func (dao *UserImplDao) watchRecorded(changes []models.Change) {
+	dao.tasksMu.Lock()
+	defer dao.tasksMu.Unlock()
+	if dao.watchTasks == nil {
+		return
+	}
+	for _, change := range changes {
+		for task := range dao.tasks {
+			if strings.HasPrefix(change.ID, task+"-") {
+				dao.watchTasks(change)
+				break
+			}
+		}
+	}
+}
+
+// byQueryStatus is the part of a by query task's status that is reported.
+type byQueryStatus struct {
+	Total            int64 `json:"total"`
+	Updated          int64 `json:"updated"`
+	Deleted          int64 `json:"deleted"`
+	VersionConflicts int64 `json:"version_conflicts"`
+}
+
+func (dao *UserImplDao) GetTask(ctx context.Context, id string) (status models.TaskStatus, err error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "es get task")
+	defer span.Finish()
+	span.LogFields(log.String("task", id))
+
+	parts := strings.SplitN(id, taskKindSeparator, 2)
+	if len(parts) != 2 || (parts[0] != models.TaskDeleteByQuery && parts[0] != models.TaskUpdateByQuery) {
+		return status, interfaces.ErrNotFound
+	}
+	res, err := dao.cli.TasksGetTask().TaskId(parts[1]).Do(ctx)
+	// a malformed task id cannot name a task either
+	if elasticv7.IsNotFound(err) || elasticv7.IsStatusCode(err, http.StatusBadRequest) {
+		return status, interfaces.ErrNotFound
+	}
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+
+	status = models.TaskStatus{ID: id, Operation: parts[0], Completed: res.Completed}
+	if res.Error != nil {
+		status.Error = res.Error.Reason
+	}
+	if res.Task == nil {
+		return
+	}
+	doc, err := json.Marshal(res.Task.Status)
+	if err != nil {
+		return
+	}
+	var counts byQueryStatus
+	if err = json.Unmarshal(doc, &counts); err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	status.Total, status.Updated, status.Deleted, status.VersionConflicts =
+		counts.Total, counts.Updated, counts.Deleted, counts.VersionConflicts
+	// deletes by query are updates marking the users deleted
+	if status.Operation == models.TaskDeleteByQuery {
+		status.Updated, status.Deleted = 0, counts.Deleted+counts.Updated
+	}
+	return
+}
@@ -0,0 +1,74 @@
+package elasticsearch
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/metildachee/userie/dao/interfaces"
+	"github.com/metildachee/userie/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func waitForTask(t *testing.T, dao *UserImplDao, id string) models.TaskStatus {
+	ctx := context.Background()
+	for i := 0; i < 50; i++ {
+		status, err := dao.GetTask(ctx, id)
+		require.Nil(t, err, "should not have error when getting task")
+		if status.Completed {
+			return status
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatal("task did not complete")
+	return models.TaskStatus{}
+}
+
+func TestUpdateAndDeleteByQuery(t *testing.T) {
+	setup()
+	ctx := context.Background()
+	dao, err := NewDao(ctx)
+	require.Nil(t, err, "should not have error when init")
+	require.Nil(t, dao.EnsureIndex(ctx), "should not have error when ensuring indices")
+	filter := models.UserFilter{NamePrefix: "by query "}
+	var ids []string
+	for _, name := range []string{"by query 1", "by query 2"} {
+		id, err := dao.Create(ctx, models.User{Name: name})
+		require.Nil(t, err, "should not have error when creating user")
+		ids = append(ids, id)
+	}
+
+	count, err := dao.Count(ctx, filter)
+	assert.Nil(t, err, "should not have error when counting")
+	assert.EqualValues(t, 2, count, "should count matching users")
+
+	id, err := dao.StartUpdateByQuery(ctx, filter, map[string]interface{}{"description": "test account"})
+	require.Nil(t, err, "should not have error when starting update by query")
+	status := waitForTask(t, dao, id)
+	assert.EqualValues(t, models.TaskUpdateByQuery, status.Operation)
+	assert.EqualValues(t, 2, status.Updated, "should update matching users")
+
+	id, err = dao.StartDeleteByQuery(ctx, filter)
+	require.Nil(t, err, "should not have error when starting delete by query")
+	status = waitForTask(t, dao, id)
+	assert.EqualValues(t, models.TaskDeleteByQuery, status.Operation)
+	assert.EqualValues(t, 2, status.Deleted, "should delete matching users")
+
+	// the task's changes are recorded once it completed
+	time.Sleep(2 * taskPollInterval)
+	_, err = dao.cli.Refresh(dao.historyIndex()).Do(ctx)
+	require.Nil(t, err, "should not have err when refreshing history")
+	page, err := dao.GetHistory(ctx, ids[0], 10, 0)
+	require.Nil(t, err, "should not have err when getting history")
+	require.Len(t, page.Changes, 3, "the tasks' writes should be recorded")
+	assert.Equal(t, models.ChangeDelete, page.Changes[0].Operation, "the delete should be recorded")
+	assert.Equal(t, "test account", page.Changes[1].Diff["description"].After, "the update should be recorded")
+	assert.Nil(t, dao.Restore(ctx, ids[0]), "users deleted by query should be restorable")
+
+	_, err = dao.GetTask(ctx, "not a task")
+	assert.NotNil(t, err, "unknown task should not be found")
+	_, err = dao.GetTask(ctx, strings.TrimPrefix(id, models.TaskDeleteByQuery+taskKindSeparator))
+	assert.Equal(t, interfaces.ErrNotFound, err, "task ids without their kind should not be found")
+}
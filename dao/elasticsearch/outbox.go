@@ -0,0 +1,303 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/google/logger"
+	"github.com/metildachee/userie/dao/interfaces"
+	"github.com/metildachee/userie/models"
+	elasticv7 "github.com/olivere/elastic/v7"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+// outboxGapTimeout is how long ReadOutbox waits for a missing offset to show
+// up. Offsets are drawn before their record is indexed, so a later record may
+// be searchable first; one still missing when the record after it was drawn
+// longer than the timeout ago was never written, its change is recorded
+// again under a new offset.
+const outboxGapTimeout = time.Minute
+
+var _ interfaces.Outbox = (*UserImplDao)(nil)
+
+// outboxMapping is the mapping of the outbox index, records are only searched
+// by offset.
+var outboxMapping = map[string]interface{}{
+	"dynamic": false,
+	"properties": map[string]interface{}{
+		"offset": map[string]interface{}{"type": "long"},
+	},
+}
+
+// outboxDoc is an outbox record as indexed. DrawnAt is when its offset was
+// drawn, in unix milliseconds, and times the gaps in front of it: the change
+// itself may be much older, when a sweep or a later write recorded it.
+type outboxDoc struct {
+	models.OutboxRecord
+	DrawnAt int64 `json:"drawn_at"`
+}
+
+// outboxIndex holds the changes waiting to be published, keyed by offset. It
+// sits outside the alias like the history index.
+func (dao *UserImplDao) outboxIndex() string {
+	return dao.cluster + "_outbox"
+}
+
+func (dao *UserImplDao) ensureOutboxIndex(ctx context.Context) error {
+	exists, err := dao.cli.IndexExists(dao.outboxIndex()).Do(ctx)
+	if err != nil || exists {
+		return err
+	}
+	_, err = dao.cli.CreateIndex(dao.outboxIndex()).
+		BodyJson(map[string]interface{}{"settings": indexSettings, "mappings": outboxMapping}).
+		Do(ctx)
+	if err == nil {
+		logger.Infof("created outbox index %s", dao.outboxIndex())
+	}
+	return err
+}
+
+// nextOffsets draws n offsets from the outbox counter in the sequence index
+// and returns the first of them.
+func (dao *UserImplDao) nextOffsets(ctx context.Context, n int) (int64, error) {
+	res, err := dao.cli.Update().
+		Index(dao.cluster + sequenceIndexSuffix).
+		Id(dao.outboxIndex()).
+		Script(elasticv7.NewScript("ctx._source.value += params.n").Param("n", n)).
+		Upsert(sequenceDoc{Value: int64(n)}).
+		RetryOnConflict(sequenceRetries).
+		FetchSource(true).
+		Do(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if res.GetResult == nil {
+		return 0, errors.New("outbox counter returned no source")
+	}
+	var doc sequenceDoc
+	if err := json.Unmarshal(res.GetResult.Source, &doc); err != nil {
+		return 0, err
+	}
+	return doc.Value - int64(n) + 1, nil
+}
+
+// addToOutbox indexes changes into the outbox once it is enabled.
+func (dao *UserImplDao) addToOutbox(ctx context.Context, changes []models.Change) error {
+	if !dao.outbox || len(changes) == 0 {
+		return nil
+	}
+	first, err := dao.nextOffsets(ctx, len(changes))
+	if err != nil {
+		return err
+	}
+	drawnAt := unixMillis(time.Now())
+	bulk := dao.cli.Bulk().Index(dao.outboxIndex())
+	for i, change := range changes {
+		offset := first + int64(i)
+		bulk.Add(elasticv7.NewBulkIndexRequest().
+			Id(strconv.FormatInt(offset, 10)).
+			Doc(outboxDoc{OutboxRecord: models.OutboxRecord{Offset: offset, Change: change}, DrawnAt: drawnAt}))
+	}
+	res, err := bulk.Do(ctx)
+	if err == nil && res.Errors {
+		err = errors.New(res.Failed()[0].Error.Reason)
+	}
+	return err
+}
+
+// EnableOutbox creates the outbox index and starts writing to it.
+func (dao *UserImplDao) EnableOutbox(ctx context.Context) error {
+	if err := dao.ensureOutboxIndex(ctx); err != nil {
+		return err
+	}
+	dao.outbox = true
+	return nil
+}
+
+// ReadOutbox returns the records after the offset up to the first offset
+// missing for less than outboxGapTimeout, so none are skipped that are still
+// being indexed. Reads start past the trimmed records, which are not missing.
+// The changes of interrupted writes are swept into the outbox first.
+func (dao *UserImplDao) ReadOutbox(ctx context.Context, after int64, limit int) (records []models.OutboxRecord, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "es read outbox")
+	defer span.Finish()
+
+	if err = dao.sweep(ctx); err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	trimmed, err := dao.trimmedThrough(ctx)
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	if trimmed > after {
+		after = trimmed
+	}
+	records = []models.OutboxRecord{}
+	searchResult, err := dao.cli.Search().
+		Index(dao.outboxIndex()).
+		Query(elasticv7.NewRangeQuery("offset").Gt(after)).
+		Sort("offset", true).
+		Size(limit).
+		Do(ctx)
+	if elasticv7.IsNotFound(err) {
+		return records, nil
+	}
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	next := after + 1
+	for _, hit := range searchResult.Hits.Hits {
+		var doc outboxDoc
+		if err = json.Unmarshal(hit.Source, &doc); err != nil {
+			ext.LogError(span, err)
+			return
+		}
+		drawnAt := time.Unix(0, doc.DrawnAt*int64(time.Millisecond))
+		if doc.Offset != next && time.Since(drawnAt) < outboxGapTimeout {
+			span.LogFields(log.Int64("waiting for offset", next))
+			break
+		}
+		records = append(records, doc.OutboxRecord)
+		next = doc.Offset + 1
+	}
+	span.LogFields(log.Int64("after", after), log.Int("records", len(records)))
+	return
+}
+
+// TrimOutbox deletes the records through the offset and remembers it, so
+// reads do not wait for the deleted offsets.
+func (dao *UserImplDao) TrimOutbox(ctx context.Context, through int64) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "es trim outbox")
+	defer span.Finish()
+
+	_, err := dao.cli.Update().
+		Index(dao.cluster + sequenceIndexSuffix).
+		Id(dao.trimDoc()).
+		Script(elasticv7.NewScript("if (ctx._source.value < params.through) { ctx._source.value = params.through } else { ctx.op = 'noop' }").
+			Param("through", through)).
+		Upsert(sequenceDoc{Value: through}).
+		RetryOnConflict(sequenceRetries).
+		Do(ctx)
+	if err != nil {
+		ext.LogError(span, err)
+		return err
+	}
+	res, err := dao.cli.DeleteByQuery(dao.outboxIndex()).
+		Query(elasticv7.NewRangeQuery("offset").Lte(through)).
+		Do(ctx)
+	if elasticv7.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		ext.LogError(span, err)
+		return err
+	}
+	span.LogFields(log.Int64("through", through), log.Int64("records", res.Deleted))
+	return nil
+}
+
+// trimDoc is the id of the document in the sequence index holding the offset
+// the outbox was last trimmed through.
+func (dao *UserImplDao) trimDoc() string {
+	return dao.outboxIndex() + "_trimmed"
+}
+
+// trimmedThrough returns the offset the outbox was last trimmed through, zero
+// before the first trim.
+func (dao *UserImplDao) trimmedThrough(ctx context.Context) (int64, error) {
+	res, err := dao.cli.Get().
+		Index(dao.cluster + sequenceIndexSuffix).
+		Id(dao.trimDoc()).
+		Do(ctx)
+	if elasticv7.IsNotFound(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var doc sequenceDoc
+	if err := json.Unmarshal(res.Source, &doc); err != nil {
+		return 0, err
+	}
+	return doc.Value, nil
+}
+
+// leaseDoc is the id of the document in the sequence index holding the
+// outbox lease, a models.OutboxLease.
+func (dao *UserImplDao) leaseDoc() string {
+	return dao.outboxIndex() + "_lease"
+}
+
+// ClaimOutbox follows models.OutboxLease in a script, which leaves the lease
+// alone while another holder's runs.
+func (dao *UserImplDao) ClaimOutbox(ctx context.Context, holder string, ttl time.Duration) (int64, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "es claim outbox")
+	defer span.Finish()
+
+	now := time.Now()
+	expiresAt := now.Add(ttl).UnixNano()
+	res, err := dao.cli.Update().
+		Index(dao.cluster + sequenceIndexSuffix).
+		Id(dao.leaseDoc()).
+		Script(elasticv7.NewScript("if (ctx._source.holder == params.holder || ctx._source.expires_at <= params.now) { "+
+			"ctx._source.holder = params.holder; ctx._source.expires_at = params.expires_at } else { ctx.op = 'noop' }").
+			Param("holder", holder).
+			Param("now", now.UnixNano()).
+			Param("expires_at", expiresAt)).
+		Upsert(models.OutboxLease{Holder: holder, ExpiresAt: expiresAt}).
+		RetryOnConflict(sequenceRetries).
+		FetchSource(true).
+		Do(ctx)
+	if err != nil {
+		ext.LogError(span, err)
+		return 0, err
+	}
+	if res.Result == "noop" {
+		return 0, interfaces.ErrOutboxLeased
+	}
+	if res.GetResult == nil {
+		return 0, errors.New("outbox lease returned no source")
+	}
+	var lease models.OutboxLease
+	if err := json.Unmarshal(res.GetResult.Source, &lease); err != nil {
+		return 0, err
+	}
+	span.LogFields(log.String("holder", holder), log.Int64("committed", lease.Committed))
+	return lease.Committed, nil
+}
+
+func (dao *UserImplDao) CommitOutbox(ctx context.Context, holder string, offset int64, ttl time.Duration) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "es commit outbox")
+	defer span.Finish()
+
+	res, err := dao.cli.Update().
+		Index(dao.cluster + sequenceIndexSuffix).
+		Id(dao.leaseDoc()).
+		Script(elasticv7.NewScript("if (ctx._source.holder == params.holder) { "+
+			"ctx._source.committed = params.offset; ctx._source.expires_at = params.expires_at } else { ctx.op = 'noop' }").
+			Param("holder", holder).
+			Param("offset", offset).
+			Param("expires_at", time.Now().Add(ttl).UnixNano())).
+		RetryOnConflict(sequenceRetries).
+		Do(ctx)
+	if elasticv7.IsNotFound(err) {
+		return interfaces.ErrOutboxLeased
+	}
+	if err != nil {
+		ext.LogError(span, err)
+		return err
+	}
+	if res.Result == "noop" {
+		return interfaces.ErrOutboxLeased
+	}
+	span.LogFields(log.String("holder", holder), log.Int64("offset", offset))
+	return nil
+}
@@ -0,0 +1,359 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/google/logger"
+	"github.com/metildachee/userie/dao/audit"
+	"github.com/metildachee/userie/models"
+	elasticv7 "github.com/olivere/elastic/v7"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+// Elasticsearch has no transactions spanning documents, so every write keeps
+// the change it makes in the user document itself, in the same request that
+// writes the user. The writer then records the change in the outbox and the
+// history; the by query tasks add a change to each user they write and their
+// changes are recorded once the task completed. A change whose writer failed
+// to record it is recorded by the next write to the user, before it writes,
+// or by the sweep of recently changed users that runs with the outbox. A
+// change is recorded once the history holds its id.
+//
+// The changes stay in the document until the next write replaces them:
+// clearing them would be a write of its own and move the user's version.
+
+const (
+	// keepChangeScript follows the write scripts and replaces the changes kept
+	// in the document with the write's own, unless the write was a noop.
+	keepChangeScript = `
+if (ctx.op != 'noop') { ctx._source.changes = [params.change]; ctx._source.changed_at = params.changed_at }`
+	// appendChangeScript precedes the by query write scripts and adds a change
+	// to the changes kept in a live user, as the task cannot record it
+	// first. Its id is made unique per user.
+	appendChangeScript = `if (ctx._source.deleted_at == null) {
+	Map before = new HashMap(ctx._source);
+	before.remove('changes');
+	before.remove('changed_at');
+	Map change = new HashMap(params.change);
+	change['id'] = params.change.id + '-' + ctx._id;
+	change['before'] = before;
+	if (ctx._source.changes == null) { ctx._source.changes = new ArrayList() }
+	ctx._source.changes.add(change);
+	ctx._source.changed_at = params.changed_at;
+}
+`
+	// sweepLookback is how far before the last sweep the next one starts, so
+	// users written just before it, but not yet searchable, are not missed.
+	sweepLookback = time.Minute
+	// sweepInterval is how often ReadOutbox sweeps.
+	sweepInterval = 10 * time.Second
+)
+
+// pendingChange is a change as kept in the user document: without the
+// version, which the write has yet to get, and with the user before it, so
+// the diff can be made once the user after it is known.
+type pendingChange struct {
+	models.Change
+	Before *models.User `json:"before,omitempty"`
+}
+
+// storedUser is a user document with the changes of its latest write.
+type storedUser struct {
+	models.User
+	Changes []pendingChange `json:"changes,omitempty"`
+	// ChangedAt is when the changes were made, in unix milliseconds
+	ChangedAt int64 `json:"changed_at,omitempty"`
+}
+
+func newPendingChange(ctx context.Context, operation string, before *models.User) (pendingChange, error) {
+	change, err := audit.NewChange(ctx, operation, nil, nil, "")
+	if err != nil {
+		return pendingChange{}, err
+	}
+	change.Diff = nil
+	return pendingChange{Change: change, Before: before}, nil
+}
+
+// stored returns the document that writes u along with the change.
+func (p pendingChange) stored(u models.User) storedUser {
+	return storedUser{User: u, Changes: []pendingChange{p}, ChangedAt: unixMillis(p.Timestamp)}
+}
+
+// keeping extends a write script to keep the change in the document.
+func (p pendingChange) keeping(source string, params map[string]interface{}) *elasticv7.Script {
+	return p.script(source+keepChangeScript, params)
+}
+
+// appending extends a by query write script to add the change to the
+// document.
+func (p pendingChange) appending(source string, params map[string]interface{}) *elasticv7.Script {
+	return p.script(appendChangeScript+source, params)
+}
+
+func (p pendingChange) script(source string, params map[string]interface{}) *elasticv7.Script {
+	script := elasticv7.NewScript(source).
+		Lang("painless").
+		Param("change", p).
+		Param("changed_at", unixMillis(p.Timestamp))
+	for name, value := range params {
+		script = script.Param(name, value)
+	}
+	return script
+}
+
+// complete returns the change of the write that left the user id as after,
+// at version. after is nil for deletes.
+func (p pendingChange) complete(id, version string, after *models.User) (models.Change, error) {
+	before := withID(p.Before, id)
+	after = withID(after, id)
+	diff, err := audit.Diff(before, after)
+	if err != nil {
+		return models.Change{}, err
+	}
+	change := p.Change
+	change.UserID, change.Version, change.Diff, change.After = id, version, diff, after
+	return change, nil
+}
+
+// pending returns the changes kept in the document of the user id, found at
+// version. The user after a change is the one before the next, or the stored
+// user after the last. Only the last change's version is known; the by query
+// writes add theirs to the changes of the write before.
+func (s storedUser) pending(id, version string) ([]models.Change, error) {
+	changes := make([]models.Change, 0, len(s.Changes))
+	for i, p := range s.Changes {
+		after, v := &s.User, version
+		if i+1 < len(s.Changes) {
+			after, v = s.Changes[i+1].Before, ""
+		}
+		if p.Operation == models.ChangeDelete {
+			after = nil
+		}
+		change, err := p.complete(id, v, after)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// withID returns a copy of u carrying id. Documents indexed with
+// Elasticsearch assigned ids have none in their source.
+func withID(u *models.User, id string) *models.User {
+	if u == nil {
+		return nil
+	}
+	copied := *u
+	copied.ID = id
+	return &copied
+}
+
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// recordChanges writes changes to the outbox, when it is enabled, and to the
+// history. The history goes last as it marks the changes recorded; changes
+// already in it are left alone. Those of running tasks are handed to the
+// watcher.
+func (dao *UserImplDao) recordChanges(ctx context.Context, changes []models.Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	if err := dao.addToOutbox(ctx, changes); err != nil {
+		return err
+	}
+	bulk := dao.cli.Bulk().Index(dao.historyIndex())
+	for _, change := range changes {
+		bulk.Add(elasticv7.NewBulkCreateRequest().Id(change.ID).Doc(change))
+	}
+	res, err := bulk.Do(ctx)
+	if err != nil {
+		return err
+	}
+	for _, item := range res.Failed() {
+		if item.Status != http.StatusConflict {
+			return errors.New(item.Error.Reason)
+		}
+	}
+	// changes already in the history were handed out by whoever recorded them
+	created := map[string]bool{}
+	for _, item := range res.Succeeded() {
+		created[item.Id] = true
+	}
+	var recorded []models.Change
+	for _, change := range changes {
+		if created[change.ID] {
+			recorded = append(recorded, change)
+		}
+	}
+	dao.watchRecorded(recorded)
+	return nil
+}
+
+// unrecorded returns the changes the history does not hold yet.
+func (dao *UserImplDao) unrecorded(ctx context.Context, changes []models.Change) ([]models.Change, error) {
+	if len(changes) == 0 {
+		return nil, nil
+	}
+	mget := dao.cli.MultiGet()
+	for _, change := range changes {
+		mget.Add(elasticv7.NewMultiGetItem().
+			Index(dao.historyIndex()).
+			Id(change.ID).
+			FetchSource(elasticv7.NewFetchSourceContext(false)))
+	}
+	res, err := mget.Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	found := map[string]bool{}
+	for _, doc := range res.Docs {
+		found[doc.Id] = doc.Found
+	}
+	var missing []models.Change
+	for _, change := range changes {
+		if !found[change.ID] {
+			missing = append(missing, change)
+		}
+	}
+	return missing, nil
+}
+
+// settle records the changes kept in the document of the user id, found at
+// version, that were not recorded yet. Writes settle the user first, as they
+// replace the changes kept.
+func (dao *UserImplDao) settle(ctx context.Context, id, version string, stored storedUser) error {
+	changes, err := stored.pending(id, version)
+	if err != nil {
+		return err
+	}
+	if changes, err = dao.unrecorded(ctx, changes); err != nil {
+		return err
+	}
+	return dao.recordChanges(ctx, changes)
+}
+
+// settleMatching settles every user matching query, a page at a time.
+func (dao *UserImplDao) settleMatching(ctx context.Context, query elasticv7.Query) (settled int, err error) {
+	scroll := dao.cli.Scroll(dao.cluster).
+		SearchSource(elasticv7.NewSearchSource().
+			Query(query).
+			SeqNoAndPrimaryTerm(true).
+			Size(reconcileBatch))
+	defer scroll.Clear(context.Background())
+	for {
+		res, err := scroll.Do(ctx)
+		if err == io.EOF {
+			return settled, nil
+		}
+		if err != nil {
+			return settled, err
+		}
+		var changes []models.Change
+		for _, hit := range res.Hits.Hits {
+			var stored storedUser
+			if err := json.Unmarshal(hit.Source, &stored); err != nil {
+				return settled, err
+			}
+			if hit.SeqNo == nil || hit.PrimaryTerm == nil {
+				return settled, errors.New("search hit without a version")
+			}
+			pending, err := stored.pending(hit.Id, formatVersion(*hit.SeqNo, *hit.PrimaryTerm))
+			if err != nil {
+				return settled, err
+			}
+			changes = append(changes, pending...)
+		}
+		if changes, err = dao.unrecorded(ctx, changes); err != nil {
+			return settled, err
+		}
+		if err = dao.recordChanges(ctx, changes); err != nil {
+			return settled, err
+		}
+		settled += len(changes)
+	}
+}
+
+// settleSince settles the users changed since the given time.
+func (dao *UserImplDao) settleSince(ctx context.Context, since time.Time) (int, error) {
+	return dao.settleMatching(ctx, elasticv7.NewRangeQuery("changed_at").Gte(unixMillis(since)))
+}
+
+// sweep settles the users changed since shortly before the last sweep, at
+// most every sweepInterval. The time of the last sweep is kept in the
+// sequence index, so a restart sweeps what was written while it was down.
+func (dao *UserImplDao) sweep(ctx context.Context) error {
+	dao.sweepMu.Lock()
+	defer dao.sweepMu.Unlock()
+	if time.Since(dao.sweptAt) < sweepInterval {
+		return nil
+	}
+	span, ctx := opentracing.StartSpanFromContext(ctx, "es sweep changes")
+	defer span.Finish()
+
+	started := time.Now()
+	last, err := dao.lastSweep(ctx)
+	if err != nil {
+		ext.LogError(span, err)
+		return err
+	}
+	since := time.Unix(0, 0)
+	if !last.IsZero() {
+		since = last.Add(-sweepLookback)
+	}
+	settled, err := dao.settleSince(ctx, since)
+	if err != nil {
+		ext.LogError(span, err)
+		return err
+	}
+	if settled > 0 {
+		logger.Infof("recorded %d changes left by interrupted writes", settled)
+	}
+	_, err = dao.cli.Index().
+		Index(dao.cluster + sequenceIndexSuffix).
+		Id(dao.sweepDoc()).
+		BodyJson(sequenceDoc{Value: unixMillis(started)}).
+		Do(ctx)
+	if err != nil {
+		ext.LogError(span, err)
+		return err
+	}
+	dao.sweptAt = started
+	span.LogFields(log.Int("settled", settled))
+	return nil
+}
+
+// sweepDoc is the id of the document in the sequence index holding the time
+// of the last sweep.
+func (dao *UserImplDao) sweepDoc() string {
+	return dao.outboxIndex() + "_swept"
+}
+
+// lastSweep returns the time of the last sweep, the zero time before the
+// first.
+func (dao *UserImplDao) lastSweep(ctx context.Context) (time.Time, error) {
+	res, err := dao.cli.Get().
+		Index(dao.cluster + sequenceIndexSuffix).
+		Id(dao.sweepDoc()).
+		Do(ctx)
+	if elasticv7.IsNotFound(err) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	var doc sequenceDoc
+	if err := json.Unmarshal(res.Source, &doc); err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, doc.Value*int64(time.Millisecond)), nil
+}
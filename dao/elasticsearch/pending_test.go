@@ -0,0 +1,37 @@
+package elasticsearch
+
+import (
+	"context"
+	"testing"
+
+	"github.com/metildachee/userie/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPendingChanges(t *testing.T) {
+	ctx := context.Background()
+	before := models.User{Name: "pending", Address: "kent ridge"}
+	patch, err := newPendingChange(ctx, models.ChangePatch, &before)
+	require.Nil(t, err, "should not have error when making change")
+	patched := before
+	patched.Address = "Kent Ridge"
+	remove, err := newPendingChange(ctx, models.ChangeDelete, &patched)
+	require.Nil(t, err, "should not have error when making change")
+	deleted := patched
+	deleted.DeletedAt = 1625097600
+
+	stored := storedUser{User: deleted, Changes: []pendingChange{patch, remove}}
+	changes, err := stored.pending("7", "3.1")
+	require.Nil(t, err, "should not have error when completing changes")
+	require.Len(t, changes, 2, "every kept change should be returned")
+
+	assert.Equal(t, "7", changes[0].UserID, "changes should carry the document id")
+	assert.Empty(t, changes[0].Version, "only the last change's version is known")
+	assert.Equal(t, "Kent Ridge", changes[0].Diff["address"].After, "a change should end where the next one starts")
+	assert.Equal(t, "7", changes[0].After.ID, "the user after should carry the document id")
+
+	assert.Equal(t, "3.1", changes[1].Version, "the last change should be at the stored version")
+	assert.Nil(t, changes[1].After, "a delete leaves no user")
+	assert.Equal(t, "Kent Ridge", changes[1].Diff["address"].Before, "a delete should show what was removed")
+}
@@ -0,0 +1,61 @@
+package elasticsearch
+
+import (
+	"github.com/metildachee/userie/models"
+	elasticv7 "github.com/olivere/elastic/v7"
+)
+
+// sortFields maps user facing sort fields onto sortable index fields. Text
+// fields are sorted on their keyword sub-field.
+var sortFields = map[string]string{
+	"name":  "name.keyword",
+	"dob":   "dob",
+	"ctime": "ctime",
+}
+
+// liveQuery leaves out deleted users.
+func liveQuery(query elasticv7.Query) *elasticv7.BoolQuery {
+	return elasticv7.NewBoolQuery().
+		Must(query).
+		MustNot(elasticv7.NewExistsQuery("deleted_at"))
+}
+
+func buildListQuery(filters ...models.UserFilter) *elasticv7.BoolQuery {
+	query := liveQuery(elasticv7.NewMatchAllQuery())
+	for _, filter := range filters {
+		if filter.DobFrom != nil || filter.DobTo != nil {
+			query.Filter(rangeQuery("dob", filter.DobFrom, filter.DobTo))
+		}
+		if filter.CtimeFrom != nil || filter.CtimeTo != nil {
+			query.Filter(rangeQuery("ctime", filter.CtimeFrom, filter.CtimeTo))
+		}
+		if filter.NamePrefix != "" {
+			query.Filter(elasticv7.NewPrefixQuery("name.keyword", filter.NamePrefix))
+		}
+	}
+	return query
+}
+
+func rangeQuery(field string, from, to *int32) *elasticv7.RangeQuery {
+	query := elasticv7.NewRangeQuery(field)
+	if from != nil {
+		query.Gte(*from)
+	}
+	if to != nil {
+		query.Lte(*to)
+	}
+	return query
+}
+
+func buildSorters(filters ...models.UserFilter) (sorters []elasticv7.Sorter) {
+	for _, filter := range filters {
+		for _, sort := range filter.Sort {
+			field, ok := sortFields[sort.Field]
+			if !ok {
+				continue
+			}
+			sorters = append(sorters, elasticv7.NewFieldSort(field).Order(!sort.Desc))
+		}
+	}
+	return
+}
@@ -0,0 +1,136 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/metildachee/userie/dao/interfaces"
+	"github.com/metildachee/userie/models"
+	elasticv7 "github.com/olivere/elastic/v7"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+// Deleted users keep their document with a deleted_at field. The write
+// scripts set ctx.op to noop on documents in the wrong state, which
+// updateResult reports as ErrNotFound.
+const (
+	// setLiveScript copies params.fields onto a user that is not deleted,
+	// after dropping every other field when params.replace is set.
+	setLiveScript = `if (ctx._source.deleted_at != null) { ctx.op = 'noop' } else {
+	if (params.replace) { ctx._source.clear() }
+	ctx._source.putAll(params.fields)
+}`
+	markDeletedScript = `if (ctx._source.deleted_at != null) { ctx.op = 'noop' } else { ctx._source.deleted_at = params.now }`
+	restoreScript     = `if (ctx._source.deleted_at == null) { ctx.op = 'noop' } else { ctx._source.remove('deleted_at') }`
+)
+
+// replaceParams are the params of setLiveScript that replace every field of
+// the stored user with u's.
+func replaceParams(u models.User) (map[string]interface{}, error) {
+	doc, err := json.Marshal(u)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(doc, &fields); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"replace": true, "fields": fields}, nil
+}
+
+func patchParams(fields map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"replace": false, "fields": fields}
+}
+
+func softDeleteParams() map[string]interface{} {
+	return map[string]interface{}{"now": time.Now().Unix()}
+}
+
+// updateLive runs script on the document id with the Update API, which
+// refuses missing documents.
+func (dao *UserImplDao) updateLive(id string, script *elasticv7.Script) *elasticv7.UpdateService {
+	return dao.cli.Update().
+		Index(dao.cluster).
+		Id(id).
+		Script(script)
+}
+
+// updateResult maps the outcome of a scripted update onto the dao errors.
+func updateResult(res *elasticv7.UpdateResponse, err error) (*elasticv7.UpdateResponse, error) {
+	switch {
+	case elasticv7.IsNotFound(err):
+		return nil, interfaces.ErrNotFound
+	case elasticv7.IsConflict(err):
+		return nil, interfaces.ErrVersionConflict
+	case err != nil:
+		return nil, err
+	case res.Result == "noop":
+		return nil, interfaces.ErrNotFound
+	}
+	return res, nil
+}
+
+func (dao *UserImplDao) Restore(ctx context.Context, id string) (err error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "es restore item")
+	defer span.Finish()
+	span.LogFields(log.String("doc id", id))
+
+	_, err = dao.recordedUpdate(ctx, span, models.ChangeRestore, id, "", restoreScript, nil, true)
+	return logUnlessExpected(span, err)
+}
+
+func (dao *UserImplDao) GetDeleted(ctx context.Context, limit, offset int) (users []models.User, err error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "es get deleted")
+	defer span.Finish()
+
+	searchResult, err := dao.cli.Search().
+		Index(dao.cluster).
+		Query(elasticv7.NewExistsQuery("deleted_at")).
+		SortBy(elasticv7.NewFieldSort("deleted_at").Desc()).
+		From(offset).
+		Size(limit).
+		Do(ctx)
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	users = make([]models.User, 0, len(searchResult.Hits.Hits))
+	for _, hit := range searchResult.Hits.Hits {
+		var u models.User
+		if u, err = decodeUser(hit); err != nil {
+			ext.LogError(span, err)
+			return
+		}
+		users = append(users, u)
+	}
+	span.LogFields(log.Int("users", len(users)))
+	return
+}
+
+// Purge runs _delete_by_query over the users deleted before the given time.
+// Users restored meanwhile are skipped as version conflicts. The changes kept
+// in the users are recorded first, they go with the documents.
+func (dao *UserImplDao) Purge(ctx context.Context, before int32) (purged int64, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "es purge")
+	defer span.Finish()
+
+	query := elasticv7.NewRangeQuery("deleted_at").Lt(before)
+	if _, err = dao.settleMatching(ctx, query); err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	res, err := dao.cli.DeleteByQuery(dao.cluster).
+		Query(query).
+		ProceedOnVersionConflict().
+		Refresh("true").
+		Do(ctx)
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	span.LogFields(log.Int64("purged", res.Deleted))
+	return res.Deleted, nil
+}
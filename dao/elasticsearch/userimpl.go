@@ -5,11 +5,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"reflect"
-	"strconv"
 	"sync"
+	"time"
 
 	"github.com/google/logger"
+	"github.com/metildachee/userie/dao/interfaces"
 	"github.com/metildachee/userie/models"
 	elasticv7 "github.com/olivere/elastic/v7"
 	"github.com/opentracing/opentracing-go"
@@ -17,21 +17,47 @@ import (
 	"github.com/opentracing/opentracing-go/log"
 )
 
+const (
+	// maxIdAttempts bounds how many ids create tries when a generated id is
+	// already taken, e.g. by users written before the sequence existed.
+	maxIdAttempts = 100
+)
+
+var _ interfaces.UserDao = (*UserImplDao)(nil)
+
 type UserImplDao struct {
 	cli     *elasticv7.Client
 	cluster string
-	safe    SafeCounter
+	ids     IdGenerator
+	// outbox is set once changes are also written to the outbox index
+	outbox bool
+	// sweptAt is when this dao last swept the changes kept in users
+	sweepMu sync.Mutex
+	sweptAt time.Time
+	// tasks holds the ids of the changes the running by query tasks keep in
+	// the users, watchTasks is handed them as they are recorded
+	tasksMu    sync.Mutex
+	tasks      map[string]bool
+	watchTasks func(change models.Change)
 }
 
-func (dao *UserImplDao) GetAll(ctx context.Context, limit, offset int) (users []models.User, err error) {
+// decodeUser reads a hit into a user. Documents indexed with Elasticsearch
+// assigned ids carry no id in their source, so it is taken from the hit.
+func decodeUser(hit *elasticv7.SearchHit) (u models.User, err error) {
+	if err = json.Unmarshal(hit.Source, &u); err != nil {
+		return
+	}
+	if u.ID == "" {
+		u.ID = hit.Id
+	}
+	return
+}
+
+func (dao *UserImplDao) GetAll(ctx context.Context, limit, offset int, filter ...models.UserFilter) (users []models.User, err error) {
 	span, _ := opentracing.StartSpanFromContext(ctx, "es get all")
 	defer span.Finish()
 
-	if !dao.CheckInit(ctx) {
-		return users, errors.New("es client not init")
-	}
-	query := elasticv7.NewBoolQuery().
-		Must(elasticv7.NewExistsQuery("id"))
+	query := buildListQuery(filter...)
 	src, err := query.Source()
 	span.LogFields(log.String("es query", fmt.Sprintf("%v", src)))
 
@@ -42,6 +68,7 @@ func (dao *UserImplDao) GetAll(ctx context.Context, limit, offset int) (users []
 	searchResult, err := dao.cli.Search().
 		Index(dao.cluster).
 		Query(query).
+		SortBy(buildSorters(filter...)...).
 		From(offset).
 		Size(limit).
 		Do(ctx)
@@ -49,84 +76,219 @@ func (dao *UserImplDao) GetAll(ctx context.Context, limit, offset int) (users []
 		ext.LogError(span, err)
 		return
 	}
-	for _, item := range searchResult.Each(reflect.TypeOf(models.User{})) {
-		if u, ok := item.(models.User); ok {
-			users = append(users, u)
+	for _, hit := range searchResult.Hits.Hits {
+		u, err := decodeUser(hit)
+		if err != nil {
+			ext.LogError(span, err)
+			return users, err
 		}
+		users = append(users, u)
 	}
 	span.LogFields(log.String("users", fmt.Sprintf("%v", users)))
 	return
 }
 
-func (dao *UserImplDao) GetById(ctx context.Context, id string) (user models.User, err error) {
-	span, _ := opentracing.StartSpanFromContext(ctx, "es by id")
+// GetAllAfter walks the listing with search_after over a point in time. An
+// empty token starts a new walk with the given filter; later pages only need
+// the returned token. The point in time is released once the last page is read.
+func (dao *UserImplDao) GetAllAfter(ctx context.Context, token string, limit int, filter ...models.UserFilter) (users []models.User, next string, err error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "es get all after")
 	defer span.Finish()
 
-	if !dao.CheckInit(ctx) {
-		return user, errors.New("es client not init")
+	var c cursor
+	if token != "" {
+		if c, err = decodeCursor(token); err != nil {
+			ext.LogError(span, err)
+			return
+		}
+	} else if len(filter) > 0 {
+		c.Filter = filter[0]
+	}
+
+	if c.PitId == "" {
+		pit, err := dao.cli.OpenPointInTime(dao.cluster).
+			KeepAlive(pitKeepAlive).
+			Do(ctx)
+		if err != nil {
+			ext.LogError(span, err)
+			return users, next, err
+		}
+		c.PitId = pit.Id
+	}
+
+	query := buildListQuery(c.Filter)
+	sorters := append(buildSorters(c.Filter), elasticv7.NewFieldSort("_shard_doc"))
+	search := dao.cli.Search().
+		PointInTime(elasticv7.NewPointInTime(c.PitId, pitKeepAlive)).
+		Query(query).
+		SortBy(sorters...).
+		Size(limit)
+	if len(c.After) > 0 {
+		search = search.SearchAfter(c.After...)
 	}
-	query := elasticv7.NewTermQuery("id", id)
+	searchResult, err := search.Do(ctx)
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	if searchResult.PitId != "" {
+		c.PitId = searchResult.PitId
+	}
+
+	hits := searchResult.Hits.Hits
+	for _, hit := range hits {
+		var u models.User
+		if u, err = decodeUser(hit); err != nil {
+			ext.LogError(span, err)
+			return
+		}
+		users = append(users, u)
+	}
+
+	if len(hits) < limit {
+		if _, err := dao.cli.ClosePointInTime(c.PitId).Do(ctx); err != nil {
+			ext.LogError(span, err)
+		}
+		span.LogKV("walk done")
+		return users, "", nil
+	}
+	c.After = hits[len(hits)-1].Sort
+	if next, err = c.encode(); err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	span.LogFields(log.Int("users", len(users)))
+	return
+}
+
+func (dao *UserImplDao) Search(ctx context.Context, text string, limit, offset int) (result models.SearchResult, err error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "es search")
+	defer span.Finish()
+
+	result.Limit, result.Offset = limit, offset
+	query := liveQuery(elasticv7.NewMultiMatchQuery(text, "name", "address", "description"))
 	src, err := query.Source()
 	if err != nil {
 		ext.LogError(span, err)
 	}
 	span.LogFields(log.String("es query", fmt.Sprintf("%v", src)))
 
+	highlight := elasticv7.NewHighlight().Fields(
+		elasticv7.NewHighlighterField("name"),
+		elasticv7.NewHighlighterField("address"),
+		elasticv7.NewHighlighterField("description"))
 	searchResult, err := dao.cli.Search().
 		Index(dao.cluster).
 		Query(query).
+		Highlight(highlight).
+		From(offset).
+		Size(limit).
 		Do(ctx)
 	if err != nil {
 		ext.LogError(span, err)
 		return
 	}
-	for _, item := range searchResult.Each(reflect.TypeOf(user)) {
-		if u, ok := item.(models.User); ok {
-			user = u
-			span.LogFields(log.String("user", fmt.Sprintf("%v", user)))
+
+	result.Total = searchResult.TotalHits()
+	result.Hits = make([]models.SearchHit, 0, len(searchResult.Hits.Hits))
+	for _, hit := range searchResult.Hits.Hits {
+		var u models.User
+		if u, err = decodeUser(hit); err != nil {
+			ext.LogError(span, err)
 			return
 		}
+		item := models.SearchHit{User: u, Highlight: hit.Highlight}
+		if hit.Score != nil {
+			item.Score = *hit.Score
+		}
+		result.Hits = append(result.Hits, item)
 	}
-	return user, errors.New("nil hit")
+	span.LogFields(log.Int64("total hits", result.Total))
+	return
 }
 
-func (dao *UserImplDao) Create(ctx context.Context, new models.User, wg ...*sync.WaitGroup) (id string, err error) {
-	if len(wg) > 0 {
-		defer wg[0].Done()
+func (dao *UserImplDao) GetById(ctx context.Context, id string) (user models.User, err error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "es by id")
+	defer span.Finish()
+
+	query := liveQuery(elasticv7.NewIdsQuery().Ids(id))
+	src, err := query.Source()
+	if err != nil {
+		ext.LogError(span, err)
+	}
+	span.LogFields(log.String("es query", fmt.Sprintf("%v", src)))
+
+	searchResult, err := dao.cli.Search().
+		Index(dao.cluster).
+		Query(query).
+		Do(ctx)
+	if err != nil {
+		ext.LogError(span, err)
+		return
 	}
-	if !dao.CheckInit(ctx) {
-		return id, errors.New("es client not init")
+	for _, hit := range searchResult.Hits.Hits {
+		if user, err = decodeUser(hit); err != nil {
+			ext.LogError(span, err)
+			return
+		}
+		span.LogFields(log.String("user", fmt.Sprintf("%v", user)))
+		return
 	}
+	return user, interfaces.ErrNotFound
+}
+
+func (dao *UserImplDao) Create(ctx context.Context, new models.User) (id string, err error) {
 	if id, err = dao.create(ctx, new); err != nil {
 		return
 	}
 	return
 }
 
-func (dao *UserImplDao) create(ctx context.Context, new models.User, wg ...*sync.WaitGroup) (id string, err error) {
+func (dao *UserImplDao) create(ctx context.Context, new models.User) (id string, err error) {
 	span, _ := opentracing.StartSpanFromContext(ctx, "es create item")
 	defer span.Finish()
 
-	if len(wg) > 0 {
-		defer wg[0].Done()
-	}
-
-	new.ID = dao.safe.GetCount()
-	doc, err := json.Marshal(new)
+	change, err := newPendingChange(ctx, models.ChangeCreate, nil)
 	if err != nil {
 		ext.LogError(span, err)
-		fmt.Println("json marshal err", err)
 		return
 	}
+	var put1 *elasticv7.IndexResponse
+	for attempt := 0; attempt < maxIdAttempts; attempt++ {
+		if new.ID, err = dao.ids.NextId(ctx); err != nil {
+			ext.LogError(span, err)
+			logger.Errorf("generate user id failed: %v", err)
+			return
+		}
+		doc, err := json.Marshal(change.stored(new))
+		if err != nil {
+			ext.LogError(span, err)
+			logger.Errorf("marshal user failed: %v", err)
+			return id, err
+		}
 
-	put1, err := dao.cli.Index().
-		Index(dao.cluster).
-		Id(new.ID).
-		BodyJson(string(doc)).
-		Do(ctx)
-	if err != nil {
+		// op type create refuses to overwrite, so an id that is already taken
+		// is skipped rather than clobbering an existing user
+		index := dao.cli.Index().
+			Index(dao.cluster).
+			BodyJson(string(doc))
+		if new.ID != "" {
+			index = index.Id(new.ID).OpType("create")
+		}
+		if put1, err = index.Do(ctx); elasticv7.IsConflict(err) {
+			span.LogFields(log.String("id taken", new.ID))
+			continue
+		}
+		if err != nil {
+			ext.LogError(span, err)
+			logger.Errorf("index user into %s failed: %v", dao.cluster, err)
+			return id, err
+		}
+		break
+	}
+	if put1 == nil {
+		err = fmt.Errorf("no free id after %d attempts", maxIdAttempts)
 		ext.LogError(span, err)
-		fmt.Println("index document failed", err, "cluster name", dao.cluster)
 		return
 	}
 
@@ -140,27 +302,29 @@ func (dao *UserImplDao) create(ctx context.Context, new models.User, wg ...*sync
 	}
 
 	id = put1.Id
+	new.ID = id
+	dao.record(ctx, span, id, formatVersion(put1.SeqNo, put1.PrimaryTerm), &new, change)
 	span.LogFields(
 		log.String("user doc", put1.Id),
 		log.String("user index", put1.Index))
 	return
 }
 
+// BatchCreate creates the users with BulkCreate and fails with the first
+// user that could not be created.
 func (dao *UserImplDao) BatchCreate(ctx context.Context, new []models.User) (err error) {
-	span, _ := opentracing.StartSpanFromContext(ctx, "es batch item")
+	span, ctx := opentracing.StartSpanFromContext(ctx, "es batch item")
 	defer span.Finish()
 
-	if !dao.CheckInit(ctx) {
-		return errors.New("es client not init")
+	results, err := dao.BulkCreate(ctx, new)
+	if err != nil {
+		ext.LogError(span, err)
+		return
 	}
-	var wg sync.WaitGroup
-
-	for _, item := range new {
-		wg.Add(1)
-		go dao.create(ctx, item, &wg)
+	if err = models.FirstBulkError(results); err != nil {
+		ext.LogError(span, err)
+		return
 	}
-	wg.Wait()
-
 	span.LogKV("batch index done")
 	return
 }
@@ -169,72 +333,127 @@ func (dao *UserImplDao) Update(ctx context.Context, updated models.User) (err er
 	span, _ := opentracing.StartSpanFromContext(ctx, "es update item")
 	defer span.Finish()
 
-	if !dao.CheckInit(ctx) {
-		return errors.New("es client not init")
-	}
-
-	doc, err := json.Marshal(updated)
+	// the Update API refuses missing documents, the script deleted ones
+	params, err := replaceParams(updated)
 	if err != nil {
-		logger.Error(err)
 		ext.LogError(span, err)
 		return
 	}
-	update, err := dao.cli.Index().
-		Index(dao.cluster).
-		Id(updated.ID).
-		BodyJson(string(doc)).
-		Do(ctx)
+	version, err := dao.recordedUpdate(ctx, span, models.ChangeUpdate, updated.ID, "", setLiveScript, params, false)
+	if errors.Is(err, interfaces.ErrNotFound) {
+		return
+	}
 	if err != nil {
 		ext.LogError(span, err)
 		logger.Error(err)
 		return
 	}
 	span.LogFields(
-		log.String("user doc", update.Id),
-		log.String("user index", strconv.FormatInt(update.Version, 10)))
+		log.String("user doc", updated.ID),
+		log.String("version", version))
 	return
 }
 
-func (dao *UserImplDao) UpdateUserName(ctx context.Context, id, newName string) (err error) {
-	span, _ := opentracing.StartSpanFromContext(ctx, "es update name of item")
+func (dao *UserImplDao) Upsert(ctx context.Context, u models.User) (created bool, err error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "es upsert item")
+	defer span.Finish()
+
+	// the stored user is read first for the history, and the write is guarded
+	// by what was read: its version, or its absence with op type create
+	for attempt := 1; ; attempt++ {
+		stored, current, err := dao.getStored(ctx, u.ID)
+		if err != nil && !errors.Is(err, interfaces.ErrNotFound) {
+			ext.LogError(span, err)
+			return false, err
+		}
+		before := stored.User
+		// a deleted user under the id is replaced, and cannot be restored anymore
+		created = current == "" || before.DeletedAt != 0
+		var change pendingChange
+		if created {
+			change, err = newPendingChange(ctx, models.ChangeCreate, nil)
+		} else {
+			change, err = newPendingChange(ctx, models.ChangeUpdate, &before)
+		}
+		if err != nil {
+			ext.LogError(span, err)
+			return false, err
+		}
+		doc, err := json.Marshal(change.stored(u))
+		if err != nil {
+			ext.LogError(span, err)
+			return false, err
+		}
+		index := dao.cli.Index().
+			Index(dao.cluster).
+			Id(u.ID).
+			BodyJson(string(doc))
+		if current == "" {
+			index = index.OpType("create")
+		} else {
+			seqNo, primaryTerm, err := parseVersion(current)
+			if err != nil {
+				ext.LogError(span, err)
+				return false, err
+			}
+			// the write replaces the changes kept in the user
+			if err := dao.settle(ctx, u.ID, current, stored); err != nil {
+				ext.LogError(span, err)
+				return false, err
+			}
+			index = index.IfSeqNo(seqNo).IfPrimaryTerm(primaryTerm)
+		}
+		put, err := index.Do(ctx)
+		if elasticv7.IsConflict(err) && attempt < maxWriteAttempts {
+			span.LogFields(log.Int("write conflict", attempt))
+			continue
+		}
+		if err != nil {
+			ext.LogError(span, err)
+			return false, err
+		}
+
+		dao.record(ctx, span, u.ID, formatVersion(put.SeqNo, put.PrimaryTerm), &u, change)
+		span.LogFields(
+			log.String("user doc", put.Id),
+			log.String("result", put.Result))
+		return created, nil
+	}
+}
+
+func (dao *UserImplDao) Patch(ctx context.Context, id string, fields map[string]interface{}) (err error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "es patch item")
 	defer span.Finish()
 
 	span.LogFields(
 		log.String("id", id),
-		log.String("new name", newName))
-	if !dao.CheckInit(ctx) {
-		return errors.New("es client not init")
+		log.String("fields", fmt.Sprintf("%v", fields)))
+	version, err := dao.recordedUpdate(ctx, span, models.ChangePatch, id, "", setLiveScript, patchParams(fields), false)
+	if errors.Is(err, interfaces.ErrNotFound) {
+		return
 	}
-	update, err := dao.cli.Update().
-		Index(dao.cluster).
-		Id(id).
-		Doc(map[string]interface{}{"name": newName}).
-		Do(ctx)
 	if err != nil {
 		ext.LogError(span, err)
 		return
 	}
 	span.LogFields(
-		log.String("user doc", update.Id),
-		log.String("user index", strconv.FormatInt(update.Version, 10)))
+		log.String("user doc", id),
+		log.String("version", version))
 	return
 }
 
+func (dao *UserImplDao) UpdateUserName(ctx context.Context, id, newName string) (err error) {
+	return dao.Patch(ctx, id, map[string]interface{}{"name": newName})
+}
+
 func (dao *UserImplDao) Delete(ctx context.Context, id string) (err error) {
 	span, _ := opentracing.StartSpanFromContext(ctx, "es delete item")
 	defer span.Finish()
 	span.LogFields(log.String("doc id", id))
 
-	if !dao.CheckInit(ctx) {
-		return errors.New("es client not init")
-	}
-	_, err = dao.cli.Delete().
-		Index(dao.cluster).
-		Id(id).Refresh("true").
-		Do(ctx)
-	if err != nil {
+	_, err = dao.recordedUpdate(ctx, span, models.ChangeDelete, id, "", markDeletedScript, softDeleteParams(), true)
+	if err != nil && !errors.Is(err, interfaces.ErrNotFound) {
 		ext.LogError(span, err)
-		return
 	}
 	return
 }
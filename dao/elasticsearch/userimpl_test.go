@@ -3,12 +3,15 @@ package elasticsearch
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"os"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/google/logger"
+	"github.com/metildachee/userie/dao/audit"
+	"github.com/metildachee/userie/dao/interfaces"
 	"github.com/metildachee/userie/models"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -40,6 +43,30 @@ func TestCreateUser(t *testing.T) {
 	assert.NotEqualValues(t, "0", id, "id should not be 0")
 }
 
+func TestCreateUsersDistinctIds(t *testing.T) {
+	setup()
+	ctx := context.Background()
+	u := models.User{
+		Name:        "metchee",
+		DOB:         int32(time.Now().Unix()),
+		Address:     "Kent Ridge",
+		Description: "default user info",
+		Ctime:       int32(time.Now().Unix()),
+	}
+
+	// each request builds its own dao, ids must still not collide
+	first, err := NewDao(ctx)
+	require.Nil(t, err, "should not have error when init")
+	firstId, err := first.Create(ctx, u)
+	require.Nil(t, err, "should not have error when create user")
+
+	second, err := NewDao(ctx)
+	require.Nil(t, err, "should not have error when init")
+	secondId, err := second.Create(ctx, u)
+	require.Nil(t, err, "should not have error when create user")
+	assert.NotEqualValues(t, firstId, secondId, "ids should not collide across daos")
+}
+
 func TestCreateMultipleUsers(t *testing.T) {
 	setup()
 	ctx := context.Background()
@@ -60,7 +87,10 @@ func TestCreateMultipleUsers(t *testing.T) {
 
 	for i := 0; i < numOfUsersToCreate; i++ {
 		wg.Add(1)
-		go dao.Create(ctx, u, &wg)
+		go func() {
+			defer wg.Done()
+			dao.Create(ctx, u)
+		}()
 	}
 	id, err := dao.Create(ctx, u)
 	require.Nil(t, err, "should not have error when create users")
@@ -99,6 +129,33 @@ func TestBatchCreateUser(t *testing.T) {
 	assert.GreaterOrEqual(t, len(res), numOfUsers, "we created many items, should have equal or more")
 }
 
+func TestBulkCreateUsers(t *testing.T) {
+	setup()
+	ctx := context.Background()
+	// more than a chunk, so the users go out in two _bulk requests
+	users := make([]models.User, bulkChunkSize+1)
+	for i := range users {
+		users[i] = models.User{Name: fmt.Sprintf("bulk %d", i), Ctime: int32(time.Now().Unix())}
+	}
+	dao, err := NewDao(ctx)
+	require.Nil(t, err, "should not have error when init")
+	results, err := dao.BulkCreate(ctx, users)
+	require.Nil(t, err, "should not have error when bulk creating")
+	require.Len(t, results, len(users), "should answer for every user")
+
+	ids := map[string]bool{}
+	for i, result := range results {
+		assert.EqualValues(t, http.StatusCreated, result.Status, fmt.Sprintf("user %d should be created", i))
+		assert.Empty(t, result.Error, "should not have item error")
+		ids[result.ID] = true
+	}
+	assert.Len(t, ids, len(users), "users should get distinct ids")
+
+	user, err := dao.GetById(ctx, results[bulkChunkSize].ID)
+	assert.Nil(t, err, "should not have err when getting user")
+	assert.EqualValues(t, fmt.Sprintf("bulk %d", bulkChunkSize), user.Name, "results should follow the request order")
+}
+
 func TestGetUser(t *testing.T) {
 	setup()
 	ctx := context.Background()
@@ -122,6 +179,63 @@ func TestGetUsers(t *testing.T) {
 	assert.True(t, len(users) > minimumNumOfDocs)
 }
 
+func TestGetUsersWithFilter(t *testing.T) {
+	setup()
+	ctimeFrom := int32(time.Now().AddDate(0, -1, 0).Unix())
+	filter := models.UserFilter{
+		CtimeFrom:  &ctimeFrom,
+		NamePrefix: "metchee",
+		Sort:       []models.SortField{{Field: "ctime", Desc: true}},
+	}
+	ctx := context.Background()
+	dao, err := NewDao(ctx)
+	assert.Nil(t, err, "should not have error when init")
+	users, err := dao.GetAll(ctx, 10, 0, filter)
+	assert.Nil(t, err, "should not have error when get users")
+	for i, user := range users {
+		assert.GreaterOrEqual(t, user.Ctime, ctimeFrom, "ctime should be within range")
+		if i > 0 {
+			assert.GreaterOrEqual(t, users[i-1].Ctime, user.Ctime, "should be sorted by ctime descending")
+		}
+	}
+}
+
+func TestGetUsersAfter(t *testing.T) {
+	setup()
+	var (
+		limit = 3
+		seen  = map[string]bool{}
+		next  = ""
+	)
+	ctx := context.Background()
+	dao, err := NewDao(ctx)
+	assert.Nil(t, err, "should not have error when init")
+	for {
+		var users []models.User
+		users, next, err = dao.GetAllAfter(ctx, next, limit)
+		require.Nil(t, err, "should not have error when walking users")
+		assert.LessOrEqual(t, len(users), limit, "should not exceed limit")
+		for _, user := range users {
+			assert.False(t, seen[user.ID], "user should not be returned twice")
+			seen[user.ID] = true
+		}
+		if next == "" {
+			break
+		}
+	}
+}
+
+func TestSearchUsers(t *testing.T) {
+	setup()
+	ctx := context.Background()
+	dao, err := NewDao(ctx)
+	assert.Nil(t, err, "should not have error when init")
+	result, err := dao.Search(ctx, "kent ridge", 5, 0)
+	assert.Nil(t, err, "should not have error when searching users")
+	assert.LessOrEqual(t, len(result.Hits), 5, "should not exceed limit")
+	assert.GreaterOrEqual(t, result.Total, int64(len(result.Hits)), "total should cover returned hits")
+}
+
 func TestUpdateUser(t *testing.T) {
 	setup()
 	var (
@@ -143,6 +257,23 @@ func TestUpdateUser(t *testing.T) {
 	assert.NotEqualValues(t, user.Description, updatedUser.Description, "should not have the same value")
 }
 
+func TestUpsertUser(t *testing.T) {
+	setup()
+	ctx := context.Background()
+	dao, err := NewDao(ctx)
+	assert.Nil(t, err, "should not have error when init")
+	dao.Delete(ctx, "legacy")
+
+	user := models.User{ID: "legacy", Name: "metchee"}
+	assert.Equal(t, interfaces.ErrNotFound, dao.Update(ctx, user), "missing user should not be updated")
+	created, err := dao.Upsert(ctx, user)
+	assert.Nil(t, err, "should not have err when upserting")
+	assert.True(t, created, "missing user should be created")
+	created, err = dao.Upsert(ctx, user)
+	assert.Nil(t, err, "should not have err when upserting")
+	assert.False(t, created, "existing user should be replaced")
+}
+
 func TestDeleteUser(t *testing.T) {
 	setup()
 	var (
@@ -161,6 +292,146 @@ func TestDeleteUser(t *testing.T) {
 	assert.NotNil(t, err)
 }
 
+func TestSoftDeleteAndRestore(t *testing.T) {
+	setup()
+	ctx := context.Background()
+	dao, err := NewDao(ctx)
+	require.Nil(t, err, "should not have error when init")
+	id, err := dao.Create(ctx, models.User{Name: "soft delete", Ctime: int32(time.Now().Unix())})
+	require.Nil(t, err, "should not have error when create user")
+
+	require.Nil(t, dao.Delete(ctx, id), "should not have err when delete user")
+	_, err = dao.GetById(ctx, id)
+	assert.Equal(t, interfaces.ErrNotFound, err, "deleted user should be hidden")
+	assert.Equal(t, interfaces.ErrNotFound, dao.Patch(ctx, id, map[string]interface{}{"name": "meow"}), "deleted user cannot be patched")
+	deleted, err := dao.GetDeleted(ctx, 10, 0)
+	assert.Nil(t, err, "should not have err when listing deleted users")
+	require.NotEmpty(t, deleted, "deleted user should be listed as deleted")
+	assert.EqualValues(t, id, deleted[0].ID, "most recently deleted user should come first")
+
+	require.Nil(t, dao.Restore(ctx, id), "should not have err when restoring")
+	user, err := dao.GetById(ctx, id)
+	assert.Nil(t, err, "restored user should be found")
+	assert.EqualValues(t, "soft delete", user.Name, "restored user should keep its fields")
+	assert.Equal(t, interfaces.ErrNotFound, dao.Restore(ctx, id), "live user cannot be restored")
+
+	require.Nil(t, dao.Delete(ctx, id), "should not have err when delete user")
+	purged, err := dao.Purge(ctx, int32(time.Now().Unix())+1)
+	assert.Nil(t, err, "should not have err when purging")
+	assert.GreaterOrEqual(t, purged, int64(1), "users past retention should be purged")
+	assert.Equal(t, interfaces.ErrNotFound, dao.Restore(ctx, id), "purged user cannot be restored")
+}
+
+func TestHistory(t *testing.T) {
+	setup()
+	ctx := audit.WithActor(context.Background(), "admin")
+	dao, err := NewDao(ctx)
+	require.Nil(t, err, "should not have error when init")
+	require.Nil(t, dao.EnsureIndex(ctx), "should not have error when ensuring indices")
+	id, err := dao.Create(ctx, models.User{Name: "history", Address: "kent ridge", Ctime: int32(time.Now().Unix())})
+	require.Nil(t, err, "should not have error when create user")
+	require.Nil(t, dao.Patch(ctx, id, map[string]interface{}{"address": "Kent Ridge"}), "should not have err when patch user")
+	require.Nil(t, dao.Delete(ctx, id), "should not have err when delete user")
+	_, err = dao.cli.Refresh(dao.historyIndex()).Do(ctx)
+	require.Nil(t, err, "should not have err when refreshing history")
+
+	page, err := dao.GetHistory(ctx, id, 10, 0)
+	require.Nil(t, err, "should not have err when getting history")
+	assert.EqualValues(t, 3, page.Total, "every write should be recorded")
+	require.Len(t, page.Changes, 3, "every write should be listed")
+	assert.Equal(t, models.ChangeDelete, page.Changes[0].Operation, "newest change should come first")
+	assert.Equal(t, "admin", page.Changes[0].Actor, "change should carry the actor")
+	assert.Equal(t, "Kent Ridge", page.Changes[1].Diff["address"].After, "patch should record the new address")
+	assert.Equal(t, models.ChangeCreate, page.Changes[2].Operation, "oldest change should come last")
+}
+
+func TestOutbox(t *testing.T) {
+	setup()
+	ctx := context.Background()
+	dao, err := NewDao(ctx)
+	require.Nil(t, err, "should not have error when init")
+	require.Nil(t, dao.EnableOutbox(ctx), "should not have error when enabling outbox")
+	records, err := dao.ReadOutbox(ctx, 0, 10000)
+	require.Nil(t, err, "should not have err when reading outbox")
+	after := int64(0)
+	if len(records) > 0 {
+		after = records[len(records)-1].Offset
+	}
+
+	id, err := dao.Create(ctx, models.User{Name: "outbox", Address: "kent ridge", Ctime: int32(time.Now().Unix())})
+	require.Nil(t, err, "should not have error when create user")
+	require.Nil(t, dao.Delete(ctx, id), "should not have err when delete user")
+	_, err = dao.cli.Refresh(dao.outboxIndex()).Do(ctx)
+	require.Nil(t, err, "should not have err when refreshing outbox")
+
+	records, err = dao.ReadOutbox(ctx, after, 10)
+	require.Nil(t, err, "should not have err when reading outbox")
+	require.Len(t, records, 2, "writes should be in the outbox")
+	assert.Equal(t, models.ChangeCreate, records[0].Operation, "records should follow the writes")
+	assert.Equal(t, models.ChangeDelete, records[1].Operation, "records should follow the writes")
+	assert.EqualValues(t, records[0].Offset+1, records[1].Offset, "offsets should have no gaps")
+
+	require.Nil(t, dao.TrimOutbox(ctx, records[0].Offset), "should not have err when trimming outbox")
+	trimmed, err := dao.ReadOutbox(ctx, 0, 10000)
+	require.Nil(t, err, "should not have err when reading outbox")
+	require.NotEmpty(t, trimmed, "reads from before the trim should not wait for the trimmed offsets")
+	assert.True(t, trimmed[0].Offset > records[0].Offset, "reads should start past the trimmed records")
+	assert.EqualValues(t, records[1].Offset, trimmed[len(trimmed)-1].Offset, "reads should reach the last record")
+}
+
+func TestOutboxLease(t *testing.T) {
+	setup()
+	ctx := context.Background()
+	dao, err := NewDao(ctx)
+	require.Nil(t, err, "should not have error when init")
+	// the lease outlives the runs, the holders are new to it
+	a, b := fmt.Sprintf("relay a %d", time.Now().UnixNano()), fmt.Sprintf("relay b %d", time.Now().UnixNano())
+	var committed int64
+	for i := 0; i < 50; i++ {
+		if committed, err = dao.ClaimOutbox(ctx, a, time.Hour); err != interfaces.ErrOutboxLeased {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Nil(t, err, "should not have error when claiming the outbox")
+	require.Nil(t, dao.CommitOutbox(ctx, a, committed+1, time.Hour), "should not have error when committing")
+	_, err = dao.ClaimOutbox(ctx, b, time.Hour)
+	assert.Equal(t, interfaces.ErrOutboxLeased, err, "another relay should wait for the lease")
+	assert.Equal(t, interfaces.ErrOutboxLeased, dao.CommitOutbox(ctx, b, committed+2, time.Hour), "only the holder should commit")
+
+	// a commit that lets the lease run out, as a stopped relay's does
+	require.Nil(t, dao.CommitOutbox(ctx, a, committed+1, -time.Second), "should not have error when committing")
+	taken, err := dao.ClaimOutbox(ctx, b, -time.Second)
+	require.Nil(t, err, "a lease that ran out should be taken over")
+	assert.EqualValues(t, committed+1, taken, "should carry on from the committed offset")
+	assert.Equal(t, interfaces.ErrOutboxLeased, dao.CommitOutbox(ctx, a, committed+2, time.Hour), "a lost lease should not commit")
+}
+
+func TestInterruptedWriteIsRecorded(t *testing.T) {
+	setup()
+	ctx := context.Background()
+	dao, err := NewDao(ctx)
+	require.Nil(t, err, "should not have error when init")
+	require.Nil(t, dao.EnsureIndex(ctx), "should not have error when ensuring indices")
+
+	// a user written with its change, by a writer that stopped before
+	// recording it
+	u := models.User{ID: fmt.Sprintf("interrupted-%d", time.Now().UnixNano()), Name: "interrupted"}
+	change, err := newPendingChange(ctx, models.ChangeCreate, nil)
+	require.Nil(t, err, "should not have error when making change")
+	_, err = dao.cli.Index().Index(dao.cluster).Id(u.ID).BodyJson(change.stored(u)).Refresh("true").Do(ctx)
+	require.Nil(t, err, "should not have error when writing user")
+
+	require.Nil(t, dao.Patch(ctx, u.ID, map[string]interface{}{"address": "Kent Ridge"}), "should not have err when patch user")
+	_, err = dao.cli.Refresh(dao.historyIndex()).Do(ctx)
+	require.Nil(t, err, "should not have err when refreshing history")
+	page, err := dao.GetHistory(ctx, u.ID, 10, 0)
+	require.Nil(t, err, "should not have err when getting history")
+	require.Len(t, page.Changes, 2, "the next write should record the change left behind")
+	assert.Equal(t, change.ID, page.Changes[1].ID, "the change left behind should keep its id")
+	assert.Equal(t, models.ChangeCreate, page.Changes[1].Operation, "the change left behind should be recorded")
+}
+
 func TestUpdateUserName(t *testing.T) {
 	setup()
 	var (
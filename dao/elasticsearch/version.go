@@ -0,0 +1,93 @@
+package elasticsearch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/metildachee/userie/dao/interfaces"
+	"github.com/metildachee/userie/models"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+// A version is a document's _seq_no and _primary_term, written as
+// "<seq_no>.<primary_term>". Together they change on every write.
+func formatVersion(seqNo, primaryTerm int64) string {
+	return strconv.FormatInt(seqNo, 10) + "." + strconv.FormatInt(primaryTerm, 10)
+}
+
+func parseVersion(version string) (seqNo, primaryTerm int64, err error) {
+	parts := strings.Split(version, ".")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("malformed version %q", version)
+	}
+	if seqNo, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
+		return
+	}
+	primaryTerm, err = strconv.ParseInt(parts[1], 10, 64)
+	return
+}
+
+func (dao *UserImplDao) GetVersioned(ctx context.Context, id string) (user models.User, version string, err error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "es versioned by id")
+	defer span.Finish()
+
+	user, version, err = dao.getRaw(ctx, id)
+	if err != nil {
+		return user, "", logUnlessExpected(span, err)
+	}
+	if user.DeletedAt != 0 {
+		return models.User{}, "", interfaces.ErrNotFound
+	}
+	span.LogFields(log.String("user", user.ToString()), log.String("version", version))
+	return
+}
+
+func (dao *UserImplDao) UpdateIfMatch(ctx context.Context, updated models.User, version string) (next string, err error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "es conditional update item")
+	defer span.Finish()
+	span.LogFields(log.String("doc id", updated.ID), log.String("version", version))
+
+	params, err := replaceParams(updated)
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	next, err = dao.recordedUpdate(ctx, span, models.ChangeUpdate, updated.ID, version, setLiveScript, params, false)
+	return next, logUnlessExpected(span, err)
+}
+
+// PatchIfMatch applies fields with the Update API, guarded by the version.
+func (dao *UserImplDao) PatchIfMatch(ctx context.Context, id string, fields map[string]interface{}, version string) (next string, err error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "es conditional patch item")
+	defer span.Finish()
+	span.LogFields(
+		log.String("doc id", id),
+		log.String("version", version),
+		log.String("fields", fmt.Sprintf("%v", fields)))
+
+	next, err = dao.recordedUpdate(ctx, span, models.ChangePatch, id, version, setLiveScript, patchParams(fields), false)
+	return next, logUnlessExpected(span, err)
+}
+
+func (dao *UserImplDao) DeleteIfMatch(ctx context.Context, id, version string) (err error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "es conditional delete item")
+	defer span.Finish()
+	span.LogFields(log.String("doc id", id), log.String("version", version))
+
+	_, err = dao.recordedUpdate(ctx, span, models.ChangeDelete, id, version, markDeletedScript, softDeleteParams(), true)
+	return logUnlessExpected(span, err)
+}
+
+// logUnlessExpected logs err on span unless it is one of the dao errors a
+// conditional write is expected to return, and passes it on.
+func logUnlessExpected(span opentracing.Span, err error) error {
+	if err != nil && !errors.Is(err, interfaces.ErrNotFound) && !errors.Is(err, interfaces.ErrVersionConflict) {
+		ext.LogError(span, err)
+	}
+	return err
+}
@@ -0,0 +1,48 @@
+package elasticsearch
+
+import (
+	"context"
+	"testing"
+
+	"github.com/metildachee/userie/dao/interfaces"
+	"github.com/metildachee/userie/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseVersion(t *testing.T) {
+	seqNo, primaryTerm, err := parseVersion(formatVersion(42, 3))
+	assert.Nil(t, err, "should parse a formatted version")
+	assert.EqualValues(t, 42, seqNo)
+	assert.EqualValues(t, 3, primaryTerm)
+
+	for _, version := range []string{"", "42", "42.x", "1.2.3"} {
+		_, _, err = parseVersion(version)
+		assert.NotNil(t, err, "should reject "+version)
+	}
+}
+
+func TestConditionalWrites(t *testing.T) {
+	setup()
+	ctx := context.Background()
+	dao, err := NewDao(ctx)
+	require.Nil(t, err, "should not have error when init")
+	id, err := dao.Create(ctx, models.User{Name: "metchee"})
+	require.Nil(t, err, "should not have error when creating user")
+
+	user, version, err := dao.GetVersioned(ctx, id)
+	require.Nil(t, err, "should not have err when getting user")
+	user.Name = "meow meow"
+	next, err := dao.UpdateIfMatch(ctx, user, version)
+	assert.Nil(t, err, "current version should update")
+	_, err = dao.UpdateIfMatch(ctx, user, version)
+	assert.Equal(t, interfaces.ErrVersionConflict, err, "stale version should conflict")
+	assert.Equal(t, interfaces.ErrVersionConflict, dao.DeleteIfMatch(ctx, id, version), "stale version should not delete")
+
+	fields := map[string]interface{}{"description": "patched"}
+	_, err = dao.PatchIfMatch(ctx, id, fields, version)
+	assert.Equal(t, interfaces.ErrVersionConflict, err, "stale version should not patch")
+	next, err = dao.PatchIfMatch(ctx, id, fields, next)
+	assert.Nil(t, err, "current version should patch")
+	assert.Nil(t, dao.DeleteIfMatch(ctx, id, next), "current version should delete")
+}
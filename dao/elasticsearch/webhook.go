@@ -0,0 +1,452 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/google/logger"
+	"github.com/metildachee/userie/dao/interfaces"
+	"github.com/metildachee/userie/models"
+	"github.com/metildachee/userie/webhook"
+	elasticv7 "github.com/olivere/elastic/v7"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+// maxWebhooks bounds how many webhooks List returns, Elasticsearch's default
+// result window.
+const maxWebhooks = 10000
+
+var (
+	// webhooksMapping is the mapping of the webhooks index, they are only
+	// looked up by id or listed as a whole.
+	webhooksMapping = map[string]interface{}{
+		"dynamic": false,
+	}
+	// webhookLogMapping is the mapping of the delivery log and dead letter
+	// indices, which are read per webhook in the order they were added.
+	webhookLogMapping = map[string]interface{}{
+		"dynamic": false,
+		"properties": map[string]interface{}{
+			"webhook_id": map[string]interface{}{"type": "keyword"},
+			"seq":        map[string]interface{}{"type": "long"},
+		},
+	}
+	// webhookPendingMapping is the mapping of the pending events index, which
+	// is read the longest untouched first.
+	webhookPendingMapping = map[string]interface{}{
+		"dynamic": false,
+		"properties": map[string]interface{}{
+			"id":         map[string]interface{}{"type": "keyword"},
+			"webhook_id": map[string]interface{}{"type": "keyword"},
+			"time":       map[string]interface{}{"type": "date_nanos"},
+		},
+	}
+)
+
+var _ webhook.Storage = (*UserImplDao)(nil)
+
+// WebhookStore keeps the webhooks in indices next to the users'. Writes wait
+// for a refresh, so they are listed once they return, but for the pending
+// events, which are written on every attempt and refreshed when listed.
+type WebhookStore struct {
+	cli     *elasticv7.Client
+	cluster string
+}
+
+var _ webhook.Store = (*WebhookStore)(nil)
+
+// storedDelivery is a delivery as indexed, seq orders a webhook's log.
+type storedDelivery struct {
+	models.WebhookDelivery
+	Seq int64 `json:"seq"`
+}
+
+// storedDeadLetter is a dead letter as indexed, seq orders a webhook's
+// letters.
+type storedDeadLetter struct {
+	models.WebhookDeadLetter
+	Seq int64 `json:"seq"`
+}
+
+// WebhookStore creates the webhook indices when they are missing.
+func (dao *UserImplDao) WebhookStore(ctx context.Context) (webhook.Store, error) {
+	s := &WebhookStore{cli: dao.cli, cluster: dao.cluster}
+	indices := map[string]interface{}{
+		s.hooksIndex():       webhooksMapping,
+		s.deliveriesIndex():  webhookLogMapping,
+		s.deadLettersIndex(): webhookLogMapping,
+		s.pendingIndex():     webhookPendingMapping,
+	}
+	for index, mapping := range indices {
+		exists, err := dao.cli.IndexExists(index).Do(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			continue
+		}
+		_, err = dao.cli.CreateIndex(index).
+			BodyJson(map[string]interface{}{"settings": indexSettings, "mappings": mapping}).
+			Do(ctx)
+		if err != nil {
+			return nil, err
+		}
+		logger.Infof("created webhook index %s", index)
+	}
+	return s, nil
+}
+
+func (s *WebhookStore) hooksIndex() string {
+	return s.cluster + "_webhooks"
+}
+
+func (s *WebhookStore) deliveriesIndex() string {
+	return s.cluster + "_webhook_deliveries"
+}
+
+func (s *WebhookStore) deadLettersIndex() string {
+	return s.cluster + "_webhook_dead_letters"
+}
+
+func (s *WebhookStore) pendingIndex() string {
+	return s.cluster + "_webhook_pending"
+}
+
+// hookExists fails with interfaces.ErrNotFound when the webhook id is unknown.
+func (s *WebhookStore) hookExists(ctx context.Context, id string) error {
+	exists, err := s.cli.Exists().Index(s.hooksIndex()).Id(id).Do(ctx)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return interfaces.ErrNotFound
+	}
+	return nil
+}
+
+// readLog decodes a page of the webhook id's log in index, the latest first,
+// with decode.
+func (s *WebhookStore) readLog(ctx context.Context, index, id string, limit, offset int, decode func(doc json.RawMessage) error) error {
+	if err := s.hookExists(ctx, id); err != nil {
+		return err
+	}
+	res, err := s.cli.Search().
+		Index(index).
+		Query(elasticv7.NewTermQuery("webhook_id", id)).
+		Sort("seq", false).
+		From(offset).
+		Size(limit).
+		Do(ctx)
+	if err != nil {
+		return err
+	}
+	for _, hit := range res.Hits.Hits {
+		if err := decode(hit.Source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *WebhookStore) Create(ctx context.Context, h models.Webhook) (models.Webhook, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "es create webhook")
+	defer span.Finish()
+
+	id, err := webhook.NewID()
+	if err != nil {
+		ext.LogError(span, err)
+		return h, err
+	}
+	h.ID = id
+	_, err = s.cli.Index().
+		Index(s.hooksIndex()).
+		Id(id).
+		OpType("create").
+		BodyJson(h).
+		Refresh("wait_for").
+		Do(ctx)
+	if err != nil {
+		ext.LogError(span, err)
+		return h, err
+	}
+	span.LogFields(log.String("webhook_id", id))
+	return h, nil
+}
+
+func (s *WebhookStore) Get(ctx context.Context, id string) (h models.Webhook, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "es get webhook")
+	defer span.Finish()
+
+	res, err := s.cli.Get().Index(s.hooksIndex()).Id(id).Do(ctx)
+	if elasticv7.IsNotFound(err) {
+		return h, interfaces.ErrNotFound
+	}
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	err = json.Unmarshal(res.Source, &h)
+	return
+}
+
+func (s *WebhookStore) List(ctx context.Context) (hooks []models.Webhook, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "es list webhooks")
+	defer span.Finish()
+
+	res, err := s.cli.Search().
+		Index(s.hooksIndex()).
+		Query(elasticv7.NewMatchAllQuery()).
+		Size(maxWebhooks).
+		Do(ctx)
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	hooks = make([]models.Webhook, 0, len(res.Hits.Hits))
+	for _, hit := range res.Hits.Hits {
+		var h models.Webhook
+		if err = json.Unmarshal(hit.Source, &h); err != nil {
+			ext.LogError(span, err)
+			return
+		}
+		hooks = append(hooks, h)
+	}
+	webhook.SortWebhooks(hooks)
+	return
+}
+
+func (s *WebhookStore) Update(ctx context.Context, h models.Webhook) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "es update webhook")
+	defer span.Finish()
+
+	if err := s.hookExists(ctx, h.ID); err != nil {
+		return err
+	}
+	_, err := s.cli.Index().
+		Index(s.hooksIndex()).
+		Id(h.ID).
+		BodyJson(h).
+		Refresh("wait_for").
+		Do(ctx)
+	if err != nil {
+		ext.LogError(span, err)
+	}
+	return err
+}
+
+func (s *WebhookStore) Delete(ctx context.Context, id string) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "es delete webhook")
+	defer span.Finish()
+
+	_, err := s.cli.Delete().Index(s.hooksIndex()).Id(id).Refresh("wait_for").Do(ctx)
+	if elasticv7.IsNotFound(err) {
+		return interfaces.ErrNotFound
+	}
+	if err != nil {
+		ext.LogError(span, err)
+		return err
+	}
+	_, err = s.cli.DeleteByQuery(s.deliveriesIndex(), s.deadLettersIndex(), s.pendingIndex()).
+		Query(elasticv7.NewTermQuery("webhook_id", id)).
+		ProceedOnVersionConflict().
+		Refresh("true").
+		Do(ctx)
+	if err != nil {
+		ext.LogError(span, err)
+	}
+	return err
+}
+
+// AddDelivery logs the attempt and forgets the webhook's oldest attempts past
+// webhook.MaxDeliveries.
+func (s *WebhookStore) AddDelivery(ctx context.Context, d models.WebhookDelivery) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "es add webhook delivery")
+	defer span.Finish()
+
+	if err := s.hookExists(ctx, d.WebhookID); err != nil {
+		return err
+	}
+	_, err := s.cli.Index().
+		Index(s.deliveriesIndex()).
+		Id(d.ID).
+		BodyJson(storedDelivery{WebhookDelivery: d, Seq: time.Now().UnixNano()}).
+		Refresh("wait_for").
+		Do(ctx)
+	if err != nil {
+		ext.LogError(span, err)
+		return err
+	}
+	res, err := s.cli.Search().
+		Index(s.deliveriesIndex()).
+		Query(elasticv7.NewTermQuery("webhook_id", d.WebhookID)).
+		Sort("seq", false).
+		From(webhook.MaxDeliveries).
+		Size(1).
+		Do(ctx)
+	if err != nil || len(res.Hits.Hits) == 0 {
+		return err
+	}
+	var oldest storedDelivery
+	if err := json.Unmarshal(res.Hits.Hits[0].Source, &oldest); err != nil {
+		return err
+	}
+	_, err = s.cli.DeleteByQuery(s.deliveriesIndex()).
+		Query(elasticv7.NewBoolQuery().Filter(
+			elasticv7.NewTermQuery("webhook_id", d.WebhookID),
+			elasticv7.NewRangeQuery("seq").Lte(oldest.Seq))).
+		ProceedOnVersionConflict().
+		Do(ctx)
+	if err != nil {
+		ext.LogError(span, err)
+	}
+	return err
+}
+
+func (s *WebhookStore) GetDeliveries(ctx context.Context, id string, limit, offset int) (deliveries []models.WebhookDelivery, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "es get webhook deliveries")
+	defer span.Finish()
+
+	deliveries = []models.WebhookDelivery{}
+	err = s.readLog(ctx, s.deliveriesIndex(), id, limit, offset, func(doc json.RawMessage) error {
+		var d storedDelivery
+		if err := json.Unmarshal(doc, &d); err != nil {
+			return err
+		}
+		deliveries = append(deliveries, d.WebhookDelivery)
+		return nil
+	})
+	return
+}
+
+func (s *WebhookStore) AddDeadLetter(ctx context.Context, l models.WebhookDeadLetter) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "es add webhook dead letter")
+	defer span.Finish()
+
+	if err := s.hookExists(ctx, l.WebhookID); err != nil {
+		return err
+	}
+	_, err := s.cli.Index().
+		Index(s.deadLettersIndex()).
+		Id(l.ID).
+		BodyJson(storedDeadLetter{WebhookDeadLetter: l, Seq: time.Now().UnixNano()}).
+		Refresh("wait_for").
+		Do(ctx)
+	if err != nil {
+		ext.LogError(span, err)
+	}
+	return err
+}
+
+func (s *WebhookStore) GetDeadLetters(ctx context.Context, id string, limit, offset int) (letters []models.WebhookDeadLetter, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "es get webhook dead letters")
+	defer span.Finish()
+
+	letters = []models.WebhookDeadLetter{}
+	err = s.readLog(ctx, s.deadLettersIndex(), id, limit, offset, func(doc json.RawMessage) error {
+		var l storedDeadLetter
+		if err := json.Unmarshal(doc, &l); err != nil {
+			return err
+		}
+		letters = append(letters, l.WebhookDeadLetter)
+		return nil
+	})
+	return
+}
+
+// TakeDeadLetter removes the dead letter, only the taker whose delete removed
+// it gets the letter.
+func (s *WebhookStore) TakeDeadLetter(ctx context.Context, id, letterID string) (letter models.WebhookDeadLetter, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "es take webhook dead letter")
+	defer span.Finish()
+
+	res, err := s.cli.Get().Index(s.deadLettersIndex()).Id(letterID).Do(ctx)
+	if elasticv7.IsNotFound(err) {
+		return letter, interfaces.ErrNotFound
+	}
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	var stored storedDeadLetter
+	if err = json.Unmarshal(res.Source, &stored); err != nil {
+		return
+	}
+	if stored.WebhookID != id {
+		return letter, interfaces.ErrNotFound
+	}
+	_, err = s.cli.Delete().Index(s.deadLettersIndex()).Id(letterID).Refresh("wait_for").Do(ctx)
+	if elasticv7.IsNotFound(err) {
+		return letter, interfaces.ErrNotFound
+	}
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	return stored.WebhookDeadLetter, nil
+}
+
+func (s *WebhookStore) AddPending(ctx context.Context, p models.WebhookPending) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "es add webhook pending")
+	defer span.Finish()
+
+	if err := s.hookExists(ctx, p.WebhookID); err != nil {
+		return err
+	}
+	_, err := s.cli.Index().
+		Index(s.pendingIndex()).
+		Id(p.ID).
+		BodyJson(p).
+		Do(ctx)
+	if err != nil {
+		ext.LogError(span, err)
+	}
+	return err
+}
+
+func (s *WebhookStore) ListPending(ctx context.Context, limit int) (pending []models.WebhookPending, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "es list webhook pending")
+	defer span.Finish()
+
+	if _, err = s.cli.Refresh(s.pendingIndex()).Do(ctx); err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	res, err := s.cli.Search().
+		Index(s.pendingIndex()).
+		Query(elasticv7.NewMatchAllQuery()).
+		Sort("time", true).
+		Sort("id", true).
+		Size(limit).
+		Do(ctx)
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	pending = make([]models.WebhookPending, 0, len(res.Hits.Hits))
+	for _, hit := range res.Hits.Hits {
+		var p models.WebhookPending
+		if err = json.Unmarshal(hit.Source, &p); err != nil {
+			ext.LogError(span, err)
+			return
+		}
+		pending = append(pending, p)
+	}
+	return
+}
+
+func (s *WebhookStore) RemovePending(ctx context.Context, id string) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "es remove webhook pending")
+	defer span.Finish()
+
+	_, err := s.cli.Delete().Index(s.pendingIndex()).Id(id).Do(ctx)
+	if elasticv7.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		ext.LogError(span, err)
+	}
+	return err
+}
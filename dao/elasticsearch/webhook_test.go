@@ -0,0 +1,25 @@
+package elasticsearch
+
+import (
+	"context"
+	"testing"
+
+	"github.com/metildachee/userie/webhook/storetest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookStore(t *testing.T) {
+	setup()
+	ctx := context.Background()
+	dao, err := NewDao(ctx)
+	require.Nil(t, err, "should not have error when init")
+	store, err := dao.WebhookStore(ctx)
+	require.Nil(t, err, "should not have error when opening the webhook store")
+	// the indices outlive the runs, so the webhooks of earlier runs go first
+	hooks, err := store.List(ctx)
+	require.Nil(t, err, "should not have error when listing webhooks")
+	for _, h := range hooks {
+		require.Nil(t, store.Delete(ctx, h.ID), "should not have error when deleting webhook")
+	}
+	storetest.Run(t, store)
+}
@@ -0,0 +1,157 @@
+// Package feed publishes the writes made through a UserDao as change events,
+// for the live change feed. The broker keeps the latest events in a ring
+// buffer so that reconnecting subscribers can resume where they left off.
+package feed
+
+import (
+	"sync"
+	"time"
+
+	"github.com/metildachee/userie/dao/internal/listing"
+	"github.com/metildachee/userie/models"
+)
+
+const (
+	EventCreated = "created"
+	EventUpdated = "updated"
+	EventDeleted = "deleted"
+
+	DefaultBufferSize = 1000
+	// subscriberBuffer bounds how many events wait for a subscriber, one
+	// falling further behind is dropped rather than holding up writes.
+	subscriberBuffer = 256
+)
+
+// Fields are the user fields an update can be narrowed to.
+var Fields = []string{"name", "dob", "address", "description", "ctime"}
+
+type Event struct {
+	// ID increases by one with every event published by the broker
+	ID     uint64    `json:"id"`
+	Type   string    `json:"type"`
+	UserID string    `json:"user_id"`
+	Time   time.Time `json:"time"`
+	// User is the user as the write left it, unset for deletes
+	User *models.User `json:"user,omitempty"`
+	// Fields lists the fields a patch set, unset when the whole user was
+	// written
+	Fields []string `json:"fields,omitempty"`
+}
+
+// Filter selects the events a subscriber is interested in.
+type Filter struct {
+	// Users is matched against the written user. Deletes carry no user and
+	// always pass.
+	Users models.UserFilter
+	// Fields, when set, drops patches that set none of them. Other writes may
+	// change any field and always pass.
+	Fields []string
+}
+
+func (f Filter) Match(e Event) bool {
+	if e.User != nil && !listing.Match(*e.User, f.Users) {
+		return false
+	}
+	if len(f.Fields) == 0 || len(e.Fields) == 0 {
+		return true
+	}
+	for _, field := range e.Fields {
+		for _, wanted := range f.Fields {
+			if field == wanted {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type Broker struct {
+	mu sync.Mutex
+	// ring holds the latest events, the oldest at start
+	ring   []Event
+	start  int
+	lastID uint64
+	subs   map[*Subscription]struct{}
+}
+
+func NewBroker(size int) *Broker {
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	return &Broker{
+		ring: make([]Event, 0, size),
+		subs: map[*Subscription]struct{}{},
+	}
+}
+
+// Publish numbers e, keeps it for resuming subscribers and hands it to the
+// current ones. Subscribers that cannot keep up are dropped.
+func (b *Broker) Publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastID++
+	e.ID = b.lastID
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	if len(b.ring) < cap(b.ring) {
+		b.ring = append(b.ring, e)
+	} else {
+		b.ring[b.start] = e
+		b.start = (b.start + 1) % len(b.ring)
+	}
+	for sub := range b.subs {
+		select {
+		case sub.c <- e:
+		default:
+			b.drop(sub)
+		}
+	}
+}
+
+// Subscribe returns the kept events after lastID and a subscription to every
+// event published from then on, none missed or repeated in between. A lastID
+// of zero only subscribes to new events. missed reports that events after
+// lastID are no longer kept, or that lastID was handed out before a restart;
+// the subscriber then has to reload what it knows.
+func (b *Broker) Subscribe(lastID uint64) (replay []Event, sub *Subscription, missed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if lastID > 0 {
+		oldest := b.lastID - uint64(len(b.ring)) + 1
+		missed = lastID > b.lastID || lastID+1 < oldest
+		for i := range b.ring {
+			if e := b.ring[(b.start+i)%len(b.ring)]; e.ID > lastID || missed {
+				replay = append(replay, e)
+			}
+		}
+	}
+	c := make(chan Event, subscriberBuffer)
+	sub = &Subscription{C: c, c: c, broker: b}
+	b.subs[sub] = struct{}{}
+	return
+}
+
+// drop closes sub, callers must hold the lock.
+func (b *Broker) drop(sub *Subscription) {
+	if _, ok := b.subs[sub]; ok {
+		delete(b.subs, sub)
+		close(sub.c)
+	}
+}
+
+type Subscription struct {
+	// C delivers the events, it is closed when the subscription is closed or
+	// dropped for falling behind.
+	C      <-chan Event
+	c      chan Event
+	broker *Broker
+}
+
+func (s *Subscription) Close() {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	s.broker.drop(s)
+}
@@ -0,0 +1,186 @@
+package feed
+
+import (
+	"context"
+	"sort"
+
+	"github.com/metildachee/userie/dao/interfaces"
+	"github.com/metildachee/userie/models"
+)
+
+// Dao publishes every successful write of the wrapped dao to the broker, the
+// writes of mass operations as their tasks record them. Purges are not
+// published, they only remove users already deleted.
+type Dao struct {
+	interfaces.UserDao
+	broker *Broker
+}
+
+// massDao keeps the wrapped dao's mass operations reachable through the
+// decorator.
+type massDao struct {
+	*Dao
+	interfaces.MassOperator
+}
+
+// NewDao wraps dao so that its writes are published to broker. The result
+// implements interfaces.MassOperator whenever dao does.
+func NewDao(dao interfaces.UserDao, broker *Broker) interfaces.UserDao {
+	d := &Dao{UserDao: dao, broker: broker}
+	if op, ok := dao.(interfaces.MassOperator); ok {
+		op.WatchTasks(d.publishChange)
+		return &massDao{Dao: d, MassOperator: op}
+	}
+	return d
+}
+
+// changeEvents are the events of the recorded operations. A restored user
+// reappears, like a created one.
+var changeEvents = map[string]string{
+	models.ChangeCreate:  EventCreated,
+	models.ChangeUpdate:  EventUpdated,
+	models.ChangePatch:   EventUpdated,
+	models.ChangeRevert:  EventUpdated,
+	models.ChangeDelete:  EventDeleted,
+	models.ChangeRestore: EventCreated,
+}
+
+// publishChange publishes a change recorded by a mass operation's task. A
+// patch is narrowed to the fields it changed.
+func (d *Dao) publishChange(change models.Change) {
+	eventType, ok := changeEvents[change.Operation]
+	if !ok {
+		return
+	}
+	var fields []string
+	if change.Operation == models.ChangePatch {
+		for name := range change.Diff {
+			fields = append(fields, name)
+		}
+		sort.Strings(fields)
+	}
+	d.broker.Publish(Event{Type: eventType, UserID: change.UserID, Time: change.Timestamp.UTC(), User: change.After, Fields: fields})
+}
+
+func (d *Dao) publish(eventType, id string, u *models.User, fields []string) {
+	d.broker.Publish(Event{Type: eventType, UserID: id, User: u, Fields: fields})
+}
+
+// publishWritten publishes a write of id as eventType with the user read back
+// from the dao, which may already include later writes.
+func (d *Dao) publishWritten(ctx context.Context, eventType, id string, fields []string) {
+	var written *models.User
+	if u, err := d.UserDao.GetById(ctx, id); err == nil {
+		written = &u
+	}
+	d.publish(eventType, id, written, fields)
+}
+
+func fieldNames(fields map[string]interface{}) []string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (d *Dao) Create(ctx context.Context, u models.User) (string, error) {
+	id, err := d.UserDao.Create(ctx, u)
+	if err == nil {
+		u.ID = id
+		d.publish(EventCreated, id, &u, nil)
+	}
+	return id, err
+}
+
+// BatchCreate creates the users with BulkCreate, so every created user is
+// known, and fails with the first user that could not be created.
+func (d *Dao) BatchCreate(ctx context.Context, users []models.User) error {
+	results, err := d.BulkCreate(ctx, users)
+	if err != nil {
+		return err
+	}
+	return models.FirstBulkError(results)
+}
+
+func (d *Dao) BulkCreate(ctx context.Context, users []models.User) ([]models.BulkItemResult, error) {
+	results, err := d.UserDao.BulkCreate(ctx, users)
+	for i, result := range results {
+		if result.Error == "" && result.ID != "" {
+			u := users[i]
+			u.ID = result.ID
+			d.publish(EventCreated, u.ID, &u, nil)
+		}
+	}
+	return results, err
+}
+
+func (d *Dao) Update(ctx context.Context, u models.User) error {
+	err := d.UserDao.Update(ctx, u)
+	if err == nil {
+		d.publish(EventUpdated, u.ID, &u, nil)
+	}
+	return err
+}
+
+func (d *Dao) Upsert(ctx context.Context, u models.User) (bool, error) {
+	created, err := d.UserDao.Upsert(ctx, u)
+	if err == nil {
+		eventType := EventUpdated
+		if created {
+			eventType = EventCreated
+		}
+		d.publish(eventType, u.ID, &u, nil)
+	}
+	return created, err
+}
+
+func (d *Dao) Patch(ctx context.Context, id string, fields map[string]interface{}) error {
+	err := d.UserDao.Patch(ctx, id, fields)
+	if err == nil {
+		d.publishWritten(ctx, EventUpdated, id, fieldNames(fields))
+	}
+	return err
+}
+
+func (d *Dao) Delete(ctx context.Context, id string) error {
+	err := d.UserDao.Delete(ctx, id)
+	if err == nil {
+		d.publish(EventDeleted, id, nil, nil)
+	}
+	return err
+}
+
+func (d *Dao) UpdateIfMatch(ctx context.Context, u models.User, version string) (string, error) {
+	next, err := d.UserDao.UpdateIfMatch(ctx, u, version)
+	if err == nil {
+		d.publish(EventUpdated, u.ID, &u, nil)
+	}
+	return next, err
+}
+
+func (d *Dao) PatchIfMatch(ctx context.Context, id string, fields map[string]interface{}, version string) (string, error) {
+	next, err := d.UserDao.PatchIfMatch(ctx, id, fields, version)
+	if err == nil {
+		d.publishWritten(ctx, EventUpdated, id, fieldNames(fields))
+	}
+	return next, err
+}
+
+func (d *Dao) DeleteIfMatch(ctx context.Context, id, version string) error {
+	err := d.UserDao.DeleteIfMatch(ctx, id, version)
+	if err == nil {
+		d.publish(EventDeleted, id, nil, nil)
+	}
+	return err
+}
+
+// Restore publishes the restored user as created, it reappears to readers.
+func (d *Dao) Restore(ctx context.Context, id string) error {
+	err := d.UserDao.Restore(ctx, id)
+	if err == nil {
+		d.publishWritten(ctx, EventCreated, id, nil)
+	}
+	return err
+}
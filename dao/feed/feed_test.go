@@ -0,0 +1,141 @@
+package feed
+
+import (
+	"context"
+	"testing"
+
+	"github.com/metildachee/userie/dao/interfaces"
+	"github.com/metildachee/userie/dao/memory"
+	"github.com/metildachee/userie/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func publishN(b *Broker, n int) {
+	for i := 0; i < n; i++ {
+		b.Publish(Event{Type: EventDeleted, UserID: "1"})
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	b := NewBroker(3)
+	publishN(b, 5)
+
+	replay, sub, missed := b.Subscribe(0)
+	defer sub.Close()
+	assert.False(t, missed, "should not miss when starting with new events")
+	assert.Empty(t, replay, "should only get new events")
+
+	replay, resumed, missed := b.Subscribe(3)
+	defer resumed.Close()
+	assert.False(t, missed, "should resume from kept events")
+	require.Len(t, replay, 2, "should replay the events after the last one")
+	assert.EqualValues(t, 4, replay[0].ID, "should replay in order")
+	assert.EqualValues(t, 5, replay[1].ID, "should replay in order")
+
+	publishN(b, 1)
+	e := <-sub.C
+	assert.EqualValues(t, 6, e.ID, "should deliver new events")
+	assert.False(t, e.Time.IsZero(), "should stamp events")
+	assert.EqualValues(t, 6, (<-resumed.C).ID, "should deliver new events after the replay")
+}
+
+func TestSubscribeMissed(t *testing.T) {
+	b := NewBroker(3)
+	publishN(b, 5)
+
+	for _, lastID := range []uint64{1, 9} {
+		replay, sub, missed := b.Subscribe(lastID)
+		assert.True(t, missed, "should miss events after %d", lastID)
+		assert.Len(t, replay, 3, "should hand out every kept event")
+		sub.Close()
+		_, ok := <-sub.C
+		assert.False(t, ok, "should close the subscription")
+	}
+}
+
+func TestSlowSubscriberDropped(t *testing.T) {
+	b := NewBroker(0)
+	_, sub, _ := b.Subscribe(0)
+	publishN(b, subscriberBuffer+1)
+
+	received := 0
+	for range sub.C {
+		received++
+	}
+	assert.EqualValues(t, subscriberBuffer, received, "should drop the subscriber once its buffer is full")
+	sub.Close()
+}
+
+func TestFilterMatch(t *testing.T) {
+	filter := Filter{Users: models.UserFilter{NamePrefix: "met"}, Fields: []string{"address"}}
+	user := &models.User{ID: "1", Name: "metchee"}
+
+	assert.True(t, filter.Match(Event{Type: EventCreated, User: user}), "should match whole writes")
+	assert.True(t, filter.Match(Event{Type: EventUpdated, User: user, Fields: []string{"address"}}), "should match patches of the fields")
+	assert.False(t, filter.Match(Event{Type: EventUpdated, User: user, Fields: []string{"name"}}), "should skip patches of other fields")
+	assert.False(t, filter.Match(Event{Type: EventCreated, User: &models.User{Name: "other"}}), "should skip other users")
+	assert.True(t, filter.Match(Event{Type: EventDeleted, UserID: "2"}), "should match deletes")
+}
+
+func TestDaoPublishes(t *testing.T) {
+	ctx := context.Background()
+	inner, err := memory.NewDao(ctx)
+	require.Nil(t, err, "should not have error when init")
+	b := NewBroker(DefaultBufferSize)
+	dao := NewDao(inner, b)
+	_, ok := dao.(interfaces.MassOperator)
+	assert.True(t, ok, "should keep mass operations")
+	_, sub, _ := b.Subscribe(0)
+	defer sub.Close()
+
+	id, err := dao.Create(ctx, models.User{Name: "metchee"})
+	require.Nil(t, err, "should not have error when create user")
+	require.Nil(t, dao.Patch(ctx, id, map[string]interface{}{"name": "patched", "address": "kent ridge"}), "should not have error when patch user")
+	require.Nil(t, dao.Delete(ctx, id), "should not have error when delete user")
+	require.Nil(t, dao.Restore(ctx, id), "should not have error when restore user")
+	assert.NotNil(t, dao.Delete(ctx, "missing"), "should fail deleting a missing user")
+
+	e := <-sub.C
+	assert.EqualValues(t, EventCreated, e.Type, "should publish the create")
+	assert.EqualValues(t, id, e.User.ID, "should publish the created user")
+	e = <-sub.C
+	assert.EqualValues(t, EventUpdated, e.Type, "should publish the patch")
+	assert.EqualValues(t, []string{"address", "name"}, e.Fields, "should publish the patched fields")
+	assert.EqualValues(t, "patched", e.User.Name, "should publish the patched user")
+	e = <-sub.C
+	assert.EqualValues(t, EventDeleted, e.Type, "should publish the delete")
+	assert.Nil(t, e.User, "should not publish a deleted user")
+	e = <-sub.C
+	assert.EqualValues(t, EventCreated, e.Type, "should publish the restore as a create")
+	assert.EqualValues(t, "patched", e.User.Name, "should publish the restored user")
+	assert.Len(t, sub.C, 0, "should not publish failed writes")
+}
+
+func TestDaoPublishesMassOperations(t *testing.T) {
+	ctx := context.Background()
+	inner, err := memory.NewDao(ctx)
+	require.Nil(t, err, "should not have error when init")
+	b := NewBroker(DefaultBufferSize)
+	dao := NewDao(inner, b)
+	op := dao.(interfaces.MassOperator)
+	id, err := dao.Create(ctx, models.User{Name: "metchee"})
+	require.Nil(t, err, "should not have error when create user")
+	_, sub, _ := b.Subscribe(0)
+	defer sub.Close()
+
+	_, err = op.StartUpdateByQuery(ctx, models.UserFilter{NamePrefix: "met"}, map[string]interface{}{"address": "kent ridge"})
+	require.Nil(t, err, "should not have error when starting update by query")
+	e := <-sub.C
+	assert.EqualValues(t, EventUpdated, e.Type, "should publish the task's update")
+	assert.EqualValues(t, id, e.UserID, "should publish the updated user")
+	assert.EqualValues(t, []string{"address"}, e.Fields, "should publish the changed fields")
+	assert.EqualValues(t, "kent ridge", e.User.Address, "should publish the user as the task left it")
+
+	_, err = op.StartDeleteByQuery(ctx, models.UserFilter{NamePrefix: "met"})
+	require.Nil(t, err, "should not have error when starting delete by query")
+	e = <-sub.C
+	assert.EqualValues(t, EventDeleted, e.Type, "should publish the task's delete")
+	assert.EqualValues(t, id, e.UserID, "should publish the deleted user")
+	assert.Nil(t, e.User, "should not publish a deleted user")
+}
@@ -1,17 +1,117 @@
 package interfaces
 
 import (
+	"context"
+	"errors"
+	"time"
+
 	"github.com/metildachee/userie/models"
 )
 
+var (
+	ErrNotFound      = errors.New("nil hit")
+	ErrInvalidCursor = errors.New("invalid cursor")
+	// ErrVersionConflict is returned by conditional writes when the stored
+	// user has changed since the given version was read.
+	ErrVersionConflict = errors.New("version conflict")
+	// ErrOutboxLeased is returned to a relay while another one holds the
+	// outbox lease.
+	ErrOutboxLeased = errors.New("outbox is leased to another relay")
+)
+
+// UserDao is the storage contract for users. Lookups and writes on a missing
+// user return ErrNotFound, and GetAllAfter returns ErrInvalidCursor for a
+// token it did not hand out.
+//
+// Deletes are soft: a deleted user gets a DeletedAt and is treated as missing
+// by every other method until it is restored, or purged for good.
+//
+// Every create, update, patch, delete and restore of a single user is recorded
+// in the user's history, with the actor and trace taken from the context; see
+// package audit. Purges are not recorded.
+//
+// A version is an opaque string that changes on every write to a user, the
+// IfMatch writes only go ahead while the stored user still has it.
 type UserDao interface {
-	create(u models.User) error
-
-	Create(u models.User) error
-	BatchCreate(u []models.User) error
-	Update(u models.User) error
-	UpdateName(id, name string) error
-	Delete(id string) error
-	GetById(id string) (models.User, error)
-	GetAll(limit int) ([]models.User, error)
+	Create(ctx context.Context, u models.User) (string, error)
+	BatchCreate(ctx context.Context, u []models.User) error
+	// BulkCreate creates the users and returns a result for each of them, in
+	// order. The error is only set when the request as a whole failed; the
+	// results of users written before still hold, users not sent have a zero
+	// result.
+	BulkCreate(ctx context.Context, u []models.User) ([]models.BulkItemResult, error)
+
+	GetById(ctx context.Context, id string) (models.User, error)
+	GetVersioned(ctx context.Context, id string) (models.User, string, error)
+	GetAll(ctx context.Context, limit, offset int, filter ...models.UserFilter) ([]models.User, error)
+	GetAllAfter(ctx context.Context, cursor string, limit int, filter ...models.UserFilter) ([]models.User, string, error)
+	Search(ctx context.Context, text string, limit, offset int) (models.SearchResult, error)
+
+	// Update replaces the stored user with the same id.
+	Update(ctx context.Context, u models.User) error
+	// Upsert replaces the stored user with the same id, or creates it under
+	// that id, and reports whether it was created.
+	Upsert(ctx context.Context, u models.User) (bool, error)
+	// Patch sets only the given fields, keyed by their json names.
+	Patch(ctx context.Context, id string, fields map[string]interface{}) error
+	Delete(ctx context.Context, id string) error
+
+	// UpdateIfMatch replaces the user if it is still at version and returns
+	// its new version.
+	UpdateIfMatch(ctx context.Context, u models.User, version string) (string, error)
+	// PatchIfMatch sets the given fields if the user is still at version and
+	// returns its new version.
+	PatchIfMatch(ctx context.Context, id string, fields map[string]interface{}, version string) (string, error)
+	DeleteIfMatch(ctx context.Context, id, version string) error
+
+	// Restore brings back a deleted user, it returns ErrNotFound when no
+	// deleted user has that id.
+	Restore(ctx context.Context, id string) error
+	// GetDeleted lists deleted users, the most recently deleted first.
+	GetDeleted(ctx context.Context, limit, offset int) ([]models.User, error)
+	// Purge removes users deleted before the unix time for good and returns
+	// how many were removed.
+	Purge(ctx context.Context, before int32) (int64, error)
+
+	// GetHistory lists the recorded changes to a user, the newest first. The
+	// history outlives the user, it is empty for ids never written.
+	GetHistory(ctx context.Context, id string, limit, offset int) (models.HistoryPage, error)
+}
+
+// MassOperator is implemented by backends that can delete or update every
+// user matching a filter in the background, recording a change for each. The
+// Start methods return a task id to follow the operation with GetTask, which
+// returns ErrNotFound for ids it does not know.
+type MassOperator interface {
+	Count(ctx context.Context, filter models.UserFilter) (int64, error)
+	// StartDeleteByQuery soft deletes every matching user, like Delete.
+	StartDeleteByQuery(ctx context.Context, filter models.UserFilter) (string, error)
+	// StartUpdateByQuery sets the given fields, keyed by their json names, on
+	// every matching user.
+	StartUpdateByQuery(ctx context.Context, filter models.UserFilter, fields map[string]interface{}) (string, error)
+	GetTask(ctx context.Context, id string) (models.TaskStatus, error)
+	// WatchTasks hands watch every change the tasks record, as they are
+	// recorded. It is called before the dao is shared.
+	WatchTasks(watch func(change models.Change))
+}
+
+// Outbox is implemented by backends that can write an outbox record of every
+// recorded change, alongside the write itself, for a relay to publish. Records
+// are numbered with increasing offsets. Purges are not written to the outbox.
+type Outbox interface {
+	// EnableOutbox starts writing outbox records, it is called before the dao
+	// is shared.
+	EnableOutbox(ctx context.Context) error
+	// ReadOutbox returns up to limit records after the offset, the oldest
+	// first. Records written after a returned one never have a lower offset.
+	ReadOutbox(ctx context.Context, after int64, limit int) ([]models.OutboxRecord, error)
+	// TrimOutbox removes the records up to and including the offset.
+	TrimOutbox(ctx context.Context, through int64) error
+	// ClaimOutbox takes or renews the lease on relaying the outbox for holder
+	// until ttl passes, see models.OutboxLease, and returns the offset last
+	// committed. It returns ErrOutboxLeased while another holder's lease runs.
+	ClaimOutbox(ctx context.Context, holder string, ttl time.Duration) (int64, error)
+	// CommitOutbox saves the offset of the last record holder published and
+	// renews its lease, it returns ErrOutboxLeased once holder lost the lease.
+	CommitOutbox(ctx context.Context, holder string, offset int64, ttl time.Duration) error
 }
@@ -0,0 +1,193 @@
+// Package listing evaluates user listings, cursors and text search in process,
+// for backends that cannot push them down to a query engine.
+package listing
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/metildachee/userie/dao/interfaces"
+	"github.com/metildachee/userie/models"
+)
+
+// Cursor is the state behind a next_cursor token: the filter the walk started
+// with and the last user returned, which the next page starts after.
+type Cursor struct {
+	After  *models.User      `json:"after,omitempty"`
+	Filter models.UserFilter `json:"filter"`
+}
+
+// Filter returns the users matching every filter, ordered by the filters'
+// sort fields with ties broken by id.
+func Filter(users []models.User, filter ...models.UserFilter) []models.User {
+	matched := make([]models.User, 0, len(users))
+	for _, u := range users {
+		if Match(u, filter...) {
+			matched = append(matched, u)
+		}
+	}
+	sorts := sortFields(filter...)
+	sort.SliceStable(matched, func(i, j int) bool {
+		return Compare(matched[i], matched[j], sorts) < 0
+	})
+	return matched
+}
+
+// Match reports whether u passes every filter.
+func Match(u models.User, filter ...models.UserFilter) bool {
+	for _, f := range filter {
+		if !inRange(u.DOB, f.DobFrom, f.DobTo) || !inRange(u.Ctime, f.CtimeFrom, f.CtimeTo) {
+			return false
+		}
+		if f.NamePrefix != "" && !strings.HasPrefix(u.Name, f.NamePrefix) {
+			return false
+		}
+	}
+	return true
+}
+
+func inRange(value int32, from, to *int32) bool {
+	if from != nil && value < *from {
+		return false
+	}
+	if to != nil && value > *to {
+		return false
+	}
+	return true
+}
+
+func sortFields(filter ...models.UserFilter) (sorts []models.SortField) {
+	for _, f := range filter {
+		sorts = append(sorts, f.Sort...)
+	}
+	return
+}
+
+// Compare orders a before b by sorts, falling back to id.
+func Compare(a, b models.User, sorts []models.SortField) int {
+	for _, s := range sorts {
+		c := 0
+		switch s.Field {
+		case "name":
+			c = strings.Compare(a.Name, b.Name)
+		case "dob":
+			c = compareInt32(a.DOB, b.DOB)
+		case "ctime":
+			c = compareInt32(a.Ctime, b.Ctime)
+		}
+		if s.Desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return strings.Compare(a.ID, b.ID)
+}
+
+func compareInt32(a, b int32) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// Slice applies limit and offset to users.
+func Slice(users []models.User, limit, offset int) []models.User {
+	if offset >= len(users) {
+		return []models.User{}
+	}
+	users = users[offset:]
+	if limit < len(users) {
+		users = users[:limit]
+	}
+	return users
+}
+
+// Deleted orders deleted users the most recently deleted first, ties broken
+// by id, and applies limit and offset.
+func Deleted(users []models.User, limit, offset int) []models.User {
+	sort.SliceStable(users, func(i, j int) bool {
+		if users[i].DeletedAt != users[j].DeletedAt {
+			return users[i].DeletedAt > users[j].DeletedAt
+		}
+		return users[i].ID < users[j].ID
+	})
+	return Slice(users, limit, offset)
+}
+
+// History orders a user's changes the newest first and applies limit and
+// offset.
+func History(changes []models.Change, limit, offset int) models.HistoryPage {
+	sort.SliceStable(changes, func(i, j int) bool {
+		if !changes[i].Timestamp.Equal(changes[j].Timestamp) {
+			return changes[i].Timestamp.After(changes[j].Timestamp)
+		}
+		return changes[i].ID > changes[j].ID
+	})
+	page := models.HistoryPage{Changes: []models.Change{}, Total: int64(len(changes))}
+	if offset < len(changes) {
+		changes = changes[offset:]
+		if limit < len(changes) {
+			changes = changes[:limit]
+		}
+		page.Changes = changes
+	}
+	return page
+}
+
+// Page returns the page after token, see interfaces.UserDao.GetAllAfter.
+func Page(users []models.User, token string, limit int, filter ...models.UserFilter) (page []models.User, next string, err error) {
+	var c Cursor
+	if token != "" {
+		if c, err = DecodeCursor(token); err != nil {
+			return
+		}
+	} else if len(filter) > 0 {
+		c.Filter = filter[0]
+	}
+
+	matched := Filter(users, c.Filter)
+	start := 0
+	if c.After != nil {
+		start = sort.Search(len(matched), func(i int) bool {
+			return Compare(matched[i], *c.After, c.Filter.Sort) > 0
+		})
+	}
+	page = Slice(matched, limit, start)
+	if len(page) < limit {
+		return page, "", nil
+	}
+	c.After = &page[len(page)-1]
+	next, err = c.Encode()
+	return
+}
+
+func (c Cursor) Encode() (string, error) {
+	raw, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// DecodeCursor reads a token made by Encode, or fails with
+// interfaces.ErrInvalidCursor.
+func DecodeCursor(token string) (c Cursor, err error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return c, interfaces.ErrInvalidCursor
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(&c); err != nil || c.After == nil {
+		return c, interfaces.ErrInvalidCursor
+	}
+	return c, nil
+}
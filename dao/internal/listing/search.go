@@ -0,0 +1,71 @@
+package listing
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/metildachee/userie/models"
+)
+
+const (
+	highlightPreTag  = "<em>"
+	highlightPostTag = "</em>"
+	wordPunctuation  = ".,;:!?\"'()[]{}"
+)
+
+// Search scores users by how many of text's words appear in their name,
+// address or description, the way a multi_match query does, and highlights
+// the matching words.
+func Search(users []models.User, text string, limit, offset int) models.SearchResult {
+	result := models.SearchResult{Limit: limit, Offset: offset, Hits: []models.SearchHit{}}
+	terms := map[string]bool{}
+	for _, term := range strings.Fields(text) {
+		terms[normalise(term)] = true
+	}
+
+	hits := make([]models.SearchHit, 0)
+	for _, u := range users {
+		hit := models.SearchHit{User: u, Highlight: map[string][]string{}}
+		for field, value := range map[string]string{"name": u.Name, "address": u.Address, "description": u.Description} {
+			score, fragment := matchField(value, terms)
+			if score > 0 {
+				hit.Score += score
+				hit.Highlight[field] = []string{fragment}
+			}
+		}
+		if hit.Score > 0 {
+			hits = append(hits, hit)
+		}
+	}
+	sort.SliceStable(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].User.ID < hits[j].User.ID
+	})
+
+	result.Total = int64(len(hits))
+	if offset < len(hits) {
+		hits = hits[offset:]
+		if limit < len(hits) {
+			hits = hits[:limit]
+		}
+		result.Hits = hits
+	}
+	return result
+}
+
+func matchField(value string, terms map[string]bool) (score float64, fragment string) {
+	words := strings.Fields(value)
+	for i, word := range words {
+		if terms[normalise(word)] {
+			words[i] = highlightPreTag + word + highlightPostTag
+			score++
+		}
+	}
+	return score, strings.Join(words, " ")
+}
+
+func normalise(word string) string {
+	return strings.ToLower(strings.Trim(word, wordPunctuation))
+}
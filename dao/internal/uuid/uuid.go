@@ -0,0 +1,57 @@
+// Package uuid generates the time ordered ids shared by the storage backends.
+package uuid
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// maxCounter is the largest value of the 12 bit counter in rand_a.
+const maxCounter = 0xfff
+
+var (
+	mu sync.Mutex
+	// lastMs and counter are the timestamp and counter of the last id, ids of
+	// the same millisecond count up from a random start.
+	lastMs  uint64
+	counter uint16
+)
+
+// NewV7 returns an RFC 9562 version 7 UUID for now. Ids generated later by
+// this process sort after earlier ones, also within the same millisecond:
+// rand_a holds a counter as in the RFC's method 1, and a clock going back or
+// a counter running out borrows the next millisecond.
+func NewV7(now time.Time) (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[6:]); err != nil {
+		return "", err
+	}
+	ms := uint64(now.UnixNano() / int64(time.Millisecond))
+
+	mu.Lock()
+	switch {
+	case ms > lastMs:
+		// a random start with the top bit clear leaves room for at least
+		// 2048 ids in the millisecond
+		counter = binary.BigEndian.Uint16(b[6:8]) & 0x7ff
+	case counter < maxCounter:
+		ms = lastMs
+		counter++
+	default:
+		ms = lastMs + 1
+		counter = binary.BigEndian.Uint16(b[6:8]) & 0x7ff
+	}
+	lastMs = ms
+	binary.BigEndian.PutUint16(b[6:8], counter)
+	mu.Unlock()
+
+	var stamp [8]byte
+	binary.BigEndian.PutUint64(stamp[:], ms)
+	copy(b[:6], stamp[2:])
+	b[6] = 0x70 | (b[6] & 0x0f)
+	b[8] = 0x80 | (b[8] & 0x3f)
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
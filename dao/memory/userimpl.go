@@ -0,0 +1,583 @@
+// Package memory keeps users in process memory. It needs no external
+// services, which makes it suited to local development and tests; nothing
+// survives a restart.
+package memory
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/metildachee/userie/dao/audit"
+	"github.com/metildachee/userie/dao/interfaces"
+	"github.com/metildachee/userie/dao/internal/listing"
+	"github.com/metildachee/userie/models"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+var (
+	_ interfaces.UserDao      = (*UserImplDao)(nil)
+	_ interfaces.MassOperator = (*UserImplDao)(nil)
+	_ interfaces.Outbox       = (*UserImplDao)(nil)
+)
+
+type UserImplDao struct {
+	mu    sync.RWMutex
+	users map[string]models.User
+	// deleted holds the soft deleted users until they are restored or purged
+	deleted map[string]models.User
+	// versions counts the writes to each user id. Purges keep the count, as
+	// the history outlives the user and its versions must stay unique.
+	versions map[string]int64
+	seq      int64
+	// history holds the changes to each user in the order they were made
+	history map[string][]models.Change
+	// outbox holds the changes waiting to be published once enabled, the
+	// oldest first
+	outbox        []models.OutboxRecord
+	outboxEnabled bool
+	outboxOffset  int64
+	outboxLease   models.OutboxLease
+	// tasks holds the by query operations, keyed by task id
+	tasks   map[string]models.TaskStatus
+	taskSeq int64
+	// watchTasks is handed the changes the tasks record
+	watchTasks func(change models.Change)
+}
+
+func NewDao(ctx context.Context) (*UserImplDao, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "get new memory dao")
+	defer span.Finish()
+
+	return &UserImplDao{
+		users:    map[string]models.User{},
+		deleted:  map[string]models.User{},
+		versions: map[string]int64{},
+		history:  map[string][]models.Change{},
+		tasks:    map[string]models.TaskStatus{},
+	}, nil
+}
+
+// all returns a snapshot of every stored user, callers must hold the lock.
+func (dao *UserImplDao) all() []models.User {
+	users := make([]models.User, 0, len(dao.users))
+	for _, u := range dao.users {
+		users = append(users, u)
+	}
+	return users
+}
+
+func (dao *UserImplDao) GetAll(ctx context.Context, limit, offset int, filter ...models.UserFilter) ([]models.User, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "memory get all")
+	defer span.Finish()
+
+	dao.mu.RLock()
+	defer dao.mu.RUnlock()
+	users := listing.Slice(listing.Filter(dao.all(), filter...), limit, offset)
+	span.LogFields(log.Int("users", len(users)))
+	return users, nil
+}
+
+func (dao *UserImplDao) GetAllAfter(ctx context.Context, token string, limit int, filter ...models.UserFilter) ([]models.User, string, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "memory get all after")
+	defer span.Finish()
+
+	dao.mu.RLock()
+	defer dao.mu.RUnlock()
+	return listing.Page(dao.all(), token, limit, filter...)
+}
+
+func (dao *UserImplDao) Search(ctx context.Context, text string, limit, offset int) (models.SearchResult, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "memory search")
+	defer span.Finish()
+
+	dao.mu.RLock()
+	defer dao.mu.RUnlock()
+	result := listing.Search(dao.all(), text, limit, offset)
+	span.LogFields(log.Int64("total hits", result.Total))
+	return result, nil
+}
+
+func (dao *UserImplDao) GetById(ctx context.Context, id string) (models.User, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "memory by id")
+	defer span.Finish()
+
+	dao.mu.RLock()
+	defer dao.mu.RUnlock()
+	u, ok := dao.users[id]
+	if !ok {
+		return u, interfaces.ErrNotFound
+	}
+	return u, nil
+}
+
+func (dao *UserImplDao) Create(ctx context.Context, new models.User) (string, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "memory create item")
+	defer span.Finish()
+
+	dao.mu.Lock()
+	defer dao.mu.Unlock()
+	new.ID = dao.nextId()
+	dao.put(new)
+	dao.record(ctx, span, models.ChangeCreate, nil, &new)
+	span.LogFields(log.String("user doc", new.ID))
+	return new.ID, nil
+}
+
+// nextId bumps the sequence past ids that are already taken, by live or
+// deleted users, callers must hold the write lock.
+func (dao *UserImplDao) nextId() string {
+	for {
+		dao.seq++
+		id := strconv.FormatInt(dao.seq, 10)
+		_, taken := dao.users[id]
+		_, deleted := dao.deleted[id]
+		if !taken && !deleted {
+			return id
+		}
+	}
+}
+
+// put stores u and bumps its version, callers must hold the write lock.
+func (dao *UserImplDao) put(u models.User) {
+	dao.users[u.ID] = u
+	dao.versions[u.ID]++
+}
+
+// record adds the change from before to after to the user's history, callers
+// must hold the write lock and have bumped the version. The write has been
+// made by then, a failure to record it is only logged and reported by ok.
+func (dao *UserImplDao) record(ctx context.Context, span opentracing.Span, operation string, before, after *models.User) (change models.Change, ok bool) {
+	change, err := audit.NewChange(ctx, operation, before, after, "")
+	if err != nil {
+		ext.LogError(span, err)
+		return change, false
+	}
+	change.Version = dao.version(change.UserID)
+	dao.history[change.UserID] = append(dao.history[change.UserID], change)
+	if dao.outboxEnabled {
+		dao.outboxOffset++
+		dao.outbox = append(dao.outbox, models.OutboxRecord{Offset: dao.outboxOffset, Change: change})
+	}
+	return change, true
+}
+
+// watchTask hands a change a task recorded to the watcher, if it was
+// recorded.
+func (dao *UserImplDao) watchTask(change models.Change, ok bool) {
+	if ok && dao.watchTasks != nil {
+		dao.watchTasks(change)
+	}
+}
+
+func (dao *UserImplDao) BatchCreate(ctx context.Context, new []models.User) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "memory batch item")
+	defer span.Finish()
+
+	for _, item := range new {
+		if _, err := dao.Create(ctx, item); err != nil {
+			return err
+		}
+	}
+	span.LogKV("batch index done")
+	return nil
+}
+
+func (dao *UserImplDao) BulkCreate(ctx context.Context, new []models.User) ([]models.BulkItemResult, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "memory bulk create")
+	defer span.Finish()
+
+	results := make([]models.BulkItemResult, len(new))
+	for i, item := range new {
+		results[i] = models.CreateResult(dao.Create(ctx, item))
+	}
+	span.LogFields(log.Int("users", len(new)))
+	return results, nil
+}
+
+func (dao *UserImplDao) Update(ctx context.Context, updated models.User) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "memory update item")
+	defer span.Finish()
+
+	dao.mu.Lock()
+	defer dao.mu.Unlock()
+	before, ok := dao.users[updated.ID]
+	if !ok {
+		return interfaces.ErrNotFound
+	}
+	dao.put(updated)
+	dao.record(ctx, span, models.ChangeUpdate, &before, &updated)
+	return nil
+}
+
+func (dao *UserImplDao) Upsert(ctx context.Context, u models.User) (bool, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "memory upsert item")
+	defer span.Finish()
+
+	dao.mu.Lock()
+	defer dao.mu.Unlock()
+	before, exists := dao.users[u.ID]
+	// a deleted user under the id is replaced, and cannot be restored anymore
+	delete(dao.deleted, u.ID)
+	dao.put(u)
+	if exists {
+		dao.record(ctx, span, models.ChangeUpdate, &before, &u)
+	} else {
+		dao.record(ctx, span, models.ChangeCreate, nil, &u)
+	}
+	return !exists, nil
+}
+
+func (dao *UserImplDao) Patch(ctx context.Context, id string, fields map[string]interface{}) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "memory patch item")
+	defer span.Finish()
+
+	dao.mu.Lock()
+	defer dao.mu.Unlock()
+	before, ok := dao.users[id]
+	if !ok {
+		return interfaces.ErrNotFound
+	}
+	u := before
+	if err := models.ApplyFields(&u, fields); err != nil {
+		return err
+	}
+	u.ID = id
+	dao.put(u)
+	dao.record(ctx, span, models.ChangePatch, &before, &u)
+	return nil
+}
+
+func (dao *UserImplDao) UpdateUserName(ctx context.Context, id, newName string) error {
+	return dao.Patch(ctx, id, map[string]interface{}{"name": newName})
+}
+
+func (dao *UserImplDao) Delete(ctx context.Context, id string) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "memory delete item")
+	defer span.Finish()
+	span.LogFields(log.String("doc id", id))
+
+	dao.mu.Lock()
+	defer dao.mu.Unlock()
+	u, ok := dao.users[id]
+	if !ok {
+		return interfaces.ErrNotFound
+	}
+	dao.softDelete(ctx, span, u)
+	return nil
+}
+
+// softDelete moves u to the deleted users, bumps its version and records the
+// delete, callers must hold the write lock.
+func (dao *UserImplDao) softDelete(ctx context.Context, span opentracing.Span, u models.User) (models.Change, bool) {
+	before := u
+	u.DeletedAt = int32(time.Now().Unix())
+	dao.deleted[u.ID] = u
+	delete(dao.users, u.ID)
+	dao.versions[u.ID]++
+	return dao.record(ctx, span, models.ChangeDelete, &before, nil)
+}
+
+func (dao *UserImplDao) GetVersioned(ctx context.Context, id string) (models.User, string, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "memory versioned by id")
+	defer span.Finish()
+
+	dao.mu.RLock()
+	defer dao.mu.RUnlock()
+	u, ok := dao.users[id]
+	if !ok {
+		return u, "", interfaces.ErrNotFound
+	}
+	return u, dao.version(id), nil
+}
+
+func (dao *UserImplDao) version(id string) string {
+	return strconv.FormatInt(dao.versions[id], 10)
+}
+
+// checkVersion compares a user's version with the expected one, callers must
+// hold the lock.
+func (dao *UserImplDao) checkVersion(id, version string) error {
+	if _, ok := dao.users[id]; !ok {
+		return interfaces.ErrNotFound
+	}
+	if dao.version(id) != version {
+		return interfaces.ErrVersionConflict
+	}
+	return nil
+}
+
+func (dao *UserImplDao) UpdateIfMatch(ctx context.Context, updated models.User, version string) (string, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "memory conditional update item")
+	defer span.Finish()
+
+	dao.mu.Lock()
+	defer dao.mu.Unlock()
+	if err := dao.checkVersion(updated.ID, version); err != nil {
+		return "", err
+	}
+	before := dao.users[updated.ID]
+	dao.put(updated)
+	dao.record(ctx, span, models.ChangeUpdate, &before, &updated)
+	return dao.version(updated.ID), nil
+}
+
+func (dao *UserImplDao) PatchIfMatch(ctx context.Context, id string, fields map[string]interface{}, version string) (string, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "memory conditional patch item")
+	defer span.Finish()
+
+	dao.mu.Lock()
+	defer dao.mu.Unlock()
+	if err := dao.checkVersion(id, version); err != nil {
+		return "", err
+	}
+	before := dao.users[id]
+	u := before
+	if err := models.ApplyFields(&u, fields); err != nil {
+		return "", err
+	}
+	u.ID = id
+	dao.put(u)
+	dao.record(ctx, span, models.ChangePatch, &before, &u)
+	return dao.version(id), nil
+}
+
+func (dao *UserImplDao) DeleteIfMatch(ctx context.Context, id, version string) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "memory conditional delete item")
+	defer span.Finish()
+	span.LogFields(log.String("doc id", id))
+
+	dao.mu.Lock()
+	defer dao.mu.Unlock()
+	if err := dao.checkVersion(id, version); err != nil {
+		return err
+	}
+	dao.softDelete(ctx, span, dao.users[id])
+	return nil
+}
+
+func (dao *UserImplDao) Restore(ctx context.Context, id string) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "memory restore item")
+	defer span.Finish()
+	span.LogFields(log.String("doc id", id))
+
+	dao.mu.Lock()
+	defer dao.mu.Unlock()
+	u, ok := dao.deleted[id]
+	if !ok {
+		return interfaces.ErrNotFound
+	}
+	delete(dao.deleted, id)
+	u.DeletedAt = 0
+	dao.put(u)
+	dao.record(ctx, span, models.ChangeRestore, nil, &u)
+	return nil
+}
+
+func (dao *UserImplDao) GetHistory(ctx context.Context, id string, limit, offset int) (models.HistoryPage, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "memory get history")
+	defer span.Finish()
+	span.LogFields(log.String("doc id", id))
+
+	dao.mu.RLock()
+	defer dao.mu.RUnlock()
+	changes := append([]models.Change(nil), dao.history[id]...)
+	return listing.History(changes, limit, offset), nil
+}
+
+func (dao *UserImplDao) EnableOutbox(ctx context.Context) error {
+	dao.mu.Lock()
+	defer dao.mu.Unlock()
+	dao.outboxEnabled = true
+	return nil
+}
+
+func (dao *UserImplDao) ReadOutbox(ctx context.Context, after int64, limit int) ([]models.OutboxRecord, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "memory read outbox")
+	defer span.Finish()
+
+	dao.mu.RLock()
+	defer dao.mu.RUnlock()
+	records := []models.OutboxRecord{}
+	for _, record := range dao.outbox {
+		if len(records) == limit {
+			break
+		}
+		if record.Offset > after {
+			records = append(records, record)
+		}
+	}
+	span.LogFields(log.Int64("after", after), log.Int("records", len(records)))
+	return records, nil
+}
+
+func (dao *UserImplDao) TrimOutbox(ctx context.Context, through int64) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "memory trim outbox")
+	defer span.Finish()
+
+	dao.mu.Lock()
+	defer dao.mu.Unlock()
+	trimmed := 0
+	for trimmed < len(dao.outbox) && dao.outbox[trimmed].Offset <= through {
+		trimmed++
+	}
+	dao.outbox = append([]models.OutboxRecord(nil), dao.outbox[trimmed:]...)
+	span.LogFields(log.Int64("through", through), log.Int("records", trimmed))
+	return nil
+}
+
+func (dao *UserImplDao) ClaimOutbox(ctx context.Context, holder string, ttl time.Duration) (int64, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "memory claim outbox")
+	defer span.Finish()
+	span.LogFields(log.String("holder", holder))
+
+	dao.mu.Lock()
+	defer dao.mu.Unlock()
+	if !dao.outboxLease.Claim(holder, time.Now(), ttl) {
+		return 0, interfaces.ErrOutboxLeased
+	}
+	return dao.outboxLease.Committed, nil
+}
+
+func (dao *UserImplDao) CommitOutbox(ctx context.Context, holder string, offset int64, ttl time.Duration) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "memory commit outbox")
+	defer span.Finish()
+	span.LogFields(log.String("holder", holder), log.Int64("offset", offset))
+
+	dao.mu.Lock()
+	defer dao.mu.Unlock()
+	if !dao.outboxLease.Commit(holder, offset, time.Now(), ttl) {
+		return interfaces.ErrOutboxLeased
+	}
+	return nil
+}
+
+func (dao *UserImplDao) GetDeleted(ctx context.Context, limit, offset int) ([]models.User, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "memory get deleted")
+	defer span.Finish()
+
+	dao.mu.RLock()
+	defer dao.mu.RUnlock()
+	users := make([]models.User, 0, len(dao.deleted))
+	for _, u := range dao.deleted {
+		users = append(users, u)
+	}
+	users = listing.Deleted(users, limit, offset)
+	span.LogFields(log.Int("users", len(users)))
+	return users, nil
+}
+
+func (dao *UserImplDao) Purge(ctx context.Context, before int32) (int64, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "memory purge")
+	defer span.Finish()
+
+	dao.mu.Lock()
+	defer dao.mu.Unlock()
+	var purged int64
+	for id, u := range dao.deleted {
+		if u.DeletedAt < before {
+			delete(dao.deleted, id)
+			purged++
+		}
+	}
+	span.LogFields(log.Int64("purged", purged))
+	return purged, nil
+}
+
+func (dao *UserImplDao) Count(ctx context.Context, filter models.UserFilter) (int64, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "memory count")
+	defer span.Finish()
+
+	dao.mu.RLock()
+	defer dao.mu.RUnlock()
+	return int64(len(listing.Filter(dao.all(), filter))), nil
+}
+
+func (dao *UserImplDao) StartDeleteByQuery(ctx context.Context, filter models.UserFilter) (string, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "memory start delete by query")
+	defer span.Finish()
+
+	return dao.startTask(ctx, models.TaskDeleteByQuery, filter, func(ctx context.Context, span opentracing.Span, u models.User, status *models.TaskStatus) error {
+		dao.watchTask(dao.softDelete(ctx, span, u))
+		status.Deleted++
+		return nil
+	}), nil
+}
+
+func (dao *UserImplDao) StartUpdateByQuery(ctx context.Context, filter models.UserFilter, fields map[string]interface{}) (string, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "memory start update by query")
+	defer span.Finish()
+
+	return dao.startTask(ctx, models.TaskUpdateByQuery, filter, func(ctx context.Context, span opentracing.Span, u models.User, status *models.TaskStatus) error {
+		before := u
+		if err := models.ApplyFields(&u, fields); err != nil {
+			return err
+		}
+		dao.put(u)
+		dao.watchTask(dao.record(ctx, span, models.ChangePatch, &before, &u))
+		status.Updated++
+		return nil
+	}), nil
+}
+
+// startTask applies op to every user matching filter in the background, one
+// user per lock so other requests are served in between. Like Elasticsearch,
+// users written after they were matched are skipped as version conflicts.
+// Changes are recorded with the actor and trace of ctx.
+func (dao *UserImplDao) startTask(ctx context.Context, operation string, filter models.UserFilter,
+	op func(ctx context.Context, span opentracing.Span, u models.User, status *models.TaskStatus) error) string {
+	dao.mu.Lock()
+	dao.taskSeq++
+	id := strconv.FormatInt(dao.taskSeq, 10)
+	matched := listing.Filter(dao.all(), filter)
+	versions := make([]int64, len(matched))
+	for i, u := range matched {
+		versions[i] = dao.versions[u.ID]
+	}
+	dao.tasks[id] = models.TaskStatus{ID: id, Operation: operation, Total: int64(len(matched))}
+	dao.mu.Unlock()
+
+	go func() {
+		span, ctx := opentracing.StartSpanFromContext(ctx, "memory run task")
+		defer span.Finish()
+		for i, u := range matched {
+			dao.mu.Lock()
+			status := dao.tasks[id]
+			if dao.versions[u.ID] != versions[i] {
+				status.VersionConflicts++
+			} else if err := op(ctx, span, u, &status); err != nil {
+				status.Error = err.Error()
+			}
+			dao.tasks[id] = status
+			dao.mu.Unlock()
+		}
+		dao.mu.Lock()
+		status := dao.tasks[id]
+		status.Completed = true
+		dao.tasks[id] = status
+		dao.mu.Unlock()
+	}()
+	return id
+}
+
+func (dao *UserImplDao) WatchTasks(watch func(change models.Change)) {
+	dao.mu.Lock()
+	defer dao.mu.Unlock()
+	dao.watchTasks = watch
+}
+
+func (dao *UserImplDao) GetTask(ctx context.Context, id string) (models.TaskStatus, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "memory get task")
+	defer span.Finish()
+
+	dao.mu.RLock()
+	defer dao.mu.RUnlock()
+	status, ok := dao.tasks[id]
+	if !ok {
+		return status, interfaces.ErrNotFound
+	}
+	return status, nil
+}
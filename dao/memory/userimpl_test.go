@@ -0,0 +1,264 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/metildachee/userie/dao/audit"
+	"github.com/metildachee/userie/dao/interfaces"
+	"github.com/metildachee/userie/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newSeededDao(t *testing.T, numOfUsers int) *UserImplDao {
+	ctx := context.Background()
+	dao, err := NewDao(ctx)
+	require.Nil(t, err, "should not have error when init")
+	for i := 0; i < numOfUsers; i++ {
+		_, err := dao.Create(ctx, models.User{
+			Name:        fmt.Sprintf("metchee %d", i),
+			DOB:         int32(time.Now().AddDate(-20, 0, i).Unix()),
+			Address:     fmt.Sprintf("kent ridge %d", i),
+			Description: fmt.Sprintf("default user info %d", i),
+			Ctime:       int32(time.Now().AddDate(0, 0, -i).Unix()),
+		})
+		require.Nil(t, err, "should not have error when create user")
+	}
+	return dao
+}
+
+func TestCreateUser(t *testing.T) {
+	dao := newSeededDao(t, 2)
+	id, err := dao.Create(context.Background(), models.User{Name: "metchee"})
+	assert.Nil(t, err, "should not have error when create user")
+	assert.EqualValues(t, "3", id, "ids should follow the sequence")
+}
+
+func TestGetUser(t *testing.T) {
+	dao := newSeededDao(t, 1)
+	user, err := dao.GetById(context.Background(), "1")
+	assert.Nil(t, err, "should not have err when getting user")
+	assert.EqualValues(t, "metchee 0", user.Name, "should get the stored user")
+
+	_, err = dao.GetById(context.Background(), "404")
+	assert.Equal(t, interfaces.ErrNotFound, err, "missing user should not be found")
+}
+
+func TestGetUsers(t *testing.T) {
+	dao := newSeededDao(t, 5)
+	users, err := dao.GetAll(context.Background(), 2, 1)
+	assert.Nil(t, err, "should not have error when get users")
+	require.Len(t, users, 2, "does not conform to limit")
+	assert.EqualValues(t, "2", users[0].ID, "should skip offset")
+}
+
+func TestGetUsersWithFilter(t *testing.T) {
+	dao := newSeededDao(t, 5)
+	ctimeFrom := int32(time.Now().AddDate(0, 0, -2).Unix()) - 1
+	filter := models.UserFilter{
+		CtimeFrom: &ctimeFrom,
+		Sort:      []models.SortField{{Field: "ctime"}},
+	}
+	users, err := dao.GetAll(context.Background(), 10, 0, filter)
+	assert.Nil(t, err, "should not have error when get users")
+	require.Len(t, users, 3, "should only get users within range")
+	assert.EqualValues(t, "3", users[0].ID, "should be sorted by ctime ascending")
+}
+
+func TestGetUsersAfter(t *testing.T) {
+	dao := newSeededDao(t, 7)
+	var (
+		seen = map[string]bool{}
+		next = ""
+	)
+	for {
+		users, token, err := dao.GetAllAfter(context.Background(), next, 3)
+		require.Nil(t, err, "should not have error when walking users")
+		for _, user := range users {
+			assert.False(t, seen[user.ID], "user should not be returned twice")
+			seen[user.ID] = true
+		}
+		if next = token; next == "" {
+			break
+		}
+	}
+	assert.Len(t, seen, 7, "should walk every user")
+
+	_, _, err := dao.GetAllAfter(context.Background(), "not-a-cursor", 3)
+	assert.Equal(t, interfaces.ErrInvalidCursor, err, "should reject unknown cursors")
+}
+
+func TestSearchUsers(t *testing.T) {
+	dao := newSeededDao(t, 3)
+	result, err := dao.Search(context.Background(), "Ridge 2", 10, 0)
+	assert.Nil(t, err, "should not have error when searching users")
+	require.EqualValues(t, 3, result.Total, "every user matches ridge")
+	assert.EqualValues(t, "3", result.Hits[0].User.ID, "best match should come first")
+	assert.EqualValues(t, []string{"kent <em>ridge</em> <em>2</em>"}, result.Hits[0].Highlight["address"], "should highlight matches")
+}
+
+func TestUpdateUserName(t *testing.T) {
+	dao := newSeededDao(t, 1)
+	ctx := context.Background()
+	err := dao.UpdateUserName(ctx, "1", "meow meow")
+	assert.Nil(t, err, "should not have err when update user")
+	updatedUser, err := dao.GetById(ctx, "1")
+	assert.Nil(t, err, "should not have err when getting user")
+	assert.EqualValues(t, "meow meow", updatedUser.Name, "should have the same value")
+	assert.EqualValues(t, "kent ridge 0", updatedUser.Address, "should keep other fields")
+}
+
+func TestDeleteUser(t *testing.T) {
+	dao := newSeededDao(t, 1)
+	ctx := context.Background()
+	err := dao.Delete(ctx, "1")
+	assert.Nil(t, err, "should not have err when delete user")
+	_, err = dao.GetById(ctx, "1")
+	assert.Equal(t, interfaces.ErrNotFound, err, "deleted user should not be found")
+	assert.Equal(t, interfaces.ErrNotFound, dao.Delete(ctx, "1"), "second delete should not be found")
+}
+
+func TestConditionalWrites(t *testing.T) {
+	dao := newSeededDao(t, 1)
+	ctx := context.Background()
+	user, version, err := dao.GetVersioned(ctx, "1")
+	require.Nil(t, err, "should not have err when getting user")
+
+	user.Name = "meow meow"
+	next, err := dao.UpdateIfMatch(ctx, user, version)
+	assert.Nil(t, err, "current version should update")
+	assert.NotEqual(t, version, next, "update should change the version")
+	_, err = dao.UpdateIfMatch(ctx, user, version)
+	assert.Equal(t, interfaces.ErrVersionConflict, err, "stale version should conflict")
+	assert.Equal(t, interfaces.ErrVersionConflict, dao.DeleteIfMatch(ctx, "1", version), "stale version should not delete")
+	assert.Nil(t, dao.DeleteIfMatch(ctx, "1", next), "current version should delete")
+	assert.Equal(t, interfaces.ErrNotFound, dao.DeleteIfMatch(ctx, "1", next), "missing user should not be found")
+}
+
+func TestUpsertUser(t *testing.T) {
+	dao := newSeededDao(t, 1)
+	ctx := context.Background()
+	created, err := dao.Upsert(ctx, models.User{ID: "legacy", Name: "metchee"})
+	assert.Nil(t, err, "should not have err when upserting")
+	assert.True(t, created, "missing user should be created")
+	created, err = dao.Upsert(ctx, models.User{ID: "legacy", Name: "meow"})
+	assert.Nil(t, err, "should not have err when upserting")
+	assert.False(t, created, "existing user should be replaced")
+	user, err := dao.GetById(ctx, "legacy")
+	assert.Nil(t, err, "should not have err when getting user")
+	assert.EqualValues(t, "meow", user.Name, "should store the last write")
+}
+
+func TestSoftDeleteAndRestore(t *testing.T) {
+	ctx := context.Background()
+	dao := newSeededDao(t, 2)
+	_, version, err := dao.GetVersioned(ctx, "1")
+	require.Nil(t, err, "should not have err when getting user")
+	require.Nil(t, dao.Delete(ctx, "1"), "should not have err when delete user")
+
+	_, err = dao.GetById(ctx, "1")
+	assert.Equal(t, interfaces.ErrNotFound, err, "deleted user should be hidden")
+	assert.Equal(t, interfaces.ErrNotFound, dao.Delete(ctx, "1"), "deleted user cannot be deleted twice")
+	users, err := dao.GetAll(ctx, 10, 0)
+	assert.Nil(t, err, "should not have err when listing users")
+	assert.Len(t, users, 1, "deleted user should not be listed")
+	deleted, err := dao.GetDeleted(ctx, 10, 0)
+	assert.Nil(t, err, "should not have err when listing deleted users")
+	require.Len(t, deleted, 1, "deleted user should be listed as deleted")
+	assert.NotZero(t, deleted[0].DeletedAt, "should say when the user was deleted")
+	id, err := dao.Create(ctx, models.User{Name: "metchee"})
+	assert.Nil(t, err, "should not have err when create user")
+	assert.EqualValues(t, "3", id, "ids of deleted users should not be reused")
+
+	require.Nil(t, dao.Restore(ctx, "1"), "should not have err when restoring")
+	user, restored, err := dao.GetVersioned(ctx, "1")
+	assert.Nil(t, err, "restored user should be found")
+	assert.Zero(t, user.DeletedAt, "restored user should not be marked")
+	assert.NotEqual(t, version, restored, "delete and restore should change the version")
+	assert.Equal(t, interfaces.ErrNotFound, dao.Restore(ctx, "1"), "live user cannot be restored")
+
+	require.Nil(t, dao.Delete(ctx, "2"), "should not have err when delete user")
+	purged, err := dao.Purge(ctx, int32(time.Now().Add(-time.Hour).Unix()))
+	assert.Nil(t, err, "should not have err when purging")
+	assert.Zero(t, purged, "users within retention should be kept")
+	purged, err = dao.Purge(ctx, int32(time.Now().Unix())+1)
+	assert.Nil(t, err, "should not have err when purging")
+	assert.EqualValues(t, 1, purged, "users past retention should be purged")
+	assert.Equal(t, interfaces.ErrNotFound, dao.Restore(ctx, "2"), "purged user cannot be restored")
+
+	_, err = dao.Upsert(ctx, models.User{ID: "2", Name: "metchee"})
+	require.Nil(t, err, "should not have err when upserting a purged id")
+	page, err := dao.GetHistory(ctx, "2", 10, 0)
+	require.Nil(t, err, "should not have err when getting history")
+	seen := map[string]bool{}
+	for _, change := range page.Changes {
+		assert.False(t, seen[change.Version], "versions should not repeat after a purge")
+		seen[change.Version] = true
+	}
+}
+
+func TestHistory(t *testing.T) {
+	ctx := audit.WithActor(context.Background(), "admin")
+	dao := newSeededDao(t, 0)
+	id, err := dao.Create(ctx, models.User{Name: "metchee", Address: "kent ridge 0"})
+	require.Nil(t, err, "should not have error when create user")
+	require.Nil(t, dao.Patch(ctx, id, map[string]interface{}{"address": "Kent Ridge"}), "should not have err when patch user")
+	require.Nil(t, dao.Delete(ctx, id), "should not have err when delete user")
+	require.Nil(t, dao.Restore(ctx, id), "should not have err when restoring")
+	_, version, err := dao.GetVersioned(ctx, id)
+	require.Nil(t, err, "should not have err when getting user")
+
+	page, err := dao.GetHistory(ctx, id, 10, 0)
+	require.Nil(t, err, "should not have err when getting history")
+	assert.EqualValues(t, 4, page.Total, "every write should be recorded")
+	require.Len(t, page.Changes, 4, "every write should be listed")
+	operations := []string{}
+	for _, change := range page.Changes {
+		operations = append(operations, change.Operation)
+		assert.Equal(t, id, change.UserID, "change should belong to the user")
+		assert.Equal(t, "admin", change.Actor, "change should carry the actor")
+	}
+	assert.Equal(t, []string{models.ChangeRestore, models.ChangeDelete, models.ChangePatch, models.ChangeCreate}, operations,
+		"newest change should come first")
+	assert.Equal(t, version, page.Changes[0].Version, "change should carry the version it left")
+	patch := page.Changes[2]
+	assert.Equal(t, map[string]models.FieldChange{
+		"address": {Before: "kent ridge 0", After: "Kent Ridge"},
+	}, patch.Diff, "patch should only change the address")
+	require.NotNil(t, patch.After, "patch should keep the patched user")
+	assert.Equal(t, "Kent Ridge", patch.After.Address, "patch should keep the patched user")
+	assert.Nil(t, page.Changes[1].After, "deleted user should not be kept")
+
+	page, err = dao.GetHistory(ctx, id, 1, 1)
+	assert.Nil(t, err, "should not have err when paging history")
+	require.Len(t, page.Changes, 1, "page should hold one change")
+	assert.Equal(t, models.ChangeDelete, page.Changes[0].Operation, "page should skip the newest change")
+	page, err = dao.GetHistory(ctx, "unknown", 10, 0)
+	assert.Nil(t, err, "should not have err for a user never written")
+	assert.Empty(t, page.Changes, "user never written should have no history")
+}
+
+func TestOutbox(t *testing.T) {
+	ctx := context.Background()
+	dao := newSeededDao(t, 1)
+	require.Nil(t, dao.EnableOutbox(ctx), "should not have error when enabling outbox")
+	id, err := dao.Create(ctx, models.User{Name: "metchee"})
+	require.Nil(t, err, "should not have error when create user")
+	require.Nil(t, dao.Delete(ctx, id), "should not have err when delete user")
+
+	records, err := dao.ReadOutbox(ctx, 0, 10)
+	require.Nil(t, err, "should not have err when reading outbox")
+	require.Len(t, records, 2, "writes should be in the outbox once enabled")
+	assert.EqualValues(t, 1, records[0].Offset, "offsets should follow the writes")
+	assert.Equal(t, models.ChangeCreate, records[0].Operation, "record should carry the change")
+	assert.Equal(t, id, records[1].UserID, "record should carry the user")
+
+	require.Nil(t, dao.TrimOutbox(ctx, 1), "should not have err when trimming outbox")
+	records, err = dao.ReadOutbox(ctx, 0, 10)
+	require.Nil(t, err, "should not have err when reading outbox")
+	require.Len(t, records, 1, "trimmed records should be gone")
+	assert.EqualValues(t, 2, records[0].Offset, "later records should be kept")
+}
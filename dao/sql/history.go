@@ -0,0 +1,104 @@
+package sql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/metildachee/userie/dao/audit"
+	"github.com/metildachee/userie/models"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+const historyColumns = "id, user_id, version, operation, actor, trace_id, changed_at, diff, snapshot"
+
+// record adds the change from before to after to the user's history inside
+// tx, after the write bumped the version. A deleted user's version is read
+// from deleted_users.
+func (dao *UserImplDao) record(ctx context.Context, tx queryer, operation string, before, after *models.User) error {
+	change, err := audit.NewChange(ctx, operation, before, after, "")
+	if err != nil {
+		return err
+	}
+	table := "users"
+	if after == nil {
+		table = "deleted_users"
+	}
+	var version int64
+	err = tx.QueryRowContext(ctx, dao.dialect.rebind(`SELECT version FROM `+table+` WHERE id = ?`), change.UserID).Scan(&version)
+	if err != nil {
+		return err
+	}
+	change.Version = strconv.FormatInt(version, 10)
+
+	diff, err := json.Marshal(change.Diff)
+	if err != nil {
+		return err
+	}
+	snapshot := []byte("null")
+	if change.After != nil {
+		if snapshot, err = json.Marshal(change.After); err != nil {
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx, dao.dialect.rebind(`INSERT INTO user_history (`+historyColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		change.ID, change.UserID, change.Version, change.Operation, change.Actor, change.TraceID,
+		change.Timestamp.UnixNano(), string(diff), string(snapshot))
+	if err != nil || !dao.outbox {
+		return err
+	}
+	return dao.addToOutbox(ctx, tx, change)
+}
+
+func (dao *UserImplDao) GetHistory(ctx context.Context, id string, limit, offset int) (page models.HistoryPage, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "sql get history")
+	defer span.Finish()
+	span.LogFields(log.String("doc id", id))
+
+	err = dao.db.QueryRowContext(ctx, dao.dialect.rebind(`SELECT COUNT(*) FROM user_history WHERE user_id = ?`), id).Scan(&page.Total)
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	query := `SELECT ` + historyColumns + ` FROM user_history WHERE user_id = ? ORDER BY changed_at DESC, id DESC` +
+		fmt.Sprintf(" LIMIT %d OFFSET %d", limit, offset)
+	rows, err := dao.db.QueryContext(ctx, dao.dialect.rebind(query), id)
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	defer rows.Close()
+	page.Changes = []models.Change{}
+	for rows.Next() {
+		change, err := scanChange(rows)
+		if err != nil {
+			ext.LogError(span, err)
+			return page, err
+		}
+		page.Changes = append(page.Changes, change)
+	}
+	if err = rows.Err(); err != nil {
+		ext.LogError(span, err)
+	}
+	return
+}
+
+func scanChange(row scanner) (change models.Change, err error) {
+	var changedAt int64
+	var diff, snapshot string
+	err = row.Scan(&change.ID, &change.UserID, &change.Version, &change.Operation, &change.Actor, &change.TraceID,
+		&changedAt, &diff, &snapshot)
+	if err != nil {
+		return
+	}
+	change.Timestamp = time.Unix(0, changedAt).UTC()
+	if err = json.Unmarshal([]byte(diff), &change.Diff); err != nil {
+		return
+	}
+	err = json.Unmarshal([]byte(snapshot), &change.After)
+	return
+}
@@ -0,0 +1,131 @@
+package sql
+
+import (
+	"context"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+// migrations are applied in order and recorded in schema_migrations by their
+// position, starting at 1. Only ever append to this list.
+var migrations = []string{
+	`CREATE TABLE users (
+		id          VARCHAR(64) NOT NULL PRIMARY KEY,
+		name        VARCHAR(255) NOT NULL,
+		dob         BIGINT NOT NULL,
+		address     TEXT NOT NULL,
+		description TEXT NOT NULL,
+		ctime       BIGINT NOT NULL
+	)`,
+	`CREATE INDEX users_name ON users (name)`,
+	`CREATE INDEX users_dob ON users (dob)`,
+	`CREATE INDEX users_ctime ON users (ctime)`,
+	`CREATE TABLE user_sequences (
+		name  VARCHAR(64) NOT NULL PRIMARY KEY,
+		value BIGINT NOT NULL
+	)`,
+	`ALTER TABLE users ADD COLUMN version BIGINT NOT NULL DEFAULT 1`,
+	`CREATE TABLE deleted_users (
+		id          VARCHAR(64) NOT NULL PRIMARY KEY,
+		name        VARCHAR(255) NOT NULL,
+		dob         BIGINT NOT NULL,
+		address     TEXT NOT NULL,
+		description TEXT NOT NULL,
+		ctime       BIGINT NOT NULL,
+		version     BIGINT NOT NULL,
+		deleted_at  BIGINT NOT NULL
+	)`,
+	`CREATE INDEX deleted_users_deleted_at ON deleted_users (deleted_at)`,
+	`CREATE TABLE user_history (
+		id         VARCHAR(64) NOT NULL PRIMARY KEY,
+		user_id    VARCHAR(64) NOT NULL,
+		version    VARCHAR(64) NOT NULL,
+		operation  VARCHAR(16) NOT NULL,
+		actor      VARCHAR(255) NOT NULL,
+		trace_id   VARCHAR(64) NOT NULL,
+		changed_at BIGINT NOT NULL,
+		diff       TEXT NOT NULL,
+		snapshot   TEXT NOT NULL
+	)`,
+	`CREATE INDEX user_history_user_id ON user_history (user_id, changed_at)`,
+	`CREATE TABLE user_outbox (
+		seq    BIGINT NOT NULL PRIMARY KEY,
+		record TEXT NOT NULL
+	)`,
+	`CREATE TABLE webhooks (
+		id    VARCHAR(64) NOT NULL PRIMARY KEY,
+		ctime BIGINT NOT NULL,
+		doc   TEXT NOT NULL
+	)`,
+	`CREATE TABLE webhook_deliveries (
+		id         VARCHAR(64) NOT NULL PRIMARY KEY,
+		seq        BIGINT NOT NULL,
+		webhook_id VARCHAR(64) NOT NULL,
+		doc        TEXT NOT NULL
+	)`,
+	`CREATE INDEX webhook_deliveries_webhook_id ON webhook_deliveries (webhook_id, seq)`,
+	`CREATE TABLE webhook_dead_letters (
+		id         VARCHAR(64) NOT NULL PRIMARY KEY,
+		seq        BIGINT NOT NULL,
+		webhook_id VARCHAR(64) NOT NULL,
+		doc        TEXT NOT NULL
+	)`,
+	`CREATE INDEX webhook_dead_letters_webhook_id ON webhook_dead_letters (webhook_id, seq)`,
+	`CREATE TABLE webhook_pending (
+		id         VARCHAR(64) NOT NULL PRIMARY KEY,
+		webhook_id VARCHAR(64) NOT NULL,
+		touched    BIGINT NOT NULL,
+		doc        TEXT NOT NULL
+	)`,
+	`CREATE INDEX webhook_pending_touched ON webhook_pending (touched)`,
+	`CREATE TABLE outbox_lease (
+		name       VARCHAR(64) NOT NULL PRIMARY KEY,
+		holder     VARCHAR(255) NOT NULL,
+		expires_at BIGINT NOT NULL,
+		committed  BIGINT NOT NULL
+	)`,
+	`INSERT INTO outbox_lease (name, holder, expires_at, committed) VALUES ('outbox', '', 0, 0)`,
+}
+
+// Migrate brings the schema up to date.
+func (dao *UserImplDao) Migrate(ctx context.Context) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "sql migrate")
+	defer span.Finish()
+
+	_, err := dao.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER NOT NULL PRIMARY KEY)`)
+	if err != nil {
+		ext.LogError(span, err)
+		return err
+	}
+	var current int
+	if err := dao.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		ext.LogError(span, err)
+		return err
+	}
+
+	for version := current + 1; version <= len(migrations); version++ {
+		tx, err := dao.db.BeginTx(ctx, nil)
+		if err != nil {
+			ext.LogError(span, err)
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, migrations[version-1]); err != nil {
+			tx.Rollback()
+			ext.LogError(span, err)
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, dao.dialect.rebind(`INSERT INTO schema_migrations (version) VALUES (?)`), version); err != nil {
+			tx.Rollback()
+			ext.LogError(span, err)
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			ext.LogError(span, err)
+			return err
+		}
+		span.LogFields(log.Int("applied migration", version))
+	}
+	return nil
+}
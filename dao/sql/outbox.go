@@ -0,0 +1,135 @@
+package sql
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/metildachee/userie/dao/interfaces"
+	"github.com/metildachee/userie/models"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+// outboxSequence names the user_sequences row numbering the outbox. Bumping
+// it locks the row until the write commits, so offsets become visible in
+// order.
+const outboxSequence = "outbox"
+
+// outboxLease names the outbox_lease row of the relay publishing the outbox.
+const outboxLease = "outbox"
+
+// addToOutbox writes change to user_outbox inside the write's tx.
+func (dao *UserImplDao) addToOutbox(ctx context.Context, tx queryer, change models.Change) error {
+	offset, err := dao.bump(ctx, tx, outboxSequence)
+	if err != nil {
+		return err
+	}
+	doc, err := json.Marshal(models.OutboxRecord{Offset: offset, Change: change})
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, dao.dialect.rebind(`INSERT INTO user_outbox (seq, record) VALUES (?, ?)`), offset, string(doc))
+	return err
+}
+
+func (dao *UserImplDao) EnableOutbox(ctx context.Context) error {
+	dao.outbox = true
+	return nil
+}
+
+func (dao *UserImplDao) ReadOutbox(ctx context.Context, after int64, limit int) (records []models.OutboxRecord, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "sql read outbox")
+	defer span.Finish()
+
+	rows, err := dao.db.QueryContext(ctx, dao.dialect.rebind(`SELECT record FROM user_outbox WHERE seq > ? ORDER BY seq LIMIT ?`), after, limit)
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	defer rows.Close()
+
+	records = []models.OutboxRecord{}
+	for rows.Next() {
+		var (
+			doc    string
+			record models.OutboxRecord
+		)
+		if err = rows.Scan(&doc); err != nil {
+			ext.LogError(span, err)
+			return
+		}
+		if err = json.Unmarshal([]byte(doc), &record); err != nil {
+			ext.LogError(span, err)
+			return
+		}
+		records = append(records, record)
+	}
+	if err = rows.Err(); err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	span.LogFields(log.Int64("after", after), log.Int("records", len(records)))
+	return
+}
+
+func (dao *UserImplDao) TrimOutbox(ctx context.Context, through int64) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "sql trim outbox")
+	defer span.Finish()
+
+	res, err := dao.db.ExecContext(ctx, dao.dialect.rebind(`DELETE FROM user_outbox WHERE seq <= ?`), through)
+	if err != nil {
+		ext.LogError(span, err)
+		return err
+	}
+	trimmed, _ := res.RowsAffected()
+	span.LogFields(log.Int64("through", through), log.Int64("records", trimmed))
+	return nil
+}
+
+// ClaimOutbox follows models.OutboxLease in a single conditional update. The
+// expiry always changes, so even MySQL counts a renewed row as affected.
+func (dao *UserImplDao) ClaimOutbox(ctx context.Context, holder string, ttl time.Duration) (committed int64, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "sql claim outbox")
+	defer span.Finish()
+
+	now := time.Now()
+	res, err := dao.db.ExecContext(ctx, dao.dialect.rebind(`UPDATE outbox_lease SET holder = ?, expires_at = ? WHERE name = ? AND (holder = ? OR expires_at <= ?)`),
+		holder, now.Add(ttl).UnixNano(), outboxLease, holder, now.UnixNano())
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return 0, err
+	} else if n == 0 {
+		return 0, interfaces.ErrOutboxLeased
+	}
+	err = dao.db.QueryRowContext(ctx, dao.dialect.rebind(`SELECT committed FROM outbox_lease WHERE name = ?`), outboxLease).Scan(&committed)
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	span.LogFields(log.String("holder", holder), log.Int64("committed", committed))
+	return
+}
+
+func (dao *UserImplDao) CommitOutbox(ctx context.Context, holder string, offset int64, ttl time.Duration) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "sql commit outbox")
+	defer span.Finish()
+
+	res, err := dao.db.ExecContext(ctx, dao.dialect.rebind(`UPDATE outbox_lease SET committed = ?, expires_at = ? WHERE name = ? AND holder = ?`),
+		offset, time.Now().Add(ttl).UnixNano(), outboxLease, holder)
+	if err != nil {
+		ext.LogError(span, err)
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return interfaces.ErrOutboxLeased
+	}
+	span.LogFields(log.String("holder", holder), log.Int64("offset", offset))
+	return nil
+}
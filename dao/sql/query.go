@@ -0,0 +1,186 @@
+package sql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/metildachee/userie/models"
+)
+
+const (
+	userColumns = "id, name, dob, address, description, ctime"
+	likeEscape  = "!"
+)
+
+// sortColumns maps user facing sort fields onto columns.
+var sortColumns = map[string]string{
+	"name":  "name",
+	"dob":   "dob",
+	"ctime": "ctime",
+}
+
+// dialect papers over the placeholder differences between drivers. Queries
+// are written with "?" and rebound for drivers that number their parameters.
+type dialect struct {
+	numbered bool
+}
+
+func dialectFor(driver string) dialect {
+	switch driver {
+	case "postgres", "pgx":
+		return dialect{numbered: true}
+	}
+	return dialect{}
+}
+
+func (d dialect) rebind(query string) string {
+	if !d.numbered {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// where collects the conditions of a select and their arguments.
+type where struct {
+	conds []string
+	args  []interface{}
+}
+
+func (w *where) add(cond string, args ...interface{}) {
+	w.conds = append(w.conds, cond)
+	w.args = append(w.args, args...)
+}
+
+func (w *where) String() string {
+	if len(w.conds) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(w.conds, " AND ")
+}
+
+func (w *where) filter(filters ...models.UserFilter) {
+	for _, f := range filters {
+		if f.DobFrom != nil {
+			w.add("dob >= ?", *f.DobFrom)
+		}
+		if f.DobTo != nil {
+			w.add("dob <= ?", *f.DobTo)
+		}
+		if f.CtimeFrom != nil {
+			w.add("ctime >= ?", *f.CtimeFrom)
+		}
+		if f.CtimeTo != nil {
+			w.add("ctime <= ?", *f.CtimeTo)
+		}
+		if f.NamePrefix != "" {
+			// compared exactly rather than with LIKE, which ignores case on
+			// some databases
+			w.add(fmt.Sprintf("SUBSTR(name, 1, %d) = ?", utf8.RuneCountInString(f.NamePrefix)), f.NamePrefix)
+		}
+	}
+}
+
+// after restricts a select to the rows ordered after u, mirroring orderBy.
+func (w *where) after(u models.User, sorts []models.SortField) {
+	var (
+		ors    []string
+		args   []interface{}
+		eqs    []string
+		eqArgs []interface{}
+	)
+	keys := append(sortKeys(sorts), sortKey{column: "id"})
+	for _, key := range keys {
+		op := ">"
+		if key.desc {
+			op = "<"
+		}
+		value := columnValue(u, key.column)
+		cond := append(append([]string{}, eqs...), key.column+" "+op+" ?")
+		ors = append(ors, "("+strings.Join(cond, " AND ")+")")
+		args = append(append(args, eqArgs...), value)
+		eqs = append(eqs, key.column+" = ?")
+		eqArgs = append(eqArgs, value)
+	}
+	w.add("("+strings.Join(ors, " OR ")+")", args...)
+}
+
+// search restricts a select to rows where any text field contains any of the
+// terms, ignoring case.
+func (w *where) search(terms []string) {
+	var ors []string
+	var args []interface{}
+	for _, term := range terms {
+		pattern := "%" + escapeLike(strings.ToLower(term)) + "%"
+		for _, column := range []string{"name", "address", "description"} {
+			ors = append(ors, "LOWER("+column+") LIKE ? ESCAPE '"+likeEscape+"'")
+			args = append(args, pattern)
+		}
+	}
+	if len(ors) > 0 {
+		w.add("("+strings.Join(ors, " OR ")+")", args...)
+	}
+}
+
+func escapeLike(value string) string {
+	return strings.NewReplacer(likeEscape, likeEscape+likeEscape, "%", likeEscape+"%", "_", likeEscape+"_").Replace(value)
+}
+
+type sortKey struct {
+	column string
+	desc   bool
+}
+
+func sortKeys(sorts []models.SortField) (keys []sortKey) {
+	for _, s := range sorts {
+		if column, ok := sortColumns[s.Field]; ok {
+			keys = append(keys, sortKey{column: column, desc: s.Desc})
+		}
+	}
+	return
+}
+
+func sortsOf(filters ...models.UserFilter) (sorts []models.SortField) {
+	for _, f := range filters {
+		sorts = append(sorts, f.Sort...)
+	}
+	return
+}
+
+// orderBy orders by sorts with ties broken by id, so every listing has a
+// total order.
+func orderBy(sorts []models.SortField) string {
+	var parts []string
+	for _, key := range sortKeys(sorts) {
+		direction := "ASC"
+		if key.desc {
+			direction = "DESC"
+		}
+		parts = append(parts, key.column+" "+direction)
+	}
+	parts = append(parts, "id ASC")
+	return " ORDER BY " + strings.Join(parts, ", ")
+}
+
+func columnValue(u models.User, column string) interface{} {
+	switch column {
+	case "name":
+		return u.Name
+	case "dob":
+		return u.DOB
+	case "ctime":
+		return u.Ctime
+	}
+	return u.ID
+}
@@ -0,0 +1,687 @@
+// Package sql stores users in a relational database through database/sql.
+// SQLite, Postgres and MySQL are supported; the caller registers the driver.
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/metildachee/userie/dao/interfaces"
+	"github.com/metildachee/userie/dao/internal/listing"
+	"github.com/metildachee/userie/dao/internal/uuid"
+	"github.com/metildachee/userie/models"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+const (
+	// maxIdAttempts bounds how many ids create tries when a generated id is
+	// already taken.
+	maxIdAttempts = 100
+	sequenceName  = "users"
+)
+
+var (
+	_ interfaces.UserDao = (*UserImplDao)(nil)
+	_ interfaces.Outbox  = (*UserImplDao)(nil)
+)
+
+type UserImplDao struct {
+	db          *sql.DB
+	dialect     dialect
+	idGenerator string
+	// outbox is set once changes are also written to user_outbox
+	outbox bool
+}
+
+// NewDao opens dsn with driver and migrates the schema. idGenerator is one of
+// the models.IdGenerator kinds; auto and sequence both draw from a counter
+// table, uuidv7 generates ids in process.
+func NewDao(ctx context.Context, driver, dsn, idGenerator string) (*UserImplDao, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "get new sql dao")
+	defer span.Finish()
+
+	switch idGenerator {
+	case models.IdGeneratorAuto, models.IdGeneratorSequence, models.IdGeneratorUUIDv7:
+	default:
+		return nil, fmt.Errorf("unknown id generator %q", idGenerator)
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		ext.LogError(span, err)
+		return nil, err
+	}
+	if driver == "sqlite3" {
+		// sqlite allows a single writer, serialise rather than fail with
+		// "database is locked"
+		db.SetMaxOpenConns(1)
+	}
+	if err := db.PingContext(ctx); err != nil {
+		ext.LogError(span, err)
+		db.Close()
+		return nil, err
+	}
+
+	dao := &UserImplDao{db: db, dialect: dialectFor(driver), idGenerator: idGenerator}
+	if err := dao.Migrate(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	span.LogFields(log.String("driver", driver))
+	return dao, nil
+}
+
+func (dao *UserImplDao) Close() error {
+	return dao.db.Close()
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanUser(row scanner) (u models.User, err error) {
+	err = row.Scan(&u.ID, &u.Name, &u.DOB, &u.Address, &u.Description, &u.Ctime)
+	return
+}
+
+func (dao *UserImplDao) get(ctx context.Context, q queryer, id string) (models.User, error) {
+	row := q.QueryRowContext(ctx, dao.dialect.rebind(`SELECT `+userColumns+` FROM users WHERE id = ?`), id)
+	u, err := scanUser(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return u, interfaces.ErrNotFound
+	}
+	return u, err
+}
+
+func (dao *UserImplDao) selectUsers(ctx context.Context, w *where, suffix string) (users []models.User, err error) {
+	rows, err := dao.db.QueryContext(ctx, dao.dialect.rebind(`SELECT `+userColumns+` FROM users`+w.String()+suffix), w.args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	users = []models.User{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func (dao *UserImplDao) GetAll(ctx context.Context, limit, offset int, filter ...models.UserFilter) (users []models.User, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "sql get all")
+	defer span.Finish()
+
+	w := &where{}
+	w.filter(filter...)
+	suffix := orderBy(sortsOf(filter...)) + fmt.Sprintf(" LIMIT %d OFFSET %d", limit, offset)
+	if users, err = dao.selectUsers(ctx, w, suffix); err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	span.LogFields(log.Int("users", len(users)))
+	return
+}
+
+// GetAllAfter pages with a keyset condition on the sort columns and id, so
+// pages stay free of skips and duplicates while rows are written.
+func (dao *UserImplDao) GetAllAfter(ctx context.Context, token string, limit int, filter ...models.UserFilter) (users []models.User, next string, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "sql get all after")
+	defer span.Finish()
+
+	var c listing.Cursor
+	if token != "" {
+		if c, err = listing.DecodeCursor(token); err != nil {
+			ext.LogError(span, err)
+			return
+		}
+	} else if len(filter) > 0 {
+		c.Filter = filter[0]
+	}
+
+	w := &where{}
+	w.filter(c.Filter)
+	if c.After != nil {
+		w.after(*c.After, c.Filter.Sort)
+	}
+	suffix := orderBy(c.Filter.Sort) + fmt.Sprintf(" LIMIT %d", limit)
+	if users, err = dao.selectUsers(ctx, w, suffix); err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	if len(users) < limit {
+		return users, "", nil
+	}
+	c.After = &users[len(users)-1]
+	next, err = c.Encode()
+	return
+}
+
+// Search narrows rows down with LIKE and ranks the candidates the same way
+// the in process backends do.
+func (dao *UserImplDao) Search(ctx context.Context, text string, limit, offset int) (result models.SearchResult, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "sql search")
+	defer span.Finish()
+
+	terms := strings.Fields(text)
+	if len(terms) == 0 {
+		return listing.Search(nil, text, limit, offset), nil
+	}
+	w := &where{}
+	w.search(terms)
+	candidates, err := dao.selectUsers(ctx, w, "")
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	result = listing.Search(candidates, text, limit, offset)
+	span.LogFields(log.Int64("total hits", result.Total))
+	return
+}
+
+func (dao *UserImplDao) GetById(ctx context.Context, id string) (models.User, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "sql by id")
+	defer span.Finish()
+
+	return dao.get(ctx, dao.db, id)
+}
+
+func (dao *UserImplDao) Create(ctx context.Context, new models.User) (id string, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "sql create item")
+	defer span.Finish()
+
+	for attempt := 0; attempt < maxIdAttempts; attempt++ {
+		if new.ID, err = dao.nextId(ctx); err != nil {
+			ext.LogError(span, err)
+			return
+		}
+		created, err := dao.insert(ctx, new)
+		if err != nil {
+			ext.LogError(span, err)
+			return id, err
+		}
+		if created {
+			span.LogFields(log.String("user doc", new.ID))
+			return new.ID, nil
+		}
+		span.LogFields(log.String("id taken", new.ID))
+	}
+	err = fmt.Errorf("no free id after %d attempts", maxIdAttempts)
+	ext.LogError(span, err)
+	return
+}
+
+// insert stores u unless its id is already taken, by a live or a deleted
+// user.
+func (dao *UserImplDao) insert(ctx context.Context, u models.User) (created bool, err error) {
+	tx, err := dao.db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err = dao.get(ctx, tx, u.ID); err == nil {
+		return false, nil
+	} else if !errors.Is(err, interfaces.ErrNotFound) {
+		return
+	}
+	var deleted int
+	err = tx.QueryRowContext(ctx, dao.dialect.rebind(`SELECT COUNT(*) FROM deleted_users WHERE id = ?`), u.ID).Scan(&deleted)
+	if err != nil || deleted > 0 {
+		return
+	}
+	if err = dao.insertRow(ctx, tx, u); err != nil {
+		return
+	}
+	if err = dao.record(ctx, tx, models.ChangeCreate, nil, &u); err != nil {
+		return
+	}
+	return true, tx.Commit()
+}
+
+func (dao *UserImplDao) insertRow(ctx context.Context, q queryer, u models.User) error {
+	_, err := q.ExecContext(ctx, dao.dialect.rebind(`INSERT INTO users (`+userColumns+`) VALUES (?, ?, ?, ?, ?, ?)`),
+		u.ID, u.Name, u.DOB, u.Address, u.Description, u.Ctime)
+	return err
+}
+
+func (dao *UserImplDao) nextId(ctx context.Context) (string, error) {
+	if dao.idGenerator == models.IdGeneratorUUIDv7 {
+		return uuid.NewV7(time.Now())
+	}
+	value, err := dao.nextSequence(ctx)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(value, 10), nil
+}
+
+// nextSequence bumps the counter row. The update locks the row until commit,
+// so concurrent instances never read the same value.
+func (dao *UserImplDao) nextSequence(ctx context.Context) (value int64, err error) {
+	tx, err := dao.db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	if value, err = dao.bump(ctx, tx, sequenceName); err != nil {
+		return
+	}
+	return value, tx.Commit()
+}
+
+// bump increments the named counter row inside tx and returns its new value.
+func (dao *UserImplDao) bump(ctx context.Context, tx queryer, name string) (value int64, err error) {
+	res, err := tx.ExecContext(ctx, dao.dialect.rebind(`UPDATE user_sequences SET value = value + 1 WHERE name = ?`), name)
+	if err != nil {
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return value, err
+	} else if n == 0 {
+		if _, err := tx.ExecContext(ctx, dao.dialect.rebind(`INSERT INTO user_sequences (name, value) VALUES (?, 1)`), name); err != nil {
+			return value, err
+		}
+	}
+	err = tx.QueryRowContext(ctx, dao.dialect.rebind(`SELECT value FROM user_sequences WHERE name = ?`), name).Scan(&value)
+	return
+}
+
+func (dao *UserImplDao) BatchCreate(ctx context.Context, new []models.User) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "sql batch item")
+	defer span.Finish()
+
+	for _, item := range new {
+		if _, err := dao.Create(ctx, item); err != nil {
+			ext.LogError(span, err)
+			return err
+		}
+	}
+	span.LogKV("batch index done")
+	return nil
+}
+
+// replace overwrites the row of u.ID inside tx and records the change as
+// operation. The row is looked up first because MySQL reports unchanged rows
+// as not affected.
+func (dao *UserImplDao) replace(ctx context.Context, tx *sql.Tx, operation string, u models.User) error {
+	old, err := dao.get(ctx, tx, u.ID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, dao.dialect.rebind(`UPDATE users SET name = ?, dob = ?, address = ?, description = ?, ctime = ?, version = version + 1 WHERE id = ?`),
+		u.Name, u.DOB, u.Address, u.Description, u.Ctime, u.ID)
+	if err != nil {
+		return err
+	}
+	return dao.record(ctx, tx, operation, &old, &u)
+}
+
+func (dao *UserImplDao) BulkCreate(ctx context.Context, new []models.User) ([]models.BulkItemResult, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "sql bulk create")
+	defer span.Finish()
+
+	results := make([]models.BulkItemResult, len(new))
+	for i, item := range new {
+		results[i] = models.CreateResult(dao.Create(ctx, item))
+	}
+	span.LogFields(log.Int("users", len(new)))
+	return results, nil
+}
+
+func (dao *UserImplDao) Update(ctx context.Context, updated models.User) (err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "sql update item")
+	defer span.Finish()
+
+	tx, err := dao.db.BeginTx(ctx, nil)
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	defer tx.Rollback()
+	if err = dao.replace(ctx, tx, models.ChangeUpdate, updated); err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	return tx.Commit()
+}
+
+func (dao *UserImplDao) Upsert(ctx context.Context, u models.User) (created bool, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "sql upsert item")
+	defer span.Finish()
+
+	tx, err := dao.db.BeginTx(ctx, nil)
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	defer tx.Rollback()
+	err = dao.replace(ctx, tx, models.ChangeUpdate, u)
+	if errors.Is(err, interfaces.ErrNotFound) {
+		created = true
+		// a deleted user under the id is replaced, and cannot be restored anymore
+		if _, err = tx.ExecContext(ctx, dao.dialect.rebind(`DELETE FROM deleted_users WHERE id = ?`), u.ID); err == nil {
+			if err = dao.insertRow(ctx, tx, u); err == nil {
+				err = dao.record(ctx, tx, models.ChangeCreate, nil, &u)
+			}
+		}
+	}
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	return created, tx.Commit()
+}
+
+func (dao *UserImplDao) Patch(ctx context.Context, id string, fields map[string]interface{}) (err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "sql patch item")
+	defer span.Finish()
+
+	tx, err := dao.db.BeginTx(ctx, nil)
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	defer tx.Rollback()
+	u, err := dao.get(ctx, tx, id)
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	if err = models.ApplyFields(&u, fields); err != nil {
+		return
+	}
+	u.ID = id
+	if err = dao.replace(ctx, tx, models.ChangePatch, u); err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	return tx.Commit()
+}
+
+func (dao *UserImplDao) UpdateUserName(ctx context.Context, id, newName string) error {
+	return dao.Patch(ctx, id, map[string]interface{}{"name": newName})
+}
+
+func (dao *UserImplDao) Delete(ctx context.Context, id string) (err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "sql delete item")
+	defer span.Finish()
+	span.LogFields(log.String("doc id", id))
+
+	tx, err := dao.db.BeginTx(ctx, nil)
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	defer tx.Rollback()
+	current, err := dao.getVersion(ctx, tx, id)
+	if err != nil {
+		return
+	}
+	if err = dao.softDelete(ctx, tx, id, current); err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	return tx.Commit()
+}
+
+// softDelete moves the row of id, while it is still at version, to the
+// deleted_users table, bumps its version and records the delete.
+func (dao *UserImplDao) softDelete(ctx context.Context, tx *sql.Tx, id string, version int64) error {
+	old, err := dao.get(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx, dao.dialect.rebind(`INSERT INTO deleted_users (`+userColumns+`, version, deleted_at)
+		SELECT `+userColumns+`, version + 1, ? FROM users WHERE id = ? AND version = ?`),
+		time.Now().Unix(), id, version)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return interfaces.ErrVersionConflict
+	}
+	if _, err = tx.ExecContext(ctx, dao.dialect.rebind(`DELETE FROM users WHERE id = ?`), id); err != nil {
+		return err
+	}
+	return dao.record(ctx, tx, models.ChangeDelete, &old, nil)
+}
+
+// getVersion reads the version column of a user, every write bumps it.
+func (dao *UserImplDao) getVersion(ctx context.Context, q queryer, id string) (version int64, err error) {
+	err = q.QueryRowContext(ctx, dao.dialect.rebind(`SELECT version FROM users WHERE id = ?`), id).Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, interfaces.ErrNotFound
+	}
+	return
+}
+
+// checkVersion compares the stored version of a user with the expected one.
+// Rows are changed with the version in their WHERE clause as well, so a write
+// that slips in between still loses.
+func (dao *UserImplDao) checkVersion(ctx context.Context, q queryer, id, expected string) (int64, error) {
+	version, err := dao.getVersion(ctx, q, id)
+	if err != nil {
+		return 0, err
+	}
+	if strconv.FormatInt(version, 10) != expected {
+		return 0, interfaces.ErrVersionConflict
+	}
+	return version, nil
+}
+
+func (dao *UserImplDao) GetVersioned(ctx context.Context, id string) (user models.User, version string, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "sql versioned by id")
+	defer span.Finish()
+
+	tx, err := dao.db.BeginTx(ctx, nil)
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	defer tx.Rollback()
+	if user, err = dao.get(ctx, tx, id); err != nil {
+		return
+	}
+	current, err := dao.getVersion(ctx, tx, id)
+	if err != nil {
+		return
+	}
+	return user, strconv.FormatInt(current, 10), tx.Commit()
+}
+
+func (dao *UserImplDao) UpdateIfMatch(ctx context.Context, updated models.User, expected string) (version string, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "sql conditional update item")
+	defer span.Finish()
+
+	tx, err := dao.db.BeginTx(ctx, nil)
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	defer tx.Rollback()
+	current, err := dao.checkVersion(ctx, tx, updated.ID, expected)
+	if err != nil {
+		return
+	}
+	if err = dao.replaceIfMatch(ctx, tx, models.ChangeUpdate, updated, current); err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	return strconv.FormatInt(current+1, 10), tx.Commit()
+}
+
+// replaceIfMatch overwrites the row of u.ID inside tx while it is still at
+// version, and records the change as operation.
+func (dao *UserImplDao) replaceIfMatch(ctx context.Context, tx *sql.Tx, operation string, u models.User, version int64) error {
+	old, err := dao.get(ctx, tx, u.ID)
+	if err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx, dao.dialect.rebind(`UPDATE users SET name = ?, dob = ?, address = ?, description = ?, ctime = ?, version = version + 1 WHERE id = ? AND version = ?`),
+		u.Name, u.DOB, u.Address, u.Description, u.Ctime, u.ID, version)
+	if err != nil {
+		return err
+	}
+	// the version always changes, so even MySQL counts the row as affected
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return interfaces.ErrVersionConflict
+	}
+	return dao.record(ctx, tx, operation, &old, &u)
+}
+
+func (dao *UserImplDao) PatchIfMatch(ctx context.Context, id string, fields map[string]interface{}, expected string) (version string, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "sql conditional patch item")
+	defer span.Finish()
+
+	tx, err := dao.db.BeginTx(ctx, nil)
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	defer tx.Rollback()
+	current, err := dao.checkVersion(ctx, tx, id, expected)
+	if err != nil {
+		return
+	}
+	u, err := dao.get(ctx, tx, id)
+	if err != nil {
+		return
+	}
+	if err = models.ApplyFields(&u, fields); err != nil {
+		return
+	}
+	u.ID = id
+	if err = dao.replaceIfMatch(ctx, tx, models.ChangePatch, u, current); err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	return strconv.FormatInt(current+1, 10), tx.Commit()
+}
+
+func (dao *UserImplDao) DeleteIfMatch(ctx context.Context, id, expected string) (err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "sql conditional delete item")
+	defer span.Finish()
+	span.LogFields(log.String("doc id", id))
+
+	tx, err := dao.db.BeginTx(ctx, nil)
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	defer tx.Rollback()
+	current, err := dao.checkVersion(ctx, tx, id, expected)
+	if err != nil {
+		return
+	}
+	if err = dao.softDelete(ctx, tx, id, current); err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	return tx.Commit()
+}
+
+func (dao *UserImplDao) Restore(ctx context.Context, id string) (err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "sql restore item")
+	defer span.Finish()
+	span.LogFields(log.String("doc id", id))
+
+	tx, err := dao.db.BeginTx(ctx, nil)
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, dao.dialect.rebind(`INSERT INTO users (`+userColumns+`, version)
+		SELECT `+userColumns+`, version + 1 FROM deleted_users WHERE id = ?`), id)
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return interfaces.ErrNotFound
+	}
+	if _, err = tx.ExecContext(ctx, dao.dialect.rebind(`DELETE FROM deleted_users WHERE id = ?`), id); err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	u, err := dao.get(ctx, tx, id)
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	if err = dao.record(ctx, tx, models.ChangeRestore, nil, &u); err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	return tx.Commit()
+}
+
+func (dao *UserImplDao) GetDeleted(ctx context.Context, limit, offset int) (users []models.User, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "sql get deleted")
+	defer span.Finish()
+
+	query := `SELECT ` + userColumns + `, deleted_at FROM deleted_users ORDER BY deleted_at DESC, id` +
+		fmt.Sprintf(" LIMIT %d OFFSET %d", limit, offset)
+	rows, err := dao.db.QueryContext(ctx, query)
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	defer rows.Close()
+	users = []models.User{}
+	for rows.Next() {
+		var u models.User
+		if err = rows.Scan(&u.ID, &u.Name, &u.DOB, &u.Address, &u.Description, &u.Ctime, &u.DeletedAt); err != nil {
+			ext.LogError(span, err)
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	if err = rows.Err(); err != nil {
+		ext.LogError(span, err)
+		return nil, err
+	}
+	span.LogFields(log.Int("users", len(users)))
+	return
+}
+
+func (dao *UserImplDao) Purge(ctx context.Context, before int32) (purged int64, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "sql purge")
+	defer span.Finish()
+
+	res, err := dao.db.ExecContext(ctx, dao.dialect.rebind(`DELETE FROM deleted_users WHERE deleted_at < ?`), before)
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	if purged, err = res.RowsAffected(); err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	span.LogFields(log.Int64("purged", purged))
+	return
+}
@@ -0,0 +1,333 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/metildachee/userie/dao/audit"
+	"github.com/metildachee/userie/dao/interfaces"
+	"github.com/metildachee/userie/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestDao(t *testing.T) (*UserImplDao, string) {
+	dir, err := ioutil.TempDir("", "userie-sql")
+	require.Nil(t, err, "should not have error when making temp dir")
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	dsn := filepath.Join(dir, "userie.sqlite")
+	dao, err := NewDao(context.Background(), "sqlite3", dsn, models.IdGeneratorSequence)
+	require.Nil(t, err, "should not have error when init")
+	t.Cleanup(func() { dao.Close() })
+	return dao, dsn
+}
+
+func newUser(i int) models.User {
+	return models.User{
+		Name:        fmt.Sprintf("metchee %d", i),
+		DOB:         int32(time.Now().AddDate(-20, 0, i).Unix()),
+		Address:     fmt.Sprintf("kent ridge %d", i),
+		Description: fmt.Sprintf("default user info %d", i),
+		Ctime:       int32(time.Now().AddDate(0, 0, -(i % 3)).Unix()),
+	}
+}
+
+func seed(t *testing.T, dao *UserImplDao, numOfUsers int) {
+	for i := 0; i < numOfUsers; i++ {
+		_, err := dao.Create(context.Background(), newUser(i))
+		require.Nil(t, err, "should not have error when create user")
+	}
+}
+
+func TestRebind(t *testing.T) {
+	query := `SELECT id FROM users WHERE name = ? AND dob > ?`
+	assert.EqualValues(t, query, dialectFor("sqlite3").rebind(query), "sqlite keeps question marks")
+	assert.EqualValues(t, `SELECT id FROM users WHERE name = $1 AND dob > $2`, dialectFor("postgres").rebind(query), "postgres numbers parameters")
+}
+
+func TestMigrateIsIdempotent(t *testing.T) {
+	dao, dsn := newTestDao(t)
+	seed(t, dao, 1)
+	require.Nil(t, dao.Close(), "should not have error when closing")
+
+	dao, err := NewDao(context.Background(), "sqlite3", dsn, models.IdGeneratorSequence)
+	require.Nil(t, err, "reopening should not reapply migrations")
+	defer dao.Close()
+	id, err := dao.Create(context.Background(), newUser(1))
+	assert.Nil(t, err, "should not have error when create user")
+	assert.EqualValues(t, "2", id, "sequence should survive restarts")
+}
+
+func TestCreateAndGetUser(t *testing.T) {
+	dao, _ := newTestDao(t)
+	ctx := context.Background()
+	id, err := dao.Create(ctx, newUser(0))
+	require.Nil(t, err, "should not have error when create user")
+	assert.EqualValues(t, "1", id, "ids should follow the sequence")
+
+	user, err := dao.GetById(ctx, id)
+	assert.Nil(t, err, "should not have err when getting user")
+	assert.EqualValues(t, newUser(0).Name, user.Name, "should read back the stored user")
+	_, err = dao.GetById(ctx, "404")
+	assert.Equal(t, interfaces.ErrNotFound, err, "missing user should not be found")
+}
+
+func TestCreateUserWithUUID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "userie-sql")
+	require.Nil(t, err, "should not have error when making temp dir")
+	defer os.RemoveAll(dir)
+	dao, err := NewDao(context.Background(), "sqlite3", filepath.Join(dir, "userie.sqlite"), models.IdGeneratorUUIDv7)
+	require.Nil(t, err, "should not have error when init")
+	defer dao.Close()
+
+	id, err := dao.Create(context.Background(), newUser(0))
+	assert.Nil(t, err, "should not have error when create user")
+	assert.Len(t, id, 36, "should be a uuid")
+}
+
+func TestGetUsersWithFilter(t *testing.T) {
+	dao, _ := newTestDao(t)
+	seed(t, dao, 6)
+	u := newUser(9)
+	u.Name = "Metchee upper"
+	_, err := dao.Create(context.Background(), u)
+	require.Nil(t, err, "should not have error when create user")
+
+	filter := models.UserFilter{
+		NamePrefix: "metchee",
+		Sort:       []models.SortField{{Field: "ctime", Desc: true}, {Field: "name"}},
+	}
+	users, err := dao.GetAll(context.Background(), 4, 1, filter)
+	assert.Nil(t, err, "should not have error when get users")
+	require.Len(t, users, 4, "does not conform to limit")
+	for i := 1; i < len(users); i++ {
+		assert.GreaterOrEqual(t, users[i-1].Ctime, users[i].Ctime, "should be sorted by ctime descending")
+	}
+	for _, user := range users {
+		assert.NotEqualValues(t, u.Name, user.Name, "name prefix should be case sensitive")
+	}
+}
+
+func TestGetUsersAfter(t *testing.T) {
+	dao, _ := newTestDao(t)
+	seed(t, dao, 7)
+	filter := models.UserFilter{Sort: []models.SortField{{Field: "ctime", Desc: true}}}
+
+	var walked []models.User
+	next := ""
+	for {
+		users, token, err := dao.GetAllAfter(context.Background(), next, 2, filter)
+		require.Nil(t, err, "should not have error when walking users")
+		walked = append(walked, users...)
+		if next = token; next == "" {
+			break
+		}
+	}
+	all, err := dao.GetAll(context.Background(), 100, 0, filter)
+	require.Nil(t, err, "should not have error when get users")
+	assert.EqualValues(t, all, walked, "walk should match the full listing in order")
+}
+
+func TestSearchUsers(t *testing.T) {
+	dao, _ := newTestDao(t)
+	seed(t, dao, 3)
+	result, err := dao.Search(context.Background(), "Ridge 2", 10, 0)
+	assert.Nil(t, err, "should not have error when searching users")
+	require.EqualValues(t, 3, result.Total, "every user matches ridge")
+	assert.EqualValues(t, "3", result.Hits[0].User.ID, "best match should come first")
+}
+
+func TestUpdateAndDeleteUser(t *testing.T) {
+	dao, _ := newTestDao(t)
+	ctx := context.Background()
+	seed(t, dao, 1)
+
+	assert.Nil(t, dao.UpdateUserName(ctx, "1", "meow meow"), "should not have err when update user")
+	user, err := dao.GetById(ctx, "1")
+	require.Nil(t, err, "should not have err when getting user")
+	assert.EqualValues(t, "meow meow", user.Name, "should have the same value")
+
+	user.Description = "let me change this up"
+	assert.Nil(t, dao.Update(ctx, user), "should not have err when update user")
+	assert.Nil(t, dao.Delete(ctx, "1"), "should not have err when delete user")
+	assert.Equal(t, interfaces.ErrNotFound, dao.Delete(ctx, "1"), "second delete should not be found")
+	assert.Equal(t, interfaces.ErrNotFound, dao.Update(ctx, user), "missing user should not be updated")
+}
+
+func TestConditionalWrites(t *testing.T) {
+	dao, _ := newTestDao(t)
+	ctx := context.Background()
+	seed(t, dao, 1)
+
+	user, version, err := dao.GetVersioned(ctx, "1")
+	require.Nil(t, err, "should not have err when getting user")
+	user.Name = "meow meow"
+	next, err := dao.UpdateIfMatch(ctx, user, version)
+	assert.Nil(t, err, "current version should update")
+	assert.NotEqual(t, version, next, "update should change the version")
+	_, err = dao.UpdateIfMatch(ctx, user, version)
+	assert.Equal(t, interfaces.ErrVersionConflict, err, "stale version should conflict")
+
+	require.Nil(t, dao.UpdateUserName(ctx, "1", "meow"), "should not have err when update user")
+	assert.Equal(t, interfaces.ErrVersionConflict, dao.DeleteIfMatch(ctx, "1", next), "stale version should not delete")
+	_, version, err = dao.GetVersioned(ctx, "1")
+	require.Nil(t, err, "should not have err when getting user")
+	assert.Nil(t, dao.DeleteIfMatch(ctx, "1", version), "current version should delete")
+	assert.Equal(t, interfaces.ErrNotFound, dao.DeleteIfMatch(ctx, "1", version), "missing user should not be found")
+}
+
+func TestUpsertUser(t *testing.T) {
+	dao, _ := newTestDao(t)
+	ctx := context.Background()
+	user := newUser(0)
+	user.ID = "legacy"
+	created, err := dao.Upsert(ctx, user)
+	assert.Nil(t, err, "should not have err when upserting")
+	assert.True(t, created, "missing user should be created")
+
+	user.Name = "meow"
+	created, err = dao.Upsert(ctx, user)
+	assert.Nil(t, err, "should not have err when upserting")
+	assert.False(t, created, "existing user should be replaced")
+	stored, err := dao.GetById(ctx, "legacy")
+	assert.Nil(t, err, "should not have err when getting user")
+	assert.EqualValues(t, "meow", stored.Name, "should store the last write")
+}
+
+func TestSoftDeleteAndRestore(t *testing.T) {
+	ctx := context.Background()
+	dao, _ := newTestDao(t)
+	defer dao.Close()
+	id, err := dao.Create(ctx, newUser(0))
+	require.Nil(t, err, "should not have error when create user")
+	_, version, err := dao.GetVersioned(ctx, id)
+	require.Nil(t, err, "should not have err when getting user")
+	require.Nil(t, dao.Delete(ctx, id), "should not have err when delete user")
+
+	_, err = dao.GetById(ctx, id)
+	assert.Equal(t, interfaces.ErrNotFound, err, "deleted user should be hidden")
+	assert.Equal(t, interfaces.ErrNotFound, dao.Delete(ctx, id), "deleted user cannot be deleted twice")
+	users, err := dao.GetAll(ctx, 10, 0)
+	assert.Nil(t, err, "should not have err when listing users")
+	assert.Empty(t, users, "deleted user should not be listed")
+	deleted, err := dao.GetDeleted(ctx, 10, 0)
+	assert.Nil(t, err, "should not have err when listing deleted users")
+	require.Len(t, deleted, 1, "deleted user should be listed as deleted")
+	assert.NotZero(t, deleted[0].DeletedAt, "should say when the user was deleted")
+
+	require.Nil(t, dao.Restore(ctx, id), "should not have err when restoring")
+	user, restored, err := dao.GetVersioned(ctx, id)
+	assert.Nil(t, err, "restored user should be found")
+	assert.EqualValues(t, newUser(0).Name, user.Name, "restored user should keep its fields")
+	assert.NotEqual(t, version, restored, "delete and restore should change the version")
+	assert.Equal(t, interfaces.ErrNotFound, dao.Restore(ctx, id), "live user cannot be restored")
+
+	require.Nil(t, dao.DeleteIfMatch(ctx, id, restored), "should not have err when delete user")
+	purged, err := dao.Purge(ctx, int32(time.Now().Add(-time.Hour).Unix()))
+	assert.Nil(t, err, "should not have err when purging")
+	assert.Zero(t, purged, "users within retention should be kept")
+	purged, err = dao.Purge(ctx, int32(time.Now().Unix())+1)
+	assert.Nil(t, err, "should not have err when purging")
+	assert.EqualValues(t, 1, purged, "users past retention should be purged")
+	assert.Equal(t, interfaces.ErrNotFound, dao.Restore(ctx, id), "purged user cannot be restored")
+}
+
+func TestHistory(t *testing.T) {
+	ctx := audit.WithActor(context.Background(), "admin")
+	dao, _ := newTestDao(t)
+	id, err := dao.Create(ctx, newUser(0))
+	require.Nil(t, err, "should not have error when create user")
+	require.Nil(t, dao.Patch(ctx, id, map[string]interface{}{"address": "Kent Ridge"}), "should not have err when patch user")
+	require.Nil(t, dao.Delete(ctx, id), "should not have err when delete user")
+	require.Nil(t, dao.Restore(ctx, id), "should not have err when restoring")
+	_, version, err := dao.GetVersioned(ctx, id)
+	require.Nil(t, err, "should not have err when getting user")
+
+	page, err := dao.GetHistory(ctx, id, 10, 0)
+	require.Nil(t, err, "should not have err when getting history")
+	assert.EqualValues(t, 4, page.Total, "every write should be recorded")
+	require.Len(t, page.Changes, 4, "every write should be listed")
+	operations := []string{}
+	for _, change := range page.Changes {
+		operations = append(operations, change.Operation)
+		assert.Equal(t, id, change.UserID, "change should belong to the user")
+		assert.Equal(t, "admin", change.Actor, "change should carry the actor")
+	}
+	assert.Equal(t, []string{models.ChangeRestore, models.ChangeDelete, models.ChangePatch, models.ChangeCreate}, operations,
+		"newest change should come first")
+	assert.Equal(t, version, page.Changes[0].Version, "change should carry the version it left")
+	patch := page.Changes[2]
+	assert.Equal(t, map[string]models.FieldChange{
+		"address": {Before: "kent ridge 0", After: "Kent Ridge"},
+	}, patch.Diff, "patch should only change the address")
+	require.NotNil(t, patch.After, "patch should keep the patched user")
+	assert.Equal(t, "Kent Ridge", patch.After.Address, "patch should keep the patched user")
+	assert.Nil(t, page.Changes[1].After, "deleted user should not be kept")
+
+	page, err = dao.GetHistory(ctx, id, 1, 1)
+	assert.Nil(t, err, "should not have err when paging history")
+	require.Len(t, page.Changes, 1, "page should hold one change")
+	assert.Equal(t, models.ChangeDelete, page.Changes[0].Operation, "page should skip the newest change")
+	page, err = dao.GetHistory(ctx, "unknown", 10, 0)
+	assert.Nil(t, err, "should not have err for a user never written")
+	assert.Empty(t, page.Changes, "user never written should have no history")
+}
+
+func TestOutbox(t *testing.T) {
+	ctx := context.Background()
+	dao, _ := newTestDao(t)
+	before, err := dao.Create(ctx, newUser(0))
+	require.Nil(t, err, "should not have error when create user")
+	require.Nil(t, dao.EnableOutbox(ctx), "should not have error when enabling outbox")
+	id, err := dao.Create(ctx, newUser(1))
+	require.Nil(t, err, "should not have error when create user")
+	require.Nil(t, dao.Patch(ctx, id, map[string]interface{}{"address": "Kent Ridge"}), "should not have err when patch user")
+	require.Nil(t, dao.Delete(ctx, id), "should not have err when delete user")
+
+	records, err := dao.ReadOutbox(ctx, 0, 10)
+	require.Nil(t, err, "should not have err when reading outbox")
+	require.Len(t, records, 3, "writes should be in the outbox once enabled")
+	for i, record := range records {
+		assert.EqualValues(t, i+1, record.Offset, "offsets should follow the writes")
+		assert.NotEqual(t, before, record.UserID, "writes before enabling should not be in the outbox")
+	}
+	assert.Equal(t, models.ChangePatch, records[1].Operation, "record should carry the change")
+	assert.Equal(t, "Kent Ridge", records[1].After.Address, "record should carry the written user")
+
+	records, err = dao.ReadOutbox(ctx, 1, 1)
+	require.Nil(t, err, "should not have err when reading outbox")
+	require.Len(t, records, 1, "should read up to the limit")
+	assert.EqualValues(t, 2, records[0].Offset, "should read after the offset")
+
+	require.Nil(t, dao.TrimOutbox(ctx, 2), "should not have err when trimming outbox")
+	records, err = dao.ReadOutbox(ctx, 0, 10)
+	require.Nil(t, err, "should not have err when reading outbox")
+	require.Len(t, records, 1, "trimmed records should be gone")
+	assert.EqualValues(t, 3, records[0].Offset, "later records should be kept")
+}
+
+func TestOutboxLease(t *testing.T) {
+	ctx := context.Background()
+	dao, _ := newTestDao(t)
+	committed, err := dao.ClaimOutbox(ctx, "relay a", time.Hour)
+	require.Nil(t, err, "should not have error when claiming the outbox")
+	assert.EqualValues(t, 0, committed, "nothing should be committed yet")
+	require.Nil(t, dao.CommitOutbox(ctx, "relay a", 3, time.Hour), "should not have error when committing")
+	_, err = dao.ClaimOutbox(ctx, "relay b", time.Hour)
+	assert.Equal(t, interfaces.ErrOutboxLeased, err, "another relay should wait for the lease")
+	assert.Equal(t, interfaces.ErrOutboxLeased, dao.CommitOutbox(ctx, "relay b", 4, time.Hour), "only the holder should commit")
+
+	// a commit that lets the lease run out, as a stopped relay's does
+	require.Nil(t, dao.CommitOutbox(ctx, "relay a", 3, -time.Second), "should not have error when committing")
+	committed, err = dao.ClaimOutbox(ctx, "relay b", time.Hour)
+	require.Nil(t, err, "a lease that ran out should be taken over")
+	assert.EqualValues(t, 3, committed, "should carry on from the committed offset")
+	assert.Equal(t, interfaces.ErrOutboxLeased, dao.CommitOutbox(ctx, "relay a", 5, time.Hour), "a lost lease should not commit")
+}
@@ -0,0 +1,381 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/metildachee/userie/dao/interfaces"
+	"github.com/metildachee/userie/models"
+	"github.com/metildachee/userie/webhook"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+// deliveriesSequence names the user_sequences row ordering the delivery logs
+// and dead letters.
+const deliveriesSequence = "webhook_deliveries"
+
+var _ webhook.Storage = (*UserImplDao)(nil)
+
+// WebhookStore keeps the webhooks in the database, next to the users. The
+// webhooks and their logs are stored as json documents.
+type WebhookStore struct {
+	dao *UserImplDao
+}
+
+var _ webhook.Store = (*WebhookStore)(nil)
+
+func (dao *UserImplDao) WebhookStore(ctx context.Context) (webhook.Store, error) {
+	return &WebhookStore{dao: dao}, nil
+}
+
+// inTx runs fn in a transaction, committed when fn succeeds.
+func (s *WebhookStore) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.dao.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// hookExists fails with interfaces.ErrNotFound when the webhook id is unknown.
+func (s *WebhookStore) hookExists(ctx context.Context, q queryer, id string) error {
+	var n int
+	if err := q.QueryRowContext(ctx, s.dao.dialect.rebind(`SELECT COUNT(*) FROM webhooks WHERE id = ?`), id).Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		return interfaces.ErrNotFound
+	}
+	return nil
+}
+
+// appendLog adds doc, with its id, to the log of the webhook id in table.
+func (s *WebhookStore) appendLog(ctx context.Context, tx *sql.Tx, table, id, docID string, doc interface{}) error {
+	if err := s.hookExists(ctx, tx, id); err != nil {
+		return err
+	}
+	seq, err := s.dao.bump(ctx, tx, deliveriesSequence)
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, s.dao.dialect.rebind(`INSERT INTO `+table+` (id, seq, webhook_id, doc) VALUES (?, ?, ?, ?)`),
+		docID, seq, id, string(value))
+	return err
+}
+
+// readLog decodes a page of the webhook id's log in table, the latest first,
+// with decode.
+func (s *WebhookStore) readLog(ctx context.Context, table, id string, limit, offset int, decode func(doc []byte) error) error {
+	if err := s.hookExists(ctx, s.dao.db, id); err != nil {
+		return err
+	}
+	query := `SELECT doc FROM ` + table + ` WHERE webhook_id = ? ORDER BY seq DESC` + fmt.Sprintf(" LIMIT %d OFFSET %d", limit, offset)
+	rows, err := s.dao.db.QueryContext(ctx, s.dao.dialect.rebind(query), id)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var doc string
+		if err := rows.Scan(&doc); err != nil {
+			return err
+		}
+		if err := decode([]byte(doc)); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *WebhookStore) Create(ctx context.Context, h models.Webhook) (models.Webhook, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "sql create webhook")
+	defer span.Finish()
+
+	id, err := webhook.NewID()
+	if err != nil {
+		ext.LogError(span, err)
+		return h, err
+	}
+	h.ID = id
+	doc, err := json.Marshal(h)
+	if err != nil {
+		ext.LogError(span, err)
+		return h, err
+	}
+	_, err = s.dao.db.ExecContext(ctx, s.dao.dialect.rebind(`INSERT INTO webhooks (id, ctime, doc) VALUES (?, ?, ?)`),
+		id, h.Ctime.UnixNano(), string(doc))
+	if err != nil {
+		ext.LogError(span, err)
+		return h, err
+	}
+	span.LogFields(log.String("webhook_id", id))
+	return h, nil
+}
+
+func (s *WebhookStore) Get(ctx context.Context, id string) (h models.Webhook, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "sql get webhook")
+	defer span.Finish()
+
+	var doc string
+	err = s.dao.db.QueryRowContext(ctx, s.dao.dialect.rebind(`SELECT doc FROM webhooks WHERE id = ?`), id).Scan(&doc)
+	if err == sql.ErrNoRows {
+		return h, interfaces.ErrNotFound
+	}
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	err = json.Unmarshal([]byte(doc), &h)
+	return
+}
+
+func (s *WebhookStore) List(ctx context.Context) (hooks []models.Webhook, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "sql list webhooks")
+	defer span.Finish()
+
+	rows, err := s.dao.db.QueryContext(ctx, `SELECT doc FROM webhooks ORDER BY ctime, id`)
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	defer rows.Close()
+	hooks = []models.Webhook{}
+	for rows.Next() {
+		var (
+			doc string
+			h   models.Webhook
+		)
+		if err = rows.Scan(&doc); err != nil {
+			ext.LogError(span, err)
+			return
+		}
+		if err = json.Unmarshal([]byte(doc), &h); err != nil {
+			ext.LogError(span, err)
+			return
+		}
+		hooks = append(hooks, h)
+	}
+	if err = rows.Err(); err != nil {
+		ext.LogError(span, err)
+	}
+	return
+}
+
+func (s *WebhookStore) Update(ctx context.Context, h models.Webhook) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "sql update webhook")
+	defer span.Finish()
+
+	doc, err := json.Marshal(h)
+	if err != nil {
+		ext.LogError(span, err)
+		return err
+	}
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		// MySQL does not count unchanged rows as affected, so the webhook is
+		// looked up first
+		if err := s.hookExists(ctx, tx, h.ID); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, s.dao.dialect.rebind(`UPDATE webhooks SET ctime = ?, doc = ? WHERE id = ?`),
+			h.Ctime.UnixNano(), string(doc), h.ID)
+		return err
+	})
+}
+
+func (s *WebhookStore) Delete(ctx context.Context, id string) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "sql delete webhook")
+	defer span.Finish()
+
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, s.dao.dialect.rebind(`DELETE FROM webhooks WHERE id = ?`), id)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return interfaces.ErrNotFound
+		}
+		for _, table := range []string{"webhook_deliveries", "webhook_dead_letters", "webhook_pending"} {
+			if _, err := tx.ExecContext(ctx, s.dao.dialect.rebind(`DELETE FROM `+table+` WHERE webhook_id = ?`), id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// AddDelivery logs the attempt and forgets the webhook's oldest attempts past
+// webhook.MaxDeliveries.
+func (s *WebhookStore) AddDelivery(ctx context.Context, d models.WebhookDelivery) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "sql add webhook delivery")
+	defer span.Finish()
+
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if err := s.appendLog(ctx, tx, "webhook_deliveries", d.WebhookID, d.ID, d); err != nil {
+			return err
+		}
+		var oldest int64
+		err := tx.QueryRowContext(ctx, s.dao.dialect.rebind(`SELECT seq FROM webhook_deliveries WHERE webhook_id = ? ORDER BY seq DESC`+
+			fmt.Sprintf(" LIMIT 1 OFFSET %d", webhook.MaxDeliveries)), d.WebhookID).Scan(&oldest)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, s.dao.dialect.rebind(`DELETE FROM webhook_deliveries WHERE webhook_id = ? AND seq <= ?`), d.WebhookID, oldest)
+		return err
+	})
+}
+
+func (s *WebhookStore) GetDeliveries(ctx context.Context, id string, limit, offset int) (deliveries []models.WebhookDelivery, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "sql get webhook deliveries")
+	defer span.Finish()
+
+	deliveries = []models.WebhookDelivery{}
+	err = s.readLog(ctx, "webhook_deliveries", id, limit, offset, func(doc []byte) error {
+		var d models.WebhookDelivery
+		if err := json.Unmarshal(doc, &d); err != nil {
+			return err
+		}
+		deliveries = append(deliveries, d)
+		return nil
+	})
+	return
+}
+
+func (s *WebhookStore) AddDeadLetter(ctx context.Context, l models.WebhookDeadLetter) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "sql add webhook dead letter")
+	defer span.Finish()
+
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		return s.appendLog(ctx, tx, "webhook_dead_letters", l.WebhookID, l.ID, l)
+	})
+}
+
+func (s *WebhookStore) GetDeadLetters(ctx context.Context, id string, limit, offset int) (letters []models.WebhookDeadLetter, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "sql get webhook dead letters")
+	defer span.Finish()
+
+	letters = []models.WebhookDeadLetter{}
+	err = s.readLog(ctx, "webhook_dead_letters", id, limit, offset, func(doc []byte) error {
+		var l models.WebhookDeadLetter
+		if err := json.Unmarshal(doc, &l); err != nil {
+			return err
+		}
+		letters = append(letters, l)
+		return nil
+	})
+	return
+}
+
+func (s *WebhookStore) TakeDeadLetter(ctx context.Context, id, letterID string) (letter models.WebhookDeadLetter, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "sql take webhook dead letter")
+	defer span.Finish()
+
+	err = s.inTx(ctx, func(tx *sql.Tx) error {
+		var doc string
+		err := tx.QueryRowContext(ctx, s.dao.dialect.rebind(`SELECT doc FROM webhook_dead_letters WHERE id = ? AND webhook_id = ?`),
+			letterID, id).Scan(&doc)
+		if err == sql.ErrNoRows {
+			return interfaces.ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal([]byte(doc), &letter); err != nil {
+			return err
+		}
+		// only the taker that removed the row gets the letter
+		res, err := tx.ExecContext(ctx, s.dao.dialect.rebind(`DELETE FROM webhook_dead_letters WHERE id = ?`), letterID)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return interfaces.ErrNotFound
+		}
+		return nil
+	})
+	return
+}
+
+func (s *WebhookStore) AddPending(ctx context.Context, p models.WebhookPending) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "sql add webhook pending")
+	defer span.Finish()
+
+	doc, err := json.Marshal(p)
+	if err != nil {
+		ext.LogError(span, err)
+		return err
+	}
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if err := s.hookExists(ctx, tx, p.WebhookID); err != nil {
+			return err
+		}
+		// the dialects have no common upsert, the pending event is replaced
+		if _, err := tx.ExecContext(ctx, s.dao.dialect.rebind(`DELETE FROM webhook_pending WHERE id = ?`), p.ID); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, s.dao.dialect.rebind(`INSERT INTO webhook_pending (id, webhook_id, touched, doc) VALUES (?, ?, ?, ?)`),
+			p.ID, p.WebhookID, p.Time.UnixNano(), string(doc))
+		return err
+	})
+}
+
+func (s *WebhookStore) ListPending(ctx context.Context, limit int) (pending []models.WebhookPending, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "sql list webhook pending")
+	defer span.Finish()
+
+	rows, err := s.dao.db.QueryContext(ctx, `SELECT doc FROM webhook_pending ORDER BY touched, id`+fmt.Sprintf(" LIMIT %d", limit))
+	if err != nil {
+		ext.LogError(span, err)
+		return
+	}
+	defer rows.Close()
+	pending = []models.WebhookPending{}
+	for rows.Next() {
+		var (
+			doc string
+			p   models.WebhookPending
+		)
+		if err = rows.Scan(&doc); err != nil {
+			ext.LogError(span, err)
+			return
+		}
+		if err = json.Unmarshal([]byte(doc), &p); err != nil {
+			ext.LogError(span, err)
+			return
+		}
+		pending = append(pending, p)
+	}
+	if err = rows.Err(); err != nil {
+		ext.LogError(span, err)
+	}
+	return
+}
+
+func (s *WebhookStore) RemovePending(ctx context.Context, id string) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "sql remove webhook pending")
+	defer span.Finish()
+
+	_, err := s.dao.db.ExecContext(ctx, s.dao.dialect.rebind(`DELETE FROM webhook_pending WHERE id = ?`), id)
+	if err != nil {
+		ext.LogError(span, err)
+	}
+	return err
+}
@@ -5,13 +5,18 @@ go 1.15
 require (
 	github.com/HdrHistogram/hdrhistogram-go v1.1.0 // indirect
 	github.com/aws/aws-sdk-go v1.38.17
+	github.com/evanphx/json-patch v4.12.0+incompatible
+	github.com/go-sql-driver/mysql v1.6.0
 	github.com/google/logger v1.1.1
 	github.com/gorilla/mux v1.8.0
+	github.com/lib/pq v1.10.2
+	github.com/mattn/go-sqlite3 v1.14.8
 	github.com/olivere/elastic/v7 v7.0.25
 	github.com/opentracing/opentracing-go v1.2.0
 	github.com/stretchr/testify v1.7.0
 	github.com/uber/jaeger-client-go v2.29.1+incompatible
 	github.com/uber/jaeger-lib v2.4.1+incompatible // indirect
+	go.etcd.io/bbolt v1.3.6
 	go.uber.org/atomic v1.8.0 // indirect
 	golang.org/x/tools v0.1.4 // indirect
 	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c
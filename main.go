@@ -2,15 +2,32 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"time"
 
+	_ "github.com/go-sql-driver/mysql"
 	"github.com/google/logger"
 	"github.com/gorilla/mux"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
 	"github.com/metildachee/userie/api"
+	"github.com/metildachee/userie/dao/bolt"
+	"github.com/metildachee/userie/dao/elasticsearch"
+	"github.com/metildachee/userie/dao/feed"
+	"github.com/metildachee/userie/dao/interfaces"
+	"github.com/metildachee/userie/dao/memory"
+	sqldao "github.com/metildachee/userie/dao/sql"
+	"github.com/metildachee/userie/models"
+	"github.com/metildachee/userie/outbox"
+	"github.com/metildachee/userie/transfer"
 	"github.com/metildachee/userie/utilities"
+	"github.com/metildachee/userie/webhook"
 	"github.com/opentracing/opentracing-go"
 )
 
@@ -40,26 +57,264 @@ func main() {
 		logger.Fatalf("failed to open log file: %v", err)
 	}
 	defer lf.Close()
-	defer logger.Init("info logger", *verbose, *verbose, lf).Close()
+	lg := logger.Init("info logger", *verbose, *verbose, lf)
+	defer lg.Close()
 
 	// Init tracer
 	tracer, closer := utilities.InitJaeger(env.GetServiceName())
 	defer closer.Close()
 	opentracing.SetGlobalTracer(tracer)
-	opentracing.ContextWithSpan(context.Background(), tracer.StartSpan("service started"))
+	ctx := opentracing.ContextWithSpan(context.Background(), tracer.StartSpan("service started"))
+
+	// Run subcommands
+	switch command := flag.Arg(0); command {
+	case "":
+	case "init-index":
+		if err := initIndex(ctx); err != nil {
+			logger.Fatalf("init index failed: %v", err)
+		}
+		logger.Info("index is ready")
+		return
+	case "reindex":
+		report, err := reindex(ctx)
+		if err != nil {
+			logger.Fatalf("reindex failed: %v", err)
+		}
+		logger.Infof("reindexed %s into %s: %d copied, %d caught up, %d deleted",
+			report.From, report.To, report.Copied, report.CaughtUp, report.Deleted)
+		return
+	case "rollback":
+		previous, err := rollback(ctx)
+		if err != nil {
+			logger.Fatalf("rollback failed: %v", err)
+		}
+		logger.Infof("rolled back to %s", previous)
+		return
+	case "purge":
+		purged, err := purgeDeleted(ctx, env)
+		if err != nil {
+			logger.Fatalf("purge failed: %v", err)
+		}
+		logger.Infof("purged %d deleted users", purged)
+		return
+	case "import":
+		report, err := importUsers(ctx, env, flag.Arg(1))
+		if err != nil {
+			logger.Errorf("import stopped: %v", err)
+		}
+		json.NewEncoder(os.Stdout).Encode(report)
+		logger.Infof("imported %d of %d rows, %d failed", report.Imported, report.Rows, report.Failed)
+		return
+	default:
+		logger.Fatalf("unknown command %q", command)
+	}
+
+	// Init dao, shared by every request; its writes feed the change stream
+	dao, err := newUserDao(ctx, env)
+	if err != nil {
+		logger.Fatalf("failed to init dao: %v", err)
+	}
+
+	// Deliver user writes to the registered webhooks in the background
+	store, err := newWebhookStore(ctx, dao)
+	if err != nil {
+		logger.Fatalf("failed to init webhook store: %v", err)
+	}
+	hooks := webhook.NewDispatcher(store, tracer, webhook.RetryPolicy{
+		MaxAttempts: env.GetWebhookMaxAttempts(),
+		Backoff:     env.GetWebhookBackoff(),
+	})
+	hooks.Start(ctx, webhook.DefaultWorkers)
+
+	sink := env.GetOutboxSink()
+	if sink != "" {
+		relay, err := newOutboxRelay(ctx, env, dao, sink, hooks)
+		if err != nil {
+			logger.Fatalf("failed to init outbox relay: %v", err)
+		}
+		go relay.Run(ctx)
+	}
+	changes := feed.NewBroker(env.GetChangeFeedBuffer())
+	dao = feed.NewDao(dao, changes)
+
+	// Purge deleted users past their retention in the background
+	if interval := env.GetPurgeInterval(); interval > 0 {
+		go purgeEvery(ctx, dao, env.GetDeletedRetention(), interval)
+	}
 
 	// Init http
 	r := mux.NewRouter()
-	prefix := r.PathPrefix("/api").Subrouter()
+	srv := api.NewServer(dao, changes, hooks, lg, tracer)
+	if sink == models.OutboxSinkBroker {
+		srv.WebhooksFromOutbox()
+	}
+	srv.Routes(r)
 
-	u := prefix.PathPrefix("/user").Subrouter()
-	u.HandleFunc("/{id}", api.GetUser).Methods(http.MethodGet)
-	u.HandleFunc("", api.UpdateUser).Methods(http.MethodPut)
-	u.HandleFunc("/{id}", api.DeleteUser).Methods(http.MethodDelete)
-	u.HandleFunc("", api.CreateUser).Methods(http.MethodPost)
+	log.Fatal(http.ListenAndServe(env.GetServerEndpoint(), r))
+}
 
-	us := prefix.PathPrefix("/users").Subrouter()
-	us.HandleFunc("/limit={limit}&offset={offset}", api.GetAll).Methods(http.MethodGet)
+func newUserDao(ctx context.Context, env models.Configuration) (interfaces.UserDao, error) {
+	switch storage := env.GetStorage(); storage {
+	case models.StorageMemory:
+		return memory.NewDao(ctx)
+	case models.StorageBolt:
+		return bolt.NewDao(ctx, env.GetBoltPath())
+	case models.StorageSql:
+		return sqldao.NewDao(ctx, env.GetSqlDriver(), env.GetSqlDsn(), env.GetIdGenerator())
+	case models.StorageElasticsearch:
+		dao, err := elasticsearch.NewDao(ctx)
+		if err != nil {
+			return nil, err
+		}
+		// keep serving on drift, the report tells operators what to fix
+		if err := dao.EnsureIndex(ctx); err != nil {
+			logger.Errorf("index is not ready: %v", err)
+		}
+		return dao, nil
+	default:
+		return nil, fmt.Errorf("unknown storage %q", storage)
+	}
+}
 
-	log.Fatal(http.ListenAndServe(env.GetServerEndpoint(), r))
+// newWebhookStore keeps the webhooks in the dao's storage, or in memory when
+// it cannot keep them.
+func newWebhookStore(ctx context.Context, dao interfaces.UserDao) (webhook.Store, error) {
+	if storage, ok := dao.(webhook.Storage); ok {
+		return storage.WebhookStore(ctx)
+	}
+	return webhook.NewMemoryStore(), nil
+}
+
+// newOutboxRelay turns on the dao's outbox and returns a relay publishing it
+// to sink. Every instance may run one, only the relay holding the outbox
+// lease publishes. The broker sink hands every recorded change to hooks, so mass
+// operations reach the webhooks too; a change counts as published once its
+// events are pending in the webhook store.
+func newOutboxRelay(ctx context.Context, env models.Configuration, dao interfaces.UserDao, sink string, hooks *webhook.Dispatcher) (*outbox.Relay, error) {
+	box, ok := dao.(interfaces.Outbox)
+	if !ok {
+		return nil, fmt.Errorf("storage %q has no outbox", env.GetStorage())
+	}
+	var publisher outbox.Sink
+	switch sink {
+	case models.OutboxSinkFile:
+		file, err := outbox.NewFileSink(env.GetOutboxPath())
+		if err != nil {
+			return nil, err
+		}
+		publisher = file
+	case models.OutboxSinkStdout:
+		publisher = outbox.NewStdoutSink()
+	case models.OutboxSinkBroker:
+		broker := outbox.NewBroker()
+		broker.Subscribe("webhooks", func(ctx context.Context, record models.OutboxRecord) error {
+			return hooks.NotifyChange(ctx, record.Change)
+		})
+		publisher = broker
+	default:
+		return nil, fmt.Errorf("unknown outbox sink %q", sink)
+	}
+	if err := box.EnableOutbox(ctx); err != nil {
+		return nil, err
+	}
+	holder, err := relayHolder()
+	if err != nil {
+		return nil, err
+	}
+	offsets := outbox.NewLeaseOffsetStore(box, holder, outbox.DefaultLeaseTTL)
+	return outbox.NewRelay(box, publisher, offsets, outbox.DefaultBatchSize, outbox.DefaultPollInterval), nil
+}
+
+// relayHolder names this instance's relay for the outbox lease.
+func relayHolder() (string, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:%d", host, os.Getpid()), nil
+}
+
+// initIndex creates the elasticsearch index, or checks an existing one for
+// mapping drift.
+func initIndex(ctx context.Context) error {
+	dao, err := elasticsearch.NewDao(ctx)
+	if err != nil {
+		return err
+	}
+	return dao.EnsureIndex(ctx)
+}
+
+// reindex copies the index behind the alias into the next generation with the
+// current mapping and swaps the alias over.
+func reindex(ctx context.Context) (elasticsearch.ReindexReport, error) {
+	dao, err := elasticsearch.NewDao(ctx)
+	if err != nil {
+		return elasticsearch.ReindexReport{}, err
+	}
+	return dao.Reindex(ctx)
+}
+
+// rollback points the alias back at the index used before the last reindex.
+func rollback(ctx context.Context) (string, error) {
+	dao, err := elasticsearch.NewDao(ctx)
+	if err != nil {
+		return "", err
+	}
+	return dao.Rollback(ctx)
+}
+
+// purgeDeleted removes the users deleted longer than the configured retention
+// ago for good.
+func purgeDeleted(ctx context.Context, env models.Configuration) (int64, error) {
+	dao, err := newUserDao(ctx, env)
+	if err != nil {
+		return 0, err
+	}
+	return dao.Purge(ctx, int32(time.Now().Add(-env.GetDeletedRetention()).Unix()))
+}
+
+// purgeEvery purges the users deleted longer than retention ago, every
+// interval until ctx is done.
+func purgeEvery(ctx context.Context, dao interfaces.UserDao, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		before := int32(time.Now().Add(-retention).Unix())
+		purged, err := dao.Purge(ctx, before)
+		if err != nil {
+			logger.Errorf("purge of deleted users failed: %v", err)
+			continue
+		}
+		logger.Infof("purged %d users deleted before %d", purged, before)
+	}
+}
+
+// importUsers loads an NDJSON (.ndjson, .jsonl) or CSV (.csv) file into the
+// configured storage.
+func importUsers(ctx context.Context, env models.Configuration, path string) (transfer.ImportReport, error) {
+	format := ""
+	switch filepath.Ext(path) {
+	case ".ndjson", ".jsonl":
+		format = transfer.FormatNDJSON
+	case ".csv":
+		format = transfer.FormatCSV
+	default:
+		return transfer.ImportReport{}, fmt.Errorf("cannot tell the format of %q, expecting .ndjson, .jsonl or .csv", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return transfer.ImportReport{}, err
+	}
+	defer f.Close()
+
+	dao, err := newUserDao(ctx, env)
+	if err != nil {
+		return transfer.ImportReport{}, err
+	}
+	return transfer.Import(ctx, dao, f, format, transfer.DefaultBatchSize)
 }
@@ -0,0 +1,38 @@
+package models
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// BulkItemResult is the outcome for one user of a bulk request, in the
+// position the user had in the request. Status is an http status code.
+type BulkItemResult struct {
+	ID     string `json:"id,omitempty"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// CreateResult is the result of creating one user with id.
+func CreateResult(id string, err error) BulkItemResult {
+	if err != nil {
+		return BulkItemResult{Status: http.StatusInternalServerError, Error: err.Error()}
+	}
+	return BulkItemResult{ID: id, Status: http.StatusCreated}
+}
+
+// FirstBulkError returns the error of the first failed item, if any.
+func FirstBulkError(results []BulkItemResult) error {
+	for i, result := range results {
+		if result.Error != "" {
+			return fmt.Errorf("user %d: %s", i, result.Error)
+		}
+	}
+	return nil
+}
+
+type BulkResult struct {
+	// Errors is set when any item failed
+	Errors bool             `json:"errors"`
+	Items  []BulkItemResult `json:"items"`
+}
@@ -2,10 +2,32 @@ package models
 
 import (
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/google/logger"
 )
 
+const (
+	StorageElasticsearch = "elasticsearch"
+	StorageMemory        = "memory"
+	StorageBolt          = "bolt"
+	StorageSql           = "sql"
+)
+
+const (
+	OutboxSinkFile   = "file"
+	OutboxSinkStdout = "stdout"
+	// OutboxSinkBroker hands the outbox to the webhook dispatcher in process
+	OutboxSinkBroker = "broker"
+)
+
+const (
+	IdGeneratorAuto     = "auto"
+	IdGeneratorUUIDv7   = "uuidv7"
+	IdGeneratorSequence = "sequence"
+)
+
 type Tracer struct {
 	ServiceName string `yaml:"service_name"`
 }
@@ -14,7 +36,29 @@ type Configuration struct {
 	ElasticEndpoint string `yaml:"elastic_endpoint"`
 	ClusterName     string `yaml:"cluster_name"`
 	ServerPort      string `yaml:"server_port"`
-	Tracer          `yaml:"tracer"`
+	IdGenerator     string `yaml:"id_generator"`
+	Storage         string `yaml:"storage"`
+	BoltPath        string `yaml:"bolt_path"`
+	SqlDriver       string `yaml:"sql_driver"`
+	SqlDsn          string `yaml:"sql_dsn"`
+	// DeletedRetention is how long deleted users can be restored before the
+	// purge job removes them, PurgeInterval how often the job runs.
+	DeletedRetention string `yaml:"deleted_retention"`
+	PurgeInterval    string `yaml:"purge_interval"`
+	// ChangeFeedBuffer is how many change events are kept for change feed
+	// clients resuming after a disconnect.
+	ChangeFeedBuffer int `yaml:"change_feed_buffer"`
+	// WebhookMaxAttempts is how often a webhook delivery is tried, waiting
+	// WebhookBackoff after the first failure and twice as long after each
+	// further one.
+	WebhookMaxAttempts int    `yaml:"webhook_max_attempts"`
+	WebhookBackoff     string `yaml:"webhook_backoff"`
+	// OutboxSink turns the outbox relay on, publishing to a file at
+	// OutboxPath, to stdout or to the webhooks. The relay keeps its offset in
+	// the storage, next to the outbox.
+	OutboxSink string `yaml:"outbox_sink"`
+	OutboxPath string `yaml:"outbox_path"`
+	Tracer     `yaml:"tracer"`
 }
 
 func (config *Configuration) Validate() bool {
@@ -31,6 +75,39 @@ func (config *Configuration) Validate() bool {
 	if config.ElasticEndpoint == "" {
 		logger.Error("err config file missing elastic end point")
 	}
+	switch config.Storage {
+	case "", StorageElasticsearch, StorageMemory, StorageBolt, StorageSql:
+	default:
+		logger.Errorf("err config file has unknown storage %q", config.Storage)
+		return false
+	}
+	for name, value := range map[string]string{"deleted_retention": config.DeletedRetention, "purge_interval": config.PurgeInterval,
+		"webhook_backoff": config.WebhookBackoff} {
+		if _, err := time.ParseDuration(value); value != "" && err != nil {
+			logger.Errorf("err config file has invalid %s %q", name, value)
+			return false
+		}
+	}
+	if config.ChangeFeedBuffer < 0 {
+		logger.Errorf("err config file has negative change_feed_buffer %d", config.ChangeFeedBuffer)
+		return false
+	}
+	if config.WebhookMaxAttempts < 0 {
+		logger.Errorf("err config file has negative webhook_max_attempts %d", config.WebhookMaxAttempts)
+		return false
+	}
+	switch config.OutboxSink {
+	case "", OutboxSinkFile, OutboxSinkStdout, OutboxSinkBroker:
+	default:
+		logger.Errorf("err config file has unknown outbox sink %q", config.OutboxSink)
+		return false
+	}
+	switch config.IdGenerator {
+	case "", IdGeneratorAuto, IdGeneratorUUIDv7, IdGeneratorSequence:
+	default:
+		logger.Errorf("err config file has unknown id generator %q", config.IdGenerator)
+		return false
+	}
 	return true
 }
 
@@ -46,6 +123,54 @@ func (config *Configuration) GetServerEnvName() string {
 	return "server_port"
 }
 
+func (config *Configuration) GetIdGeneratorEnvName() string {
+	return "id_generator"
+}
+
+func (config *Configuration) GetStorageEnvName() string {
+	return "storage"
+}
+
+func (config *Configuration) GetBoltPathEnvName() string {
+	return "bolt_path"
+}
+
+func (config *Configuration) GetSqlDriverEnvName() string {
+	return "sql_driver"
+}
+
+func (config *Configuration) GetSqlDsnEnvName() string {
+	return "sql_dsn"
+}
+
+func (config *Configuration) GetDeletedRetentionEnvName() string {
+	return "deleted_retention"
+}
+
+func (config *Configuration) GetPurgeIntervalEnvName() string {
+	return "purge_interval"
+}
+
+func (config *Configuration) GetChangeFeedBufferEnvName() string {
+	return "change_feed_buffer"
+}
+
+func (config *Configuration) GetWebhookMaxAttemptsEnvName() string {
+	return "webhook_max_attempts"
+}
+
+func (config *Configuration) GetWebhookBackoffEnvName() string {
+	return "webhook_backoff"
+}
+
+func (config *Configuration) GetOutboxSinkEnvName() string {
+	return "outbox_sink"
+}
+
+func (config *Configuration) GetOutboxPathEnvName() string {
+	return "outbox_path"
+}
+
 func (config *Configuration) GetServiceEnvName() string {
 	return "service_name"
 }
@@ -63,7 +188,7 @@ func (config *Configuration) GetClusterName() string {
 		return env
 	}
 	logger.Info("cannot get cluster name from env, using default")
-	return "usersg0"
+	return "usersg"
 }
 
 func (config *Configuration) GetServerEndpoint() string {
@@ -74,6 +199,102 @@ func (config *Configuration) GetServerEndpoint() string {
 	return ":8080"
 }
 
+func (config *Configuration) GetIdGenerator() string {
+	if env := os.Getenv(config.GetIdGeneratorEnvName()); env != "" {
+		return env
+	}
+	logger.Info("cannot get id generator from env, using default")
+	return IdGeneratorSequence
+}
+
+func (config *Configuration) GetStorage() string {
+	if env := os.Getenv(config.GetStorageEnvName()); env != "" {
+		return env
+	}
+	logger.Info("cannot get storage from env, using default")
+	return StorageElasticsearch
+}
+
+func (config *Configuration) GetBoltPath() string {
+	if env := os.Getenv(config.GetBoltPathEnvName()); env != "" {
+		return env
+	}
+	logger.Info("cannot get bolt path from env, using default")
+	return "userie.db"
+}
+
+func (config *Configuration) GetSqlDriver() string {
+	if env := os.Getenv(config.GetSqlDriverEnvName()); env != "" {
+		return env
+	}
+	logger.Info("cannot get sql driver from env, using default")
+	return "sqlite3"
+}
+
+func (config *Configuration) GetSqlDsn() string {
+	if env := os.Getenv(config.GetSqlDsnEnvName()); env != "" {
+		return env
+	}
+	logger.Info("cannot get sql dsn from env, using default")
+	return "userie.sqlite"
+}
+
+func (config *Configuration) GetDeletedRetention() time.Duration {
+	if retention, err := time.ParseDuration(os.Getenv(config.GetDeletedRetentionEnvName())); err == nil {
+		return retention
+	}
+	logger.Info("cannot get deleted retention from env, using default")
+	return 30 * 24 * time.Hour
+}
+
+// GetPurgeInterval returns how often deleted users are purged, zero turns the
+// purge job off.
+func (config *Configuration) GetPurgeInterval() time.Duration {
+	if interval, err := time.ParseDuration(os.Getenv(config.GetPurgeIntervalEnvName())); err == nil {
+		return interval
+	}
+	logger.Info("cannot get purge interval from env, using default")
+	return time.Hour
+}
+
+func (config *Configuration) GetChangeFeedBuffer() int {
+	if size, err := strconv.Atoi(os.Getenv(config.GetChangeFeedBufferEnvName())); err == nil && size > 0 {
+		return size
+	}
+	logger.Info("cannot get change feed buffer from env, using default")
+	return 1000
+}
+
+func (config *Configuration) GetWebhookMaxAttempts() int {
+	if attempts, err := strconv.Atoi(os.Getenv(config.GetWebhookMaxAttemptsEnvName())); err == nil && attempts > 0 {
+		return attempts
+	}
+	logger.Info("cannot get webhook max attempts from env, using default")
+	return 8
+}
+
+func (config *Configuration) GetWebhookBackoff() time.Duration {
+	if backoff, err := time.ParseDuration(os.Getenv(config.GetWebhookBackoffEnvName())); err == nil && backoff > 0 {
+		return backoff
+	}
+	logger.Info("cannot get webhook backoff from env, using default")
+	return time.Second
+}
+
+// GetOutboxSink returns where the outbox relay publishes to, empty turns the
+// relay off.
+func (config *Configuration) GetOutboxSink() string {
+	return os.Getenv(config.GetOutboxSinkEnvName())
+}
+
+func (config *Configuration) GetOutboxPath() string {
+	if env := os.Getenv(config.GetOutboxPathEnvName()); env != "" {
+		return env
+	}
+	logger.Info("cannot get outbox path from env, using default")
+	return "outbox.ndjson"
+}
+
 func (config *Configuration) GetServiceName() string {
 	if env := os.Getenv(config.GetServiceEnvName()); env != "" {
 		return env
@@ -0,0 +1,74 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+)
+
+var (
+	// FilterParams are the listing query parameters understood by UserFilter.
+	FilterParams = []string{"dob_from", "dob_to", "ctime_from", "ctime_to", "name_prefix", "sort"}
+	// SortFields are the user fields a listing can be ordered by.
+	SortFields = []string{"name", "dob", "ctime"}
+)
+
+type SortField struct {
+	Field string `json:"field"`
+	Desc  bool   `json:"desc,omitempty"`
+}
+
+type UserFilter struct {
+	DobFrom    *int32      `json:"dob_from,omitempty"`
+	DobTo      *int32      `json:"dob_to,omitempty"`
+	CtimeFrom  *int32      `json:"ctime_from,omitempty"`
+	CtimeTo    *int32      `json:"ctime_to,omitempty"`
+	NamePrefix string      `json:"name_prefix,omitempty"`
+	Sort       []SortField `json:"sort,omitempty"`
+}
+
+// IsEmpty reports whether the filter matches every user. The sort order does
+// not narrow anything down and is ignored.
+func (f UserFilter) IsEmpty() bool {
+	return f.DobFrom == nil && f.DobTo == nil && f.CtimeFrom == nil && f.CtimeTo == nil && f.NamePrefix == ""
+}
+
+// UnknownParamError is returned when a listing request names a filter or sort
+// field that is not supported.
+type UnknownParamError struct {
+	Kind    string   `json:"kind"`
+	Name    string   `json:"name"`
+	Allowed []string `json:"allowed"`
+}
+
+func (e *UnknownParamError) Error() string {
+	return fmt.Sprintf("unknown %s %q, allowed: %s", e.Kind, e.Name, strings.Join(e.Allowed, ", "))
+}
+
+// ParseSort parses a comma separated list of fields such as "-ctime,name",
+// where a leading "-" sorts that field in descending order.
+func ParseSort(value string) (sorts []SortField, err error) {
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		sort := SortField{Field: item}
+		if strings.HasPrefix(item, "-") {
+			sort = SortField{Field: item[1:], Desc: true}
+		}
+		if !contains(SortFields, sort.Field) {
+			return nil, &UnknownParamError{Kind: "sort field", Name: sort.Field, Allowed: SortFields}
+		}
+		sorts = append(sorts, sort)
+	}
+	return
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,43 @@
+package models
+
+import "time"
+
+// Operations recorded in a user's history.
+const (
+	ChangeCreate  = "create"
+	ChangeUpdate  = "update"
+	ChangePatch   = "patch"
+	ChangeDelete  = "delete"
+	ChangeRestore = "restore"
+	// ChangeRevert is an update back to the user of an earlier version
+	ChangeRevert = "revert"
+)
+
+// Change is one write to a user as kept in its history.
+type Change struct {
+	ID        string `json:"id"`
+	UserID    string `json:"user_id"`
+	Operation string `json:"operation"`
+	// Version is the user's version after the change
+	Version   string    `json:"version"`
+	Actor     string    `json:"actor"`
+	Timestamp time.Time `json:"timestamp"`
+	TraceID   string    `json:"trace_id,omitempty"`
+	// RevertedTo is the version a revert went back to
+	RevertedTo string                 `json:"reverted_to,omitempty"`
+	Diff       map[string]FieldChange `json:"diff"`
+	// After is the whole user as the change left it
+	After *User `json:"after,omitempty"`
+}
+
+// FieldChange holds a field's values around a change, nil where the field
+// was not set.
+type FieldChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+type HistoryPage struct {
+	Changes []Change `json:"changes"`
+	Total   int64    `json:"total"`
+}
@@ -0,0 +1,41 @@
+package models
+
+import "time"
+
+// OutboxRecord is a recorded change waiting in the outbox to be published.
+type OutboxRecord struct {
+	Offset int64 `json:"offset"`
+	Change
+}
+
+// OutboxLease is held by the relay publishing the outbox, along with the
+// offset of the last record it published. One relay holds it at a time, so
+// records are only trimmed once no relay needs them.
+type OutboxLease struct {
+	Holder string `json:"holder"`
+	// ExpiresAt is when the lease runs out unless renewed, in unix
+	// nanoseconds
+	ExpiresAt int64 `json:"expires_at"`
+	Committed int64 `json:"committed"`
+}
+
+// Claim takes or renews the lease for holder until ttl passes, unless the
+// lease of another holder still runs at now.
+func (l *OutboxLease) Claim(holder string, now time.Time, ttl time.Duration) bool {
+	if l.Holder != holder && l.ExpiresAt > now.UnixNano() {
+		return false
+	}
+	l.Holder = holder
+	l.ExpiresAt = now.Add(ttl).UnixNano()
+	return true
+}
+
+// Commit saves the offset and renews the lease, as long as holder has it.
+func (l *OutboxLease) Commit(holder string, offset int64, now time.Time, ttl time.Duration) bool {
+	if l.Holder != holder {
+		return false
+	}
+	l.Committed = offset
+	l.ExpiresAt = now.Add(ttl).UnixNano()
+	return true
+}
@@ -0,0 +1,8 @@
+package models
+
+// UserPage is one page of a cursor paginated listing. NextCursor is empty once
+// the listing is exhausted.
+type UserPage struct {
+	Users      []User `json:"users"`
+	NextCursor string `json:"next_cursor"`
+}
@@ -0,0 +1,32 @@
+package models
+
+// Problem codes are stable, clients can branch on them where the detail
+// message may change.
+const (
+	ProblemValidationFailed     = "validation_failed"
+	ProblemUnknownParameter     = "unknown_parameter"
+	ProblemMalformedJson        = "malformed_json"
+	ProblemInvalidRequest       = "invalid_request"
+	ProblemNotFound             = "not_found"
+	ProblemVersionConflict      = "version_conflict"
+	ProblemPayloadTooLarge      = "payload_too_large"
+	ProblemUnsupportedMediaType = "unsupported_media_type"
+	ProblemNotImplemented       = "not_implemented"
+	ProblemInternalError        = "internal_error"
+)
+
+// Problem is the RFC 7807 problem details body of every failed request. Code
+// tells failures apart, RequestID and TraceID find the request in the logs
+// and traces. Errors lists every field that failed validation and Allowed
+// the values an unknown parameter can take.
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Code      string       `json:"code"`
+	RequestID string       `json:"request_id,omitempty"`
+	TraceID   string       `json:"trace_id,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+	Allowed   []string     `json:"allowed,omitempty"`
+}
@@ -0,0 +1,14 @@
+package models
+
+type SearchHit struct {
+	User      User                `json:"user"`
+	Score     float64             `json:"score"`
+	Highlight map[string][]string `json:"highlight,omitempty"`
+}
+
+type SearchResult struct {
+	Total  int64       `json:"total"`
+	Limit  int         `json:"limit"`
+	Offset int         `json:"offset"`
+	Hits   []SearchHit `json:"hits"`
+}
@@ -0,0 +1,33 @@
+package models
+
+const (
+	TaskDeleteByQuery = "delete_by_query"
+	TaskUpdateByQuery = "update_by_query"
+)
+
+// TaskStatus is the progress of a mass operation running in the background.
+type TaskStatus struct {
+	ID        string `json:"id"`
+	Operation string `json:"operation,omitempty"`
+	Completed bool   `json:"completed"`
+	Total     int64  `json:"total"`
+	Updated   int64  `json:"updated"`
+	Deleted   int64  `json:"deleted"`
+	// VersionConflicts counts users skipped because they changed while the
+	// task ran
+	VersionConflicts int64  `json:"version_conflicts"`
+	Error            string `json:"error,omitempty"`
+}
+
+// TaskAccepted answers a request that started a task.
+type TaskAccepted struct {
+	Task      string `json:"task"`
+	StatusUrl string `json:"status_url"`
+}
+
+// DryRunResult answers a mass operation asked for a dry run, Matched users
+// would have been changed.
+type DryRunResult struct {
+	DryRun  bool  `json:"dry_run"`
+	Matched int64 `json:"matched"`
+}
@@ -1,6 +1,8 @@
 package models
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"time"
@@ -13,33 +15,103 @@ type User struct {
 	Address     string `json:"address"`
 	Description string `json:"description"`
 	Ctime       int32  `json:"ctime"`
+	// DeletedAt is set on deleted users, which are hidden until restored or
+	// purged.
+	DeletedAt int32 `json:"deleted_at,omitempty"`
 }
 
+// Validate checks a user about to be created, its id is assigned by the
+// storage and must be left empty. Failed fields are reported together in a
+// *ValidationError.
 func (u *User) Validate() (err error) {
 	if u == nil {
 		return errors.New("empty user")
 	}
+	invalid := &ValidationError{}
 	if u.ID != "" {
-		return errors.New("invalid user id")
+		invalid.add("id", "id is assigned by the storage and cannot be set")
+	}
+	u.validateFields(invalid)
+	return invalid.err()
+}
+
+// ValidateUpdate checks a user about to replace a stored one, it must carry
+// the stored user's id. Failed fields are reported together in a
+// *ValidationError.
+func (u *User) ValidateUpdate() (err error) {
+	if u == nil {
+		return errors.New("empty user")
+	}
+	invalid := &ValidationError{}
+	if u.ID == "" {
+		invalid.add("id", "id is required")
+	}
+	u.validateFields(invalid)
+	return invalid.err()
+}
+
+func (u *User) validateFields(invalid *ValidationError) {
+	now := int32(time.Now().Unix())
+	if u.DeletedAt != 0 {
+		invalid.add("deleted_at", "deleted_at cannot be set")
 	}
 	if u.Name == "" {
-		return errors.New("invalid username")
+		invalid.add("name", "name is required")
 	}
-	if u.DOB >= int32(time.Now().Unix()) {
-		return errors.New("invalid dob, expecting greater than now")
+	if u.DOB >= now {
+		invalid.add("dob", "dob must be before now")
 	}
 	if u.Address == "" {
-		return errors.New("invalid address")
+		invalid.add("address", "address is required")
 	}
 	if u.Description == "" {
-		return errors.New("invalid description")
+		invalid.add("description", "description is required")
 	}
-	if u.Ctime > int32(time.Now().Unix()) {
-		return errors.New("invalid ctime")
+	if u.Ctime > now {
+		invalid.add("ctime", "ctime cannot be in the future")
 	}
-	return nil
 }
 
 func (u *User) ToString() string {
 	return fmt.Sprintf("%v", u)
 }
+
+// ApplyFields sets the fields, keyed by their json names, on u.
+func ApplyFields(u *User, fields map[string]interface{}) error {
+	doc, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(doc, u)
+}
+
+// ValidateFields checks fields, keyed by their json names, that are about to
+// be set on stored users. Only known fields other than the id and deleted_at
+// may be set, and their values have to pass the same rules as an update.
+func ValidateFields(fields map[string]interface{}) error {
+	if len(fields) == 0 {
+		return errors.New("no fields to set")
+	}
+	invalid := &ValidationError{}
+	if _, ok := fields["id"]; ok {
+		invalid.add("id", "user id cannot be set")
+	}
+	if _, ok := fields["deleted_at"]; ok {
+		invalid.add("deleted_at", "deleted_at cannot be set")
+	}
+	if err := invalid.err(); err != nil {
+		return err
+	}
+	doc, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	// a valid user, so only the given fields can fail validation
+	probe := User{ID: "probe", Name: "probe", Address: "probe", Description: "probe"}
+	decoder := json.NewDecoder(bytes.NewReader(doc))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&probe); err != nil {
+		return fmt.Errorf("invalid fields: %v", err)
+	}
+	return probe.ValidateUpdate()
+}
@@ -0,0 +1,36 @@
+package models
+
+import "strings"
+
+// FieldError is one rule a field of a request failed, the field is named by
+// its json name.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every field of a user that failed validation, not
+// just the first one.
+type ValidationError struct {
+	Fields []FieldError `json:"fields"`
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Fields))
+	for i, field := range e.Fields {
+		messages[i] = field.Message
+	}
+	return "invalid user: " + strings.Join(messages, "; ")
+}
+
+func (e *ValidationError) add(field, message string) {
+	e.Fields = append(e.Fields, FieldError{Field: field, Message: message})
+}
+
+// err returns e when any field failed, nil otherwise.
+func (e *ValidationError) err() error {
+	if len(e.Fields) == 0 {
+		return nil
+	}
+	return e
+}
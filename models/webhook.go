@@ -0,0 +1,113 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+const (
+	WebhookUserCreated = "user.created"
+	WebhookUserUpdated = "user.updated"
+	WebhookUserDeleted = "user.deleted"
+)
+
+// WebhookEvents are the events a webhook can subscribe to.
+var WebhookEvents = []string{WebhookUserCreated, WebhookUserUpdated, WebhookUserDeleted}
+
+// Webhook is a partner endpoint told about user lifecycle events.
+type Webhook struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// Events the webhook is subscribed to, every event when empty
+	Events []string `json:"events,omitempty"`
+	// Secret signs the deliveries, it is only shown when the webhook is
+	// created
+	Secret string    `json:"secret,omitempty"`
+	Active bool      `json:"active"`
+	Ctime  time.Time `json:"ctime"`
+}
+
+func (h *Webhook) Validate() error {
+	if h == nil {
+		return errors.New("empty webhook")
+	}
+	target, err := url.Parse(h.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return fmt.Errorf("invalid url %q, expecting an http or https url", h.URL)
+	}
+	for _, event := range h.Events {
+		known := false
+		for _, e := range WebhookEvents {
+			known = known || e == event
+		}
+		if !known {
+			return &UnknownParamError{Kind: "event", Name: event, Allowed: WebhookEvents}
+		}
+	}
+	return nil
+}
+
+// Subscribed reports whether the webhook wants event.
+func (h *Webhook) Subscribed(event string) bool {
+	if !h.Active {
+		return false
+	}
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookEvent is the payload delivered to webhooks.
+type WebhookEvent struct {
+	ID     string    `json:"id"`
+	Type   string    `json:"type"`
+	Time   time.Time `json:"time"`
+	UserID string    `json:"user_id"`
+	// User is the user as the write left it, unset for deletes
+	User *User `json:"user,omitempty"`
+}
+
+// WebhookDelivery logs one attempt at delivering an event to a webhook.
+type WebhookDelivery struct {
+	ID        string    `json:"id"`
+	WebhookID string    `json:"webhook_id"`
+	EventID   string    `json:"event_id"`
+	EventType string    `json:"event_type"`
+	Attempt   int       `json:"attempt"`
+	Time      time.Time `json:"time"`
+	// StatusCode is the webhook's response code, zero when no response came
+	StatusCode int    `json:"status_code,omitempty"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+	Delivered  bool   `json:"delivered"`
+}
+
+// WebhookDeadLetter is an event that could not be delivered after every
+// retry. It is kept until redelivered or its webhook is deleted.
+type WebhookDeadLetter struct {
+	ID        string       `json:"id"`
+	WebhookID string       `json:"webhook_id"`
+	Event     WebhookEvent `json:"event"`
+	Attempts  int          `json:"attempts"`
+	LastError string       `json:"last_error"`
+	Time      time.Time    `json:"time"`
+}
+
+// WebhookPending is an event a webhook has yet to take. It is kept from the
+// moment the event is accepted until it is delivered or becomes a dead letter,
+// so a restart does not lose it.
+type WebhookPending struct {
+	ID        string       `json:"id"`
+	WebhookID string       `json:"webhook_id"`
+	Event     WebhookEvent `json:"event"`
+	// Time is when the event was accepted or last attempted
+	Time time.Time `json:"time"`
+}
@@ -0,0 +1,113 @@
+package outbox
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/metildachee/userie/dao/interfaces"
+)
+
+// DefaultLeaseTTL is how long a relay keeps the outbox lease without renewing
+// it. Every round renews it, so it only runs out once the relay stopped.
+const DefaultLeaseTTL = 30 * time.Second
+
+// OffsetStore keeps the offset of the last record the relay published.
+type OffsetStore interface {
+	// Load returns the saved offset, zero when none was saved yet.
+	Load(ctx context.Context) (int64, error)
+	Save(ctx context.Context, offset int64) error
+}
+
+// LeaseOffsetStore keeps the offset in the backend, next to the outbox, under
+// the outbox lease. Loading takes or renews the lease, so relays sharing the
+// outbox take turns and none trims records another has yet to publish; both
+// return interfaces.ErrOutboxLeased while another relay holds it.
+type LeaseOffsetStore struct {
+	outbox interfaces.Outbox
+	holder string
+	ttl    time.Duration
+}
+
+// NewLeaseOffsetStore keeps the offset in outbox for the relay named holder,
+// which must differ between the relays.
+func NewLeaseOffsetStore(outbox interfaces.Outbox, holder string, ttl time.Duration) *LeaseOffsetStore {
+	if ttl <= 0 {
+		ttl = DefaultLeaseTTL
+	}
+	return &LeaseOffsetStore{outbox: outbox, holder: holder, ttl: ttl}
+}
+
+func (s *LeaseOffsetStore) Load(ctx context.Context) (int64, error) {
+	return s.outbox.ClaimOutbox(ctx, s.holder, s.ttl)
+}
+
+func (s *LeaseOffsetStore) Save(ctx context.Context, offset int64) error {
+	return s.outbox.CommitOutbox(ctx, s.holder, offset, s.ttl)
+}
+
+// FileOffsetStore keeps the offset in a local file. It is replaced as a
+// whole on save, so a crash leaves either the old or the new offset.
+type FileOffsetStore struct {
+	path string
+}
+
+func NewFileOffsetStore(path string) *FileOffsetStore {
+	return &FileOffsetStore{path: path}
+}
+
+func (s *FileOffsetStore) Load(ctx context.Context) (int64, error) {
+	doc, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(doc)), 10, 64)
+}
+
+func (s *FileOffsetStore) Save(ctx context.Context, offset int64) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(strconv.FormatInt(offset, 10) + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// MemoryOffsetStore keeps the offset in process memory, for sinks that do not
+// outlive the process themselves.
+type MemoryOffsetStore struct {
+	mu     sync.Mutex
+	offset int64
+}
+
+func (s *MemoryOffsetStore) Load(ctx context.Context) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.offset, nil
+}
+
+func (s *MemoryOffsetStore) Save(ctx context.Context, offset int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offset = offset
+	return nil
+}
@@ -0,0 +1,120 @@
+// Package outbox relays the records a backend writes to its outbox, see
+// interfaces.Outbox, to a sink. Records are published at least once: the
+// offset of the last published record is saved after publishing, so a crash
+// in between has them published again after the restart.
+package outbox
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/logger"
+	"github.com/metildachee/userie/dao/interfaces"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+const (
+	DefaultBatchSize    = 100
+	DefaultPollInterval = time.Second
+	// maxRetryDelay caps the wait after failed rounds, which doubles with
+	// every further failure.
+	maxRetryDelay = time.Minute
+)
+
+type Relay struct {
+	outbox    interfaces.Outbox
+	sink      Sink
+	offsets   OffsetStore
+	batchSize int
+	poll      time.Duration
+}
+
+// NewRelay relays the records of outbox to sink in batches of batchSize,
+// checking for new records every poll while the outbox is empty.
+func NewRelay(outbox interfaces.Outbox, sink Sink, offsets OffsetStore, batchSize int, poll time.Duration) *Relay {
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	if poll <= 0 {
+		poll = DefaultPollInterval
+	}
+	return &Relay{outbox: outbox, sink: sink, offsets: offsets, batchSize: batchSize, poll: poll}
+}
+
+// RelayOnce publishes the batch after the saved offset, saves the offset of
+// its last record and trims the published records off the outbox. It returns
+// how many records were published, none while another relay holds the outbox
+// lease.
+func (r *Relay) RelayOnce(ctx context.Context) (int, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "outbox relay")
+	defer span.Finish()
+
+	after, err := r.offsets.Load(ctx)
+	if errors.Is(err, interfaces.ErrOutboxLeased) {
+		span.LogFields(log.String("skipped", "outbox leased to another relay"))
+		return 0, nil
+	}
+	if err != nil {
+		ext.LogError(span, err)
+		return 0, err
+	}
+	records, err := r.outbox.ReadOutbox(ctx, after, r.batchSize)
+	if err != nil {
+		ext.LogError(span, err)
+		return 0, err
+	}
+	if len(records) == 0 {
+		return 0, nil
+	}
+	if err := r.sink.Publish(ctx, records); err != nil {
+		ext.LogError(span, err)
+		return 0, err
+	}
+	last := records[len(records)-1].Offset
+	if err := r.offsets.Save(ctx, last); errors.Is(err, interfaces.ErrOutboxLeased) {
+		// the relay now holding the lease publishes the batch again
+		span.LogFields(log.String("skipped", "outbox lease lost while publishing"))
+		return 0, nil
+	} else if err != nil {
+		ext.LogError(span, err)
+		return 0, err
+	}
+	// records up to the saved offset are never read again, trimming only
+	// keeps the outbox small and is retried with the next batch
+	if err := r.outbox.TrimOutbox(ctx, last); err != nil {
+		ext.LogError(span, err)
+		logger.Errorf("trimming the outbox through %d failed: %v", last, err)
+	}
+	span.LogFields(log.Int64("after", after), log.Int64("through", last), log.Int("records", len(records)))
+	return len(records), nil
+}
+
+// Run relays until ctx is done. Full batches are relayed back to back, and
+// failed rounds are retried after a growing delay.
+func (r *Relay) Run(ctx context.Context) {
+	retryDelay := r.poll
+	for {
+		wait := r.poll
+		n, err := r.RelayOnce(ctx)
+		switch {
+		case err != nil:
+			logger.Errorf("outbox relay failed, retrying in %s: %v", retryDelay, err)
+			wait = retryDelay
+			if retryDelay *= 2; retryDelay > maxRetryDelay {
+				retryDelay = maxRetryDelay
+			}
+		case n == r.batchSize:
+			wait, retryDelay = 0, r.poll
+		default:
+			retryDelay = r.poll
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
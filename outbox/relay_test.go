@@ -0,0 +1,154 @@
+package outbox
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/metildachee/userie/dao/memory"
+	"github.com/metildachee/userie/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newOutboxDao(t *testing.T, users int) *memory.UserImplDao {
+	ctx := context.Background()
+	dao, err := memory.NewDao(ctx)
+	require.Nil(t, err, "should not have error when init")
+	require.Nil(t, dao.EnableOutbox(ctx), "should not have error when enabling outbox")
+	for i := 0; i < users; i++ {
+		_, err := dao.Create(ctx, models.User{Name: "metchee"})
+		require.Nil(t, err, "should not have error when create user")
+	}
+	return dao
+}
+
+func decodeRecords(t *testing.T, buf *bytes.Buffer) (records []models.OutboxRecord) {
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		var record models.OutboxRecord
+		require.Nil(t, json.Unmarshal(scanner.Bytes(), &record), "json decoder err")
+		records = append(records, record)
+	}
+	return
+}
+
+type failingSink struct{}
+
+func (failingSink) Publish(ctx context.Context, records []models.OutboxRecord) error {
+	return errors.New("sink is down")
+}
+
+func TestRelayOnce(t *testing.T) {
+	ctx := context.Background()
+	dao := newOutboxDao(t, 3)
+	offsets := NewFileOffsetStore(filepath.Join(t.TempDir(), "outbox.offset"))
+
+	failing := NewRelay(dao, failingSink{}, offsets, 2, 0)
+	_, err := failing.RelayOnce(ctx)
+	assert.NotNil(t, err, "should fail with the sink")
+	offset, err := offsets.Load(ctx)
+	require.Nil(t, err, "should not have error when loading offset")
+	assert.EqualValues(t, 0, offset, "should not move past unpublished records")
+
+	buf := &bytes.Buffer{}
+	relay := NewRelay(dao, NewWriterSink(buf), offsets, 2, 0)
+	n, err := relay.RelayOnce(ctx)
+	require.Nil(t, err, "should not have error when relaying")
+	assert.EqualValues(t, 2, n, "should relay a batch")
+	n, err = relay.RelayOnce(ctx)
+	require.Nil(t, err, "should not have error when relaying")
+	assert.EqualValues(t, 1, n, "should relay the rest")
+	n, err = relay.RelayOnce(ctx)
+	require.Nil(t, err, "should not have error when relaying")
+	assert.EqualValues(t, 0, n, "should have nothing left")
+
+	records := decodeRecords(t, buf)
+	require.Len(t, records, 3, "should publish every record once")
+	for i, record := range records {
+		assert.EqualValues(t, i+1, record.Offset, "should publish in order")
+		assert.Equal(t, models.ChangeCreate, record.Operation, "should publish the change")
+	}
+	offset, err = offsets.Load(ctx)
+	require.Nil(t, err, "should not have error when loading offset")
+	assert.EqualValues(t, 3, offset, "should save the last offset")
+	left, err := dao.ReadOutbox(ctx, 0, 10)
+	require.Nil(t, err, "should not have err when reading outbox")
+	assert.Empty(t, left, "should trim published records")
+}
+
+func TestRelayResumes(t *testing.T) {
+	ctx := context.Background()
+	dao := newOutboxDao(t, 2)
+	dir := t.TempDir()
+	offsetPath, outPath := filepath.Join(dir, "outbox.offset"), filepath.Join(dir, "outbox.ndjson")
+	// a crash after publishing but before trimming leaves the records behind
+	require.Nil(t, NewFileOffsetStore(offsetPath).Save(ctx, 1), "should not have error when saving offset")
+
+	sink, err := NewFileSink(outPath)
+	require.Nil(t, err, "should not have error when opening sink")
+	_, err = NewRelay(dao, sink, NewFileOffsetStore(offsetPath), 10, 0).RelayOnce(ctx)
+	require.Nil(t, err, "should not have error when relaying")
+	require.Nil(t, sink.Close(), "should not have error when closing sink")
+
+	doc, err := ioutil.ReadFile(outPath)
+	require.Nil(t, err, "should not have error when reading sink")
+	records := decodeRecords(t, bytes.NewBuffer(doc))
+	require.Len(t, records, 1, "should resume after the saved offset")
+	assert.EqualValues(t, 2, records[0].Offset, "should resume after the saved offset")
+}
+
+func TestBroker(t *testing.T) {
+	ctx := context.Background()
+	dao := newOutboxDao(t, 2)
+	broker := NewBroker()
+	var received []int64
+	broker.Subscribe("audit", func(ctx context.Context, record models.OutboxRecord) error {
+		received = append(received, record.Offset)
+		return nil
+	})
+	broker.Subscribe("flaky", func(ctx context.Context, record models.OutboxRecord) error {
+		return errors.New("not now")
+	})
+	relay := NewRelay(dao, broker, &MemoryOffsetStore{}, 10, 0)
+
+	_, err := relay.RelayOnce(ctx)
+	assert.NotNil(t, err, "should fail with a handler")
+	broker.Unsubscribe("flaky")
+	received = nil
+	n, err := relay.RelayOnce(ctx)
+	require.Nil(t, err, "should not have error when relaying")
+	assert.EqualValues(t, 2, n, "should relay the records again")
+	assert.Equal(t, []int64{1, 2}, received, "should hand the records over in order")
+}
+
+func TestRelayLease(t *testing.T) {
+	ctx := context.Background()
+	dao := newOutboxDao(t, 3)
+	first, second := &bytes.Buffer{}, &bytes.Buffer{}
+	holding := NewRelay(dao, NewWriterSink(first), NewLeaseOffsetStore(dao, "relay a", time.Hour), 2, 0)
+	waiting := NewRelay(dao, NewWriterSink(second), NewLeaseOffsetStore(dao, "relay b", time.Hour), 2, 0)
+
+	n, err := holding.RelayOnce(ctx)
+	require.Nil(t, err, "should not have error when relaying")
+	assert.EqualValues(t, 2, n, "the relay holding the lease should relay a batch")
+	n, err = waiting.RelayOnce(ctx)
+	require.Nil(t, err, "a relay without the lease should not fail")
+	assert.EqualValues(t, 0, n, "a relay without the lease should not relay")
+	assert.Empty(t, second.Bytes(), "a relay without the lease should not publish")
+
+	// the holder stops, its lease running out
+	require.Nil(t, dao.CommitOutbox(ctx, "relay a", 2, -time.Second), "should not have error when committing")
+	n, err = waiting.RelayOnce(ctx)
+	require.Nil(t, err, "should not have error when relaying")
+	assert.EqualValues(t, 1, n, "should take over the lease")
+	records := decodeRecords(t, second)
+	require.Len(t, records, 1, "should carry on from the committed offset")
+	assert.EqualValues(t, 3, records[0].Offset, "should carry on from the committed offset")
+}
@@ -0,0 +1,113 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/metildachee/userie/models"
+)
+
+// Sink publishes outbox records. Publish returns once every record is
+// published, an error has the relay publish the whole batch again later.
+type Sink interface {
+	Publish(ctx context.Context, records []models.OutboxRecord) error
+}
+
+// WriterSink writes each record as a line of JSON.
+type WriterSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+// NewStdoutSink writes the records to standard output.
+func NewStdoutSink() *WriterSink {
+	return NewWriterSink(os.Stdout)
+}
+
+func (s *WriterSink) Publish(ctx context.Context, records []models.OutboxRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	encoder := json.NewEncoder(s.w)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FileSink appends the records to a local file as lines of JSON, synced to
+// disk before Publish returns.
+type FileSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewFileSink(path string) (*FileSink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{file: file}, nil
+}
+
+func (s *FileSink) Publish(ctx context.Context, records []models.OutboxRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := NewWriterSink(s.file).Publish(ctx, records); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+func (s *FileSink) Close() error {
+	return s.file.Close()
+}
+
+// Handler consumes the records published to a Broker. An error has the batch
+// published to every handler again, so handlers see records at least once.
+type Handler func(ctx context.Context, record models.OutboxRecord) error
+
+// Broker is an in-process sink handing the records to its subscribed
+// handlers, in offset order.
+type Broker struct {
+	mu       sync.RWMutex
+	handlers map[string]Handler
+}
+
+func NewBroker() *Broker {
+	return &Broker{handlers: map[string]Handler{}}
+}
+
+// Subscribe registers handler under name, replacing one registered before.
+func (b *Broker) Subscribe(name string, handler Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers[name] = handler
+}
+
+func (b *Broker) Unsubscribe(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.handlers, name)
+}
+
+func (b *Broker) Publish(ctx context.Context, records []models.OutboxRecord) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, record := range records {
+		for _, handler := range b.handlers {
+			if err := handler(ctx, record); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+// Package transfer moves users in and out of storage as NDJSON or CSV
+// streams, one row at a time so files of any size can be handled.
+package transfer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/metildachee/userie/models"
+)
+
+const (
+	FormatNDJSON = "ndjson"
+	FormatCSV    = "csv"
+	// maxLineBytes bounds a single NDJSON line.
+	maxLineBytes = 1 << 20
+)
+
+var (
+	Formats = []string{FormatNDJSON, FormatCSV}
+	// csvColumns are the csv columns, named after the user's json fields.
+	csvColumns = []string{"id", "name", "dob", "address", "description", "ctime"}
+)
+
+// rowError is a problem with a single row, reading carries on with the next.
+type rowError struct {
+	err error
+}
+
+func (e *rowError) Error() string {
+	return e.err.Error()
+}
+
+// decoder reads users one row at a time. next returns the user and the line
+// it was read from, a *rowError for a row that cannot be read and io.EOF at
+// the end.
+type decoder interface {
+	next() (models.User, int, error)
+}
+
+func newDecoder(format string, r io.Reader) (decoder, error) {
+	switch format {
+	case FormatNDJSON:
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), maxLineBytes)
+		return &ndjsonDecoder{scanner: scanner}, nil
+	case FormatCSV:
+		return newCsvDecoder(r)
+	}
+	return nil, fmt.Errorf("unknown format %q, expecting one of %v", format, Formats)
+}
+
+type ndjsonDecoder struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func (d *ndjsonDecoder) next() (u models.User, line int, err error) {
+	for d.scanner.Scan() {
+		d.line++
+		row := bytes.TrimSpace(d.scanner.Bytes())
+		if len(row) == 0 {
+			continue
+		}
+		decoder := json.NewDecoder(bytes.NewReader(row))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&u); err != nil {
+			return u, d.line, &rowError{err: err}
+		}
+		return u, d.line, nil
+	}
+	if err := d.scanner.Err(); err != nil {
+		return u, d.line + 1, err
+	}
+	return u, d.line, io.EOF
+}
+
+// csvDecoder reads a csv file whose header names a subset of csvColumns.
+// Lines are counted as one per record, header included.
+type csvDecoder struct {
+	reader  *csv.Reader
+	columns []string
+	line    int
+}
+
+func newCsvDecoder(r io.Reader) (*csvDecoder, error) {
+	d := &csvDecoder{reader: csv.NewReader(r), line: 1}
+	d.reader.FieldsPerRecord = -1
+	d.reader.ReuseRecord = true
+	header, err := d.reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("missing csv header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, column := range header {
+		if !contains(csvColumns, column) {
+			return nil, fmt.Errorf("unknown csv column %q, expecting some of %v", column, csvColumns)
+		}
+		d.columns = append(d.columns, column)
+	}
+	return d, nil
+}
+
+func (d *csvDecoder) next() (u models.User, line int, err error) {
+	record, err := d.reader.Read()
+	d.line++
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		d.line = parseErr.Line
+		return u, parseErr.StartLine, &rowError{err: err}
+	}
+	if err != nil {
+		return u, d.line, err
+	}
+	if len(record) != len(d.columns) {
+		return u, d.line, &rowError{err: fmt.Errorf("expecting %d fields, found %d", len(d.columns), len(record))}
+	}
+	for i, column := range d.columns {
+		if err := setColumn(&u, column, record[i]); err != nil {
+			return u, d.line, &rowError{err: err}
+		}
+	}
+	return u, d.line, nil
+}
+
+func setColumn(u *models.User, column, value string) error {
+	switch column {
+	case "id":
+		u.ID = value
+	case "name":
+		u.Name = value
+	case "address":
+		u.Address = value
+	case "description":
+		u.Description = value
+	case "dob", "ctime":
+		parsed, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q", column, value)
+		}
+		if column == "dob" {
+			u.DOB = int32(parsed)
+		} else {
+			u.Ctime = int32(parsed)
+		}
+	}
+	return nil
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package transfer
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/metildachee/userie/dao/interfaces"
+	"github.com/metildachee/userie/models"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+// ExportPageSize is how many users are read from storage at a time.
+const ExportPageSize = 500
+
+// encoder writes users one row at a time, flush pushes buffered rows out.
+type encoder interface {
+	encode(u models.User) error
+	flush() error
+}
+
+func newEncoder(format string, w io.Writer) (encoder, error) {
+	switch format {
+	case FormatNDJSON:
+		return &ndjsonEncoder{encoder: json.NewEncoder(w)}, nil
+	case FormatCSV:
+		e := &csvEncoder{writer: csv.NewWriter(w)}
+		return e, e.writer.Write(csvColumns)
+	}
+	return nil, fmt.Errorf("unknown format %q, expecting one of %v", format, Formats)
+}
+
+type ndjsonEncoder struct {
+	encoder *json.Encoder
+}
+
+func (e *ndjsonEncoder) encode(u models.User) error {
+	return e.encoder.Encode(u)
+}
+
+func (e *ndjsonEncoder) flush() error {
+	return nil
+}
+
+// csvEncoder writes a header with every csvColumns column, in the layout the
+// csv decoder reads.
+type csvEncoder struct {
+	writer *csv.Writer
+}
+
+func (e *csvEncoder) encode(u models.User) error {
+	return e.writer.Write([]string{
+		u.ID,
+		u.Name,
+		strconv.Itoa(int(u.DOB)),
+		u.Address,
+		u.Description,
+		strconv.Itoa(int(u.Ctime)),
+	})
+}
+
+func (e *csvEncoder) flush() error {
+	e.writer.Flush()
+	return e.writer.Error()
+}
+
+// flusher is implemented by writers that buffer, like http.ResponseWriter.
+type flusher interface {
+	Flush()
+}
+
+// Export walks every user matching filter with cursor pagination and writes
+// them to w in format, a page at a time as they are read. It stops with the
+// context's error once ctx is done; what was written by then stays written.
+func Export(ctx context.Context, dao interfaces.UserDao, w io.Writer, format string, filter models.UserFilter) (exported int, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "export users")
+	defer span.Finish()
+	defer func() {
+		if err != nil {
+			ext.LogError(span, err)
+		}
+		span.LogFields(log.String("format", format), log.Int("exported", exported))
+	}()
+
+	enc, err := newEncoder(format, w)
+	if err != nil {
+		return
+	}
+	var (
+		users []models.User
+		next  string
+	)
+	for {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		if users, next, err = dao.GetAllAfter(ctx, next, ExportPageSize, filter); err != nil {
+			return
+		}
+		for _, u := range users {
+			if err = enc.encode(u); err != nil {
+				return
+			}
+			exported++
+		}
+		if err = enc.flush(); err != nil {
+			return
+		}
+		if f, ok := w.(flusher); ok {
+			f.Flush()
+		}
+		if next == "" {
+			return
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/metildachee/userie/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExport(t *testing.T) {
+	ctx := context.Background()
+	dao := newTestDao(t)
+	// more than a page, so the export walks two
+	users := make([]models.User, ExportPageSize+1)
+	for i := range users {
+		users[i] = models.User{Name: fmt.Sprintf("metchee %d", i), Address: "kent ridge, sg", Description: "exported", Ctime: int32(i)}
+	}
+	_, err := dao.BulkCreate(ctx, users)
+	require.Nil(t, err, "should not have error when creating users")
+
+	for _, format := range Formats {
+		var out bytes.Buffer
+		exported, err := Export(ctx, dao, &out, format, models.UserFilter{})
+		require.Nil(t, err, "should not have error when exporting "+format)
+		assert.EqualValues(t, len(users), exported, "should export every user")
+
+		// the export reads back with the import decoders
+		dec, err := newDecoder(format, &out)
+		require.Nil(t, err, "should read the export header")
+		seen := map[string]bool{}
+		for {
+			u, _, err := dec.next()
+			if err == io.EOF {
+				break
+			}
+			require.Nil(t, err, "should read back every row")
+			assert.EqualValues(t, "kent ridge, sg", u.Address, "should keep the fields")
+			seen[u.ID] = true
+		}
+		assert.Len(t, seen, len(users), "should export every user once")
+	}
+}
+
+func TestExportWithFilter(t *testing.T) {
+	ctx := context.Background()
+	dao := newTestDao(t)
+	_, err := dao.BulkCreate(ctx, []models.User{{Name: "metchee"}, {Name: "meow"}})
+	require.Nil(t, err, "should not have error when creating users")
+
+	var out bytes.Buffer
+	exported, err := Export(ctx, dao, &out, FormatCSV, models.UserFilter{NamePrefix: "met"})
+	require.Nil(t, err, "should not have error when exporting")
+	assert.EqualValues(t, 1, exported, "should only export matching users")
+	assert.Contains(t, out.String(), "metchee")
+	assert.False(t, strings.Contains(out.String(), "meow"), "should skip other users")
+
+	_, err = Export(ctx, dao, &out, "xml", models.UserFilter{})
+	assert.NotNil(t, err, "should reject unknown formats")
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = Export(cancelled, dao, &out, FormatNDJSON, models.UserFilter{})
+	assert.Equal(t, context.Canceled, err, "should stop once the client went away")
+}
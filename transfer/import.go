@@ -0,0 +1,138 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/metildachee/userie/dao/interfaces"
+	"github.com/metildachee/userie/models"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+const (
+	DefaultBatchSize = 500
+	// MaxReportedErrors bounds the errors kept in a report, failures past it
+	// are only counted.
+	MaxReportedErrors = 1000
+)
+
+type RowError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+type ImportReport struct {
+	Rows     int `json:"rows"`
+	Imported int `json:"imported"`
+	Failed   int `json:"failed"`
+	// Errors lists the first MaxReportedErrors failed rows
+	Errors          []RowError `json:"errors"`
+	ErrorsTruncated bool       `json:"errors_truncated,omitempty"`
+}
+
+func (r *ImportReport) fail(line int, err string) {
+	r.Failed++
+	if len(r.Errors) >= MaxReportedErrors {
+		r.ErrorsTruncated = true
+		return
+	}
+	r.Errors = append(r.Errors, RowError{Line: line, Error: err})
+}
+
+// FormatError is returned when an import cannot start, e.g. for a csv file
+// with unknown columns.
+type FormatError struct {
+	err error
+}
+
+func (e *FormatError) Error() string {
+	return e.err.Error()
+}
+
+func (e *FormatError) Unwrap() error {
+	return e.err
+}
+
+// Import reads users in format from r, validates every row and creates the
+// valid ones batchSize at a time. Rows that fail are listed in the report
+// with their line; the error is only set when the import had to stop, the
+// report then covers the rows read so far.
+func Import(ctx context.Context, dao interfaces.UserDao, r io.Reader, format string, batchSize int) (report ImportReport, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "import users")
+	defer span.Finish()
+
+	report.Errors = []RowError{}
+	dec, err := newDecoder(format, r)
+	if err != nil {
+		err = &FormatError{err: err}
+		ext.LogError(span, err)
+		return
+	}
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+
+	batch, lines := make([]models.User, 0, batchSize), make([]int, 0, batchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		results, err := dao.BulkCreate(ctx, batch)
+		if err != nil {
+			return err
+		}
+		for i, result := range results {
+			if result.Error != "" {
+				report.fail(lines[i], result.Error)
+			} else {
+				report.Imported++
+			}
+		}
+		batch, lines = batch[:0], lines[:0]
+		return nil
+	}
+
+	for {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		u, line, readErr := dec.next()
+		if readErr == io.EOF {
+			err = flush()
+			break
+		}
+		var rowErr *rowError
+		if errors.As(readErr, &rowErr) {
+			report.Rows++
+			report.fail(line, rowErr.Error())
+			continue
+		}
+		if readErr != nil {
+			err = readErr
+			break
+		}
+
+		report.Rows++
+		if validateErr := u.Validate(); validateErr != nil {
+			report.fail(line, validateErr.Error())
+			continue
+		}
+		batch, lines = append(batch, u), append(lines, line)
+		if len(batch) == batchSize {
+			if err = flush(); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		ext.LogError(span, err)
+	}
+	span.LogFields(
+		log.Int("rows", report.Rows),
+		log.Int("imported", report.Imported),
+		log.Int("failed", report.Failed))
+	return
+}
@@ -0,0 +1,82 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/metildachee/userie/dao/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestDao(t *testing.T) *memory.UserImplDao {
+	dao, err := memory.NewDao(context.Background())
+	require.Nil(t, err, "should not have error when init dao")
+	return dao
+}
+
+func TestImportNDJSON(t *testing.T) {
+	dao := newTestDao(t)
+	input := strings.Join([]string{
+		`{"name": "metchee 1", "dob": 1, "address": "kent ridge", "description": "one", "ctime": 1}`,
+		``,
+		`{"name": "", "dob": 1, "address": "kent ridge", "description": "two", "ctime": 1}`,
+		`{"name": "metchee 3", "nickname": "x"}`,
+		`not json`,
+		`{"name": "metchee 6", "dob": 1, "address": "kent ridge", "description": "six", "ctime": 1}`,
+	}, "\n")
+
+	report, err := Import(context.Background(), dao, strings.NewReader(input), FormatNDJSON, 1)
+	require.Nil(t, err, "should not have error when importing")
+	assert.EqualValues(t, 5, report.Rows, "blank lines are not rows")
+	assert.EqualValues(t, 2, report.Imported, "valid rows should be imported")
+	assert.EqualValues(t, 3, report.Failed, "invalid rows should fail")
+	require.Len(t, report.Errors, 3, "should report every failed row")
+	for i, line := range []int{3, 4, 5} {
+		assert.EqualValues(t, line, report.Errors[i].Line, "should report the line")
+		assert.NotEmpty(t, report.Errors[i].Error, "should report the reason")
+	}
+
+	users, err := dao.GetAll(context.Background(), 10, 0)
+	require.Nil(t, err, "should not have error when listing")
+	assert.Len(t, users, 2, "should store the valid rows")
+}
+
+func TestImportCSV(t *testing.T) {
+	dao := newTestDao(t)
+	input := "name,address,description,dob,ctime\n" +
+		"metchee 1,kent ridge,one,1,1\n" +
+		"metchee 2,kent ridge,two,yesterday,1\n" +
+		"metchee 3,kent ridge\n" +
+		"\"metchee, 4\",kent ridge,four,1,1\n"
+
+	report, err := Import(context.Background(), dao, strings.NewReader(input), FormatCSV, 0)
+	require.Nil(t, err, "should not have error when importing")
+	assert.EqualValues(t, 4, report.Rows)
+	assert.EqualValues(t, 2, report.Imported, "valid rows should be imported")
+	require.Len(t, report.Errors, 2, "should report every failed row")
+	assert.EqualValues(t, 3, report.Errors[0].Line, "should count the header as line 1")
+	assert.EqualValues(t, 4, report.Errors[1].Line)
+
+	_, err = Import(context.Background(), dao, strings.NewReader("name,nickname\n"), FormatCSV, 0)
+	var formatErr *FormatError
+	assert.True(t, errors.As(err, &formatErr), "unknown columns should stop the import")
+	_, err = Import(context.Background(), dao, strings.NewReader(""), "xml", 0)
+	assert.True(t, errors.As(err, &formatErr), "unknown formats should stop the import")
+}
+
+func TestImportReportIsBounded(t *testing.T) {
+	dao := newTestDao(t)
+	var b strings.Builder
+	for i := 0; i < MaxReportedErrors+5; i++ {
+		fmt.Fprintf(&b, "{\"name\": \"%d\"}\n", i)
+	}
+	report, err := Import(context.Background(), dao, strings.NewReader(b.String()), FormatNDJSON, 0)
+	require.Nil(t, err, "should not have error when importing")
+	assert.EqualValues(t, MaxReportedErrors+5, report.Failed, "should count every failure")
+	assert.Len(t, report.Errors, MaxReportedErrors, "should keep a bounded list")
+	assert.True(t, report.ErrorsTruncated, "should say the list is cut")
+}
@@ -3,6 +3,7 @@ package utilities
 import (
 	"errors"
 	"os"
+	"strconv"
 
 	"github.com/google/logger"
 	"github.com/metildachee/userie/models"
@@ -30,6 +31,18 @@ func SetConfig(configPath string) (config models.Configuration, err error) {
 	os.Setenv(config.GetElasticEndpointEnvName(), config.ElasticEndpoint)
 	os.Setenv(config.GetClusterNameEnvName(), config.ClusterName)
 	os.Setenv(config.GetServerEnvName(), config.ServerPort)
+	os.Setenv(config.GetIdGeneratorEnvName(), config.IdGenerator)
+	os.Setenv(config.GetStorageEnvName(), config.Storage)
+	os.Setenv(config.GetBoltPathEnvName(), config.BoltPath)
+	os.Setenv(config.GetSqlDriverEnvName(), config.SqlDriver)
+	os.Setenv(config.GetSqlDsnEnvName(), config.SqlDsn)
+	os.Setenv(config.GetDeletedRetentionEnvName(), config.DeletedRetention)
+	os.Setenv(config.GetPurgeIntervalEnvName(), config.PurgeInterval)
+	os.Setenv(config.GetChangeFeedBufferEnvName(), strconv.Itoa(config.ChangeFeedBuffer))
+	os.Setenv(config.GetWebhookMaxAttemptsEnvName(), strconv.Itoa(config.WebhookMaxAttempts))
+	os.Setenv(config.GetWebhookBackoffEnvName(), config.WebhookBackoff)
+	os.Setenv(config.GetOutboxSinkEnvName(), config.OutboxSink)
+	os.Setenv(config.GetOutboxPathEnvName(), config.OutboxPath)
 
 	logger.Info("set config successfully")
 	return
@@ -0,0 +1,442 @@
+// Package webhook tells partner endpoints about user lifecycle events. Every
+// delivery is signed with the webhook's secret, retried with exponential
+// backoff and logged; events that still fail are kept as dead letters. Events
+// stay pending in the store until then, so a restart does not lose them.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/logger"
+	"github.com/metildachee/userie/dao/interfaces"
+	"github.com/metildachee/userie/models"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+const (
+	// SignatureHeader carries "sha256=" and the hex HMAC-SHA256 of the
+	// timestamp header, a dot and the body, keyed with the webhook secret.
+	SignatureHeader = "X-Userie-Signature"
+	TimestampHeader = "X-Userie-Timestamp"
+	EventHeader     = "X-Userie-Event"
+	// DeliveryHeader carries the event id, retries of an event repeat it.
+	DeliveryHeader = "X-Userie-Delivery"
+
+	DefaultMaxAttempts = 8
+	DefaultBackoff     = time.Second
+	DefaultWorkers     = 4
+	// maxBackoff caps the wait between two attempts.
+	maxBackoff = 10 * time.Minute
+	// queueSize bounds the deliveries waiting for a worker, events past it
+	// stay pending until the queue has room.
+	queueSize       = 1000
+	deliveryTimeout = 10 * time.Second
+	// requeueInterval is how often the pending events are looked through for
+	// events to queue again.
+	requeueInterval = 10 * time.Second
+	// abandonedAfter is how long a pending event goes untouched before it is
+	// taken for left behind by a stopped dispatcher: the longest wait between
+	// two attempts, with room for an attempt.
+	abandonedAfter = maxBackoff + 2*deliveryTimeout
+)
+
+// RetryPolicy is how often a delivery is attempted, the wait after the first
+// failed attempt is Backoff and doubles after each one.
+type RetryPolicy struct {
+	MaxAttempts int
+	Backoff     time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: DefaultMaxAttempts, Backoff: DefaultBackoff}
+
+// delay returns the wait after the failed attempt.
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	delay := p.Backoff
+	for i := 1; i < attempt && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return delay
+}
+
+// Sign returns the SignatureHeader value of a delivery.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewSecret returns a random secret for a new webhook.
+func NewSecret() (string, error) {
+	return NewID()
+}
+
+type job struct {
+	hookID string
+	event  models.WebhookEvent
+	// parent is the span of the request that caused the event
+	parent opentracing.SpanContext
+}
+
+// pendingID names the pending event of a webhook, so an event accepted again
+// replaces it.
+func pendingID(hookID, eventID string) string {
+	sum := sha256.Sum256([]byte(hookID + "\x00" + eventID))
+	return hex.EncodeToString(sum[:])
+}
+
+type Dispatcher struct {
+	store  Store
+	tracer opentracing.Tracer
+	client *http.Client
+	retry  RetryPolicy
+	jobs   chan job
+
+	mu sync.Mutex
+	// queued are the pending events queued or being delivered here
+	queued map[string]bool
+	// overflow are the pending events accepted here while the queue was full
+	overflow map[string]bool
+}
+
+func NewDispatcher(store Store, tracer opentracing.Tracer, retry RetryPolicy) *Dispatcher {
+	if retry.MaxAttempts <= 0 {
+		retry.MaxAttempts = DefaultMaxAttempts
+	}
+	return &Dispatcher{
+		store:  store,
+		tracer: tracer,
+		client: &http.Client{Timeout: deliveryTimeout},
+		retry:  retry,
+		jobs:   make(chan job, queueSize),
+
+		queued:   map[string]bool{},
+		overflow: map[string]bool{},
+	}
+}
+
+func (d *Dispatcher) Store() Store {
+	return d.store
+}
+
+// Start runs workers delivering the queued events until ctx is done. A worker
+// waiting to retry a delivery does not pick up other events meanwhile. The
+// pending events left for a full queue, or by a dispatcher that stopped, are
+// queued again.
+func (d *Dispatcher) Start(ctx context.Context, workers int) {
+	go d.requeue(ctx)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case j := <-d.jobs:
+					d.deliver(ctx, j)
+				}
+			}
+		}()
+	}
+}
+
+// Notify queues an event for every active webhook subscribed to it. It
+// returns once the event is pending in the store, without waiting for the
+// deliveries; the span in ctx is carried over to them.
+func (d *Dispatcher) Notify(ctx context.Context, eventType, userID string, u *models.User) error {
+	id, err := NewID()
+	if err != nil {
+		return err
+	}
+	return d.notify(ctx, models.WebhookEvent{ID: id, Type: eventType, Time: time.Now().UTC(), UserID: userID, User: u})
+}
+
+// changeEvents are the webhook events of the recorded operations. A restored
+// user reappears, like in the api.
+var changeEvents = map[string]string{
+	models.ChangeCreate:  models.WebhookUserCreated,
+	models.ChangeUpdate:  models.WebhookUserUpdated,
+	models.ChangePatch:   models.WebhookUserUpdated,
+	models.ChangeRevert:  models.WebhookUserUpdated,
+	models.ChangeDelete:  models.WebhookUserDeleted,
+	models.ChangeRestore: models.WebhookUserCreated,
+}
+
+// NotifyChange queues the event of a recorded change, for webhooks fed by the
+// outbox. The event keeps the change's id, so a change the outbox publishes
+// again is delivered under the same id. Once it returns the event is pending
+// in the store, so the outbox may forget the change.
+func (d *Dispatcher) NotifyChange(ctx context.Context, change models.Change) error {
+	eventType, ok := changeEvents[change.Operation]
+	if !ok {
+		return nil
+	}
+	return d.notify(ctx, models.WebhookEvent{
+		ID:     change.ID,
+		Type:   eventType,
+		Time:   change.Timestamp.UTC(),
+		UserID: change.UserID,
+		User:   change.After,
+	})
+}
+
+func (d *Dispatcher) notify(ctx context.Context, event models.WebhookEvent) error {
+	hooks, err := d.store.List(ctx)
+	if err != nil {
+		return err
+	}
+	var parent opentracing.SpanContext
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		parent = span.Context()
+	}
+	for _, h := range hooks {
+		if !h.Subscribed(event.Type) {
+			continue
+		}
+		p := models.WebhookPending{ID: pendingID(h.ID, event.ID), WebhookID: h.ID, Event: event, Time: time.Now().UTC()}
+		if err := d.store.AddPending(ctx, p); errors.Is(err, interfaces.ErrNotFound) {
+			// deleted since it was listed
+			continue
+		} else if err != nil {
+			return err
+		}
+		d.enqueue(job{hookID: h.ID, event: event, parent: parent})
+	}
+	return nil
+}
+
+// Redeliver queues a dead letter of a webhook again, with a fresh set of
+// attempts.
+func (d *Dispatcher) Redeliver(ctx context.Context, hookID, letterID string) error {
+	letter, err := d.store.TakeDeadLetter(ctx, hookID, letterID)
+	if err != nil {
+		return err
+	}
+	p := models.WebhookPending{ID: pendingID(hookID, letter.Event.ID), WebhookID: hookID, Event: letter.Event, Time: time.Now().UTC()}
+	if err := d.store.AddPending(ctx, p); err != nil {
+		// keep the letter rather than lose the event
+		d.store.AddDeadLetter(ctx, letter)
+		return err
+	}
+	var parent opentracing.SpanContext
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		parent = span.Context()
+	}
+	d.enqueue(job{hookID: hookID, event: letter.Event, parent: parent})
+	return nil
+}
+
+// enqueue hands j to the workers unless it is queued here already. When the
+// queue is full j stays pending, to be queued again by requeue.
+func (d *Dispatcher) enqueue(j job) {
+	id := pendingID(j.hookID, j.event.ID)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.queued[id] {
+		return
+	}
+	select {
+	case d.jobs <- j:
+		d.queued[id] = true
+		delete(d.overflow, id)
+	default:
+		d.overflow[id] = true
+	}
+}
+
+// requeue queues the pending events again every requeueInterval, until ctx is
+// done.
+func (d *Dispatcher) requeue(ctx context.Context) {
+	ticker := time.NewTicker(requeueInterval)
+	defer ticker.Stop()
+	for {
+		d.requeuePending(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// requeuePending queues the pending events accepted here while the queue was
+// full, and those untouched for abandonedAfter. Events being delivered by
+// another dispatcher are touched before every attempt, so they are left to
+// it.
+func (d *Dispatcher) requeuePending(ctx context.Context) {
+	pending, err := d.store.ListPending(ctx, queueSize)
+	if err != nil {
+		logger.Errorf("failed to list pending webhook events: %v", err)
+		return
+	}
+	var jobs []job
+	listed := map[string]bool{}
+	d.mu.Lock()
+	for _, p := range pending {
+		listed[p.ID] = true
+		if !d.queued[p.ID] && (d.overflow[p.ID] || time.Since(p.Time) > abandonedAfter) {
+			jobs = append(jobs, job{hookID: p.WebhookID, event: p.Event})
+		}
+	}
+	if len(pending) < queueSize {
+		// every pending event was listed, the others were removed since
+		for id := range d.overflow {
+			if !listed[id] {
+				delete(d.overflow, id)
+			}
+		}
+	}
+	d.mu.Unlock()
+	for _, j := range jobs {
+		d.enqueue(j)
+	}
+}
+
+func (d *Dispatcher) deadLetter(j job, attempts int, lastError string) models.WebhookDeadLetter {
+	id, _ := NewID()
+	return models.WebhookDeadLetter{
+		ID:        id,
+		WebhookID: j.hookID,
+		Event:     j.event,
+		Attempts:  attempts,
+		LastError: lastError,
+		Time:      time.Now().UTC(),
+	}
+}
+
+// deliver attempts j until the webhook takes it, or gives up and keeps it as
+// a dead letter. Every attempt reads the webhook again, so deliveries stop
+// once it is deactivated or deleted. The pending event is touched before each
+// attempt and removed once j is settled; it is kept when ctx is done first.
+func (d *Dispatcher) deliver(ctx context.Context, j job) {
+	pending := models.WebhookPending{ID: pendingID(j.hookID, j.event.ID), WebhookID: j.hookID, Event: j.event}
+	defer func() {
+		d.mu.Lock()
+		delete(d.queued, pending.ID)
+		d.mu.Unlock()
+	}()
+
+	var opts []opentracing.StartSpanOption
+	if j.parent != nil {
+		opts = append(opts, opentracing.FollowsFrom(j.parent))
+	}
+	span := d.tracer.StartSpan("deliver webhook", opts...)
+	ext.SpanKindRPCClient.Set(span)
+	defer span.Finish()
+	span.LogFields(log.String("webhook_id", j.hookID), log.String("event_id", j.event.ID), log.String("event", j.event.Type))
+	settle := func() {
+		if err := d.store.RemovePending(ctx, pending.ID); err != nil {
+			ext.LogError(span, err)
+		}
+	}
+
+	body, err := json.Marshal(j.event)
+	if err != nil {
+		ext.LogError(span, err)
+		settle()
+		return
+	}
+	for attempt := 1; ; attempt++ {
+		hook, err := d.store.Get(ctx, j.hookID)
+		if err != nil || !hook.Active {
+			if err != nil && !errors.Is(err, interfaces.ErrNotFound) {
+				ext.LogError(span, err)
+			}
+			span.LogFields(log.String("stopped", "webhook deleted or inactive"))
+			if err == nil || errors.Is(err, interfaces.ErrNotFound) {
+				settle()
+			}
+			return
+		}
+		pending.Time = time.Now().UTC()
+		if err := d.store.AddPending(ctx, pending); err != nil {
+			ext.LogError(span, err)
+		}
+		delivery := d.attempt(ctx, span, hook, j.event, body, attempt)
+		if err := d.store.AddDelivery(ctx, delivery); err != nil {
+			ext.LogError(span, err)
+		}
+		if delivery.Delivered {
+			settle()
+			return
+		}
+		if attempt >= d.retry.MaxAttempts {
+			ext.LogError(span, fmt.Errorf("giving up after %d attempts: %s", attempt, delivery.Error))
+			if err := d.store.AddDeadLetter(ctx, d.deadLetter(j, attempt, delivery.Error)); err != nil {
+				// left pending, to be tried again once abandoned
+				ext.LogError(span, err)
+				return
+			}
+			settle()
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(d.retry.delay(attempt)):
+		}
+	}
+}
+
+// attempt posts the event once and logs how it went.
+func (d *Dispatcher) attempt(ctx context.Context, span opentracing.Span, hook models.Webhook, event models.WebhookEvent, body []byte, attempt int) models.WebhookDelivery {
+	id, _ := NewID()
+	delivery := models.WebhookDelivery{
+		ID:        id,
+		WebhookID: hook.ID,
+		EventID:   event.ID,
+		EventType: event.Type,
+		Attempt:   attempt,
+		Time:      time.Now().UTC(),
+	}
+	defer func() {
+		delivery.DurationMs = time.Since(delivery.Time).Milliseconds()
+		span.LogFields(log.Int("attempt", attempt), log.Int("status", delivery.StatusCode), log.String("error", delivery.Error))
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		delivery.Error = err.Error()
+		return delivery
+	}
+	timestamp := strconv.FormatInt(delivery.Time.Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, event.Type)
+	req.Header.Set(DeliveryHeader, event.ID)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, Sign(hook.Secret, timestamp, body))
+	ext.HTTPUrl.Set(span, hook.URL)
+	ext.HTTPMethod.Set(span, http.MethodPost)
+	if err := d.tracer.Inject(span.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header)); err != nil {
+		ext.LogError(span, err)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		delivery.Error = err.Error()
+		return delivery
+	}
+	resp.Body.Close()
+	delivery.StatusCode = resp.StatusCode
+	delivery.Delivered = resp.StatusCode >= 200 && resp.StatusCode < 300
+	if !delivery.Delivered {
+		delivery.Error = fmt.Sprintf("webhook answered %s", resp.Status)
+	}
+	return delivery
+}
@@ -0,0 +1,203 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/metildachee/userie/dao/interfaces"
+	"github.com/metildachee/userie/models"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestDispatcher(t *testing.T, tracer opentracing.Tracer) *Dispatcher {
+	d := NewDispatcher(NewMemoryStore(), tracer, RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond})
+	ctx, stop := context.WithCancel(context.Background())
+	t.Cleanup(stop)
+	d.Start(ctx, 1)
+	return d
+}
+
+func addWebhook(t *testing.T, d *Dispatcher, url string, events ...string) models.Webhook {
+	h, err := d.Store().Create(context.Background(), models.Webhook{URL: url, Events: events, Secret: "secret", Active: true, Ctime: time.Now()})
+	require.Nil(t, err, "should not have error when creating webhook")
+	return h
+}
+
+// waitFor polls until done holds or a second passed.
+func waitFor(t *testing.T, done func() bool) {
+	for deadline := time.Now().Add(time.Second); !done(); time.Sleep(5 * time.Millisecond) {
+		require.True(t, time.Now().Before(deadline), "timed out waiting")
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 20, Backoff: time.Second}
+	assert.EqualValues(t, time.Second, p.delay(1), "should wait the backoff first")
+	assert.EqualValues(t, 4*time.Second, p.delay(3), "should double the wait")
+	assert.EqualValues(t, maxBackoff, p.delay(20), "should cap the wait")
+}
+
+func TestDeliver(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer target.Close()
+
+	tracer := mocktracer.New()
+	d := newTestDispatcher(t, tracer)
+	h := addWebhook(t, d, target.URL, models.WebhookUserCreated)
+
+	request := tracer.StartSpan("create user")
+	ctx := opentracing.ContextWithSpan(context.Background(), request)
+	u := &models.User{ID: "1", Name: "metchee"}
+	require.Nil(t, d.Notify(ctx, models.WebhookUserDeleted, "1", nil), "should not have error when notifying")
+	require.Nil(t, d.Notify(ctx, models.WebhookUserCreated, "1", u), "should not have error when notifying")
+	request.Finish()
+
+	r, body := <-received, <-bodies
+	assert.EqualValues(t, models.WebhookUserCreated, r.Header.Get(EventHeader), "should only deliver subscribed events")
+	assert.EqualValues(t, Sign("secret", r.Header.Get(TimestampHeader), body), r.Header.Get(SignatureHeader), "should sign the body")
+	assert.NotEmpty(t, r.Header.Get("Mockpfx-Ids-Traceid"), "should carry the trace")
+	event := models.WebhookEvent{}
+	require.Nil(t, json.Unmarshal(body, &event), "json decoder err")
+	assert.EqualValues(t, r.Header.Get(DeliveryHeader), event.ID, "should name the event")
+	assert.EqualValues(t, "metchee", event.User.Name, "should deliver the user")
+
+	var deliveries []models.WebhookDelivery
+	waitFor(t, func() bool {
+		deliveries, _ = d.Store().GetDeliveries(context.Background(), h.ID, 10, 0)
+		return len(deliveries) == 1
+	})
+	assert.True(t, deliveries[0].Delivered, "should log the delivery")
+	assert.EqualValues(t, http.StatusOK, deliveries[0].StatusCode, "should log the response")
+
+	waitFor(t, func() bool { return len(tracer.FinishedSpans()) == 2 })
+	delivery := tracer.FinishedSpans()[1]
+	assert.EqualValues(t, "deliver webhook", delivery.OperationName, "should trace the delivery")
+	assert.EqualValues(t, request.Context().(mocktracer.MockSpanContext).TraceID, delivery.SpanContext.TraceID, "should follow the request trace")
+}
+
+func TestDeliverDeadLetter(t *testing.T) {
+	var calls int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) > 3 {
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer target.Close()
+
+	ctx := context.Background()
+	d := newTestDispatcher(t, opentracing.NoopTracer{})
+	h := addWebhook(t, d, target.URL)
+	require.Nil(t, d.Notify(ctx, models.WebhookUserUpdated, "1", &models.User{ID: "1"}), "should not have error when notifying")
+
+	var letters []models.WebhookDeadLetter
+	waitFor(t, func() bool {
+		letters, _ = d.Store().GetDeadLetters(ctx, h.ID, 10, 0)
+		return len(letters) == 1
+	})
+	assert.EqualValues(t, 3, letters[0].Attempts, "should give up after the attempts")
+	assert.Contains(t, letters[0].LastError, "503", "should keep the last error")
+	deliveries, err := d.Store().GetDeliveries(ctx, h.ID, 10, 0)
+	require.Nil(t, err, "should not have error when listing deliveries")
+	require.Len(t, deliveries, 3, "should log every attempt")
+	assert.EqualValues(t, 3, deliveries[0].Attempt, "should list the latest attempt first")
+
+	require.Nil(t, d.Redeliver(ctx, h.ID, letters[0].ID), "should not have error when redelivering")
+	waitFor(t, func() bool {
+		deliveries, _ = d.Store().GetDeliveries(ctx, h.ID, 10, 0)
+		return len(deliveries) == 4
+	})
+	assert.True(t, deliveries[0].Delivered, "should deliver the dead letter again")
+	letters, _ = d.Store().GetDeadLetters(ctx, h.ID, 10, 0)
+	assert.Empty(t, letters, "should take the dead letter off the list")
+	assert.Equal(t, interfaces.ErrNotFound, d.Redeliver(ctx, h.ID, "missing"), "should not find unknown dead letters")
+}
+
+func TestStoreDelete(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	h, err := store.Create(ctx, models.Webhook{URL: "http://localhost", Active: true})
+	require.Nil(t, err, "should not have error when creating webhook")
+	require.Nil(t, store.AddDelivery(ctx, models.WebhookDelivery{WebhookID: h.ID}), "should not have error when logging")
+
+	require.Nil(t, store.Delete(ctx, h.ID), "should not have error when deleting")
+	_, err = store.GetDeliveries(ctx, h.ID, 10, 0)
+	assert.Equal(t, interfaces.ErrNotFound, err, "should delete the deliveries")
+	assert.Equal(t, interfaces.ErrNotFound, store.Delete(ctx, h.ID), "should not find deleted webhooks")
+}
+
+func TestNotifyChange(t *testing.T) {
+	events := make(chan models.WebhookEvent, 2)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := models.WebhookEvent{}
+		json.NewDecoder(r.Body).Decode(&event)
+		events <- event
+	}))
+	defer target.Close()
+
+	ctx := context.Background()
+	d := newTestDispatcher(t, opentracing.NoopTracer{})
+	addWebhook(t, d, target.URL, models.WebhookUserUpdated)
+	patch := models.Change{ID: "change-1", UserID: "1", Operation: models.ChangePatch, Timestamp: time.Now(),
+		After: &models.User{ID: "1", Name: "metchee"}}
+	require.Nil(t, d.NotifyChange(ctx, models.Change{ID: "change-0", UserID: "1", Operation: models.ChangeDelete}), "should not have error when notifying")
+	require.Nil(t, d.NotifyChange(ctx, patch), "should not have error when notifying")
+
+	event := <-events
+	assert.EqualValues(t, models.WebhookUserUpdated, event.Type, "a patch should be delivered as an update")
+	assert.EqualValues(t, "change-1", event.ID, "the event should keep the change's id")
+	assert.EqualValues(t, "metchee", event.User.Name, "should deliver the user after the change")
+}
+
+func TestPendingEvents(t *testing.T) {
+	var calls int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer target.Close()
+
+	ctx := context.Background()
+	store := NewMemoryStore()
+	d := NewDispatcher(store, opentracing.NoopTracer{}, RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond})
+	h := addWebhook(t, d, target.URL)
+	// a queue without room, as no worker runs yet
+	d.jobs = make(chan job)
+	require.Nil(t, d.Notify(ctx, models.WebhookUserCreated, "1", &models.User{ID: "1"}), "should not have error when notifying")
+	pending, err := store.ListPending(ctx, 10)
+	require.Nil(t, err, "should not have error when listing pending events")
+	require.Len(t, pending, 1, "an event the queue had no room for should stay pending")
+
+	abandoned := models.WebhookPending{ID: pendingID(h.ID, "abandoned"), WebhookID: h.ID,
+		Event: models.WebhookEvent{ID: "abandoned", Type: models.WebhookUserDeleted, UserID: "2"},
+		Time:  time.Now().Add(-abandonedAfter - time.Minute)}
+	require.Nil(t, store.AddPending(ctx, abandoned), "should not have error when adding pending event")
+	recent := models.WebhookPending{ID: pendingID(h.ID, "recent"), WebhookID: h.ID,
+		Event: models.WebhookEvent{ID: "recent", Type: models.WebhookUserDeleted, UserID: "3"}, Time: time.Now()}
+	require.Nil(t, store.AddPending(ctx, recent), "should not have error when adding pending event")
+
+	d.jobs = make(chan job, queueSize)
+	started, stop := context.WithCancel(ctx)
+	defer stop()
+	d.Start(started, 1)
+	waitFor(t, func() bool {
+		pending, _ = store.ListPending(ctx, 10)
+		return len(pending) == 1
+	})
+	assert.EqualValues(t, 2, atomic.LoadInt32(&calls), "should deliver the overflowed and the abandoned events")
+	assert.EqualValues(t, recent.ID, pending[0].ID, "should leave events another dispatcher may be delivering")
+}
@@ -0,0 +1,261 @@
+package webhook
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"sync"
+
+	"github.com/metildachee/userie/dao/interfaces"
+	"github.com/metildachee/userie/models"
+)
+
+// MaxDeliveries bounds the delivery log kept for each webhook, the oldest
+// attempts are forgotten first.
+const MaxDeliveries = 1000
+
+// Store keeps the webhooks, their delivery logs and dead letters. Lookups of
+// unknown ids return interfaces.ErrNotFound.
+type Store interface {
+	Create(ctx context.Context, h models.Webhook) (models.Webhook, error)
+	Get(ctx context.Context, id string) (models.Webhook, error)
+	// List returns the webhooks, the oldest first.
+	List(ctx context.Context) ([]models.Webhook, error)
+	Update(ctx context.Context, h models.Webhook) error
+	// Delete removes the webhook with its deliveries, dead letters and
+	// pending events.
+	Delete(ctx context.Context, id string) error
+
+	AddDelivery(ctx context.Context, d models.WebhookDelivery) error
+	// GetDeliveries returns the logged attempts of a webhook, the latest
+	// first.
+	GetDeliveries(ctx context.Context, id string, limit, offset int) ([]models.WebhookDelivery, error)
+
+	AddDeadLetter(ctx context.Context, l models.WebhookDeadLetter) error
+	// GetDeadLetters returns the dead letters of a webhook, the latest first.
+	GetDeadLetters(ctx context.Context, id string, limit, offset int) ([]models.WebhookDeadLetter, error)
+	// TakeDeadLetter removes a dead letter and returns it.
+	TakeDeadLetter(ctx context.Context, id, letterID string) (models.WebhookDeadLetter, error)
+
+	// AddPending keeps an event for its webhook, replacing the pending event
+	// with the same id.
+	AddPending(ctx context.Context, p models.WebhookPending) error
+	// ListPending returns up to limit pending events of every webhook, the
+	// longest untouched first.
+	ListPending(ctx context.Context, limit int) ([]models.WebhookPending, error)
+	// RemovePending forgets a pending event, unknown ids are ignored.
+	RemovePending(ctx context.Context, id string) error
+}
+
+// Storage is implemented by the user storages that can keep the webhooks
+// too, so they outlive a restart.
+type Storage interface {
+	WebhookStore(ctx context.Context) (Store, error)
+}
+
+// SortWebhooks orders hooks the way List returns them, the oldest first.
+func SortWebhooks(hooks []models.Webhook) {
+	sort.Slice(hooks, func(i, j int) bool {
+		if !hooks[i].Ctime.Equal(hooks[j].Ctime) {
+			return hooks[i].Ctime.Before(hooks[j].Ctime)
+		}
+		return hooks[i].ID < hooks[j].ID
+	})
+}
+
+// NewID returns a random hex id, as stores give the webhooks.
+func NewID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// SortPending orders pending events the way ListPending returns them, the
+// longest untouched first.
+func SortPending(pending []models.WebhookPending) {
+	sort.Slice(pending, func(i, j int) bool {
+		if !pending[i].Time.Equal(pending[j].Time) {
+			return pending[i].Time.Before(pending[j].Time)
+		}
+		return pending[i].ID < pending[j].ID
+	})
+}
+
+// MemoryStore keeps webhooks in process memory, they are lost on restart.
+type MemoryStore struct {
+	mu          sync.RWMutex
+	hooks       map[string]models.Webhook
+	deliveries  map[string][]models.WebhookDelivery
+	deadLetters map[string][]models.WebhookDeadLetter
+	pending     map[string]models.WebhookPending
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		hooks:       map[string]models.Webhook{},
+		deliveries:  map[string][]models.WebhookDelivery{},
+		deadLetters: map[string][]models.WebhookDeadLetter{},
+		pending:     map[string]models.WebhookPending{},
+	}
+}
+
+func (s *MemoryStore) Create(ctx context.Context, h models.Webhook) (models.Webhook, error) {
+	id, err := NewID()
+	if err != nil {
+		return h, err
+	}
+	h.ID = id
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hooks[id] = h
+	return h, nil
+}
+
+func (s *MemoryStore) Get(ctx context.Context, id string) (models.Webhook, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	h, ok := s.hooks[id]
+	if !ok {
+		return h, interfaces.ErrNotFound
+	}
+	return h, nil
+}
+
+func (s *MemoryStore) List(ctx context.Context) ([]models.Webhook, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	hooks := make([]models.Webhook, 0, len(s.hooks))
+	for _, h := range s.hooks {
+		hooks = append(hooks, h)
+	}
+	SortWebhooks(hooks)
+	return hooks, nil
+}
+
+func (s *MemoryStore) Update(ctx context.Context, h models.Webhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.hooks[h.ID]; !ok {
+		return interfaces.ErrNotFound
+	}
+	s.hooks[h.ID] = h
+	return nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.hooks[id]; !ok {
+		return interfaces.ErrNotFound
+	}
+	delete(s.hooks, id)
+	delete(s.deliveries, id)
+	delete(s.deadLetters, id)
+	for pendingID, p := range s.pending {
+		if p.WebhookID == id {
+			delete(s.pending, pendingID)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) AddDelivery(ctx context.Context, d models.WebhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.hooks[d.WebhookID]; !ok {
+		return interfaces.ErrNotFound
+	}
+	deliveries := append(s.deliveries[d.WebhookID], d)
+	if len(deliveries) > MaxDeliveries {
+		deliveries = append([]models.WebhookDelivery(nil), deliveries[len(deliveries)-MaxDeliveries:]...)
+	}
+	s.deliveries[d.WebhookID] = deliveries
+	return nil
+}
+
+func (s *MemoryStore) GetDeliveries(ctx context.Context, id string, limit, offset int) ([]models.WebhookDelivery, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.hooks[id]; !ok {
+		return nil, interfaces.ErrNotFound
+	}
+	all := s.deliveries[id]
+	page := []models.WebhookDelivery{}
+	for i := len(all) - 1 - offset; i >= 0 && len(page) < limit; i-- {
+		page = append(page, all[i])
+	}
+	return page, nil
+}
+
+func (s *MemoryStore) AddDeadLetter(ctx context.Context, l models.WebhookDeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.hooks[l.WebhookID]; !ok {
+		return interfaces.ErrNotFound
+	}
+	s.deadLetters[l.WebhookID] = append(s.deadLetters[l.WebhookID], l)
+	return nil
+}
+
+func (s *MemoryStore) GetDeadLetters(ctx context.Context, id string, limit, offset int) ([]models.WebhookDeadLetter, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.hooks[id]; !ok {
+		return nil, interfaces.ErrNotFound
+	}
+	all := s.deadLetters[id]
+	page := []models.WebhookDeadLetter{}
+	for i := len(all) - 1 - offset; i >= 0 && len(page) < limit; i-- {
+		page = append(page, all[i])
+	}
+	return page, nil
+}
+
+func (s *MemoryStore) TakeDeadLetter(ctx context.Context, id, letterID string) (models.WebhookDeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	letters := s.deadLetters[id]
+	for i, l := range letters {
+		if l.ID == letterID {
+			s.deadLetters[id] = append(letters[:i:i], letters[i+1:]...)
+			return l, nil
+		}
+	}
+	return models.WebhookDeadLetter{}, interfaces.ErrNotFound
+}
+
+func (s *MemoryStore) AddPending(ctx context.Context, p models.WebhookPending) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.hooks[p.WebhookID]; !ok {
+		return interfaces.ErrNotFound
+	}
+	s.pending[p.ID] = p
+	return nil
+}
+
+func (s *MemoryStore) ListPending(ctx context.Context, limit int) ([]models.WebhookPending, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	pending := make([]models.WebhookPending, 0, len(s.pending))
+	for _, p := range s.pending {
+		pending = append(pending, p)
+	}
+	SortPending(pending)
+	if len(pending) > limit {
+		pending = pending[:limit]
+	}
+	return pending, nil
+}
+
+func (s *MemoryStore) RemovePending(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.pending, id)
+	return nil
+}
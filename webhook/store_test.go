@@ -0,0 +1,12 @@
+package webhook_test
+
+import (
+	"testing"
+
+	"github.com/metildachee/userie/webhook"
+	"github.com/metildachee/userie/webhook/storetest"
+)
+
+func TestMemoryStore(t *testing.T) {
+	storetest.Run(t, webhook.NewMemoryStore())
+}
@@ -0,0 +1,129 @@
+// Package storetest checks that a webhook.Store keeps to the contract, for
+// the tests of the storages implementing it.
+package storetest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/metildachee/userie/dao/interfaces"
+	"github.com/metildachee/userie/models"
+	"github.com/metildachee/userie/webhook"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Run checks store, which must hold no webhooks yet.
+func Run(t *testing.T, store webhook.Store) {
+	ctx := context.Background()
+	now := time.Now().UTC()
+	first, err := store.Create(ctx, models.Webhook{URL: "https://partner.example/1", Secret: "secret", Active: true, Ctime: now})
+	require.Nil(t, err, "should not have error when creating webhook")
+	assert.NotEmpty(t, first.ID, "should give the webhook an id")
+	second, err := store.Create(ctx, models.Webhook{URL: "https://partner.example/2", Events: []string{models.WebhookUserCreated}, Ctime: now.Add(time.Second)})
+	require.Nil(t, err, "should not have error when creating webhook")
+
+	got, err := store.Get(ctx, first.ID)
+	require.Nil(t, err, "should not have error when getting webhook")
+	assert.EqualValues(t, "secret", got.Secret, "should keep the secret")
+	assert.True(t, got.Active, "should keep the active flag")
+	assert.True(t, now.Equal(got.Ctime), "should keep the creation time")
+	_, err = store.Get(ctx, "missing")
+	assert.Equal(t, interfaces.ErrNotFound, err, "unknown webhook should not be found")
+
+	hooks, err := store.List(ctx)
+	require.Nil(t, err, "should not have error when listing webhooks")
+	require.Len(t, hooks, 2, "should list every webhook")
+	assert.EqualValues(t, first.ID, hooks[0].ID, "should list the oldest first")
+
+	second.Active = true
+	require.Nil(t, store.Update(ctx, second), "should not have error when updating webhook")
+	got, err = store.Get(ctx, second.ID)
+	require.Nil(t, err, "should not have error when getting webhook")
+	assert.True(t, got.Active, "should store the update")
+	assert.EqualValues(t, []string{models.WebhookUserCreated}, got.Events, "should keep the events")
+	assert.Equal(t, interfaces.ErrNotFound, store.Update(ctx, models.Webhook{ID: "missing"}), "unknown webhook cannot be updated")
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		delivery := models.WebhookDelivery{ID: webhookID(t), WebhookID: first.ID, EventID: "event", Attempt: attempt, Time: now}
+		require.Nil(t, store.AddDelivery(ctx, delivery), "should not have error when adding delivery")
+	}
+	assert.Equal(t, interfaces.ErrNotFound, store.AddDelivery(ctx, models.WebhookDelivery{WebhookID: "missing"}), "unknown webhook takes no deliveries")
+	deliveries, err := store.GetDeliveries(ctx, first.ID, 2, 0)
+	require.Nil(t, err, "should not have error when getting deliveries")
+	require.Len(t, deliveries, 2, "should page the deliveries")
+	assert.EqualValues(t, 3, deliveries[0].Attempt, "should list the latest first")
+	deliveries, err = store.GetDeliveries(ctx, first.ID, 2, 2)
+	require.Nil(t, err, "should not have error when getting deliveries")
+	require.Len(t, deliveries, 1, "should skip the offset")
+	assert.EqualValues(t, 1, deliveries[0].Attempt, "should list the oldest last")
+	deliveries, err = store.GetDeliveries(ctx, second.ID, 10, 0)
+	require.Nil(t, err, "should not have error when getting deliveries")
+	assert.Empty(t, deliveries, "should only list the webhook's own deliveries")
+
+	event := models.WebhookEvent{ID: "event", Type: models.WebhookUserCreated, Time: now, UserID: "1"}
+	var letters []models.WebhookDeadLetter
+	for i := 0; i < 2; i++ {
+		letter := models.WebhookDeadLetter{ID: webhookID(t), WebhookID: first.ID, Event: event, Attempts: i + 1, LastError: "timeout", Time: now.Add(time.Duration(i) * time.Second)}
+		require.Nil(t, store.AddDeadLetter(ctx, letter), "should not have error when adding dead letter")
+		letters = append(letters, letter)
+	}
+	assert.Equal(t, interfaces.ErrNotFound, store.AddDeadLetter(ctx, models.WebhookDeadLetter{WebhookID: "missing"}), "unknown webhook takes no dead letters")
+	listed, err := store.GetDeadLetters(ctx, first.ID, 10, 0)
+	require.Nil(t, err, "should not have error when getting dead letters")
+	require.Len(t, listed, 2, "should list the dead letters")
+	assert.EqualValues(t, letters[1].ID, listed[0].ID, "should list the latest first")
+	assert.EqualValues(t, "1", listed[0].Event.UserID, "should keep the event")
+
+	taken, err := store.TakeDeadLetter(ctx, first.ID, letters[0].ID)
+	require.Nil(t, err, "should not have error when taking dead letter")
+	assert.EqualValues(t, letters[0].ID, taken.ID, "should take the dead letter")
+	_, err = store.TakeDeadLetter(ctx, first.ID, letters[0].ID)
+	assert.Equal(t, interfaces.ErrNotFound, err, "dead letter cannot be taken twice")
+	_, err = store.TakeDeadLetter(ctx, second.ID, letters[1].ID)
+	assert.Equal(t, interfaces.ErrNotFound, err, "dead letter cannot be taken from another webhook")
+
+	var pending []models.WebhookPending
+	for i, hookID := range []string{first.ID, second.ID, first.ID} {
+		p := models.WebhookPending{ID: webhookID(t), WebhookID: hookID, Event: event, Time: now.Add(time.Duration(i) * time.Second)}
+		require.Nil(t, store.AddPending(ctx, p), "should not have error when adding pending event")
+		pending = append(pending, p)
+	}
+	assert.Equal(t, interfaces.ErrNotFound, store.AddPending(ctx, models.WebhookPending{ID: "missing", WebhookID: "missing"}), "unknown webhook takes no pending events")
+	pending[0].Time = now.Add(time.Minute)
+	require.Nil(t, store.AddPending(ctx, pending[0]), "should not have error when touching pending event")
+	listedPending, err := store.ListPending(ctx, 10)
+	require.Nil(t, err, "should not have error when listing pending events")
+	require.Len(t, listedPending, 3, "should replace the pending event with the same id")
+	assert.EqualValues(t, pending[1].ID, listedPending[0].ID, "should list the longest untouched first")
+	assert.EqualValues(t, pending[0].ID, listedPending[2].ID, "should list the touched event last")
+	assert.EqualValues(t, "1", listedPending[0].Event.UserID, "should keep the event")
+	listedPending, err = store.ListPending(ctx, 1)
+	require.Nil(t, err, "should not have error when listing pending events")
+	assert.Len(t, listedPending, 1, "should list up to the limit")
+	require.Nil(t, store.RemovePending(ctx, pending[2].ID), "should not have error when removing pending event")
+	require.Nil(t, store.RemovePending(ctx, pending[2].ID), "should ignore unknown pending events")
+
+	require.Nil(t, store.Delete(ctx, first.ID), "should not have error when deleting webhook")
+	assert.Equal(t, interfaces.ErrNotFound, store.Delete(ctx, first.ID), "webhook cannot be deleted twice")
+	_, err = store.GetDeliveries(ctx, first.ID, 10, 0)
+	assert.Equal(t, interfaces.ErrNotFound, err, "deleted webhook has no deliveries")
+	_, err = store.GetDeadLetters(ctx, first.ID, 10, 0)
+	assert.Equal(t, interfaces.ErrNotFound, err, "deleted webhook has no dead letters")
+	_, err = store.TakeDeadLetter(ctx, first.ID, letters[1].ID)
+	assert.Equal(t, interfaces.ErrNotFound, err, "deleted webhook's dead letters should be removed")
+	hooks, err = store.List(ctx)
+	require.Nil(t, err, "should not have error when listing webhooks")
+	assert.Len(t, hooks, 1, "should not list the deleted webhook")
+	listedPending, err = store.ListPending(ctx, 10)
+	require.Nil(t, err, "should not have error when listing pending events")
+	require.Len(t, listedPending, 1, "deleted webhook's pending events should be removed")
+	assert.EqualValues(t, pending[1].ID, listedPending[0].ID, "should keep the other webhook's pending events")
+}
+
+func webhookID(t *testing.T) string {
+	id, err := webhook.NewID()
+	require.Nil(t, err, "should not have error when making an id")
+	return id
+}